@@ -0,0 +1,63 @@
+// Command ext-acl-ldap-ctl sends an administration command to a helper or a
+// lookup daemon listening on --control-socket, and prints its output.
+//
+//	ext-acl-ldap-ctl --socket /run/squid/ext-acl-ldap.ctl stats
+//	ext-acl-ldap-ctl --socket /run/squid/ext-acl-ldap.ctl evict-user jdoe
+//
+// The command help lists the commands of the helper.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/control"
+)
+
+const (
+	version = "0.0.5"
+)
+
+type options struct {
+	Sockets []string `short:"s" long:"socket" description:"Control socket of the helper, given with its --control-socket option. Can be repeated to send the command to several helpers (required)" required:"true"`
+	Timeout int      `long:"timeout" description:"Give up when the helper does not answer within this time in milliseconds (default: 5000)" default:"5000"`
+	Args    struct {
+		Command []string `positional-arg-name:"COMMAND" required:"1" description:"Command and its arguments, such as stats, health, get USER ENTITY, evict-user USER, flush or reload"`
+	} `positional-args:"yes"`
+}
+
+var opts options
+
+func main() {
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.Usage = fmt.Sprintf("[OPTIONS] COMMAND [ARGS...]\n\nVersion: %s", version)
+
+	if len(os.Args) == 1 {
+		parser.WriteHelp(os.Stderr)
+		os.Exit(0)
+	}
+	if _, err := parser.Parse(); err != nil {
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, socket := range opts.Sockets {
+		output, err := control.Run(socket, time.Duration(opts.Timeout)*time.Millisecond, strings.Join(opts.Args.Command, " "))
+		if len(opts.Sockets) > 1 {
+			fmt.Printf("%s:\n", socket)
+		}
+		if output != "" {
+			fmt.Println(output)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", socket, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldapbackend"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldappool"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/profile"
+)
+
+// backend is an LDAP directory served by the helper: the default one set up
+// by the options, or a profile overriding some of them
+type backend struct {
+	*ldapbackend.Backend
+	opts   *options
+	gcPool ldappool.Pool
+}
+
+// newBackend returns the backend with the given options and opens its
+// connection pools
+func newBackend(name string, o *options) *backend {
+	core, err := ldapbackend.New(name, &o.Options, o.ServerPort)
+	if err != nil {
+		log.Fatalf("[ERROR] Cannot open LDAP backend %s. Message - %s", name, err.Error())
+	}
+	b := &backend{Backend: core, opts: o}
+	if o.GlobalCatalog {
+		b.gcPool, err = ldapbackend.NewPool(&o.Options, o.GlobalCatalogPort())
+		if err != nil {
+			log.Fatalf("[ERROR] Cannot open the Global Catalog of LDAP backend %s. Message - %s", name, err.Error())
+		}
+	}
+	return b
+}
+
+// newBackends returns the default backend, the profile backends by name and
+// the router of the users to the profiles
+func newBackends() (*backend, map[string]*backend, *profile.Router) {
+	profiles := map[string]*backend{}
+	r, err := ldapbackend.ParseProfiles(opts.Profiles, opts.Routes, func(p *profile.Profile) error {
+		o, err := profileOptions(p)
+		if err != nil {
+			return err
+		}
+		profiles[p.Name] = newBackend(p.Name, o)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid backend profile. Message - %s", err.Error())
+	}
+	return newBackend("", &opts), profiles, r
+}
+
+// closeBackends closes the connection pools of the backends and logs their
+// metrics
+func closeBackends() {
+	defaultBackend.close()
+	for _, b := range backends {
+		b.close()
+	}
+}
+
+func (b *backend) close() {
+	b.Close()
+	if b.gcPool != nil {
+		b.gcPool.Close()
+	}
+}
+
+// route returns the backend of the user, from the NT domain or realm of the
+// username before it is stripped
+func route(username string) *backend {
+	if name := router.Route(normalize.Parse(normalizer.Rewrite(username))); name != "" {
+		return backends[name]
+	}
+	return defaultBackend
+}
+
+// profileOptions returns a copy of the options with the settings of the
+// profile applied
+func profileOptions(p *profile.Profile) (*options, error) {
+	o := opts
+	err := o.ApplyProfile(p, func(setting profile.Setting) error {
+		return applyProfileSetting(&o, setting)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if b := (&backend{opts: &o}); b.userFilter() == "" || b.groupFilter() == "" {
+		return nil, fmt.Errorf("user-filter and group-filter are required without schema")
+	}
+	return &o, nil
+}
+
+// applyProfileSetting sets the option of the helper named by the key of the
+// setting. The connection options are set by ApplyProfile.
+func applyProfileSetting(o *options, setting profile.Setting) error {
+	var err error
+	value := setting.Value
+	switch setting.Key {
+	case "schema":
+		if _, ok := schemas[value]; !ok {
+			return fmt.Errorf("unknown schema %q", value)
+		}
+		o.Schema = value
+	case "user-filter":
+		o.UserFilter = value
+	case "group-filter":
+		o.GroupFilter = value
+	case "login-attribute":
+		o.LoginAttribute = value
+	case "token-groups":
+		o.TokenGroups, err = strconv.ParseBool(value)
+	case "primary-group":
+		o.PrimaryGroup, err = strconv.ParseBool(value)
+	case "resolve-groups":
+		o.ResolveGroups, err = strconv.ParseBool(value)
+	default:
+		return fmt.Errorf("unknown option %q", setting.Key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q of option %s", value, setting.Key)
+	}
+	return nil
+}
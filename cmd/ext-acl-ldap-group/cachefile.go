@@ -0,0 +1,19 @@
+package main
+
+import (
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/cachefile"
+)
+
+// cacheFileSaveInterval is the interval between two saves of the cache file
+const cacheFileSaveInterval = time.Minute
+
+// startCacheFile keeps the answers and the resolved group references in the
+// cache file. There are no user DNs to keep, the users of the lookups not
+// answered from the cache are searched again. The returned function stops
+// the periodic saves and saves the file one last time.
+func startCacheFile() (stop func()) {
+	caches := cachefile.Caches{"decision/": c, "group/": groupCache}
+	return caches.Keep(opts.CacheFile, int64(opts.CacheFileSize)*1024, cacheFileSaveInterval)
+}
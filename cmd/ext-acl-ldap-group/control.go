@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/control"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldapbackend"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+)
+
+// controlHelper gives the shared administration commands access to the
+// caches and the backends
+var controlHelper = &control.Helper{
+	Entity:  "group",
+	Answers: c,
+	Caches:  []control.Cache{{Name: "group", Entries: "group reference", Cache: groupCache}},
+	Stats: func() []string {
+		lines := []string{
+			"workers: " + workers.Stats().String(),
+			fmt.Sprintf("coalesced requests: %d, coalesced user searches: %d", requestLookups.Shared(), userLookups.Shared()),
+		}
+		if warmer != nil {
+			lines = append(lines, "warm-up: "+warmer.Stats().String())
+		}
+		return lines
+	},
+	Backends: func() []control.Backend {
+		var list []control.Backend
+		for _, b := range append([]*backend{defaultBackend}, backendList()...) {
+			list = append(list, control.Backend{Backend: b.Backend, GlobalCatalog: b.gcPool})
+		}
+		return list
+	},
+	Normalize: func(username string) (normalize.Identity, error) { return normalizer.Normalize(username) },
+	Route:     func(username string) *ldapbackend.Backend { return route(username).Backend },
+	Reload:    signalHupChan,
+}
+
+// startControl serves the administration commands on --control-socket. The
+// returned function stops serving them once the commands in flight are
+// answered.
+func startControl() (stop func()) {
+	if opts.ControlSocket == "" {
+		return func() {}
+	}
+	server := control.NewServer()
+	server.HandleHelper(controlHelper)
+	server.Handle("evict-group", "evict-group GROUP - evict the cached answers for the group and its resolved reference", controlEvictGroup)
+	return server.Start(opts.ControlSocket, opts.ControlMode)
+}
+
+func controlEvictGroup(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("usage: evict-group GROUP")
+	}
+	_, _, _, ref, err := defaultBackend.groupReference(args[0])
+	if err != nil {
+		return "", err
+	}
+	evicted := c.DeleteFunc(func(key, result string) bool {
+		_, entity := controlHelper.SplitKey(key)
+		_, _, _, entityRef, err := defaultBackend.groupReference(entity)
+		return err == nil && entityRef == ref
+	})
+	groupCache.DeleteFunc(func(key, result string) bool {
+		return controlHelper.StripProfile(key) == ref
+	})
+	return fmt.Sprintf("%d cached answers evicted", evicted), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldappool"
+)
+
+// groupIdentity is the canonical identity of a group reference
+type groupIdentity struct {
+	// DN is the DN of the group, empty if the reference was not resolved
+	DN string
+	// Name is the group name substituted for %g in the group filter
+	Name string
+}
+
+// String returns the identity as cached, the DN and the name on two lines
+func (g groupIdentity) String() string {
+	return g.DN + "\n" + g.Name
+}
+
+// parseGroupIdentity returns the identity cached as String returns it
+func parseGroupIdentity(s string) groupIdentity {
+	fs := strings.SplitN(s, "\n", 2)
+	if len(fs) != 2 {
+		return groupIdentity{Name: s}
+	}
+	return groupIdentity{DN: fs[0], Name: fs[1]}
+}
+
+// unresolvedGroup reports whether the cached identity is the one of a
+// reference which was not resolved
+func unresolvedGroup(s string) bool {
+	return strings.HasPrefix(s, "\n")
+}
+
+// groupNameAttribute returns the group attribute holding the name of the
+// group
+func (b *backend) groupNameAttribute() string {
+	if s, ok := schemas[b.opts.Schema]; ok {
+		return s.groupNameAttribute
+	}
+	return "cn"
+}
+
+// groupReference returns the filter finding the group referenced by ref, the
+// base and scope of its search, and the key identifying the reference in the
+// cache. A reference is a DN, a SID, a DOMAIN\group name, or a plain cn or
+// sAMAccountName.
+func (b *backend) groupReference(ref string) (filter, baseDN string, scope int, key string, err error) {
+	switch {
+	case strings.HasPrefix(strings.ToUpper(ref), "S-1-"):
+		sid, err := ldap.EncodeSID(ref)
+		if err != nil {
+			return "", "", 0, "", err
+		}
+		key, _ = ldap.ParseSID(sid)
+		return fmt.Sprintf("(objectSid=%s)", ldap.EscapeFilterBytes(sid)), b.opts.BaseDN, ldap.ScopeWholeSubtree, "sid:" + key, nil
+	case strings.Contains(ref, "="):
+		dn, err := ldap.ParseDN(ref)
+		if err != nil {
+			return "", "", 0, "", err
+		}
+		return "(objectClass=*)", ref, ldap.ScopeBaseObject, "dn:" + normalizeDN(dn), nil
+	}
+
+	if i := strings.LastIndex(ref, "\\"); i >= 0 {
+		ref = ref[i+1:]
+	}
+	name := ldap.EscapeFilter(ref)
+	filter = fmt.Sprintf("(|(%s=%s)(sAMAccountName=%s))", b.groupNameAttribute(), name, name)
+	if s, ok := schemas[b.opts.Schema]; ok {
+		filter = fmt.Sprintf("(&(objectClass=%s)%s)", s.groupClass, filter)
+	}
+	return filter, b.opts.BaseDN, ldap.ScopeWholeSubtree, "name:" + strings.ToLower(ref), nil
+}
+
+// normalizeDN returns the DN with its attribute types and values lower cased
+// and the spaces between its components removed
+func normalizeDN(dn *ldap.DN) string {
+	var rdns []string
+	for _, rdn := range dn.RDNs {
+		var attributes []string
+		for _, attribute := range rdn.Attributes {
+			attributes = append(attributes, strings.ToLower(attribute.Type)+"="+strings.ToLower(attribute.Value))
+		}
+		rdns = append(rdns, strings.Join(attributes, "+"))
+	}
+	return strings.Join(rdns, ",")
+}
+
+// resolveGroup returns the canonical identity of the group referenced by
+// ref. Resolved identities are cached. A reference matching no group, or
+// several, is kept as it is.
+func (b *backend) resolveGroup(ctx context.Context, conn *ldappool.PoolConn, ref string) (groupIdentity, error) {
+	filter, baseDN, scope, key, err := b.groupReference(ref)
+	if err != nil {
+		log.Printf("[WARN] Invalid group reference '%s'. Message - %s", ref, err.Error())
+		return groupIdentity{Name: ref}, nil
+	}
+	key = b.CacheKey(key)
+	if identity, found := groupCache.Peek(key); found {
+		return parseGroupIdentity(identity), nil
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		baseDN,
+		scope, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{b.groupNameAttribute()},
+		nil,
+	)
+	sr, err := b.Search(ctx, conn, searchRequest)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return groupIdentity{}, err
+	}
+
+	identity := groupIdentity{Name: ref}
+	if err == nil && len(sr.Entries) == 1 && sr.Entries[0].GetAttributeValue(b.groupNameAttribute()) != "" {
+		identity = groupIdentity{
+			DN:   sr.Entries[0].DN,
+			Name: sr.Entries[0].GetAttributeValue(b.groupNameAttribute()),
+		}
+		if scope == ldap.ScopeBaseObject {
+			// the server may return the DN in another form than the reference
+			expected, _ := ldap.ParseDN(ref)
+			if dn, err := ldap.ParseDN(identity.DN); err != nil || !dn.Equal(expected) {
+				identity = groupIdentity{Name: ref}
+			}
+		}
+	} else {
+		log.Printf("[WARN] Group '%s' is not found in domain. Using LDAP path - %s", ref, baseDN)
+	}
+	groupCache.Set(key, identity.String())
+	return identity, nil
+}
@@ -2,19 +2,29 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/jessevdk/go-flags"
-	cache "github.com/patrickmn/go-cache"
 	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldapbackend"
 	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldappool"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/lookupd"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/profile"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/resultcache"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/singleflight"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/unixsock"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/workpool"
 )
 
 const (
@@ -22,32 +32,69 @@ const (
 )
 
 var (
-	rewriterExitChan    chan int       = make(chan int, 1)
-	responseChan        chan string    = make(chan string, 1024*10)
+	responseChan        chan string
 	signalHupChan       chan os.Signal = make(chan os.Signal, 1)
 	signalInterruptChan chan os.Signal = make(chan os.Signal, 1)
-	stdinLineChan       chan string    = make(chan string, 100)
+	requestWaitGroup    sync.WaitGroup
 	lastUsedIndex       int
-	ldapConnPool        ldappool.Pool
-	c                   = cache.New(300*time.Second, 30*time.Second)
+	normalizer          *normalize.Normalizer
+	domainBaseDNs       map[string]string
+	defaultBackend      *backend
+	backends            map[string]*backend
+	router              *profile.Router
+	lookupClient        *lookupd.Client
+	c                   = resultcache.New()
+	requestLookups      singleflight.Group
+	userLookups         singleflight.Group
+	workers             *workpool.Pool
+	groupCache          = resultcache.New()
 )
 
-var opts struct {
-	ServerSlice     []string `short:"s" long:"server" description:"Domain controller server address (required)" required:"true"`
-	ServerPort      int      `short:"p" long:"port" description:"Domain controller LDAP service port (default: 389)" default:"389"`
-	UseTLS          bool     `long:"tls" description:"Using LDAP over TLS"`
-	BindUsername    string   `short:"u" long:"binduser" description:"Username for LDAP Bind operation (required)" required:"true"`
-	BindPassword    string   `short:"w" long:"bindpassword" description:"Password for LDAP Bind operation"`
-	PwdFile         string   `short:"f" long:"pwdfile" description:"File with password for Bind operation"`
-	BaseDN          string   `short:"b" long:"basedn" description:"BaseDN for user search process. %ou = OU (required)" required:"true"`
-	UserFilter      string   `long:"user-filter" description:"User search filter pattern. %u = login (required)" required:"true"`
-	GroupFilter     string   `long:"group-filter" description:"Group search filter pattern. %u = user DN, %g = user group name (required)" required:"true"`
-	StripRealm      bool     `long:"strip-realm" description:"Strip Kerberos Realm from usernames"`
-	StripDomain     bool     `long:"strip-domain" description:"Strip NT domain from usernames"`
-	CacheExpiration int      `long:"cache" description:"Use in-memory cache. Set entry expiration time in seconds"`
-	LogFile         string   `long:"log" description:"Path to log file (default: /var/log/squid-ext-acl-ldap.log)" default:"/var/log/squid-ext-acl-ldap.log"`
+type options struct {
+	ldapbackend.Options
+	Schema           string   `long:"schema" description:"Directory schema preset for the default user and group filters" choice:"ad" choice:"rfc2307" choice:"rfc2307bis" choice:"freeipa" choice:"389ds"`
+	UserFilter       string   `long:"user-filter" description:"User search filter pattern. %u = login (required without --schema)"`
+	GroupFilter      string   `long:"group-filter" description:"Group search filter pattern. %u = user DN, %n = user login, %g = user group name, all escaped for the filter (required without --schema)"`
+	LoginAttribute   string   `long:"login-attribute" description:"User attribute substituted for %n in the group filter (default: from --schema, or sAMAccountName)"`
+	StripRealm       bool     `long:"strip-realm" description:"Strip Kerberos Realm from usernames"`
+	StripDomain      bool     `long:"strip-domain" description:"Strip NT domain from usernames. Cannot be used with --domain-basedn"`
+	Lowercase        bool     `long:"lowercase" description:"Convert usernames to lower case"`
+	Rewrites         []string `long:"rewrite" description:"Rewrite usernames with a regular expression, given as pattern=>replacement. Can be repeated"`
+	AllowDomains     []string `long:"allow-domain" description:"Only accept usernames without domain or of this NT domain or Kerberos realm. Can be repeated"`
+	DenyDomains      []string `long:"deny-domain" description:"Reject usernames of this NT domain or Kerberos realm. Can be repeated"`
+	DomainBaseDNs    []string `long:"domain-basedn" description:"Search the users of an NT domain under another BaseDN, given as DOMAIN=basedn. Can be repeated"`
+	CacheExpiration  int      `long:"cache" description:"Use in-memory cache. Set entry expiration time in seconds"`
+	CacheStale       int      `long:"cache-stale" description:"Serve answers up to this time in seconds after their --cache expiration, and refresh them in the background"`
+	CacheError       int      `long:"cache-error" description:"Serve answers up to this time in seconds after their --cache expiration when LDAP cannot be queried"`
+	CachePositiveTTL int      `long:"cache-positive-ttl" description:"Expiration time in seconds of the positive answers in the caches (default: --cache)"`
+	CacheNegativeTTL int      `long:"cache-negative-ttl" description:"Expiration time in seconds of the negative answers in the caches (default: --cache)"`
+	CacheSize        int      `long:"cache-size" description:"Maximum number of entries of each cache, the least recently used are evicted. 0 = no limit (default: 100000)" default:"100000"`
+	CacheJitter      int      `long:"cache-jitter" description:"Shorten the expiration time of each entry by a random part of up to this percentage, so that the entries cached together do not expire together (default: 10)" default:"10"`
+	WatchInterval    int      `long:"watch-interval" description:"Time in seconds between two polls of the directory changes (default: 30)" default:"30"`
+	WarmGroups       []string `long:"warm-group" description:"Look up the requests of the members of this group of the default backend when the lookup daemon (--daemon) starts, so that their first requests are answered from the cache. Helps when usernames are stripped of their NT domain and realm. Can be repeated"`
+	RefreshHot       int      `long:"refresh-hot" description:"Look up again this number of the most requested answers before they expire, every 10 seconds. Done by the lookup daemon (--daemon). 0 = no refresh"`
+	RefreshRate      int      `long:"refresh-rate" description:"Maximum number of lookups per second of the warm-up and the refresh of the most requested answers. 0 = no limit (default: 10)" default:"10"`
+	CacheFile        string   `long:"cache-file" description:"Keep the cached answers and group references in this file, so that they survive restarts of the helper. Written by the lookup daemon, or by one of the helper processes without --socket"`
+	CacheFileSize    int      `long:"cache-file-size" description:"Maximum size of the cache file in KiB, the entries expiring first are left out (default: 10240)" default:"10240"`
+	RequestTimeout   int      `long:"timeout" description:"Cancel LDAP queries of a request after this time in milliseconds. 0 = no limit"`
+	MaxRequests      int      `long:"max-requests" description:"Maximum number of requests querying LDAP at the same time, the others wait in the queue. 0 = no limit (default: 100)" default:"100"`
+	QueueTimeout     int      `long:"queue-timeout" description:"Answer BH to the requests waiting in the queue for longer than this time in milliseconds. 0 = no limit (default: 2000)" default:"2000"`
+	TokenGroups      bool     `long:"token-groups" description:"Match the group filter only against the groups in the tokenGroups attribute of the user, which includes nested and primary groups"`
+	PrimaryGroup     bool     `long:"primary-group" description:"Treat the primary group of the user (primaryGroupID), and the groups containing it, as membership"`
+	ResolveGroups    bool     `long:"resolve-groups" description:"Accept groups as DN, cn, sAMAccountName, SID or DOMAIN\\group and resolve them to the group name substituted for %g. %d = group DN"`
+	Profiles         []string `long:"profile" description:"LDAP backend profile, given as name:key=value;key=value;flag where the keys are the long names of the server, bind, search, schema, group and watch options. Can be repeated"`
+	Routes           []string `long:"route" description:"Send the users of an NT domain or Kerberos realm to a backend profile, given as DOMAIN=profile. Can be repeated"`
+	Socket           string   `long:"socket" description:"Unix socket of the lookup daemon shared by the helper processes. Requests are sent to the daemon, and answered from LDAP while it is unavailable"`
+	SocketMode       string   `long:"socket-mode" description:"Permissions of the lookup daemon socket, in octal (default: 0600)" default:"0600"`
+	SocketTimeout    int      `long:"socket-timeout" description:"Answer from LDAP when the lookup daemon does not answer within this time in milliseconds. 0 = the time the daemon may take with the same options, --queue-timeout plus --timeout, and a second more, or no limit if either is 0"`
+	Daemon           bool     `long:"daemon" description:"Run as the lookup daemon listening on --socket, owning the LDAP connections and the cache, instead of answering Squid on stdin"`
+	ControlSocket    string   `long:"control-socket" description:"Unix socket of the administration commands, sent with ext-acl-ldap-ctl. %p = process ID, to tell apart the helper processes started by Squid"`
+	ControlMode      string   `long:"control-mode" description:"Permissions of the control socket, in octal. The commands evict and flush the caches and reload the helper, so the socket is kept to its owner by default (default: 0600)" default:"0600"`
+	LogFile          string   `long:"log" description:"Path to log file (default: /var/log/squid-ext-acl-ldap.log)" default:"/var/log/squid-ext-acl-ldap.log"`
 }
 
+var opts options
+
 func isInt(s string) bool {
 	_, err := strconv.Atoi(s)
 	return err == nil
@@ -57,53 +104,344 @@ func addResponse(s string) {
 	responseChan <- s
 }
 
-func writerResponseLines() {
-	out := bufio.NewWriter(os.Stdout)
-	for {
-		line := <-responseChan
+func readRequestLines(r io.Reader, lines chan<- string, readErr chan<- error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines <- scanner.Text()
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("[WARN] Stdin error. Message - %s", err.Error())
+		readErr <- err
+	}
+	close(lines)
+}
+
+func writerResponseLines(w io.Writer, done chan<- struct{}) {
+	out := bufio.NewWriter(w)
+	for line := range responseChan {
 		out.WriteString(line)
 		out.WriteString("\n")
 		out.Flush()
 	}
+	close(done)
 }
 
-func startChecker() {
-	var (
-		line    string
-		err     error
-		servers []string
+// newNormalizer returns the username normalization pipeline configured by
+// the options
+func newNormalizer() (*normalize.Normalizer, map[string]string) {
+	n, err := normalize.New(normalize.Config{
+		Rewrites:     opts.Rewrites,
+		AllowDomains: opts.AllowDomains,
+		DenyDomains:  opts.DenyDomains,
+		StripRealm:   opts.StripRealm,
+		StripDomain:  opts.StripDomain,
+		Lowercase:    opts.Lowercase,
+	})
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid username normalization rules. Message - %s", err.Error())
+	}
+	baseDNs, err := normalize.ParseMap(opts.DomainBaseDNs)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid domain BaseDN. Message - %s", err.Error())
+	}
+	if opts.StripDomain && len(baseDNs) != 0 {
+		log.Fatalf("[ERROR] Invalid domain BaseDN. Message - --domain-basedn cannot be used with --strip-domain, which drops the NT domain it is looked up by")
+	}
+	return n, baseDNs
+}
+
+// userSearch returns the BaseDN and filter of the search of the user. The
+// users of a domain with its own BaseDN are searched under it, and the
+// users with a realm are searched by userPrincipalName if enabled.
+func (b *backend) userSearch(identity normalize.Identity) (baseDN, filter string) {
+	baseDN = b.opts.BaseDN
+	if domainBaseDN, ok := domainBaseDNs[strings.ToUpper(identity.Domain)]; ok && identity.Domain != "" {
+		baseDN = domainBaseDN
+	}
+	if b.opts.UPNLookup && identity.UPN() != "" {
+		return baseDN, fmt.Sprintf("(userPrincipalName=%s)", ldap.EscapeFilter(identity.UPN()))
+	}
+	return baseDN, fmt.Sprintf("(&(%s))", strings.Replace(b.userFilter(), "%u", ldap.EscapeFilter(identity.Name), -1))
+}
+
+// findUser returns the entry of the user, or nil if the user is not found.
+// Concurrent searches of the same user are coalesced.
+func (b *backend) findUser(ctx context.Context, conn *ldappool.PoolConn, identity normalize.Identity) (*ldap.Entry, error) {
+	user, err, _ := userLookups.Do(b.CacheKey(identity.Key()), func() (interface{}, error) {
+		userAttributes := []string{b.loginAttribute()}
+		if b.opts.PrimaryGroup {
+			userAttributes = append(userAttributes, "objectSid", "primaryGroupID")
+		}
+		userBaseDN, userSearchFilter := b.userSearch(identity)
+		searchRequest := ldap.NewSearchRequest(
+			userBaseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			userSearchFilter,
+			userAttributes,
+			nil,
+		)
+		sr, err := b.Search(ctx, conn, searchRequest)
+		if err != nil || len(sr.Entries) != 1 {
+			return (*ldap.Entry)(nil), err
+		}
+		return sr.Entries[0], nil
+	})
+	return user.(*ldap.Entry), err
+}
+
+// tokenGroupsFilter returns a filter matching the groups listed in the
+// tokenGroups attribute of the user. tokenGroups is computed by the server
+// and can only be read with a base scope search of the user entry. The
+// filter is empty if the user is a member of no group.
+func (b *backend) tokenGroupsFilter(ctx context.Context, conn *ldappool.PoolConn, userDN string) (string, error) {
+	searchRequest := ldap.NewSearchRequest(
+		userDN,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"tokenGroups"},
+		nil,
 	)
+	sr, err := b.Search(ctx, conn, searchRequest)
+	if err != nil {
+		return "", err
+	}
+	if len(sr.Entries) != 1 {
+		return "", nil
+	}
+	sids := sr.Entries[0].GetRawAttributeValues("tokenGroups")
+	if len(sids) == 0 {
+		return "", nil
+	}
+	return ldap.SIDsFilter("objectSid", sids)
+}
 
-	for _, server := range opts.ServerSlice {
-		servers = append(servers, fmt.Sprintf("%s:%d", server, opts.ServerPort))
+// primaryGroupSID returns the SID of the primary group of the user. The
+// primaryGroupID attribute is the relative identifier of the group in the
+// domain of the user, so the SID is the one of the user with its last
+// sub-authority replaced.
+func primaryGroupSID(user *ldap.Entry) (string, error) {
+	primaryGroupID := user.GetAttributeValue("primaryGroupID")
+	if primaryGroupID == "" {
+		return "", nil
+	}
+	if !isInt(primaryGroupID) {
+		return "", fmt.Errorf("invalid primaryGroupID %q", primaryGroupID)
 	}
+	userSID, err := ldap.ParseSID(user.GetRawAttributeValue("objectSid"))
+	if err != nil {
+		return "", err
+	}
+	return userSID[:strings.LastIndex(userSID, "-")+1] + primaryGroupID, nil
+}
 
-	serverpool, err := ldappool.NewServerPool(&servers, 10000, 200, true)
+// primaryGroupMember reports whether the primary group of the user is the
+// group, or a member of a group matching the group filter
+func (b *backend) primaryGroupMember(ctx context.Context, conn *ldappool.PoolConn, user *ldap.Entry, group groupIdentity) (bool, error) {
+	sid, err := primaryGroupSID(user)
+	if err != nil || sid == "" {
+		return false, err
+	}
+	filter, err := ldap.SIDFilter("objectSid", sid)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot create LDAP server pool. Error - %s", err.Error())
-		os.Exit(1)
+		return false, err
 	}
+	searchRequest := ldap.NewSearchRequest(
+		b.opts.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{"cn", "sAMAccountName"},
+		nil,
+	)
+	sr, err := b.Search(ctx, conn, searchRequest)
+	if err != nil {
+		return false, err
+	}
+	if len(sr.Entries) != 1 {
+		return false, nil
+	}
+	primaryGroup := sr.Entries[0]
+	if group.DN != "" {
+		dn, err := ldap.ParseDN(group.DN)
+		primaryDN, primaryErr := ldap.ParseDN(primaryGroup.DN)
+		if err == nil && primaryErr == nil && dn.Equal(primaryDN) {
+			return true, nil
+		}
+	} else if strings.EqualFold(primaryGroup.GetAttributeValue("cn"), group.Name) || strings.EqualFold(primaryGroup.GetAttributeValue("sAMAccountName"), group.Name) {
+		return true, nil
+	}
+
+	r := strings.NewReplacer("%u", ldap.EscapeFilter(primaryGroup.DN),
+		"%g", ldap.EscapeFilter(group.Name),
+		"%d", ldap.EscapeFilter(group.DN))
+	searchRequest = ldap.NewSearchRequest(
+		b.opts.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		r.Replace(b.groupFilter()),
+		[]string{"sAMAccountName"},
+		nil,
+	)
+	return b.SearchExists(ctx, conn, searchRequest)
+}
+
+// startWorkers sets up the pool of workers running the LDAP queries. The
+// returned function logs the counters of the pool.
+func startWorkers() (stop func()) {
+	workers = workpool.New(opts.MaxRequests, time.Duration(opts.QueueTimeout)*time.Millisecond)
+	return func() {
+		log.Printf("[INFO] Workers - %s", workers.Stats().String())
+	}
+}
+
+// directoryCacheTTL is the expiration time in seconds of the entries of the
+// caches of directory lookups without --cache
+const directoryCacheTTL = 300
+
+// cacheConfig returns the configuration of a cache set by the options. The
+// answers without a TTL option are kept for ttl seconds.
+func cacheConfig(ttl int, negative func(result string) bool) resultcache.Config {
+	positiveTTL, negativeTTL := ttl, ttl
+	if opts.CachePositiveTTL != 0 {
+		positiveTTL = opts.CachePositiveTTL
+	}
+	if opts.CacheNegativeTTL != 0 {
+		negativeTTL = opts.CacheNegativeTTL
+	}
+	return resultcache.Config{
+		PositiveTTL: time.Duration(positiveTTL) * time.Second,
+		NegativeTTL: time.Duration(negativeTTL) * time.Second,
+		Stale:       time.Duration(opts.CacheStale) * time.Second,
+		ErrorTTL:    time.Duration(opts.CacheError) * time.Second,
+		Jitter:      float64(opts.CacheJitter) / 100,
+		MaxEntries:  opts.CacheSize,
+		Negative:    negative,
+	}
+}
+
+// startCache configures the cache of the answers and the caches of directory
+// lookups. The returned function waits for the background refreshes and logs
+// the cache counters.
+func startCache() (stop func()) {
+	config := cacheConfig(opts.CacheExpiration, func(result string) bool { return result == negativeResult })
+	config.CountHits = opts.RefreshHot != 0
+	c.Configure(config)
+	ttl := opts.CacheExpiration
+	if ttl == 0 {
+		ttl = directoryCacheTTL
+	}
+	config = cacheConfig(ttl, unresolvedGroup)
+	config.Stale, config.ErrorTTL = 0, 0
+	groupCache.Configure(config)
+	return func() {
+		c.Wait()
+		if opts.CacheExpiration != 0 || opts.CachePositiveTTL != 0 || opts.CacheNegativeTTL != 0 {
+			log.Printf("[INFO] Cache - %s", c.Stats().String())
+		}
+		log.Printf("[INFO] Coalesced requests: %d, coalesced user searches: %d", requestLookups.Shared(), userLookups.Shared())
+	}
+}
+
+// socketTimeout returns the time the lookup daemon has to answer a request.
+// By default it outlasts the queue and the LDAP queries of the daemon, so
+// that the helper does not query LDAP for a request the daemon still works
+// on.
+func socketTimeout() time.Duration {
+	if opts.SocketTimeout != 0 {
+		return time.Duration(opts.SocketTimeout) * time.Millisecond
+	}
+	if opts.QueueTimeout == 0 || opts.RequestTimeout == 0 {
+		return 0
+	}
+	return time.Duration(opts.QueueTimeout+opts.RequestTimeout)*time.Millisecond + time.Second
+}
 
-	ldapConnPool, err = ldappool.NewChannelPool(0, 100*len(opts.ServerSlice), serverpool, opts.UseTLS, []uint8{ldap.LDAPResultTimeLimitExceeded, ldap.ErrorNetwork, ldap.LDAPResultInvalidCredentials})
+// serveDaemon answers the requests of the helper processes on the unix
+// socket until the daemon is told to exit
+func serveDaemon(path string) {
+	mode, err := unixsock.ParseMode(opts.SocketMode)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot create LDAP connection pool. Message - %s", err.Error())
-		os.Exit(1)
+		log.Fatalf("[ERROR] Invalid lookup daemon socket permissions. Message - %s", err.Error())
+	}
+	d := &lookupd.Daemon{
+		Start:    startDaemonServices,
+		Lookup:   lookup,
+		Negative: negativeResult,
+		Reload:   signalHupChan,
+		Exit:     signalInterruptChan,
+	}
+	if err := d.Serve(path, mode); err != nil {
+		log.Fatalf("[ERROR] Cannot listen on the lookup daemon socket. Message - %s", err.Error())
 	}
-	defer ldapConnPool.Close()
+}
 
-scanloop:
-	for {
+// startDaemonServices sets up the lookups of the daemon: the backends, the
+// workers, the caches, the cache file, the directory watchers, the warm-up
+// and the control socket. The returned function stops them in the reverse
+// order.
+func startDaemonServices() (stop func()) {
+	normalizer, domainBaseDNs = newNormalizer()
+	defaultBackend, backends, router = newBackends()
+	stops := []func(){closeBackends, startWorkers(), startCache()}
+	if opts.CacheFile != "" {
+		stops = append(stops, startCacheFile())
+	}
+	stops = append(stops, startWatchers(), startWarmer(), startControl())
+	return func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+}
 
+// startChecker answers request lines until the input is exhausted or a
+// signal arrives. It waits for the requests still in flight and reports
+// whether the helper has to be started again to reload its configuration.
+func startChecker(lines <-chan string) bool {
+	var (
+		line string
+		ok   bool
+	)
+
+	normalizer, domainBaseDNs = newNormalizer()
+	defaultBackend, backends, router = newBackends()
+	defer closeBackends()
+	stopWorkers := startWorkers()
+	defer stopWorkers()
+	stopCache := startCache()
+	defer stopCache()
+	lookupClient = nil
+	if opts.Socket != "" {
+		// the lookup daemon keeps the cache file and watches the directory
+		// for the helpers sharing it. The pools of the helper only connect
+		// when the daemon is unavailable.
+		lookupClient = lookupd.NewClient(opts.Socket, socketTimeout())
+		defer lookupClient.Close()
+	} else {
+		if opts.CacheFile != "" {
+			stopCacheFile := startCacheFile()
+			defer stopCacheFile()
+		}
+		stopWatchers := startWatchers()
+		defer stopWatchers()
+		stopControl := startControl()
+		defer stopControl()
+	}
+	defer requestWaitGroup.Wait()
+
+	for {
 		select {
-		case line = <-stdinLineChan:
+		case line, ok = <-lines:
+			if !ok {
+				log.Print("[INFO] Got EOF on stdin")
+				return false
+			}
 
 		case <-signalHupChan:
 			log.Print("[INFO] Got SIGHUP to reload configuration")
-			break scanloop
+			return true
 
 		case <-signalInterruptChan:
 			log.Print("[INFO] Got signal to exit squid LDAP external acl helper")
-			os.Exit(0)
+			return false
 		}
 
 		line = strings.TrimSpace(line)
@@ -126,59 +464,148 @@ scanloop:
 		}
 
 		if concurrency {
-			go doRequest(id, username, searchEntity)
+			requestWaitGroup.Add(1)
+			go func() {
+				defer requestWaitGroup.Done()
+				doRequest(id, username, searchEntity)
+			}()
 		} else {
 			doRequest(id, username, searchEntity)
 		}
 	}
+}
+
+// serve answers the request lines read from r on w the same way Squid talks
+// to the helper over stdin and stdout. It returns once the input is exhausted
+// or the helper is told to exit, after every answer has been written, and
+// returns the error which ended the input, if any.
+func serve(r io.Reader, w io.Writer) error {
+	lines := make(chan string, 100)
+	readErr := make(chan error, 1)
+	writerDone := make(chan struct{})
+	responseChan = make(chan string, 1024*10)
+
+	go readRequestLines(r, lines, readErr)
+	go writerResponseLines(w, writerDone)
+
+	for {
+		log.Print("[INFO] Start squid LDAP external acl helper")
+		if !startChecker(lines) {
+			break
+		}
+	}
 
 	log.Print("[INFO] Stop squid LDAP external acl helper")
-	rewriterExitChan <- 1
+	close(responseChan)
+	<-writerDone
+	select {
+	case err := <-readErr:
+		return err
+	default:
+		return nil
+	}
 }
 
-func printPositiveResult(id, searchEntity string) {
-	if id == "" {
-		addResponse(fmt.Sprintf("OK tag=%s", searchEntity))
-	} else {
-		addResponse(fmt.Sprintf("%s OK tag=%s", id, searchEntity))
-	}
+const negativeResult = "ERR"
+
+// busyResult is the answer to the requests which found no free worker
+// within the queue deadline
+const busyResult = `BH message="too many LDAP requests in flight"`
+
+func positiveResult(searchEntity string) string {
+	return fmt.Sprintf("OK tag=%s", searchEntity)
 }
 
-func printNegativeResult(id string) {
+func printResult(id, result string) {
 	if id == "" {
-		addResponse(fmt.Sprintf("ERR"))
+		addResponse(result)
 	} else {
-		addResponse(fmt.Sprintf("%s ERR", id))
+		addResponse(fmt.Sprintf("%s %s", id, result))
 	}
 }
 
+// doRequest answers the request of the user for the search entity, from the
+// lookup daemon if enabled, or else from LDAP
 func doRequest(id, username string, searchEntity string) {
-	if opts.StripRealm {
-		username = strings.Split(username, "@")[0]
+	if lookupClient != nil {
+		result, err := lookupClient.Lookup(username + " " + searchEntity)
+		if err == nil {
+			printResult(id, result)
+			return
+		}
+		if err != lookupd.ErrUnavailable {
+			log.Printf("[WARN] Lookup daemon error. Falling back to LDAP. Message - %s", err.Error())
+		}
+	}
+	printResult(id, lookup(username, searchEntity))
+}
+
+// lookup returns the result of the request of the user for the search
+// entity, "OK tag=..." or "ERR"
+func lookup(username, searchEntity string) string {
+	identity, err := normalizer.Normalize(username)
+	if err != nil {
+		log.Printf("[WARN] User '%s' is rejected. Message - %s", username, err.Error())
+		return negativeResult
 	}
-	if opts.StripDomain && strings.Contains(username, "\\") {
-		username = strings.Split(username, "\\")[1]
+	b := route(username)
+	b.Metrics.Request()
+	cacheKey := b.CacheKey(fmt.Sprintf("%s:%s", identity.Key(), searchEntity))
+
+	result := c.Get(cacheKey, func() (string, error) {
+		return b.coalescedQuery(cacheKey, identity, searchEntity)
+	})
+	switch result {
+	case negativeResult:
+		b.Metrics.Negative()
+	case busyResult:
+		// counted as an error when the request gave up
+	default:
+		b.Metrics.Positive()
 	}
+	return result
+}
 
-	if opts.CacheExpiration != 0 {
-		searchResult, cacheFound := c.Get(fmt.Sprintf("%s:%s", username, searchEntity))
-		if cacheFound {
-			if searchResult == 1 {
-				printPositiveResult(id, searchEntity)
-			} else {
-				printNegativeResult(id)
-			}
-			return
+// coalescedQuery runs the query of the request on a worker. Concurrent
+// requests of the user for the entity, with the same cache key, share one
+// query.
+func (b *backend) coalescedQuery(cacheKey string, identity normalize.Identity, searchEntity string) (string, error) {
+	result, err, _ := requestLookups.Do(cacheKey, func() (interface{}, error) {
+		var (
+			result string
+			err    error
+		)
+		if werr := workers.Do(func() { result, err = b.query(identity, searchEntity) }); werr != nil {
+			log.Printf("[WARN] Request of user '%s' is not answered. Message - %s", identity.Key(), werr.Error())
+			b.Metrics.Error()
+			return busyResult, werr
 		}
+		return result, err
+	})
+	return result.(string), err
+}
+
+// query looks up the result of the request of the user for the search
+// entity in the directory. The error reports an answer given because the
+// directory could not be queried.
+func (b *backend) query(identity normalize.Identity, searchEntity string) (string, error) {
+	username := identity.Name
+
+	ctx := context.Background()
+	if opts.RequestTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.RequestTimeout)*time.Millisecond)
+		defer cancel()
 	}
 
-	conn, err := ldapConnPool.Get()
+	conn, err := b.Pool.Get(ctx)
 	if err != nil {
-		log.Fatal("[ERROR] Cannot get active LDAP connection")
-		printNegativeResult(id)
+		log.Printf("[ERROR] Cannot get active LDAP connection. Message - %s", err.Error())
+		b.Metrics.Error()
+		return negativeResult, err
 	}
 
-	err = conn.Bind(opts.BindUsername, opts.BindPassword)
+	err = conn.BindContext(ctx, b.opts.BindUsername, b.opts.BindPassword)
 
 	if err != nil {
 		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
@@ -186,71 +613,103 @@ func doRequest(id, username string, searchEntity string) {
 		} else {
 			log.Printf("[WARN] LDAP binding operation error. Message - %s", err.Error())
 		}
-		printNegativeResult(id)
-		return
+		conn.MarkUnusable()
+		conn.Close()
+		b.Metrics.Error()
+		return negativeResult, err
 	}
 	defer conn.Close()
 
-	searchRequest := ldap.NewSearchRequest(
-		opts.BaseDN,
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(&(%s))", strings.Replace(opts.UserFilter, "%u", username, -1)),
-		[]string{"sAMAccountName"},
-		nil,
-	)
-	sr, err := conn.Search(searchRequest)
+	userConn := conn
+	if b.opts.GlobalCatalog {
+		userConn, err = b.gcPool.Get(ctx)
+		if err != nil {
+			log.Printf("[ERROR] Cannot get active Global Catalog connection. Message - %s", err.Error())
+			b.Metrics.Error()
+			return negativeResult, err
+		}
+		err = userConn.BindContext(ctx, b.opts.BindUsername, b.opts.BindPassword)
+		if err != nil {
+			log.Printf("[WARN] Global Catalog binding operation error. Message - %s", err.Error())
+			userConn.MarkUnusable()
+			userConn.Close()
+			b.Metrics.Error()
+			return negativeResult, err
+		}
+		defer userConn.Close()
+	}
+
+	user, err := b.findUser(ctx, userConn, identity)
 	if err != nil {
 		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
-			log.Printf("[WARN] Exception during execution of the LDAP query. User '%s' is not found in domain. Using LDAP path - %s", username, opts.BaseDN)
+			log.Printf("[WARN] Exception during execution of the LDAP query. User '%s' is not found in domain. Using LDAP path - %s", username, b.opts.BaseDN)
 		} else {
 			log.Printf("[WARN] Exception during execution of the LDAP query. Message - %s", err.Error())
 		}
-		printNegativeResult(id)
-		return
+		b.Metrics.Error()
+		return negativeResult, err
 	} else {
-		if len(sr.Entries) == 1 {
-			r := strings.NewReplacer("%u", sr.Entries[0].DN,
-				"%g", searchEntity)
-
-			searchRequest := ldap.NewSearchRequest(
-				opts.BaseDN,
-				ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-				r.Replace(opts.GroupFilter),
-				[]string{"sAMAccountName"},
-				nil,
+		if user != nil {
+			login := user.GetAttributeValue(b.loginAttribute())
+			if login == "" {
+				login = username
+			}
+			var (
+				found bool
+				err   error
 			)
-
-			sr, err = conn.Search(searchRequest)
+			group := groupIdentity{Name: searchEntity}
+			if b.opts.ResolveGroups {
+				group, err = b.resolveGroup(ctx, conn, searchEntity)
+			}
+			r := strings.NewReplacer("%u", ldap.EscapeFilter(user.DN),
+				"%n", ldap.EscapeFilter(login),
+				"%g", ldap.EscapeFilter(group.Name),
+				"%d", ldap.EscapeFilter(group.DN))
+			filter := r.Replace(b.groupFilter())
+
+			if err == nil && b.opts.TokenGroups {
+				var sidsFilter string
+				sidsFilter, err = b.tokenGroupsFilter(ctx, conn, user.DN)
+				if sidsFilter == "" {
+					filter = ""
+				} else {
+					filter = fmt.Sprintf("(&%s%s)", filter, sidsFilter)
+				}
+			}
+			if err == nil && filter != "" {
+				searchRequest := ldap.NewSearchRequest(
+					b.opts.BaseDN,
+					ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+					filter,
+					[]string{"sAMAccountName"},
+					nil,
+				)
+
+				found, err = b.SearchExists(ctx, conn, searchRequest)
+			}
+			if err == nil && !found && b.opts.PrimaryGroup {
+				found, err = b.primaryGroupMember(ctx, conn, user, group)
+			}
 			if err != nil {
 				if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
-					log.Printf("[WARN] Exception during execution of the LDAP query. User '%s' is not found in domain. Using LDAP path - %s", username, opts.BaseDN)
+					log.Printf("[WARN] Exception during execution of the LDAP query. User '%s' is not found in domain. Using LDAP path - %s", username, b.opts.BaseDN)
 				} else {
 					log.Printf("[WARN] Exception during execution of the LDAP query. Message - %s", err.Error())
 				}
 
-				printNegativeResult(id)
-				return
+				b.Metrics.Error()
+				return negativeResult, err
 			} else {
-				if len(sr.Entries) > 0 {
-					if opts.CacheExpiration != 0 {
-						c.Set(fmt.Sprintf("%s:%s", username, searchEntity), 1, time.Duration(opts.CacheExpiration)*time.Second)
-					}
-
-					printPositiveResult(id, searchEntity)
-					return
+				if found {
+					return positiveResult(searchEntity), nil
 				} else {
-					if opts.CacheExpiration != 0 {
-						c.Set(fmt.Sprintf("%s:%s", username, searchEntity), 0, time.Duration(opts.CacheExpiration)*time.Second)
-					}
-
-					printNegativeResult(id)
-					return
+					return negativeResult, nil
 				}
 			}
 		} else {
-			log.Printf("[WARN] Exception during execution of the LDAP query. User '%s' is not found in domain. Using LDAP path - %s", username, opts.BaseDN)
-			printNegativeResult(id)
-			return
+			log.Printf("[WARN] Exception during execution of the LDAP query. User '%s' is not found in domain. Using LDAP path - %s", username, b.opts.BaseDN)
+			return negativeResult, nil
 		}
 	}
 }
@@ -269,6 +728,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	if b := (&backend{opts: &opts}); b.userFilter() == "" || b.groupFilter() == "" {
+		fmt.Fprintln(os.Stderr, "the --user-filter and --group-filter options are required without --schema")
+		os.Exit(1)
+	}
+
+	if opts.Daemon && opts.Socket == "" {
+		fmt.Fprintln(os.Stderr, "the --socket option is required with --daemon")
+		os.Exit(1)
+	}
+
 	f, err := os.OpenFile(opts.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatalf("[ERROR] Error opening log file: %v", err.Error())
@@ -299,26 +768,11 @@ func main() {
 	signal.Notify(signalHupChan, syscall.SIGHUP)
 	signal.Notify(signalInterruptChan, os.Interrupt, syscall.SIGTERM)
 
-	go writerResponseLines()
-
-	inscanner := bufio.NewScanner(os.Stdin)
-	go func() {
-		for inscanner.Scan() {
-			stdinLineChan <- inscanner.Text()
-		}
-		err := inscanner.Err()
-		if err != nil {
-			log.Printf("[WARN] Stdin error. Message - %s", err.Error())
-			os.Exit(1)
-		}
-		log.Print("[INFO] Stop squid LDAP external acl helper")
-		os.Exit(0)
-	}()
-
-	rewriterExitChan <- 1
-	for {
-		<-rewriterExitChan
-		log.Print("[INFO] Start squid LDAP external acl helper")
-		go startChecker()
+	if opts.Daemon {
+		serveDaemon(opts.Socket)
+		return
+	}
+	if err := serve(os.Stdin, os.Stdout); err != nil {
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,1457 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/cachefile"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/control"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldaptest"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/lookupd"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func newTestDirectory(t *testing.T) *ldaptest.Server {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	srv.AddCredentials("squid@domain.local", "secret")
+
+	srv.AddEntry("dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	srv.AddEntry("ou=Users,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}})
+	srv.AddEntry("ou=Groups,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}})
+	srv.AddEntry("cn=John Doe,ou=Users,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"jdoe"},
+		"objectSid":      {testSID(t, 1104)},
+		"primaryGroupID": {"513"},
+		"tokenGroups":    {testSID(t, 513), testSID(t, 1102), testSID(t, 1101)},
+	})
+	srv.AddEntry("cn=Bob,ou=Users,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"bob"},
+		"objectSid":      {testSID(t, 1105)},
+		"primaryGroupID": {"513"},
+		"tokenGroups":    {testSID(t, 513), testSID(t, 1103)},
+	})
+	srv.AddEntry("cn=Internet,ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"group"},
+		"cn":             {"Internet"},
+		"sAMAccountName": {"InetAccess"},
+		"objectSid":      {testSID(t, 1101)},
+		"member":         {"cn=Staff,ou=Groups,dc=domain,dc=local"},
+	})
+	srv.AddEntry("cn=Staff,ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"Staff"},
+		"objectSid":   {testSID(t, 1102)},
+		"member":      {"cn=John Doe,ou=Users,dc=domain,dc=local"},
+	})
+	srv.AddEntry("cn=Mail,ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"Mail"},
+		"objectSid":   {testSID(t, 1103)},
+		"member":      {"cn=Bob,ou=Users,dc=domain,dc=local"},
+	})
+	// the primary group of the users, which does not list them as members
+	srv.AddEntry("cn=Employees,ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"Employees"},
+		"objectSid":   {testSID(t, 513)},
+	})
+	return srv
+}
+
+// testSID returns the binary SID of the domain account with the given
+// relative identifier
+func testSID(t *testing.T, rid int) string {
+	sid, err := ldap.EncodeSID(fmt.Sprintf("S-1-5-21-1004336348-1177238915-682003330-%d", rid))
+	if err != nil {
+		t.Fatalf("cannot encode SID: %s", err)
+	}
+	return string(sid)
+}
+
+func setTestOptions(srv *ldaptest.Server) {
+	opts.ServerSlice = []string{srv.Host()}
+	opts.ServerPort = srv.Port()
+	opts.UseTLS = false
+	opts.BindUsername = "squid@domain.local"
+	opts.BindPassword = "secret"
+	opts.BaseDN = "dc=domain,dc=local"
+	opts.Schema = ""
+	opts.UserFilter = "sAMAccountName=%u"
+	opts.GroupFilter = "(&(objectClass=group)(cn=%g)(member:1.2.840.113556.1.4.1941:=%u))"
+	opts.LoginAttribute = ""
+	opts.StripRealm = true
+	opts.StripDomain = true
+	opts.Lowercase = false
+	opts.Rewrites = nil
+	opts.AllowDomains = nil
+	opts.DenyDomains = nil
+	opts.DomainBaseDNs = nil
+	opts.UPNLookup = false
+	opts.CacheExpiration = 0
+	opts.RequestTimeout = 0
+	opts.Referrals = false
+	opts.ReferralHops = 5
+	opts.ReferralHosts = nil
+	opts.ReferralTimeout = 300
+	opts.ReferralNoVerify = false
+	opts.ReferralInsecure = false
+	opts.GlobalCatalog = false
+	opts.GCPort = 0
+	opts.TokenGroups = false
+	opts.PrimaryGroup = false
+	opts.ResolveGroups = false
+	opts.Profiles = nil
+	opts.Routes = nil
+	opts.Socket = ""
+	opts.SocketTimeout = 1000
+	opts.SocketMode = "0600"
+	opts.Daemon = false
+	opts.CacheStale = 0
+	opts.CacheError = 0
+	opts.CacheFile = ""
+	opts.CacheFileSize = 10240
+	opts.MaxRequests = 100
+	opts.QueueTimeout = 2000
+	opts.MaxDials = 10
+	opts.CachePositiveTTL = 0
+	opts.CacheNegativeTTL = 0
+	opts.CacheSize = 100000
+	opts.CacheJitter = 10
+	opts.Watch = ""
+	opts.WatchInterval = 30
+	opts.WarmGroups = nil
+	opts.RefreshHot = 0
+	opts.RefreshRate = 10
+	opts.ControlSocket = ""
+	opts.ControlMode = "0600"
+	groupCache.Flush()
+}
+
+func startTestHelper(t *testing.T, srv *ldaptest.Server) *ldaptest.Helper {
+	setTestOptions(srv)
+	return ldaptest.StartHelper(t, serve)
+}
+
+func TestNonConcurrentRequests(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	h.Send(
+		"jdoe Internet",
+		"jdoe Mail",
+		"DOMAIN\\bob Mail",
+		"jdoe@DOMAIN.LOCAL Staff",
+		"unknown Internet",
+	)
+
+	expected := []string{
+		"OK tag=Internet",
+		"ERR",
+		"OK tag=Mail",
+		"OK tag=Staff",
+		"ERR",
+	}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	expected := map[string]string{}
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("%d", i)
+		switch i % 3 {
+		case 0:
+			h.Send(id + " jdoe Internet")
+			expected[id] = id + " OK tag=Internet"
+		case 1:
+			h.Send(id + " bob Internet")
+			expected[id] = id + " ERR"
+		case 2:
+			h.Send(id + " bob Mail")
+			expected[id] = id + " OK tag=Mail"
+		}
+	}
+
+	for _, response := range h.ReceiveAll(len(expected)) {
+		var id string
+		fmt.Sscan(response, &id)
+		if expected[id] != response {
+			t.Errorf("channel %s: got %q, expected %q", id, response, expected[id])
+		}
+		delete(expected, id)
+	}
+	if len(expected) != 0 {
+		t.Errorf("no answer for channels %v", expected)
+	}
+}
+
+func TestEOFAnswersPendingRequests(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+
+	h.Send("0 jdoe Internet", "1 bob Internet", "2 bob Mail")
+	h.CloseInput()
+
+	responses := h.Wait()
+	sort.Strings(responses)
+	expected := []string{"0 OK tag=Internet", "1 ERR", "2 OK tag=Mail"}
+	if fmt.Sprint(responses) != fmt.Sprint(expected) {
+		t.Errorf("got %q, expected %q", responses, expected)
+	}
+	if err := h.Err(); err != nil {
+		t.Errorf("got error %v at EOF", err)
+	}
+}
+
+func TestInputErrorAnswersPendingRequests(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+
+	h.Send("0 jdoe Internet", "1 bob Internet")
+	h.CloseInputWithError(errors.New("read error"))
+
+	responses := h.Wait()
+	sort.Strings(responses)
+	expected := []string{"0 OK tag=Internet", "1 ERR"}
+	if fmt.Sprint(responses) != fmt.Sprint(expected) {
+		t.Errorf("got %q, expected %q", responses, expected)
+	}
+	// the helper exits with a non-zero status on the error
+	if err := h.Err(); err == nil || err.Error() != "read error" {
+		t.Errorf("got error %v, expected the read error", err)
+	}
+}
+
+func TestSIGHUPReloadsHelper(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "OK tag=Internet" {
+		t.Fatalf("got %q before reload", response)
+	}
+	connections := srv.Connections()
+
+	signalHupChan <- syscall.SIGHUP
+	for len(signalHupChan) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "OK tag=Internet" {
+		t.Fatalf("got %q after reload", response)
+	}
+	if srv.Connections() <= connections {
+		t.Errorf("LDAP connection pool was not recreated on reload")
+	}
+}
+
+func TestSIGTERMStopsHelper(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.CloseInput()
+
+	h.Send("0 jdoe Internet")
+	if response := h.Receive(); response != "0 OK tag=Internet" {
+		t.Fatalf("got %q", response)
+	}
+
+	signalInterruptChan <- syscall.SIGTERM
+
+	if responses := h.Wait(); len(responses) != 0 {
+		t.Errorf("unexpected answers after SIGTERM: %q", responses)
+	}
+}
+
+func TestRequestTimeoutAbandonsSearch(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+	opts.RequestTimeout = 50
+	srv.SetSearchDelay(200 * time.Millisecond)
+
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "ERR" {
+		t.Fatalf("got %q for a timed out request", response)
+	}
+	if !srv.WaitRequest(ldap.ApplicationAbandonRequest, time.Second) {
+		t.Errorf("timed out search was not abandoned")
+	}
+}
+
+func TestStopUnbindsConnections(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+
+	h.Send("0 jdoe Internet", "1 jdoe Internet", "2 jdoe Internet")
+	h.ReceiveAll(3)
+	h.Stop()
+
+	if !srv.WaitRequest(ldap.ApplicationUnbindRequest, time.Second) {
+		t.Errorf("pooled connections were closed without unbind")
+	}
+}
+
+// newChildDomain starts the directory of a child domain the test directory
+// refers to
+func newChildDomain(t *testing.T, root *ldaptest.Server) *ldaptest.Server {
+	child, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	child.AddCredentials("squid@domain.local", "secret")
+
+	child.AddEntry("dc=child,dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	child.AddEntry("cn=Alice,ou=Users,dc=child,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"alice"},
+	})
+	child.AddEntry("cn=Developers,ou=Groups,dc=child,dc=domain,dc=local", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"Developers"},
+		"member":      {"cn=Alice,ou=Users,dc=child,dc=domain,dc=local"},
+	})
+	root.AddReferral("dc=child,dc=domain,dc=local", fmt.Sprintf("ldap://%s/dc=child,dc=domain,dc=local", child.Addr()))
+	return child
+}
+
+func TestReferralsServeChildDomainUsers(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	child := newChildDomain(t, srv)
+	defer child.Close()
+
+	h := startTestHelper(t, srv)
+	h.Send("alice Developers")
+	if response := h.Receive(); response != "ERR" {
+		t.Errorf("got %q without following referrals", response)
+	}
+	h.Stop()
+
+	// the credentials are not sent to the child domain over plain LDAP
+	setTestOptions(srv)
+	opts.Referrals = true
+	h = ldaptest.StartHelper(t, serve)
+	h.Send("alice Developers")
+	if response := h.Receive(); response != "ERR" {
+		t.Errorf("got %q following a referral over plain LDAP", response)
+	}
+	h.Stop()
+	if child.CountRequests(ldap.ApplicationBindRequest) != 0 {
+		t.Errorf("credentials were sent to the child domain over plain LDAP")
+	}
+
+	setTestOptions(srv)
+	opts.Referrals = true
+	opts.ReferralInsecure = true
+	h = ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("alice Developers", "jdoe Developers", "jdoe Internet")
+	expected := []string{"OK tag=Developers", "ERR", "OK tag=Internet"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestGlobalCatalogUserLookup(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	srv.AddEntry("cn=Proxy,ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"Proxy"},
+		"member":      {"cn=Alice,ou=Users,dc=child,dc=domain,dc=local"},
+	})
+
+	gc, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	defer gc.Close()
+	gc.AddCredentials("squid@domain.local", "secret")
+	gc.AddEntry("dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	gc.AddEntry("cn=John Doe,ou=Users,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"jdoe"},
+	})
+	gc.AddEntry("cn=Alice,ou=Users,dc=child,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"alice"},
+	})
+
+	setTestOptions(srv)
+	opts.GlobalCatalog = true
+	opts.GCPort = gc.Port()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("alice Proxy", "alice Internet", "jdoe Internet")
+	expected := []string{"OK tag=Proxy", "ERR", "OK tag=Internet"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+	if gc.CountRequests(ldap.ApplicationSearchRequest) == 0 {
+		t.Errorf("users were not searched in the Global Catalog")
+	}
+}
+
+func TestSearchStopsAtFirstMatch(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "OK tag=Internet" {
+		t.Fatalf("got %q", response)
+	}
+	if !srv.WaitRequest(ldap.ApplicationAbandonRequest, time.Second) {
+		t.Errorf("search was not abandoned after the first match")
+	}
+}
+
+func TestNoticeOfDisconnectionDropsPooledConnections(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "OK tag=Internet" {
+		t.Fatalf("got %q before the notice of disconnection", response)
+	}
+	connections := srv.Connections()
+	srv.Disconnect()
+
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "OK tag=Internet" {
+		t.Fatalf("got %q after the notice of disconnection", response)
+	}
+	if srv.Connections() <= connections {
+		t.Errorf("disconnected connection was reused")
+	}
+}
+
+func TestUnauthenticatedBindIsRejected(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.BindPassword = ""
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "ERR" {
+		t.Errorf("got %q with an anonymous connection", response)
+	}
+	if srv.CountRequests(ldap.ApplicationSearchRequest) != 0 {
+		t.Errorf("directory was searched with an anonymous connection")
+	}
+}
+
+func TestTokenGroupsMembership(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.TokenGroups = true
+	opts.GroupFilter = "(&(objectClass=group)(cn=%g))"
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Internet", "jdoe Mail", "jdoe Employees", "bob Employees", "bob Staff", "unknown Employees")
+	expected := []string{"OK tag=Internet", "ERR", "OK tag=Employees", "OK tag=Employees", "ERR", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestPrimaryGroupMembership(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	srv.AddEntry("cn=Web,ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"Web"},
+		"member":      {"cn=Employees,ou=Groups,dc=domain,dc=local"},
+	})
+
+	h := startTestHelper(t, srv)
+	h.Send("bob Employees", "bob Web")
+	for i, response := range h.ReceiveAll(2) {
+		if response != "ERR" {
+			t.Errorf("response %d: got %q without primary group support", i, response)
+		}
+	}
+	h.Stop()
+
+	setTestOptions(srv)
+	opts.PrimaryGroup = true
+	h = ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("bob Employees", "bob Web", "bob Mail", "bob Internet", "jdoe Employees")
+	expected := []string{"OK tag=Employees", "OK tag=Web", "OK tag=Mail", "ERR", "OK tag=Employees"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestPrimaryGroupWithSpecialCharacters(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	srv.AddEntry("cn=Contractors (External),ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"Contractors (External)"},
+		"objectSid":   {testSID(t, 1110)},
+	})
+	srv.AddEntry("cn=Vendors,ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"Vendors"},
+		"member":      {"cn=Contractors (External),ou=Groups,dc=domain,dc=local"},
+	})
+	srv.AddEntry("cn=Carol,ou=Users,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"carol"},
+		"objectSid":      {testSID(t, 1106)},
+		"primaryGroupID": {"1110"},
+	})
+	setTestOptions(srv)
+	opts.PrimaryGroup = true
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("carol Vendors", "carol Mail")
+	expected := []string{"OK tag=Vendors", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestGroupFilterWithSpecialCharacters(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	srv.AddEntry("cn=Smith\\, John (IT),ou=Users,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"jsmith"},
+	})
+	srv.AddEntry("cn=Proxy(All*),ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass":       {"group"},
+		"cn":                {"Proxy(All*)"},
+		"distinguishedName": {"cn=Proxy(All*),ou=Groups,dc=domain,dc=local"},
+		"member":            {"cn=Smith\\, John (IT),ou=Users,dc=domain,dc=local"},
+	})
+	setTestOptions(srv)
+	opts.GroupFilter = "(&(objectClass=group)(cn=%g)(distinguishedName=%d)(member=%u))"
+	opts.ResolveGroups = true
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jsmith Proxy(All*)", "jsmith cn=Proxy(All*),ou=Groups,dc=domain,dc=local", "jdoe Proxy(All*)")
+	expected := []string{"OK tag=Proxy(All*)", "OK tag=cn=Proxy(All*),ou=Groups,dc=domain,dc=local", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestResolveGroupReferences(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.ResolveGroups = true
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	internetSID := "S-1-5-21-1004336348-1177238915-682003330-1101"
+	requests := []string{
+		"jdoe CN=Internet,OU=Groups,DC=domain,DC=local",
+		"jdoe " + internetSID,
+		"jdoe DOMAIN\\InetAccess",
+		"jdoe inetaccess",
+		"jdoe internet",
+		"jdoe S-1-5-21-1004336348-1177238915-682003330-1103",
+		"jdoe cn=Missing,ou=Groups,dc=domain,dc=local",
+		"bob " + internetSID,
+	}
+	expected := []string{
+		"OK tag=CN=Internet,OU=Groups,DC=domain,DC=local",
+		"OK tag=" + internetSID,
+		"OK tag=DOMAIN\\InetAccess",
+		"OK tag=inetaccess",
+		"OK tag=internet",
+		"ERR",
+		"ERR",
+		"ERR",
+	}
+	h.Send(requests...)
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+
+	// the group of a reference already seen is not resolved again
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	h.Send("jdoe " + internetSID)
+	if response := h.Receive(); response != "OK tag="+internetSID {
+		t.Errorf("got %q", response)
+	}
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n != 2 {
+		t.Errorf("got %d searches for a resolved group, expected 2", n)
+	}
+}
+
+func TestUsernameNormalization(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	srv.AddEntry("ou=Lab,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}})
+	srv.AddEntry("cn=Ann,ou=Lab,dc=domain,dc=local", map[string][]string{
+		"objectClass":       {"user"},
+		"sAMAccountName":    {"ann"},
+		"userPrincipalName": {"ann.smith@domain.local"},
+	})
+	srv.AddEntry("cn=Proxy,ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"Proxy"},
+		"member":      {"cn=Ann,ou=Lab,dc=domain,dc=local"},
+	})
+
+	setTestOptions(srv)
+	opts.StripRealm = false
+	opts.StripDomain = false
+	opts.Lowercase = true
+	opts.UPNLookup = true
+	opts.Rewrites = []string{`^ann\.smith$=>ann`}
+	opts.DenyDomains = []string{"GUEST"}
+	opts.DomainBaseDNs = []string{"LAB=ou=Lab,dc=domain,dc=local", "USERS=ou=Users,dc=domain,dc=local"}
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send(
+		"ANN.SMITH@DOMAIN.LOCAL Proxy",
+		"LAB\\Ann Proxy",
+		"USERS\\ann Proxy",
+		"ann.smith Proxy",
+	)
+	expected := []string{"OK tag=Proxy", "OK tag=Proxy", "ERR", "OK tag=Proxy"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	h.Send("GUEST\\ann Proxy")
+	if response := h.Receive(); response != "ERR" {
+		t.Errorf("got %q for a denied domain", response)
+	}
+	if srv.CountRequests(ldap.ApplicationSearchRequest) != searches {
+		t.Errorf("user of a denied domain was searched")
+	}
+}
+
+func TestUserNameIsEscaped(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	srv.SetAttribute("cn=John Doe,ou=Users,dc=domain,dc=local", "userPrincipalName", []string{"jdoe@domain.local"})
+	setTestOptions(srv)
+	opts.StripRealm = false
+	opts.UPNLookup = true
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	// the filter characters of the name do not match other users
+	h.Send("jd* Internet", "*)(sAMAccountName=jdoe Internet", "*@domain.local Internet")
+	expected := []string{"ERR", "ERR", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestCacheKeyIsNormalized(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.Lowercase = true
+	opts.CacheExpiration = 60
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "OK tag=Internet" {
+		t.Fatalf("got %q", response)
+	}
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	h.Send("DOMAIN\\JDoe Internet", "JDOE@DOMAIN.LOCAL Internet")
+	for i, response := range h.ReceiveAll(2) {
+		if response != "OK tag=Internet" {
+			t.Errorf("response %d: got %q", i, response)
+		}
+	}
+	if srv.CountRequests(ldap.ApplicationSearchRequest) != searches {
+		t.Errorf("the cached answer of the normalized username was not used")
+	}
+}
+
+func newCorpDirectory(t *testing.T) *ldaptest.Server {
+	corp, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	corp.AddCredentials("squid@corp.local", "corpsecret")
+
+	corp.AddEntry("dc=corp,dc=local", map[string][]string{"objectClass": {"domain"}})
+	corp.AddEntry("uid=jdoe,ou=People,dc=corp,dc=local", map[string][]string{
+		"objectClass": {"posixAccount"},
+		"uid":         {"jdoe"},
+	})
+	corp.AddEntry("cn=Proxy,ou=Groups,dc=corp,dc=local", map[string][]string{
+		"objectClass": {"posixGroup"},
+		"cn":          {"Proxy"},
+		"memberUid":   {"jdoe"},
+	})
+	return corp
+}
+
+func TestBackendProfiles(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	corp := newCorpDirectory(t)
+	defer corp.Close()
+	setTestOptions(srv)
+	opts.CacheExpiration = 60
+	opts.Profiles = []string{fmt.Sprintf("corp:server=%s;port=%d;binduser=squid@corp.local;bindpassword=corpsecret;basedn=dc=corp,dc=local;schema=rfc2307;user-filter=;group-filter=", corp.Host(), corp.Port())}
+	opts.Routes = []string{"corp=corp", "CORP.LOCAL=corp"}
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send(
+		"jdoe Internet",
+		"CORP\\jdoe Internet",
+		"CORP\\jdoe Proxy",
+		"jdoe@CORP.LOCAL Proxy",
+		"DOMAIN\\jdoe Proxy",
+	)
+	expected := []string{"OK tag=Internet", "ERR", "OK tag=Proxy", "OK tag=Proxy", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+	if corp.CountRequests(ldap.ApplicationSearchRequest) == 0 {
+		t.Errorf("the users of the routed domain were not searched in the profile backend")
+	}
+
+	requests, positive, negative, errors := backends["corp"].Metrics.Counts()
+	if requests != 3 || positive != 2 || negative != 1 || errors != 0 {
+		t.Errorf("got profile metrics %s", backends["corp"].Metrics.String())
+	}
+}
+
+func TestLookupDaemon(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "ext-acl-ldap-group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lookupd.sock")
+
+	setTestOptions(srv)
+	opts.CacheExpiration = 60
+	c.Flush()
+	defer c.Flush()
+	stopped := make(chan struct{})
+	go func() {
+		serveDaemon(path)
+		close(stopped)
+	}()
+	defer func() {
+		signalInterruptChan <- syscall.SIGTERM
+		<-stopped
+	}()
+
+	// every helper process shares the connections and the cache of the daemon
+	var clients []*lookupd.Client
+	for i := 0; i < 3; i++ {
+		client := lookupd.NewClient(path, time.Second)
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i, client := range clients {
+		result, err := client.Lookup("jdoe Internet")
+		if err != nil || result != "OK tag=Internet" {
+			t.Errorf("client %d: got %q, %v", i, result, err)
+		}
+	}
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest); n != 2 {
+		t.Errorf("got %d searches for 3 identical lookups, expected 2", n)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got daemon socket %v, %v, once answering, expected permissions 0600", fi, err)
+	}
+}
+
+func TestHelperUsesLookupDaemon(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "ext-acl-ldap-group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lookupd.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		lookupd.NewServer(func(request string) string {
+			return "OK tag=" + strings.Fields(request)[1] + "-daemon"
+		}).Serve(l)
+		close(served)
+	}()
+
+	setTestOptions(srv)
+	opts.Socket = path
+	opts.ControlSocket = filepath.Join(dir, "control.sock")
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("0 jdoe Mail", "1 jdoe Internet")
+	responses := h.ReceiveAll(2)
+	sort.Strings(responses)
+	if fmt.Sprint(responses) != fmt.Sprint([]string{"0 OK tag=Mail-daemon", "1 OK tag=Internet-daemon"}) {
+		t.Errorf("got %q from the daemon", responses)
+	}
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest); n != 0 {
+		t.Errorf("got %d searches with the daemon up", n)
+	}
+	if _, err := os.Stat(opts.ControlSocket); err == nil {
+		t.Error("helper sharing the daemon serves a control socket")
+	}
+
+	// the helper answers from LDAP while the daemon is down
+	l.Close()
+	<-served
+	h.Send("jdoe Mail", "jdoe Internet")
+	expected := []string{"ERR", "OK tag=Internet"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("fallback response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestCacheFileSurvivesRestart(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "ext-acl-ldap-group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setTestOptions(srv)
+	opts.CacheExpiration = 60
+	opts.ResolveGroups = true
+	opts.CacheFile = filepath.Join(dir, "cache")
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	h.Send("jdoe InetAccess", "bob InetAccess")
+	h.ReceiveAll(2)
+	h.Stop()
+
+	c.Flush()
+	groupCache.Flush()
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	h = ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+	h.Send("jdoe InetAccess", "bob InetAccess")
+	expected := []string{"OK tag=InetAccess", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+	if srv.CountRequests(ldap.ApplicationSearchRequest) != searches {
+		t.Errorf("the answers of the cache file were not used")
+	}
+	if _, found := groupCache.Peek("name:inetaccess"); !found {
+		t.Errorf("the resolved group was not restored")
+	}
+}
+
+func TestCacheFileIsWrittenByLockHolder(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "ext-acl-ldap-group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setTestOptions(srv)
+	opts.CacheExpiration = 60
+	opts.CacheFile = filepath.Join(dir, "cache")
+	c.Flush()
+	defer c.Flush()
+	// another helper process holds the lock of the cache file
+	lock, err := cachefile.TryLock(opts.CacheFile)
+	if err != nil {
+		t.Fatalf("cannot lock the cache file: %s", err)
+	}
+	h := ldaptest.StartHelper(t, serve)
+	h.Send("jdoe Internet")
+	h.Receive()
+	h.Stop()
+	if _, err := os.Stat(opts.CacheFile); err == nil {
+		t.Error("cache file was written without its lock")
+	}
+
+	lock.Unlock()
+	h = ldaptest.StartHelper(t, serve)
+	h.Send("jdoe Internet")
+	h.Receive()
+	h.Stop()
+	if _, err := os.Stat(opts.CacheFile); err != nil {
+		t.Errorf("cache file was not written by the lock holder: %s", err)
+	}
+}
+
+// ageAnswers makes every cached answer as old as d
+func ageAnswers(d time.Duration) {
+	for _, entry := range c.Entries() {
+		entry.Time = time.Now().Add(-d)
+		c.Restore(entry)
+	}
+}
+
+func TestStaleAnswers(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.CacheExpiration = 60
+	opts.CacheStale = 60
+	opts.CacheError = 3600
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Internet")
+	h.Receive()
+
+	// a stale answer is served while it is refreshed
+	ageAnswers(90 * time.Second)
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "OK tag=Internet" {
+		t.Errorf("got %q while refreshing", response)
+	}
+	c.Wait()
+	if srv.CountRequests(ldap.ApplicationSearchRequest) == searches {
+		t.Errorf("the stale answer was not refreshed")
+	}
+
+	// a stale answer is served when LDAP is down
+	ageAnswers(30 * time.Minute)
+	srv.Close()
+	h.Send("jdoe Internet", "bob Internet")
+	expected := []string{"OK tag=Internet", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+	if s := c.Stats(); s.StaleOnError == 0 {
+		t.Errorf("got cache stats %s", s)
+	}
+}
+
+func TestConcurrentRequestsAreCoalesced(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+	srv.SetSearchDelay(100 * time.Millisecond)
+
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf("%d jdoe Internet", i))
+	}
+	h.Send(lines...)
+	for _, response := range h.ReceiveAll(len(lines)) {
+		if !strings.HasSuffix(response, " OK tag=Internet") {
+			t.Errorf("got %q", response)
+		}
+	}
+	// one search of the user and one of the group
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest); n != 2 {
+		t.Errorf("got %d searches for 50 identical requests, expected 2", n)
+	}
+
+	// the requests of a user for several groups share the user search
+	h.Send("50 bob Internet", "51 bob Mail", "52 bob Staff")
+	h.ReceiveAll(3)
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest); n != 2+1+3 {
+		t.Errorf("got %d searches, expected one user search and 3 group searches", n-2)
+	}
+}
+
+func TestQueueDeadlineAnswersBH(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.MaxRequests = 1
+	opts.QueueTimeout = 50
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+	srv.SetSearchDelay(200 * time.Millisecond)
+
+	// the first request holds the only worker while the second one waits
+	h.Send("0 jdoe Internet")
+	srv.WaitRequest(ldap.ApplicationSearchRequest, time.Second)
+	h.Send("1 bob Mail")
+	expected := []string{`1 BH message="too many LDAP requests in flight"`, "0 OK tag=Internet"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+
+	// the request is answered once the worker is free
+	h.Send("2 bob Mail")
+	if response := h.Receive(); response != "2 OK tag=Mail" {
+		t.Errorf("got %q", response)
+	}
+	if s := workers.Stats(); s.Rejected != 1 {
+		t.Errorf("got worker stats %s", s)
+	}
+}
+
+func TestMaxRequestsBoundsConnections(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.MaxRequests = 2
+	opts.QueueTimeout = 0
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+	srv.SetSearchDelay(20 * time.Millisecond)
+
+	var lines []string
+	for i, group := range []string{"Internet", "Mail", "Staff", "Employees"} {
+		lines = append(lines, fmt.Sprintf("%d jdoe %s", 2*i, group), fmt.Sprintf("%d bob %s", 2*i+1, group))
+	}
+	h.Send(lines...)
+	for _, response := range h.ReceiveAll(len(lines)) {
+		if strings.Contains(response, " BH") {
+			t.Errorf("got %q", response)
+		}
+	}
+	if n := defaultBackend.Pool.Stats().Dials; n > 2 {
+		t.Errorf("got %d connections dialed for 2 workers", n)
+	}
+	if s := workers.Stats(); s.Done != 8 || s.Queued == 0 {
+		t.Errorf("got worker stats %s", s)
+	}
+}
+
+func TestPositiveAndNegativeTTL(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.CachePositiveTTL = 3600
+	opts.CacheNegativeTTL = 60
+	opts.CacheError = 3600
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Internet", "bob Internet")
+	h.ReceiveAll(2)
+	ageAnswers(30 * time.Minute)
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	h.Send("jdoe Internet", "bob Internet")
+	expected := []string{"OK tag=Internet", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+	// the user and group searches of the expired negative answer only
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n != 2 {
+		t.Errorf("got %d searches, expected 2", n)
+	}
+}
+
+func TestWatchEvictsChangedGroups(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.CacheExpiration = 3600
+	opts.Watch = "usn"
+	opts.WatchInterval = 3600
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Internet", "bob Mail")
+	h.ReceiveAll(2)
+	watcher := defaultBackend.Watcher
+	for watcher.Stats().Polls == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// jdoe leaves Staff, and so Internet which contains it
+	srv.SetAttribute("cn=Staff,ou=Groups,dc=domain,dc=local", "member", nil)
+	if err := watcher.Poll(); err != nil {
+		t.Fatalf("cannot poll the directory changes: %s", err)
+	}
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	h.Send("jdoe Internet", "bob Mail")
+	expected := []string{"ERR", "OK tag=Mail"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+	// the user and group searches of the evicted answer only
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n != 2 {
+		t.Errorf("got %d searches, expected 2", n)
+	}
+}
+
+func TestParentGroupsOfChangedGroup(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	srv.AddEntry("cn=Everyone,ou=Groups,dc=domain,dc=local", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"Everyone"},
+		"member":      {"cn=Internet,ou=Groups,dc=domain,dc=local"},
+	})
+	setTestOptions(srv)
+	// the parent groups are not searched with the group filter
+	opts.GroupFilter = "(&(objectClass=group)(cn=%g)(memberUid=%n))"
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+	h.Send("jdoe Internet")
+	h.Receive()
+
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	keys := map[string]bool{}
+	if err := defaultBackend.addParentGroups(keys, "cn=Staff,ou=Groups,dc=domain,dc=local"); err != nil {
+		t.Fatalf("cannot search the parent groups: %s", err)
+	}
+	if !keys["name:internet"] || !keys["name:inetaccess"] || !keys["name:everyone"] || keys["name:mail"] {
+		t.Errorf("got parent group keys %v", keys)
+	}
+	// Staff, Internet and Everyone are searched as members
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n != 3 {
+		t.Errorf("got %d searches, expected 3", n)
+	}
+}
+
+func TestSocketTimeout(t *testing.T) {
+	defer func() { opts.SocketTimeout, opts.QueueTimeout, opts.RequestTimeout = 1000, 2000, 0 }()
+	for _, test := range []struct {
+		socket, queue, request int
+		expected               time.Duration
+	}{
+		{500, 2000, 3000, 500 * time.Millisecond},
+		{0, 2000, 3000, 6 * time.Second},
+		{0, 0, 3000, 0},
+		{0, 2000, 0, 0},
+	} {
+		opts.SocketTimeout, opts.QueueTimeout, opts.RequestTimeout = test.socket, test.queue, test.request
+		if got := socketTimeout(); got != test.expected {
+			t.Errorf("%+v: got %s", test, got)
+		}
+	}
+}
+
+func TestWarmUpGroupMembers(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.CacheExpiration = 3600
+	opts.WarmGroups = []string{"Internet"}
+	opts.RefreshRate = 0
+	c.Flush()
+	defer c.Flush()
+	stop := startDaemonServices()
+	defer stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for warmer.Stats().Warmed == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// jdoe is a member of Internet through Staff
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	if response := lookup("jdoe", "Internet"); response != "OK tag=Internet" {
+		t.Errorf("got %q", response)
+	}
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n != 0 {
+		t.Errorf("got %d searches for a warmed up answer", n)
+	}
+	if s := warmer.Stats(); s.Warmed != 1 {
+		t.Errorf("got warm-up stats %s", s)
+	}
+}
+
+func TestWarmUpWithinBudget(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	// without Attribute Scoped Query, the members are read one by one
+	srv.RejectControl(ldap.ControlTypeAttributeScopedQuery)
+	setTestOptions(srv)
+	opts.CacheExpiration = 3600
+	opts.WarmGroups = []string{"Internet"}
+	opts.RefreshRate = 20
+	c.Flush()
+	defer c.Flush()
+	start := time.Now()
+	stop := startDaemonServices()
+	defer stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for warmer.Stats().Warmed == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// the group, the members of Internet and of Staff, Staff and jdoe are
+	// read 50ms apart before the lookup of jdoe
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("warmed up in %s, within the budget of 20 queries per second", elapsed)
+	}
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	if response := lookup("jdoe", "Internet"); response != "OK tag=Internet" {
+		t.Errorf("got %q", response)
+	}
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n != 0 {
+		t.Errorf("got %d searches for a warmed up answer", n)
+	}
+}
+
+func TestWarmUpNestedGroupMembers(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.Schema = "ad"
+	opts.CacheExpiration = 3600
+	opts.WarmGroups = []string{"Internet"}
+	opts.RefreshRate = 0
+	// Active Directory computes memberOf, the test directory does not
+	srv.SetAttribute("cn=John Doe,ou=Users,dc=domain,dc=local", "memberOf", []string{"cn=Staff,ou=Groups,dc=domain,dc=local"})
+	srv.SetAttribute("cn=Staff,ou=Groups,dc=domain,dc=local", "memberOf", []string{"cn=Internet,ou=Groups,dc=domain,dc=local"})
+	c.Flush()
+	defer c.Flush()
+	stop := startDaemonServices()
+	defer stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for warmer.Stats().Warmed == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	if response := lookup("jdoe", "Internet"); response != "OK tag=Internet" {
+		t.Errorf("got %q", response)
+	}
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n != 0 {
+		t.Errorf("got %d searches for a warmed up answer", n)
+	}
+	if s := warmer.Stats(); s.Warmed != 1 {
+		t.Errorf("got warm-up stats %s", s)
+	}
+}
+
+func TestRefreshHotAnswers(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	// the answers expire before the refresh after the next one
+	opts.CacheExpiration = 15
+	opts.RefreshHot = 10
+	c.Flush()
+	defer c.Flush()
+	stop := startDaemonServices()
+	defer stop()
+
+	lookup("jdoe", "Internet")
+	lookup("jdoe", "Internet")
+
+	srv.SetAttribute("cn=Staff,ou=Groups,dc=domain,dc=local", "member", nil)
+	warmer.Refresh()
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	if response := lookup("jdoe", "Internet"); response != "ERR" {
+		t.Errorf("got %q after the refresh", response)
+	}
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n != 0 {
+		t.Errorf("got %d searches for a refreshed answer", n)
+	}
+	if s := warmer.Stats(); s.Refreshed != 1 {
+		t.Errorf("got warm-up stats %s", s)
+	}
+}
+
+func TestStandaloneHelperDoesNotWarmUp(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.WarmGroups = []string{"Internet"}
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("bob Mail")
+	h.Receive()
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "OK tag=Internet" {
+		t.Errorf("got %q", response)
+	}
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n == 0 {
+		t.Error("the answer of a standalone helper is warmed up")
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "ext-acl-ldap-group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setTestOptions(srv)
+	opts.CacheExpiration = 3600
+	opts.ControlMode = "0640"
+	opts.ControlSocket = filepath.Join(dir, "control-%p.sock")
+	path := filepath.Join(dir, fmt.Sprintf("control-%d.sock", os.Getpid()))
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Internet", "bob Internet", "jdoe Mail")
+	h.ReceiveAll(3)
+	run := func(command string) string {
+		output, err := control.Run(path, time.Second, command)
+		if err != nil {
+			t.Fatalf("%s: %s", command, err)
+		}
+		return output
+	}
+
+	if output := run("get jdoe Internet"); !strings.Contains(output, "result: OK tag=Internet") {
+		t.Errorf("got %q", output)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("got control socket %v, error %v", fi, err)
+	}
+	if output := run("evict-user jdoe"); output != "2 cached answers evicted" {
+		t.Errorf("got %q", output)
+	}
+	if _, err := control.Run(path, time.Second, "get jdoe Internet"); err == nil {
+		t.Error("got an evicted answer")
+	}
+	if output := run("evict-group InetAccess"); output != "0 cached answers evicted" {
+		t.Errorf("got %q", output)
+	}
+	if output := run("evict-group Internet"); output != "1 cached answers evicted" {
+		t.Errorf("got %q", output)
+	}
+	if output := run("stats"); !strings.Contains(output, "backend default: requests: 3, positive: 1, negative: 2") {
+		t.Errorf("got stats %q", output)
+	}
+	if output := run("health"); !strings.Contains(output, fmt.Sprintf("server %s: up", srv.Addr())) {
+		t.Errorf("got health %q", output)
+	}
+
+	h.Send("bob Mail")
+	h.Receive()
+	if output := run("flush"); output != "1 cached answers evicted" {
+		t.Errorf("got %q", output)
+	}
+
+	// the helper starts again and listens on the socket again
+	connections := srv.Connections()
+	run("reload")
+	h.Send("jdoe Internet")
+	if response := h.Receive(); response != "OK tag=Internet" {
+		t.Errorf("got %q after reload", response)
+	}
+	if srv.Connections() == connections {
+		t.Error("the helper did not connect again after reload")
+	}
+	run("stats")
+}
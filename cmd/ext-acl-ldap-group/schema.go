@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// schema describes how users and groups are stored in a directory
+type schema struct {
+	// userFilter is the default user search filter pattern, %u = login
+	userFilter string
+	// loginAttribute is the user attribute holding the login
+	loginAttribute string
+	// groupClass is the object class of the groups
+	groupClass string
+	// groupNameAttribute is the group attribute matched against the
+	// requested group name
+	groupNameAttribute string
+	// memberAttribute is the group attribute listing the members
+	memberAttribute string
+	// memberIsDN is set if the members are listed by DN, and unset if they
+	// are listed by login
+	memberIsDN bool
+}
+
+// schemas are the presets selected with --schema
+var schemas = map[string]schema{
+	// Active Directory, with nested groups resolved by the server
+	"ad": {
+		userFilter:         "&(objectClass=user)(sAMAccountName=%u)",
+		loginAttribute:     "sAMAccountName",
+		groupClass:         "group",
+		groupNameAttribute: "cn",
+		memberAttribute:    "member:1.2.840.113556.1.4.1941:",
+		memberIsDN:         true,
+	},
+	// NIS groups listing the logins of their members
+	"rfc2307": {
+		userFilter:         "&(objectClass=posixAccount)(uid=%u)",
+		loginAttribute:     "uid",
+		groupClass:         "posixGroup",
+		groupNameAttribute: "cn",
+		memberAttribute:    "memberUid",
+	},
+	// NIS accounts with groups listing the DNs of their members
+	"rfc2307bis": {
+		userFilter:         "&(objectClass=posixAccount)(uid=%u)",
+		loginAttribute:     "uid",
+		groupClass:         "groupOfNames",
+		groupNameAttribute: "cn",
+		memberAttribute:    "member",
+		memberIsDN:         true,
+	},
+	"freeipa": {
+		userFilter:         "&(objectClass=posixAccount)(uid=%u)",
+		loginAttribute:     "uid",
+		groupClass:         "ipaUserGroup",
+		groupNameAttribute: "cn",
+		memberAttribute:    "member",
+		memberIsDN:         true,
+	},
+	"389ds": {
+		userFilter:         "&(objectClass=inetOrgPerson)(uid=%u)",
+		loginAttribute:     "uid",
+		groupClass:         "groupOfUniqueNames",
+		groupNameAttribute: "cn",
+		memberAttribute:    "uniqueMember",
+		memberIsDN:         true,
+	},
+}
+
+// groupFilter returns the group search filter pattern of the schema, %u =
+// user DN, %n = user login, %g = user group name. The query escapes the
+// values it substitutes, so that DNs like cn=Smith\, John (IT) match.
+func (s schema) groupFilter() string {
+	member := "%n"
+	if s.memberIsDN {
+		member = "%u"
+	}
+	return fmt.Sprintf("(&(objectClass=%s)(%s=%%g)(%s=%s))", s.groupClass, s.groupNameAttribute, s.memberAttribute, member)
+}
+
+// userFilter returns the user search filter pattern, from --user-filter or
+// the schema preset
+func (b *backend) userFilter() string {
+	if b.opts.UserFilter != "" {
+		return b.opts.UserFilter
+	}
+	return schemas[b.opts.Schema].userFilter
+}
+
+// groupFilter returns the group search filter pattern, from --group-filter
+// or the schema preset
+func (b *backend) groupFilter() string {
+	if b.opts.GroupFilter != "" {
+		return b.opts.GroupFilter
+	}
+	if s, ok := schemas[b.opts.Schema]; ok {
+		return s.groupFilter()
+	}
+	return ""
+}
+
+// loginAttribute returns the user attribute substituted for %n in the group
+// filter
+func (b *backend) loginAttribute() string {
+	if b.opts.LoginAttribute != "" {
+		return b.opts.LoginAttribute
+	}
+	if s, ok := schemas[b.opts.Schema]; ok {
+		return s.loginAttribute
+	}
+	return "sAMAccountName"
+}
+
+// memberAttribute returns the group attribute listing the members, from the
+// schema preset or else member, and whether the members are listed by DN
+func (b *backend) memberAttribute() (attribute string, isDN bool) {
+	s, ok := schemas[b.opts.Schema]
+	if !ok {
+		return "member", true
+	}
+	// the member attribute of a filter may name a matching rule
+	if i := strings.Index(s.memberAttribute, ":"); i >= 0 {
+		return s.memberAttribute[:i], s.memberIsDN
+	}
+	return s.memberAttribute, s.memberIsDN
+}
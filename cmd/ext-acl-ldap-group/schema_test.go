@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldaptest"
+)
+
+// newSchemaDirectory returns a directory where jdoe is a member of Internet
+// and bob a member of Mail, stored the way the schema preset expects
+func newSchemaDirectory(t *testing.T, name string) *ldaptest.Server {
+	if name == "ad" {
+		return newTestDirectory(t)
+	}
+
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	srv.AddCredentials("squid@domain.local", "secret")
+	srv.AddEntry("dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+
+	people, groups := "ou=People,dc=domain,dc=local", "ou=Groups,dc=domain,dc=local"
+	userClasses := []string{"top", "person", "organizationalPerson", "inetOrgPerson", "posixAccount"}
+	groupClasses := map[string][]string{
+		"rfc2307":    {"top", "posixGroup"},
+		"rfc2307bis": {"top", "groupOfNames", "posixGroup"},
+		"freeipa":    {"top", "groupOfNames", "nestedGroup", "ipaUserGroup", "ipaObject", "posixGroup"},
+		"389ds":      {"top", "groupOfUniqueNames"},
+	}[name]
+	if name == "freeipa" {
+		people, groups = "cn=users,cn=accounts,dc=domain,dc=local", "cn=groups,cn=accounts,dc=domain,dc=local"
+		userClasses = append(userClasses, "ipaObject")
+	}
+	if name == "389ds" {
+		userClasses = userClasses[:4]
+	}
+	srv.AddEntry(people, map[string][]string{"objectClass": {"organizationalUnit"}})
+	srv.AddEntry(groups, map[string][]string{"objectClass": {"organizationalUnit"}})
+
+	for _, uid := range []string{"jdoe", "bob"} {
+		srv.AddEntry("uid="+uid+","+people, map[string][]string{
+			"objectClass": userClasses,
+			"uid":         {uid},
+			"cn":          {uid},
+		})
+	}
+	for group, uid := range map[string]string{"Internet": "jdoe", "Mail": "bob"} {
+		attributes := map[string][]string{
+			"objectClass": groupClasses,
+			"cn":          {group},
+		}
+		switch name {
+		case "rfc2307":
+			attributes["memberUid"] = []string{uid}
+		case "rfc2307bis", "freeipa":
+			attributes["member"] = []string{"uid=" + uid + "," + people}
+		case "389ds":
+			attributes["uniqueMember"] = []string{"uid=" + uid + "," + people}
+		}
+		srv.AddEntry("cn="+group+","+groups, attributes)
+	}
+	return srv
+}
+
+func TestSchemaPresets(t *testing.T) {
+	for _, name := range []string{"ad", "rfc2307", "rfc2307bis", "freeipa", "389ds"} {
+		t.Run(name, func(t *testing.T) {
+			srv := newSchemaDirectory(t, name)
+			defer srv.Close()
+			setTestOptions(srv)
+			opts.Schema = name
+			opts.UserFilter = ""
+			opts.GroupFilter = ""
+			h := ldaptest.StartHelper(t, serve)
+			defer h.Stop()
+
+			h.Send("jdoe Internet", "jdoe Mail", "bob Mail", "bob Internet", "unknown Internet")
+			expected := []string{"OK tag=Internet", "ERR", "OK tag=Mail", "ERR", "ERR"}
+			for i, response := range h.ReceiveAll(len(expected)) {
+				if response != expected[i] {
+					t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaPresetsWithSpecialCharacters(t *testing.T) {
+	for _, name := range []string{"ad", "rfc2307bis", "freeipa", "389ds"} {
+		t.Run(name, func(t *testing.T) {
+			srv := newSchemaDirectory(t, name)
+			defer srv.Close()
+			people, groups := "ou=People,dc=domain,dc=local", "ou=Groups,dc=domain,dc=local"
+			user := map[string][]string{
+				"objectClass": {"top", "person", "organizationalPerson", "inetOrgPerson", "posixAccount", "ipaObject"},
+				"uid":         {"jsmith"},
+			}
+			group := map[string][]string{
+				"objectClass": {"top", "groupOfNames", "ipaUserGroup", "groupOfUniqueNames"},
+				"cn":          {"Proxy"},
+			}
+			switch name {
+			case "ad":
+				people = "ou=Users,dc=domain,dc=local"
+				user = map[string][]string{"objectClass": {"user"}, "sAMAccountName": {"jsmith"}}
+				group["objectClass"] = []string{"group"}
+			case "freeipa":
+				people, groups = "cn=users,cn=accounts,dc=domain,dc=local", "cn=groups,cn=accounts,dc=domain,dc=local"
+			}
+			dn := "cn=Smith\\, John (IT)," + people
+			srv.AddEntry(dn, user)
+			if name == "389ds" {
+				group["uniqueMember"] = []string{dn}
+			} else {
+				group["member"] = []string{dn}
+			}
+			srv.AddEntry("cn=Proxy,"+groups, group)
+			setTestOptions(srv)
+			opts.Schema = name
+			opts.UserFilter = ""
+			opts.GroupFilter = ""
+			h := ldaptest.StartHelper(t, serve)
+			defer h.Stop()
+
+			h.Send("jsmith Proxy", "jsmith Internet", "jdoe Proxy")
+			expected := []string{"OK tag=Proxy", "ERR", "ERR"}
+			for i, response := range h.ReceiveAll(len(expected)) {
+				if response != expected[i] {
+					t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaFilterOverride(t *testing.T) {
+	srv := newSchemaDirectory(t, "rfc2307")
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.Schema = "rfc2307"
+	opts.UserFilter = "uid=%u"
+	opts.GroupFilter = "(&(cn=%g)(memberUid=%n))"
+
+	b := &backend{opts: &opts}
+	if b.userFilter() != "uid=%u" || b.groupFilter() != "(&(cn=%g)(memberUid=%n))" {
+		t.Errorf("explicit filters are not preferred to the schema preset")
+	}
+	if b.loginAttribute() != "uid" {
+		t.Errorf("got login attribute %q, expected uid", b.loginAttribute())
+	}
+
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+	h.Send("jdoe Internet", "jdoe Mail")
+	expected := []string{"OK tag=Internet", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
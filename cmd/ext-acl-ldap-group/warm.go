@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldappool"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/resultcache"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/warmup"
+)
+
+// refreshInterval is the time between two refreshes of the most requested
+// answers
+const refreshInterval = 10 * time.Second
+
+// memberPagingSize is the page size of the search of the members of a group
+// to warm up
+const memberPagingSize = 500
+
+var warmer *warmup.Warmer
+
+// startWarmer starts the warm-up of the --warm-group groups and the refresh
+// of the most requested answers. The returned function stops them and logs
+// their counters.
+func startWarmer() (stop func()) {
+	warmer = nil
+	if len(opts.WarmGroups) == 0 && opts.RefreshHot == 0 {
+		return func() {}
+	}
+	if opts.CacheExpiration == 0 && opts.CachePositiveTTL == 0 && opts.CacheNegativeTTL == 0 {
+		log.Print("[WARN] Warm-up and refresh of the answers are disabled without --cache")
+		return func() {}
+	}
+	warmer = warmup.New(c, warmup.Config{
+		Rate:     opts.RefreshRate,
+		Hot:      opts.RefreshHot,
+		Interval: refreshInterval,
+	}, refreshLookup)
+	warmer.Start(warmGroups)
+	return func() {
+		warmer.Stop()
+		log.Printf("[INFO] Warm-up - %s", warmer.Stats().String())
+	}
+}
+
+// warmGroups looks up the requests of the members of the --warm-group groups
+// for the group. The members are requested by login, as Squid sends them
+// once stripped of their NT domain and realm.
+func warmGroups() {
+	for _, group := range opts.WarmGroups {
+		logins, err := defaultBackend.groupMembers(warmer, group)
+		if err == errWarmupStopped {
+			return
+		}
+		if err != nil {
+			log.Printf("[WARN] Cannot list the members of group '%s' to warm up the cache. Message - %s", group, err.Error())
+			continue
+		}
+		for _, login := range logins {
+			identity, err := normalizer.Normalize(login)
+			if err != nil {
+				continue
+			}
+			cacheKey := defaultBackend.CacheKey(fmt.Sprintf("%s:%s", identity.Key(), group))
+			if !warmer.Do(func() {
+				c.Get(cacheKey, func() (string, error) {
+					return defaultBackend.coalescedQuery(cacheKey, identity, group)
+				})
+			}) {
+				return
+			}
+		}
+		log.Printf("[INFO] Warmed up the cache with %d members of group '%s'", len(logins), group)
+	}
+}
+
+// refreshLookup returns the lookup of the answer of a cache key
+func refreshLookup(key string) resultcache.Lookup {
+	b := defaultBackend
+	for name, p := range backends {
+		if strings.HasPrefix(key, name+"/") {
+			b, key = p, strings.TrimPrefix(key, name+"/")
+			break
+		}
+	}
+	fs := strings.SplitN(key, ":", 2)
+	if len(fs) != 2 {
+		return func() (string, error) {
+			return negativeResult, fmt.Errorf("invalid cache key %q", key)
+		}
+	}
+	identity, searchEntity := normalize.Parse(fs[0]), fs[1]
+	return func() (string, error) {
+		return b.coalescedQuery(b.CacheKey(key), identity, searchEntity)
+	}
+}
+
+// errWarmupStopped is returned by the queries of the warm-up stopped while
+// they wait for the budget
+var errWarmupStopped = errors.New("the warm-up is stopped")
+
+// requestContext returns the context of an LDAP operation, bounded by
+// --timeout
+func requestContext() (context.Context, context.CancelFunc) {
+	if opts.RequestTimeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(opts.RequestTimeout)*time.Millisecond)
+}
+
+// warmupQuery runs query with its own --timeout once the budget of the
+// warm-up allows it
+func warmupQuery(w *warmup.Warmer, query func(ctx context.Context) error) error {
+	if !w.Wait() {
+		return errWarmupStopped
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	return query(ctx)
+}
+
+// warmupStream runs the search in pages of memberPagingSize and calls
+// handler for each entry. Each page waits for the budget of the warm-up, and
+// the search is given up when no entry arrives within --timeout.
+func warmupStream(w *warmup.Warmer, conn *ldappool.PoolConn, request *ldap.SearchRequest, handler func(*ldap.Entry)) error {
+	if !w.Wait() {
+		return errWarmupStopped
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timeout := time.Duration(opts.RequestTimeout) * time.Millisecond
+	var timer *time.Timer
+	if timeout != 0 {
+		timer = time.AfterFunc(timeout, cancel)
+		defer timer.Stop()
+	}
+	entries := 0
+	_, err := conn.SearchStreamContext(ctx, request, memberPagingSize, func(entry *ldap.Entry) error {
+		handler(entry)
+		entries++
+		if timer != nil {
+			timer.Stop()
+		}
+		// the next page is requested once the last entry of the page is
+		// handled
+		if entries%memberPagingSize == 0 && !w.Wait() {
+			return errWarmupStopped
+		}
+		if timer != nil {
+			timer.Reset(timeout)
+		}
+		return nil
+	})
+	return err
+}
+
+// groupMembers returns the logins of the members of the group referenced by
+// ref, and of the groups it contains. Each directory query waits for the
+// budget of the warm-up and has its own --timeout.
+func (b *backend) groupMembers(w *warmup.Warmer, ref string) ([]string, error) {
+	ctx, cancel := requestContext()
+	conn, err := b.Pool.Get(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.BindContext(ctx, b.opts.BindUsername, b.opts.BindPassword)
+	cancel()
+	if err != nil {
+		conn.MarkUnusable()
+		return nil, err
+	}
+
+	filter, baseDN, scope, _, err := b.groupReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	var sr *ldap.SearchResult
+	err = warmupQuery(w, func(ctx context.Context) error {
+		var err error
+		sr, err = b.Search(ctx, conn, ldap.NewSearchRequest(
+			baseDN,
+			scope, ldap.NeverDerefAliases, 0, 0, false,
+			filter,
+			[]string{b.groupNameAttribute()},
+			nil,
+		))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(sr.Entries) != 1 {
+		return nil, errors.New("the group is not found")
+	}
+	group := sr.Entries[0].DN
+
+	attribute, isDN := b.memberAttribute()
+	if !isDN {
+		var logins []string
+		err = warmupQuery(w, func(ctx context.Context) error {
+			var err error
+			logins, err = conn.SearchRangedAttributeContext(ctx, group, attribute)
+			return err
+		})
+		return logins, err
+	}
+	if s, ok := schemas[b.opts.Schema]; ok && s.memberAttribute != attribute {
+		return b.nestedMembers(w, conn, group)
+	}
+	return b.memberLogins(w, conn, group, attribute)
+}
+
+// nestedMembers returns the logins of the users member of the group at any
+// depth, found by Active Directory with a search of the users whose memberOf
+// matches the group in chain
+func (b *backend) nestedMembers(w *warmup.Warmer, conn *ldappool.PoolConn, group string) ([]string, error) {
+	var logins []string
+	err := warmupStream(w, conn, ldap.NewSearchRequest(
+		b.opts.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(&(%s)(memberOf:1.2.840.113556.1.4.1941:=%s))", strings.Replace(b.userFilter(), "%u", "*", -1), ldap.EscapeFilter(group)),
+		[]string{"objectClass", b.loginAttribute()},
+		nil,
+	), func(entry *ldap.Entry) {
+		if isGroupEntry(entry) {
+			return
+		}
+		if login := entry.GetAttributeValue(b.loginAttribute()); login != "" {
+			logins = append(logins, login)
+		}
+	})
+	return logins, err
+}
+
+// memberLogins returns the logins of the members of the group and of the
+// groups it contains. The members of each group are read with one Attribute
+// Scoped Query of the member attribute. Servers which do not support it have
+// the members listed with ranged retrieval and read one by one.
+func (b *backend) memberLogins(w *warmup.Warmer, conn *ldappool.PoolConn, group, attribute string) ([]string, error) {
+	var logins []string
+	queue := []string{group}
+	seen := map[string]bool{dnKey(group): true}
+	known := func(dn string) bool {
+		key := dnKey(dn)
+		return key == "" || seen[key]
+	}
+	add := func(entry *ldap.Entry) {
+		if known(entry.DN) {
+			return
+		}
+		seen[dnKey(entry.DN)] = true
+		if isGroupEntry(entry) {
+			queue = append(queue, entry.DN)
+		} else if login := entry.GetAttributeValue(b.loginAttribute()); login != "" {
+			logins = append(logins, login)
+		}
+	}
+	for ; len(queue) != 0; queue = queue[1:] {
+		err := warmupStream(w, conn, ldap.NewSearchRequest(
+			queue[0],
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			[]string{"objectClass", b.loginAttribute()},
+			[]ldap.Control{ldap.NewControlAttributeScopedQuery(true, attribute)},
+		), add)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailableCriticalExtension) {
+			err = b.readMembers(w, conn, queue[0], attribute, known, add)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return logins, nil
+}
+
+// readMembers lists the members of the group with ranged retrieval and calls
+// add for each member entry not known yet, read by DN
+func (b *backend) readMembers(w *warmup.Warmer, conn *ldappool.PoolConn, group, attribute string, known func(dn string) bool, add func(*ldap.Entry)) error {
+	var members []string
+	err := warmupQuery(w, func(ctx context.Context) error {
+		var err error
+		members, err = conn.SearchRangedAttributeContext(ctx, group, attribute)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if known(member) {
+			continue
+		}
+		var sr *ldap.SearchResult
+		err := warmupQuery(w, func(ctx context.Context) error {
+			var err error
+			sr, err = conn.SearchContext(ctx, ldap.NewSearchRequest(
+				member,
+				ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+				"(objectClass=*)",
+				[]string{"objectClass", b.loginAttribute()},
+				nil,
+			))
+			return err
+		})
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range sr.Entries {
+			add(entry)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/changewatch"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+)
+
+// watchFilter selects the users and groups watched for changes
+const watchFilter = "(|(objectClass=user)(objectClass=person)(objectClass=group)(objectClass=groupOfNames)(objectClass=groupOfUniqueNames)(objectClass=posixGroup)(objectClass=ipaUserGroup))"
+
+// groupClasses are the object classes of the groups of the schemas
+var groupClasses = []string{"group", "groupOfNames", "groupOfUniqueNames", "posixGroup", "ipaUserGroup"}
+
+// startWatchers watches the directory changes of the backends with --watch.
+// The returned function stops the watchers and logs their counters.
+func startWatchers() (stop func()) {
+	var watched []*backend
+	for _, b := range append([]*backend{defaultBackend}, backendList()...) {
+		if b.opts.Watch == "" {
+			continue
+		}
+		w, err := changewatch.New(changewatch.Config{
+			Mode:         b.opts.Watch,
+			Servers:      b.opts.Servers(b.opts.ServerPort),
+			UseTLS:       b.opts.UseTLS,
+			BindUsername: b.opts.BindUsername,
+			BindPassword: b.opts.BindPassword,
+			BaseDN:       b.opts.BaseDN,
+			Filter:       watchFilter,
+			Attributes:   []string{"objectClass", "cn", "sAMAccountName", b.loginAttribute()},
+			Interval:     time.Duration(opts.WatchInterval) * time.Second,
+			Timeout:      time.Duration(opts.WatchInterval) * time.Second,
+		}, b)
+		if err != nil {
+			log.Fatalf("[ERROR] Cannot watch the directory changes. Message - %s", err.Error())
+		}
+		b.Watcher = w
+		w.Start()
+		watched = append(watched, b)
+	}
+	return func() {
+		for _, b := range watched {
+			b.Watcher.Stop()
+			log.Printf("[INFO] Backend %s - directory changes, %s", b.Label(), b.Watcher.Stats().String())
+		}
+	}
+}
+
+// Changed evicts the cached answers of the changed users, and of the changed
+// groups and the groups containing them
+func (b *backend) Changed(entries []*ldap.Entry) {
+	users := map[string]bool{}
+	groups := map[string]bool{}
+	for _, entry := range entries {
+		if !isGroupEntry(entry) {
+			for _, login := range entry.GetAttributeValues(b.loginAttribute()) {
+				users[strings.ToLower(login)] = true
+			}
+			continue
+		}
+		addGroupKeys(groups, entry)
+		if err := b.addParentGroups(groups, entry.DN); err != nil {
+			log.Printf("[WARN] Cannot search the groups containing the changed group %s. Message - %s", entry.DN, err.Error())
+			b.Reset()
+			return
+		}
+	}
+
+	// the references resolved to the changed groups, such as SIDs, are
+	// evicted with them
+	groupCache.DeleteFunc(func(key, result string) bool {
+		key, own := b.ownKey(key)
+		if !own {
+			return false
+		}
+		group := parseGroupIdentity(result)
+		if groups["name:"+strings.ToLower(group.Name)] || groups[dnKey(group.DN)] {
+			groups[key] = true
+			return true
+		}
+		return false
+	})
+	evicted := c.DeleteFunc(func(key, result string) bool {
+		key, own := b.ownKey(key)
+		fs := strings.SplitN(key, ":", 2)
+		if !own || len(fs) != 2 {
+			return false
+		}
+		if users[strings.ToLower(normalize.KeyName(fs[0]))] {
+			return true
+		}
+		_, _, _, ref, err := b.groupReference(fs[1])
+		return err == nil && groups[ref]
+	})
+	log.Printf("[INFO] Backend %s - %d entries changed in the directory, %d cached answers evicted", b.Label(), len(entries), evicted)
+}
+
+// Reset evicts every cached answer of the backend, as changes of the
+// directory may have been missed
+func (b *backend) Reset() {
+	own := func(key, result string) bool {
+		_, own := b.ownKey(key)
+		return own
+	}
+	evicted := c.DeleteFunc(own)
+	groupCache.DeleteFunc(own)
+	log.Printf("[INFO] Backend %s - changes of the directory may have been missed, %d cached answers evicted", b.Label(), evicted)
+}
+
+// addParentGroups adds the cache keys of the groups containing the group to
+// keys. The groups listing the DN of the group in their member attribute are
+// searched, and then the groups containing them, unless the member attribute
+// of the schema matches nested groups at any depth. Groups listing their
+// members by login cannot contain groups.
+func (b *backend) addParentGroups(keys map[string]bool, dn string) error {
+	attribute, isDN := b.memberAttribute()
+	if !isDN {
+		return nil
+	}
+	nested := false
+	if s, ok := schemas[b.opts.Schema]; ok && s.memberAttribute != attribute {
+		attribute, nested = s.memberAttribute, true
+	}
+
+	ctx := context.Background()
+	if opts.RequestTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.RequestTimeout)*time.Millisecond)
+		defer cancel()
+	}
+	conn, err := b.Pool.Get(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.BindContext(ctx, b.opts.BindUsername, b.opts.BindPassword); err != nil {
+		conn.MarkUnusable()
+		return err
+	}
+
+	seen := map[string]bool{strings.ToLower(dn): true}
+	for queue := []string{dn}; len(queue) != 0; queue = queue[1:] {
+		searchRequest := ldap.NewSearchRequest(
+			b.opts.BaseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf("(%s=%s)", attribute, ldap.EscapeFilter(queue[0])),
+			[]string{"cn", "sAMAccountName"},
+			nil,
+		)
+		sr, err := b.Search(ctx, conn, searchRequest)
+		if err != nil {
+			return err
+		}
+		for _, entry := range sr.Entries {
+			addGroupKeys(keys, entry)
+			if !nested && !seen[strings.ToLower(entry.DN)] {
+				seen[strings.ToLower(entry.DN)] = true
+				queue = append(queue, entry.DN)
+			}
+		}
+	}
+	return nil
+}
+
+// ownKey returns the key of a cache entry without the profile prefix, and
+// whether the entry belongs to the backend
+func (b *backend) ownKey(key string) (string, bool) {
+	for name := range backends {
+		if strings.HasPrefix(key, name+"/") {
+			return strings.TrimPrefix(key, name+"/"), name == b.Name
+		}
+	}
+	return key, b.Name == ""
+}
+
+// backendList returns the profile backends
+func backendList() []*backend {
+	var list []*backend
+	for _, b := range backends {
+		list = append(list, b)
+	}
+	return list
+}
+
+func isGroupEntry(entry *ldap.Entry) bool {
+	for _, class := range entry.GetAttributeValues("objectClass") {
+		for _, groupClass := range groupClasses {
+			if strings.EqualFold(class, groupClass) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addGroupKeys adds the cache keys of the references to the group by DN, cn
+// and sAMAccountName to keys
+func addGroupKeys(keys map[string]bool, entry *ldap.Entry) {
+	if key := dnKey(entry.DN); key != "" {
+		keys[key] = true
+	}
+	for _, attribute := range []string{"cn", "sAMAccountName"} {
+		for _, name := range entry.GetAttributeValues(attribute) {
+			keys["name:"+strings.ToLower(name)] = true
+		}
+	}
+}
+
+// dnKey returns the cache key of a reference to the group by DN, empty if the
+// DN is invalid
+func dnKey(s string) string {
+	dn, err := ldap.ParseDN(s)
+	if s == "" || err != nil {
+		return ""
+	}
+	return "dn:" + normalizeDN(dn)
+}
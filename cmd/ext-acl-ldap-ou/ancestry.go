@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldappool"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/resultcache"
+)
+
+// userDNCache holds the DN of the users found in ancestry mode. An empty DN
+// is cached for the users which are not found.
+var userDNCache = resultcache.New()
+
+// findUserDN returns the DN of the user, or an empty string if the user is
+// not found under the base DN. Concurrent searches of the same user are
+// coalesced.
+func (b *backend) findUserDN(ctx context.Context, conn *ldappool.PoolConn, identity normalize.Identity) (string, error) {
+	key := b.CacheKey(identity.Key())
+	if dn, found := userDNCache.Peek(key); found {
+		return dn, nil
+	}
+
+	dn, err, _ := userLookups.Do(key, func() (interface{}, error) {
+		baseDN, filter := b.userSearch(identity)
+		searchRequest := ldap.NewSearchRequest(
+			baseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			filter,
+			[]string{"sAMAccountName"},
+			nil,
+		)
+		sr, err := b.Search(ctx, conn, searchRequest)
+		if err != nil {
+			return "", err
+		}
+		dn := ""
+		if len(sr.Entries) == 1 {
+			dn = sr.Entries[0].DN
+		}
+		userDNCache.Set(key, dn)
+		return dn, nil
+	})
+	return dn.(string), err
+}
+
+// inOU reports whether the user DN is in the OU given as a full DN, an OU
+// name or a path of OU names from the top, separated by slashes, such as
+// "Sales/Europe". Unless nested is set, the OU must directly contain the
+// user.
+func inOU(user *ldap.DN, ou string, nested bool) bool {
+	if len(user.RDNs) < 2 {
+		return false
+	}
+	if strings.Contains(ou, "=") {
+		dn, err := ldap.ParseDN(ou)
+		if err != nil {
+			return false
+		}
+		if nested {
+			return dn.AncestorOf(user)
+		}
+		return dn.Equal(&ldap.DN{RDNs: user.RDNs[1:]})
+	}
+
+	var path []string
+	for _, name := range strings.Split(ou, "/") {
+		if name != "" {
+			path = append(path, name)
+		}
+	}
+	if len(path) == 0 {
+		return false
+	}
+	// the RDNs of the user start with its own, so the OUs containing it are
+	// compared from the bottom of the path
+	last := len(user.RDNs) - len(path)
+	if !nested && last > 1 {
+		last = 1
+	}
+	for i := 1; i <= last; i++ {
+		match := true
+		for j := range path {
+			if !isOU(user.RDNs[i+j], path[len(path)-1-j]) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func isOU(rdn *ldap.RelativeDN, name string) bool {
+	return len(rdn.Attributes) == 1 && strings.EqualFold(rdn.Attributes[0].Type, "ou") && strings.EqualFold(rdn.Attributes[0].Value, name)
+}
+
+// userInOU reports whether the user is in the OU, from the ancestry of the
+// DN of the user
+func (b *backend) userInOU(ctx context.Context, conn *ldappool.PoolConn, identity normalize.Identity, ou string) (bool, error) {
+	dn, err := b.findUserDN(ctx, conn, identity)
+	if err != nil || dn == "" {
+		return false, err
+	}
+	user, err := ldap.ParseDN(dn)
+	if err != nil {
+		return false, err
+	}
+	return inOU(user, ou, b.opts.OUMatch != "direct"), nil
+}
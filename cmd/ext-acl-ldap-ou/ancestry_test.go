@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+)
+
+func TestInOU(t *testing.T) {
+	user, err := ldap.ParseDN("cn=Eve,ou=Europe,ou=Sales,ou=Staff,dc=domain,dc=local")
+	if err != nil {
+		t.Fatalf("cannot parse DN: %s", err)
+	}
+	tests := []struct {
+		ou             string
+		nested, direct bool
+	}{
+		{ou: "Europe", nested: true, direct: true},
+		{ou: "europe", nested: true, direct: true},
+		{ou: "Sales", nested: true},
+		{ou: "Staff", nested: true},
+		{ou: "Sales/Europe", nested: true, direct: true},
+		{ou: "Staff/Sales", nested: true},
+		{ou: "/Staff/Sales/Europe/", nested: true, direct: true},
+		{ou: "Staff/Europe"},
+		{ou: "Europe/Sales"},
+		{ou: "Staff/Sales/Europe/Eve"},
+		{ou: "Eve"},
+		{ou: "domain"},
+		{ou: ""},
+		{ou: "ou=Sales,ou=Staff,dc=domain,dc=local", nested: true},
+		{ou: "OU=Europe, OU=Sales, OU=Staff, DC=domain, DC=local", nested: true, direct: true},
+		{ou: "dc=domain,dc=local", nested: true},
+		{ou: "cn=Eve,ou=Europe,ou=Sales,ou=Staff,dc=domain,dc=local"},
+		{ou: "ou=Sales,dc=domain,dc=local"},
+		{ou: "ou=Sales,"},
+	}
+	for _, test := range tests {
+		if got := inOU(user, test.ou, true); got != test.nested {
+			t.Errorf("%q nested: got %v, expected %v", test.ou, got, test.nested)
+		}
+		if got := inOU(user, test.ou, false); got != test.direct {
+			t.Errorf("%q direct: got %v, expected %v", test.ou, got, test.direct)
+		}
+	}
+}
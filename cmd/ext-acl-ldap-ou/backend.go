@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldapbackend"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/profile"
+)
+
+// backend is an LDAP directory served by the helper: the default one set up
+// by the options, or a profile overriding some of them
+type backend struct {
+	*ldapbackend.Backend
+	opts *options
+}
+
+// newBackend returns the backend with the given options and opens its
+// connection pool, to the Global Catalog if enabled
+func newBackend(name string, o *options) *backend {
+	port := o.ServerPort
+	if o.GlobalCatalog {
+		port = o.GlobalCatalogPort()
+	}
+	core, err := ldapbackend.New(name, &o.Options, port)
+	if err != nil {
+		log.Fatalf("[ERROR] Cannot open LDAP backend %s. Message - %s", name, err.Error())
+	}
+	return &backend{Backend: core, opts: o}
+}
+
+// newBackends returns the default backend, the profile backends by name and
+// the router of the users to the profiles
+func newBackends() (*backend, map[string]*backend, *profile.Router) {
+	profiles := map[string]*backend{}
+	r, err := ldapbackend.ParseProfiles(opts.Profiles, opts.Routes, func(p *profile.Profile) error {
+		o, err := profileOptions(p)
+		if err != nil {
+			return err
+		}
+		profiles[p.Name] = newBackend(p.Name, o)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid backend profile. Message - %s", err.Error())
+	}
+	return newBackend("", &opts), profiles, r
+}
+
+// closeBackends closes the connection pools of the backends and logs their
+// metrics
+func closeBackends() {
+	defaultBackend.Close()
+	for _, b := range backends {
+		b.Close()
+	}
+}
+
+// route returns the backend of the user, from the NT domain or realm of the
+// username before it is stripped
+func route(username string) *backend {
+	if name := router.Route(normalize.Parse(normalizer.Rewrite(username))); name != "" {
+		return backends[name]
+	}
+	return defaultBackend
+}
+
+// profileOptions returns a copy of the options with the settings of the
+// profile applied
+func profileOptions(p *profile.Profile) (*options, error) {
+	o := opts
+	err := o.ApplyProfile(p, func(setting profile.Setting) error {
+		return applyProfileSetting(&o, setting)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// applyProfileSetting sets the option of the helper named by the key of the
+// setting. The connection options are set by ApplyProfile.
+func applyProfileSetting(o *options, setting profile.Setting) error {
+	var err error
+	value := setting.Value
+	switch setting.Key {
+	case "filter":
+		o.Filter = value
+	case "ancestry":
+		o.Ancestry, err = strconv.ParseBool(value)
+	case "ou-match":
+		if value != "direct" && value != "nested" {
+			return fmt.Errorf("invalid value %q of option %s", value, setting.Key)
+		}
+		o.OUMatch = value
+	default:
+		return fmt.Errorf("unknown option %q", setting.Key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q of option %s", value, setting.Key)
+	}
+	return nil
+}
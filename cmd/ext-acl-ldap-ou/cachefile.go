@@ -0,0 +1,18 @@
+package main
+
+import (
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/cachefile"
+)
+
+// cacheFileSaveInterval is the interval between two saves of the cache file
+const cacheFileSaveInterval = time.Minute
+
+// startCacheFile keeps the answers and the user DNs in the cache file. The
+// returned function stops the periodic saves and saves the file one last
+// time.
+func startCacheFile() (stop func()) {
+	caches := cachefile.Caches{"decision/": c, "userdn/": userDNCache}
+	return caches.Keep(opts.CacheFile, int64(opts.CacheFileSize)*1024, cacheFileSaveInterval)
+}
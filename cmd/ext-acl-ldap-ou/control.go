@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/control"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldapbackend"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+)
+
+// controlHelper gives the shared administration commands access to the
+// caches and the backends
+var controlHelper = &control.Helper{
+	Entity:  "OU",
+	Answers: c,
+	Caches:  []control.Cache{{Name: "user DN", Entries: "user DN", Cache: userDNCache, ByUser: true}},
+	Stats: func() []string {
+		lines := []string{
+			"workers: " + workers.Stats().String(),
+			fmt.Sprintf("coalesced requests: %d, coalesced user searches: %d", requestLookups.Shared(), userLookups.Shared()),
+		}
+		if warmer != nil {
+			lines = append(lines, "refresh: "+warmer.Stats().String())
+		}
+		return lines
+	},
+	Backends: func() []control.Backend {
+		var list []control.Backend
+		for _, b := range append([]*backend{defaultBackend}, backendList()...) {
+			list = append(list, control.Backend{Backend: b.Backend})
+		}
+		return list
+	},
+	Normalize: func(username string) (normalize.Identity, error) { return normalizer.Normalize(username) },
+	Route:     func(username string) *ldapbackend.Backend { return route(username).Backend },
+	Reload:    signalHupChan,
+}
+
+// startControl serves the administration commands on --control-socket. The
+// returned function stops serving them once the commands in flight are
+// answered.
+func startControl() (stop func()) {
+	if opts.ControlSocket == "" {
+		return func() {}
+	}
+	server := control.NewServer()
+	server.HandleHelper(controlHelper)
+	server.Handle("evict-ou", "evict-ou OU - evict the cached answers for the OU", controlEvictOU)
+	return server.Start(opts.ControlSocket, opts.ControlMode)
+}
+
+func controlEvictOU(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("usage: evict-ou OU")
+	}
+	evicted := c.DeleteFunc(func(key, result string) bool {
+		_, entity := controlHelper.SplitKey(key)
+		return strings.EqualFold(entity, args[0])
+	})
+	return fmt.Sprintf("%d cached answers evicted", evicted), nil
+}
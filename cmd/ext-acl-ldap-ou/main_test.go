@@ -0,0 +1,917 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/control"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldapbackend"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldaptest"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/lookupd"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func newTestDirectory(t *testing.T) *ldaptest.Server {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	srv.AddCredentials("squid@domain.local", "secret")
+
+	srv.AddEntry("dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	srv.AddEntry("ou=Sales,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}})
+	srv.AddEntry("ou=IT,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}})
+	srv.AddEntry("cn=John Doe,ou=Sales,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"jdoe"},
+	})
+	srv.AddEntry("cn=Bob,ou=IT,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"bob"},
+	})
+	return srv
+}
+
+func setTestOptions(srv *ldaptest.Server) {
+	opts.ServerSlice = []string{srv.Host()}
+	opts.ServerPort = srv.Port()
+	opts.UseTLS = false
+	opts.BindUsername = "squid@domain.local"
+	opts.BindPassword = "secret"
+	opts.BaseDN = "ou=%ou,dc=domain,dc=local"
+	opts.Filter = "sAMAccountName=%u"
+	opts.StripRealm = true
+	opts.StripDomain = true
+	opts.Lowercase = false
+	opts.Rewrites = nil
+	opts.AllowDomains = nil
+	opts.DenyDomains = nil
+	opts.DomainBaseDNs = nil
+	opts.UPNLookup = false
+	opts.CacheExpiration = 0
+	opts.RequestTimeout = 0
+	opts.Referrals = false
+	opts.ReferralHops = 5
+	opts.ReferralHosts = nil
+	opts.ReferralTimeout = 300
+	opts.ReferralNoVerify = false
+	opts.ReferralInsecure = false
+	opts.GlobalCatalog = false
+	opts.GCPort = 0
+	opts.Ancestry = false
+	opts.OUMatch = "nested"
+	opts.Profiles = nil
+	opts.Routes = nil
+	opts.Socket = ""
+	opts.SocketTimeout = 1000
+	opts.SocketMode = "0600"
+	opts.Daemon = false
+	opts.CacheStale = 0
+	opts.CacheError = 0
+	opts.CacheFile = ""
+	opts.CacheFileSize = 10240
+	opts.MaxRequests = 100
+	opts.QueueTimeout = 2000
+	opts.MaxDials = 10
+	opts.CachePositiveTTL = 0
+	opts.CacheNegativeTTL = 0
+	opts.CacheSize = 100000
+	opts.CacheJitter = 10
+	opts.Watch = ""
+	opts.WatchInterval = 30
+	opts.RefreshHot = 0
+	opts.RefreshRate = 10
+	opts.ControlSocket = ""
+	opts.ControlMode = "0600"
+	userDNCache.Flush()
+}
+
+func startTestHelper(t *testing.T, srv *ldaptest.Server) *ldaptest.Helper {
+	setTestOptions(srv)
+	return ldaptest.StartHelper(t, serve)
+}
+
+func TestNonConcurrentRequests(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	h.Send(
+		"jdoe Sales",
+		"jdoe IT",
+		"DOMAIN\\bob IT",
+		"jdoe Missing",
+		"unknown Sales",
+	)
+
+	expected := []string{
+		"OK tag=Sales",
+		"ERR",
+		"OK tag=IT",
+		"ERR",
+		"ERR",
+	}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	expected := map[string]string{}
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("%d", i)
+		switch i % 3 {
+		case 0:
+			h.Send(id + " jdoe Sales")
+			expected[id] = id + " OK tag=Sales"
+		case 1:
+			h.Send(id + " bob Sales")
+			expected[id] = id + " ERR"
+		case 2:
+			h.Send(id + " bob IT")
+			expected[id] = id + " OK tag=IT"
+		}
+	}
+
+	for _, response := range h.ReceiveAll(len(expected)) {
+		var id string
+		fmt.Sscan(response, &id)
+		if expected[id] != response {
+			t.Errorf("channel %s: got %q, expected %q", id, response, expected[id])
+		}
+		delete(expected, id)
+	}
+	if len(expected) != 0 {
+		t.Errorf("no answer for channels %v", expected)
+	}
+}
+
+func TestEOFAnswersPendingRequests(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+
+	h.Send("0 jdoe Sales", "1 bob Sales", "2 bob IT")
+	h.CloseInput()
+
+	responses := h.Wait()
+	sort.Strings(responses)
+	expected := []string{"0 OK tag=Sales", "1 ERR", "2 OK tag=IT"}
+	if fmt.Sprint(responses) != fmt.Sprint(expected) {
+		t.Errorf("got %q, expected %q", responses, expected)
+	}
+	if err := h.Err(); err != nil {
+		t.Errorf("got error %v at EOF", err)
+	}
+}
+
+func TestInputErrorAnswersPendingRequests(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+
+	h.Send("0 jdoe Sales", "1 bob Sales")
+	h.CloseInputWithError(errors.New("read error"))
+
+	responses := h.Wait()
+	sort.Strings(responses)
+	expected := []string{"0 OK tag=Sales", "1 ERR"}
+	if fmt.Sprint(responses) != fmt.Sprint(expected) {
+		t.Errorf("got %q, expected %q", responses, expected)
+	}
+	// the helper exits with a non-zero status on the error
+	if err := h.Err(); err == nil || err.Error() != "read error" {
+		t.Errorf("got error %v, expected the read error", err)
+	}
+}
+
+func TestSIGHUPReloadsHelper(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	h.Send("jdoe Sales")
+	if response := h.Receive(); response != "OK tag=Sales" {
+		t.Fatalf("got %q before reload", response)
+	}
+	connections := srv.Connections()
+
+	signalHupChan <- syscall.SIGHUP
+	for len(signalHupChan) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	h.Send("jdoe Sales")
+	if response := h.Receive(); response != "OK tag=Sales" {
+		t.Fatalf("got %q after reload", response)
+	}
+	if srv.Connections() <= connections {
+		t.Errorf("LDAP connection pool was not recreated on reload")
+	}
+}
+
+func TestSIGTERMStopsHelper(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.CloseInput()
+
+	h.Send("0 jdoe Sales")
+	if response := h.Receive(); response != "0 OK tag=Sales" {
+		t.Fatalf("got %q", response)
+	}
+
+	signalInterruptChan <- syscall.SIGTERM
+
+	if responses := h.Wait(); len(responses) != 0 {
+		t.Errorf("unexpected answers after SIGTERM: %q", responses)
+	}
+}
+
+func TestRequestTimeoutAbandonsSearch(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+	opts.RequestTimeout = 50
+	srv.SetSearchDelay(200 * time.Millisecond)
+
+	h.Send("jdoe Sales")
+	if response := h.Receive(); response != "ERR" {
+		t.Fatalf("got %q for a timed out request", response)
+	}
+	if !srv.WaitRequest(ldap.ApplicationAbandonRequest, time.Second) {
+		t.Errorf("timed out search was not abandoned")
+	}
+}
+
+func TestStopUnbindsConnections(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+
+	h.Send("0 jdoe Sales", "1 jdoe Sales", "2 jdoe Sales")
+	h.ReceiveAll(3)
+	h.Stop()
+
+	if !srv.WaitRequest(ldap.ApplicationUnbindRequest, time.Second) {
+		t.Errorf("pooled connections were closed without unbind")
+	}
+}
+
+func TestReferralsServeChildDomainUsers(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	child, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	defer child.Close()
+	child.AddCredentials("squid@domain.local", "secret")
+	child.AddEntry("dc=child,dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	child.AddEntry("ou=Dev,dc=child,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}})
+	child.AddEntry("cn=Alice,ou=Dev,dc=child,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"alice"},
+	})
+	srv.AddReferral("dc=child,dc=domain,dc=local", fmt.Sprintf("ldap://%s/dc=child,dc=domain,dc=local", child.Addr()))
+
+	setTestOptions(srv)
+	opts.BaseDN = "ou=%ou,dc=child,dc=domain,dc=local"
+	h := ldaptest.StartHelper(t, serve)
+	h.Send("alice Dev")
+	if response := h.Receive(); response != "ERR" {
+		t.Errorf("got %q without following referrals", response)
+	}
+	h.Stop()
+
+	// the credentials are not sent to the child domain over plain LDAP
+	setTestOptions(srv)
+	opts.BaseDN = "ou=%ou,dc=child,dc=domain,dc=local"
+	opts.Referrals = true
+	h = ldaptest.StartHelper(t, serve)
+	h.Send("alice Dev")
+	if response := h.Receive(); response != "ERR" {
+		t.Errorf("got %q following a referral over plain LDAP", response)
+	}
+	h.Stop()
+	if child.CountRequests(ldap.ApplicationBindRequest) != 0 {
+		t.Errorf("credentials were sent to the child domain over plain LDAP")
+	}
+
+	setTestOptions(srv)
+	opts.BaseDN = "ou=%ou,dc=child,dc=domain,dc=local"
+	opts.Referrals = true
+	opts.ReferralInsecure = true
+	h = ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("alice Dev", "jdoe Dev")
+	expected := []string{"OK tag=Dev", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestGlobalCatalogUserLookup(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+
+	gc, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	defer gc.Close()
+	gc.AddCredentials("squid@domain.local", "secret")
+	gc.AddEntry("dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	gc.AddEntry("ou=Dev,dc=child,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}})
+	gc.AddEntry("cn=Alice,ou=Dev,dc=child,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"alice"},
+	})
+
+	setTestOptions(srv)
+	opts.BaseDN = "ou=%ou,dc=child,dc=domain,dc=local"
+	opts.GlobalCatalog = true
+	opts.GCPort = gc.Port()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("alice Dev")
+	if response := h.Receive(); response != "OK tag=Dev" {
+		t.Errorf("got %q", response)
+	}
+	if srv.CountRequests(ldap.ApplicationSearchRequest) != 0 {
+		t.Errorf("users were searched outside of the Global Catalog")
+	}
+}
+
+func TestSearchStopsAtFirstMatch(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	h.Send("jdoe Sales")
+	if response := h.Receive(); response != "OK tag=Sales" {
+		t.Fatalf("got %q", response)
+	}
+	if !srv.WaitRequest(ldap.ApplicationAbandonRequest, time.Second) {
+		t.Errorf("search was not abandoned after the first match")
+	}
+}
+
+func TestNoticeOfDisconnectionDropsPooledConnections(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	h.Send("jdoe Sales")
+	if response := h.Receive(); response != "OK tag=Sales" {
+		t.Fatalf("got %q before the notice of disconnection", response)
+	}
+	connections := srv.Connections()
+	srv.Disconnect()
+
+	h.Send("jdoe Sales")
+	if response := h.Receive(); response != "OK tag=Sales" {
+		t.Fatalf("got %q after the notice of disconnection", response)
+	}
+	if srv.Connections() <= connections {
+		t.Errorf("disconnected connection was reused")
+	}
+}
+
+func TestUnauthenticatedBindIsRejected(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.BindPassword = ""
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Sales")
+	if response := h.Receive(); response != "ERR" {
+		t.Errorf("got %q with an anonymous connection", response)
+	}
+	if srv.CountRequests(ldap.ApplicationSearchRequest) != 0 {
+		t.Errorf("directory was searched with an anonymous connection")
+	}
+}
+
+func TestUserMovedToAnotherOU(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	h := startTestHelper(t, srv)
+	defer h.Stop()
+
+	h.Send("jdoe Sales")
+	if response := h.Receive(); response != "OK tag=Sales" {
+		t.Fatalf("got %q before the move", response)
+	}
+
+	conn, err := ldap.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.Bind("squid@domain.local", "secret"); err != nil {
+		t.Fatalf("cannot bind: %s", err)
+	}
+	if err := conn.ModifyDN(ldap.NewModifyDNRequest("cn=John Doe,ou=Sales,dc=domain,dc=local", "cn=John Doe", true, "ou=IT,dc=domain,dc=local", nil)); err != nil {
+		t.Fatalf("cannot move user: %s", err)
+	}
+
+	h.Send("jdoe Sales", "jdoe IT")
+	expected := []string{"ERR", "OK tag=IT"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d after the move: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestAncestryMode(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	srv.AddEntry("ou=Europe,ou=Sales,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}})
+	srv.AddEntry("cn=Eve,ou=Europe,ou=Sales,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"eve"},
+	})
+	srv.AddEntry("ou=R\\,D,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}})
+	srv.AddEntry("cn=Carol,ou=R\\,D,dc=domain,dc=local", map[string][]string{
+		"objectClass":    {"user"},
+		"sAMAccountName": {"carol"},
+	})
+
+	setTestOptions(srv)
+	opts.BaseDN = "dc=domain,dc=local"
+	opts.Ancestry = true
+	h := ldaptest.StartHelper(t, serve)
+
+	h.Send(
+		"eve Sales",
+		"eve Europe",
+		"eve Sales/Europe",
+		"eve Europe/Sales",
+		"eve ou=Sales,dc=domain,dc=local",
+		"eve IT",
+		"carol R,D",
+		"unknown Sales",
+	)
+	expected := []string{
+		"OK tag=Sales",
+		"OK tag=Europe",
+		"OK tag=Sales/Europe",
+		"ERR",
+		"OK tag=ou=Sales,dc=domain,dc=local",
+		"ERR",
+		"OK tag=R,D",
+		"ERR",
+	}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+	// every user is searched once
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest); n != 3 {
+		t.Errorf("got %d searches, expected 3", n)
+	}
+	h.Stop()
+
+	setTestOptions(srv)
+	opts.BaseDN = "dc=domain,dc=local"
+	opts.Ancestry = true
+	opts.OUMatch = "direct"
+	h = ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send(
+		"eve Sales",
+		"eve Europe",
+		"eve Sales/Europe",
+		"eve OU=Europe,OU=Sales,DC=domain,DC=local",
+		"eve ou=Sales,dc=domain,dc=local",
+	)
+	expected = []string{
+		"ERR",
+		"OK tag=Europe",
+		"OK tag=Sales/Europe",
+		"OK tag=OU=Europe,OU=Sales,DC=domain,DC=local",
+		"ERR",
+	}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("direct response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestBackendProfiles(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	corp, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	defer corp.Close()
+	corp.AddCredentials("squid@corp.local", "corpsecret")
+	corp.AddEntry("dc=corp,dc=local", map[string][]string{"objectClass": {"domain"}})
+	corp.AddEntry("ou=IT,dc=corp,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}})
+	corp.AddEntry("uid=jdoe,ou=IT,dc=corp,dc=local", map[string][]string{
+		"objectClass": {"posixAccount"},
+		"uid":         {"jdoe"},
+	})
+
+	setTestOptions(srv)
+	opts.CacheExpiration = 60
+	opts.Profiles = []string{fmt.Sprintf("corp:server=%s;port=%d;binduser=squid@corp.local;bindpassword=corpsecret;basedn=dc=corp,dc=local;filter=uid=%%u;ancestry", corp.Host(), corp.Port())}
+	opts.Routes = []string{"CORP=corp"}
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Sales", "CORP\\jdoe Sales", "CORP\\jdoe IT", "jdoe IT")
+	expected := []string{"OK tag=Sales", "ERR", "OK tag=IT", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+	if requests, positive, negative, _ := backends["corp"].Metrics.Counts(); requests != 2 || positive != 1 || negative != 1 {
+		t.Errorf("got profile metrics %s", backends["corp"].Metrics.String())
+	}
+}
+
+func TestLookupDaemon(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "ext-acl-ldap-ou")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lookupd.sock")
+
+	setTestOptions(srv)
+	stopped := make(chan struct{})
+	go func() {
+		serveDaemon(path)
+		close(stopped)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	client := lookupd.NewClient(path, time.Second)
+	defer client.Close()
+	for request, expected := range map[string]string{"jdoe Sales": "OK tag=Sales", "jdoe IT": "ERR"} {
+		if result, err := client.Lookup(request); err != nil || result != expected {
+			t.Errorf("%s: got %q, %v", request, result, err)
+		}
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got daemon socket %v, %v, once answering, expected permissions 0600", fi, err)
+	}
+	signalInterruptChan <- syscall.SIGTERM
+	<-stopped
+
+	// the helper answers from LDAP without daemon
+	opts.Socket = path
+	opts.ControlSocket = filepath.Join(dir, "control.sock")
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+	h.Send("bob IT")
+	if response := h.Receive(); response != "OK tag=IT" {
+		t.Errorf("got %q without daemon", response)
+	}
+	if _, err := os.Stat(opts.ControlSocket); err == nil {
+		t.Error("helper sharing the daemon serves a control socket")
+	}
+}
+
+func TestCacheFileSurvivesRestart(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "ext-acl-ldap-ou")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setTestOptions(srv)
+	opts.BaseDN = "dc=domain,dc=local"
+	opts.Ancestry = true
+	opts.CacheExpiration = 60
+	opts.CacheFile = filepath.Join(dir, "cache")
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	h.Send("jdoe Sales")
+	h.Receive()
+	h.Stop()
+
+	c.Flush()
+	userDNCache.Flush()
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	h = ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+	h.Send("jdoe Sales", "jdoe IT")
+	expected := []string{"OK tag=Sales", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+	if srv.CountRequests(ldap.ApplicationSearchRequest) != searches {
+		t.Errorf("the user DN of the cache file was not used")
+	}
+}
+
+func TestStaleAnswerWhenLDAPIsDown(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.CacheExpiration = 60
+	opts.CacheError = 3600
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Sales")
+	h.Receive()
+	for _, entry := range c.Entries() {
+		entry.Time = time.Now().Add(-30 * time.Minute)
+		c.Restore(entry)
+	}
+	srv.Close()
+
+	h.Send("jdoe Sales", "bob IT")
+	expected := []string{"OK tag=Sales", "ERR"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+}
+
+func TestConcurrentUserSearchesAreCoalesced(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.BaseDN = "dc=domain,dc=local"
+	opts.Ancestry = true
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+	srv.SetSearchDelay(100 * time.Millisecond)
+
+	var lines []string
+	for i := 0; i < 30; i++ {
+		ou := []string{"Sales", "IT", "ou=Sales,dc=domain,dc=local"}[i%3]
+		lines = append(lines, fmt.Sprintf("%d jdoe %s", i, ou))
+	}
+	h.Send(lines...)
+	h.ReceiveAll(len(lines))
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest); n != 1 {
+		t.Errorf("got %d searches for 30 concurrent requests of a user, expected 1", n)
+	}
+}
+
+func TestQueueDeadlineAnswersBH(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.MaxRequests = 1
+	opts.QueueTimeout = 50
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+	srv.SetSearchDelay(200 * time.Millisecond)
+
+	// the first request holds the only worker while the second one waits
+	h.Send("0 jdoe Sales")
+	srv.WaitRequest(ldap.ApplicationSearchRequest, time.Second)
+	h.Send("1 bob IT")
+	expected := []string{`1 BH message="too many LDAP requests in flight"`, "0 OK tag=Sales"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d: got %q, expected %q", i, response, expected[i])
+		}
+	}
+
+	h.Send("2 bob IT")
+	if response := h.Receive(); response != "2 OK tag=IT" {
+		t.Errorf("got %q", response)
+	}
+}
+
+func TestCacheSizeEvictsLeastRecentlyUsed(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.CacheExpiration = 3600
+	opts.CacheSize = 2
+	c.Flush()
+	defer c.Flush()
+	evictions := c.Stats().Evictions
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Sales", "bob IT", "jdoe Sales", "jdoe IT", "bob IT")
+	h.ReceiveAll(5)
+	// bob IT is evicted by jdoe IT, while jdoe Sales was used more recently
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest); n != 4 {
+		t.Errorf("got %d searches, expected 4", n)
+	}
+	if s := c.Stats(); s.Evictions-evictions != 2 || s.Entries != 2 {
+		t.Errorf("got cache stats %s", s)
+	}
+}
+
+func TestWatchEvictsMovedUsers(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	opts.CacheExpiration = 3600
+	opts.Watch = "usn"
+	opts.WatchInterval = 3600
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Sales", "bob IT")
+	h.ReceiveAll(2)
+	watcher := defaultBackend.Watcher
+	for watcher.Stats().Polls == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	conn, err := ldap.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.Bind("squid@domain.local", "secret"); err != nil {
+		t.Fatalf("cannot bind: %s", err)
+	}
+	if err := conn.ModifyDN(ldap.NewModifyDNRequest("cn=John Doe,ou=Sales,dc=domain,dc=local", "cn=John Doe", true, "ou=IT,dc=domain,dc=local", nil)); err != nil {
+		t.Fatalf("cannot move user: %s", err)
+	}
+	if err := watcher.Poll(); err != nil {
+		t.Fatalf("cannot poll the directory changes: %s", err)
+	}
+
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	h.Send("jdoe Sales", "bob IT")
+	expected := []string{"ERR", "OK tag=IT"}
+	for i, response := range h.ReceiveAll(len(expected)) {
+		if response != expected[i] {
+			t.Errorf("response %d after the move: got %q, expected %q", i, response, expected[i])
+		}
+	}
+	// the search of the moved user only
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n != 1 {
+		t.Errorf("got %d searches, expected 1", n)
+	}
+}
+
+func TestWatchBaseDN(t *testing.T) {
+	tests := map[string]string{
+		"ou=%ou,dc=domain,dc=local":           "dc=domain,dc=local",
+		"ou=%ou, ou=Staff,dc=domain,dc=local": "ou=Staff,dc=domain,dc=local",
+		"dc=domain,dc=local":                  "dc=domain,dc=local",
+		"ou=%ou":                              "",
+	}
+	for baseDN, expected := range tests {
+		b := &backend{opts: &options{Options: ldapbackend.Options{BaseDN: baseDN}}}
+		if got := b.watchBaseDN(); got != expected {
+			t.Errorf("%q: got %q, expected %q", baseDN, got, expected)
+		}
+	}
+}
+
+func TestRefreshHotAnswers(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	setTestOptions(srv)
+	// the answers expire before the refresh after the next one
+	opts.CacheExpiration = 15
+	opts.RefreshHot = 10
+	c.Flush()
+	defer c.Flush()
+	stop := startDaemonServices()
+	defer stop()
+
+	lookup("jdoe", "Sales")
+	lookup("jdoe", "Sales")
+
+	conn, err := ldap.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.Bind("squid@domain.local", "secret"); err != nil {
+		t.Fatalf("cannot bind: %s", err)
+	}
+	if err := conn.ModifyDN(ldap.NewModifyDNRequest("cn=John Doe,ou=Sales,dc=domain,dc=local", "cn=John Doe", true, "ou=IT,dc=domain,dc=local", nil)); err != nil {
+		t.Fatalf("cannot move user: %s", err)
+	}
+	warmer.Refresh()
+
+	searches := srv.CountRequests(ldap.ApplicationSearchRequest)
+	if response := lookup("jdoe", "Sales"); response != "ERR" {
+		t.Errorf("got %q after the refresh", response)
+	}
+	if n := srv.CountRequests(ldap.ApplicationSearchRequest) - searches; n != 0 {
+		t.Errorf("got %d searches for a refreshed answer", n)
+	}
+	if s := warmer.Stats(); s.Refreshed != 1 {
+		t.Errorf("got refresh stats %s", s)
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "ext-acl-ldap-ou")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setTestOptions(srv)
+	opts.CacheExpiration = 3600
+	opts.ControlMode = "0640"
+	opts.ControlSocket = filepath.Join(dir, "control.sock")
+	c.Flush()
+	defer c.Flush()
+	h := ldaptest.StartHelper(t, serve)
+	defer h.Stop()
+
+	h.Send("jdoe Sales", "bob Sales", "jdoe IT")
+	h.ReceiveAll(3)
+	run := func(command string) string {
+		output, err := control.Run(opts.ControlSocket, time.Second, command)
+		if err != nil {
+			t.Fatalf("%s: %s", command, err)
+		}
+		return output
+	}
+
+	if output := run("get jdoe Sales"); !strings.Contains(output, "result: OK tag=Sales") {
+		t.Errorf("got %q", output)
+	}
+	if fi, err := os.Stat(opts.ControlSocket); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("got control socket %v, error %v", fi, err)
+	}
+	if output := run("evict-user jdoe"); output != "2 cached answers evicted" {
+		t.Errorf("got %q", output)
+	}
+	if output := run("evict-ou sales"); output != "1 cached answers evicted" {
+		t.Errorf("got %q", output)
+	}
+	if output := run("stats"); !strings.Contains(output, "backend default: requests: 3, positive: 1, negative: 2") {
+		t.Errorf("got stats %q", output)
+	}
+	if output := run("health"); !strings.Contains(output, fmt.Sprintf("server %s: up", srv.Addr())) {
+		t.Errorf("got health %q", output)
+	}
+	h.Send("bob IT")
+	h.Receive()
+	if output := run("flush"); output != "1 cached answers evicted" {
+		t.Errorf("got %q", output)
+	}
+}
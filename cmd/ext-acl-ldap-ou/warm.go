@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/resultcache"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/warmup"
+)
+
+// refreshInterval is the time between two refreshes of the most requested
+// answers
+const refreshInterval = 10 * time.Second
+
+var warmer *warmup.Warmer
+
+// startWarmer starts the refresh of the most requested answers. The returned
+// function stops it and logs its counters.
+func startWarmer() (stop func()) {
+	warmer = nil
+	if opts.RefreshHot == 0 {
+		return func() {}
+	}
+	if opts.CacheExpiration == 0 && opts.CachePositiveTTL == 0 && opts.CacheNegativeTTL == 0 {
+		log.Print("[WARN] Refresh of the answers is disabled without --cache")
+		return func() {}
+	}
+	warmer = warmup.New(c, warmup.Config{
+		Rate:     opts.RefreshRate,
+		Hot:      opts.RefreshHot,
+		Interval: refreshInterval,
+	}, refreshLookup)
+	warmer.Start(nil)
+	return func() {
+		warmer.Stop()
+		log.Printf("[INFO] Refresh - %s", warmer.Stats().String())
+	}
+}
+
+// refreshLookup returns the lookup of the answer of a cache key
+func refreshLookup(key string) resultcache.Lookup {
+	b := defaultBackend
+	for name, p := range backends {
+		if strings.HasPrefix(key, name+"/") {
+			b, key = p, strings.TrimPrefix(key, name+"/")
+			break
+		}
+	}
+	fs := strings.SplitN(key, ":", 2)
+	if len(fs) != 2 {
+		return func() (string, error) {
+			return negativeResult, fmt.Errorf("invalid cache key %q", key)
+		}
+	}
+	identity, searchEntity := normalize.Parse(fs[0]), fs[1]
+	return func() (string, error) {
+		return b.coalescedQuery(b.CacheKey(key), identity, searchEntity)
+	}
+}
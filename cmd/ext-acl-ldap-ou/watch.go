@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/changewatch"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+)
+
+// watchFilter selects the users and OUs watched for changes
+const watchFilter = "(|(objectClass=user)(objectClass=person)(objectClass=organizationalUnit))"
+
+// watchAttributes are the user attributes matched against the usernames
+var watchAttributes = []string{"objectClass", "sAMAccountName", "uid", "userPrincipalName"}
+
+// startWatchers watches the directory changes of the backends with --watch.
+// The returned function stops the watchers and logs their counters.
+func startWatchers() (stop func()) {
+	var watched []*backend
+	for _, b := range append([]*backend{defaultBackend}, backendList()...) {
+		if b.opts.Watch == "" {
+			continue
+		}
+		w, err := changewatch.New(changewatch.Config{
+			Mode:         b.opts.Watch,
+			Servers:      b.opts.Servers(b.opts.ServerPort),
+			UseTLS:       b.opts.UseTLS,
+			BindUsername: b.opts.BindUsername,
+			BindPassword: b.opts.BindPassword,
+			BaseDN:       b.watchBaseDN(),
+			Filter:       watchFilter,
+			Attributes:   watchAttributes,
+			Interval:     time.Duration(opts.WatchInterval) * time.Second,
+			Timeout:      time.Duration(opts.WatchInterval) * time.Second,
+		}, b)
+		if err != nil {
+			log.Fatalf("[ERROR] Cannot watch the directory changes. Message - %s", err.Error())
+		}
+		b.Watcher = w
+		w.Start()
+		watched = append(watched, b)
+	}
+	return func() {
+		for _, b := range watched {
+			b.Watcher.Stop()
+			log.Printf("[INFO] Backend %s - directory changes, %s", b.Label(), b.Watcher.Stats().String())
+		}
+	}
+}
+
+// watchBaseDN returns the base DN of the watched entries: the BaseDN, without
+// the RDNs up to the one holding %ou
+func (b *backend) watchBaseDN() string {
+	baseDN := b.opts.BaseDN
+	if i := strings.LastIndex(baseDN, "%ou"); i >= 0 {
+		baseDN = baseDN[i:]
+		if j := strings.Index(baseDN, ","); j >= 0 {
+			return strings.TrimSpace(baseDN[j+1:])
+		}
+		return ""
+	}
+	return baseDN
+}
+
+// Changed evicts the cached answers and DNs of the changed users. A changed
+// OU may have moved the users it contains, so every answer of the backend is
+// evicted.
+func (b *backend) Changed(entries []*ldap.Entry) {
+	users := map[string]bool{}
+	for _, entry := range entries {
+		for _, class := range entry.GetAttributeValues("objectClass") {
+			if strings.EqualFold(class, "organizationalUnit") {
+				b.Reset()
+				return
+			}
+		}
+		for _, attribute := range watchAttributes[1:] {
+			for _, name := range entry.GetAttributeValues(attribute) {
+				users[strings.ToLower(name)] = true
+				if i := strings.Index(name, "@"); i >= 0 {
+					users[strings.ToLower(name[:i])] = true
+				}
+			}
+		}
+	}
+
+	evicted := c.DeleteFunc(func(key, result string) bool {
+		key, own := b.ownKey(key)
+		fs := strings.SplitN(key, ":", 2)
+		return own && len(fs) == 2 && users[strings.ToLower(normalize.KeyName(fs[0]))]
+	})
+	userDNCache.DeleteFunc(func(key, result string) bool {
+		key, own := b.ownKey(key)
+		return own && users[strings.ToLower(normalize.KeyName(key))]
+	})
+	log.Printf("[INFO] Backend %s - %d entries changed in the directory, %d cached answers evicted", b.Label(), len(entries), evicted)
+}
+
+// Reset evicts every cached answer of the backend, as changes of the
+// directory may have been missed
+func (b *backend) Reset() {
+	own := func(key, result string) bool {
+		_, own := b.ownKey(key)
+		return own
+	}
+	evicted := c.DeleteFunc(own)
+	userDNCache.DeleteFunc(own)
+	log.Printf("[INFO] Backend %s - changes of the directory may have been missed, %d cached answers evicted", b.Label(), evicted)
+}
+
+// ownKey returns the key of a cache entry without the profile prefix, and
+// whether the entry belongs to the backend
+func (b *backend) ownKey(key string) (string, bool) {
+	for name := range backends {
+		if strings.HasPrefix(key, name+"/") {
+			return strings.TrimPrefix(key, name+"/"), name == b.Name
+		}
+	}
+	return key, b.Name == ""
+}
+
+// backendList returns the profile backends
+func backendList() []*backend {
+	var list []*backend
+	for _, b := range backends {
+		list = append(list, b)
+	}
+	return list
+}
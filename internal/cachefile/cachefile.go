@@ -0,0 +1,147 @@
+// Package cachefile keeps cache entries in a file, so that a restarted helper
+// starts with the answers of the previous one.
+//
+// The file starts with the magic "EXTACLC" followed by the format version 1,
+// and holds one record per entry:
+//
+//	length     uint32, big endian, of the body
+//	checksum   uint32, big endian, CRC-32 (IEEE) of the body
+//	body       expiration (int64, Unix nanoseconds), key length (uint16),
+//	           key, value
+//
+// A record with a wrong checksum or cut short marks the end of the valid
+// entries. The file is replaced atomically on save.
+package cachefile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	magic = "EXTACLC\x01"
+	// maxRecordSize bounds the length read from a damaged file
+	maxRecordSize = 1 << 20
+)
+
+// ErrCorrupt is returned by Load when the file is damaged. The entries read
+// before the damage are returned along with it.
+var ErrCorrupt = errors.New("cachefile: corrupt cache file")
+
+// Entry is a cache entry
+type Entry struct {
+	Key   string
+	Value []byte
+	// Expiration is the expiration time in Unix nanoseconds
+	Expiration int64
+}
+
+// Load returns the entries of the file which have not expired
+func Load(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != magic {
+		return nil, ErrCorrupt
+	}
+
+	var entries []Entry
+	now := time.Now().UnixNano()
+	head := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, head); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, ErrCorrupt
+		}
+		length := binary.BigEndian.Uint32(head[0:4])
+		if length < 10 || length > maxRecordSize {
+			return entries, ErrCorrupt
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(head[4:8]) {
+			return entries, ErrCorrupt
+		}
+		keyLength := int(binary.BigEndian.Uint16(body[8:10]))
+		if 10+keyLength > len(body) {
+			return entries, ErrCorrupt
+		}
+		entry := Entry{
+			Key:        string(body[10 : 10+keyLength]),
+			Value:      body[10+keyLength:],
+			Expiration: int64(binary.BigEndian.Uint64(body[0:8])),
+		}
+		if entry.Expiration == 0 || entry.Expiration > now {
+			entries = append(entries, entry)
+		}
+	}
+}
+
+// Save replaces the file with the entries which have not expired, keeping
+// the entries expiring last if they do not all fit in maxSize bytes. It
+// returns the number of entries saved.
+func Save(path string, entries []Entry, maxSize int64) (int, error) {
+	sorted := make([]Entry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Expiration > sorted[j].Expiration })
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	w.WriteString(magic)
+
+	size := int64(len(magic))
+	saved := 0
+	now := time.Now().UnixNano()
+	var body bytes.Buffer
+	for _, entry := range sorted {
+		if entry.Expiration != 0 && entry.Expiration <= now {
+			continue
+		}
+		if len(entry.Key) > 0xffff || 10+len(entry.Key)+len(entry.Value) > maxRecordSize {
+			continue
+		}
+		body.Reset()
+		binary.Write(&body, binary.BigEndian, entry.Expiration)
+		binary.Write(&body, binary.BigEndian, uint16(len(entry.Key)))
+		body.WriteString(entry.Key)
+		body.Write(entry.Value)
+		if size+8+int64(body.Len()) > maxSize {
+			break
+		}
+		binary.Write(w, binary.BigEndian, uint32(body.Len()))
+		binary.Write(w, binary.BigEndian, crc32.ChecksumIEEE(body.Bytes()))
+		w.Write(body.Bytes())
+		size += 8 + int64(body.Len())
+		saved++
+	}
+
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return saved, os.Rename(f.Name(), path)
+}
@@ -0,0 +1,172 @@
+package cachefile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/resultcache"
+)
+
+func tempFile(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "cachefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "cache"), func() { os.RemoveAll(dir) }
+}
+
+func TestSaveLoad(t *testing.T) {
+	path, cleanup := tempFile(t)
+	defer cleanup()
+	later := time.Now().Add(time.Hour).UnixNano()
+	entries := []Entry{
+		{Key: "decision/jdoe:Internet", Value: []byte("1"), Expiration: later},
+		{Key: "group/name:internet", Value: []byte("cn=Internet,dc=domain,dc=local\nInternet"), Expiration: later + 1},
+		{Key: "expired", Value: []byte("0"), Expiration: time.Now().Add(-time.Second).UnixNano()},
+		{Key: "forever", Value: []byte{}},
+	}
+	n, err := Save(path, entries, 1<<20)
+	if err != nil || n != 3 {
+		t.Fatalf("saved %d entries, %v", n, err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Entry{entries[1], entries[0], entries[3]}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Errorf("got %+v, expected %+v", loaded, expected)
+	}
+}
+
+func TestSaveMaxSize(t *testing.T) {
+	path, cleanup := tempFile(t)
+	defer cleanup()
+	var entries []Entry
+	now := time.Now().Add(time.Hour).UnixNano()
+	for i := 0; i < 100; i++ {
+		entries = append(entries, Entry{Key: fmt.Sprintf("key%02d", i), Value: []byte("1"), Expiration: now + int64(i)})
+	}
+	// every record takes 8 + 10 + 5 + 1 bytes
+	n, err := Save(path, entries, int64(len(magic))+10*24)
+	if err != nil || n != 10 {
+		t.Fatalf("saved %d entries, %v", n, err)
+	}
+	loaded, _ := Load(path)
+	if len(loaded) != 10 || loaded[0].Key != "key99" || loaded[9].Key != "key90" {
+		t.Errorf("the entries expiring last were not kept: %+v", loaded)
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	path, cleanup := tempFile(t)
+	defer cleanup()
+	later := time.Now().Add(time.Hour).UnixNano()
+	entries := []Entry{
+		{Key: "a", Value: []byte("1"), Expiration: later + 2},
+		{Key: "b", Value: []byte("1"), Expiration: later + 1},
+		{Key: "c", Value: []byte("1"), Expiration: later},
+	}
+	if _, err := Save(path, entries, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a flipped bit in the second record
+	damaged := append([]byte{}, data...)
+	damaged[len(magic)+19+12] ^= 1
+	ioutil.WriteFile(path, damaged, 0600)
+	loaded, err := Load(path)
+	if err != ErrCorrupt || len(loaded) != 1 || loaded[0].Key != "a" {
+		t.Errorf("bit flip: got %+v, %v", loaded, err)
+	}
+
+	// a file cut short
+	ioutil.WriteFile(path, data[:len(data)-3], 0600)
+	loaded, err = Load(path)
+	if err != ErrCorrupt || len(loaded) != 2 {
+		t.Errorf("truncation: got %+v, %v", loaded, err)
+	}
+
+	// another file
+	ioutil.WriteFile(path, []byte("not a cache file"), 0600)
+	if loaded, err = Load(path); err != ErrCorrupt || len(loaded) != 0 {
+		t.Errorf("wrong magic: got %+v, %v", loaded, err)
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	path, cleanup := tempFile(t)
+	defer cleanup()
+
+	lock, err := TryLock(path)
+	if err != nil {
+		t.Fatalf("cannot lock: %s", err)
+	}
+	if _, err := TryLock(path); err != ErrLocked {
+		t.Errorf("got %v locking a locked file, expected ErrLocked", err)
+	}
+	lock.Unlock()
+	lock, err = TryLock(path)
+	if err != nil {
+		t.Fatalf("cannot lock an unlocked file: %s", err)
+	}
+	lock.Unlock()
+}
+
+func newCache() *resultcache.Cache {
+	cache := resultcache.New()
+	cache.SetTTL(time.Hour, 0, 0)
+	return cache
+}
+
+func TestKeepCaches(t *testing.T) {
+	path, cleanup := tempFile(t)
+	defer cleanup()
+	decisions, groups := newCache(), newCache()
+	decisions.Set("jdoe:Internet", "OK tag=Internet")
+	groups.Set("name:internet", "cn=Internet,dc=domain,dc=local\nInternet")
+	if err := (Caches{"decision/": decisions, "group/": groups}).Save(path, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// a process without the lock loads the file but does not save it
+	lock, err := TryLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := Caches{"decision/": newCache(), "group/": newCache()}
+	stop := restored.Keep(path, 1<<20, time.Hour)
+	if result, ok := restored["decision/"].Peek("jdoe:Internet"); !ok || result != "OK tag=Internet" {
+		t.Errorf("got decision %q, %v", result, ok)
+	}
+	if result, ok := restored["group/"].Peek("name:internet"); !ok || result != "cn=Internet,dc=domain,dc=local\nInternet" {
+		t.Errorf("got group %q, %v", result, ok)
+	}
+	restored["decision/"].Set("bob:Mail", "ERR")
+	stop()
+	if n, _ := (Caches{"decision/": newCache()}).Load(path); n != 2 {
+		t.Errorf("got %d entries saved without the lock, expected the 2 saved before", n)
+	}
+
+	// the process taking the lock saves the file when stopped
+	lock.Unlock()
+	stop = restored.Keep(path, 1<<20, time.Hour)
+	stop()
+	saved := Caches{"decision/": newCache()}
+	if n, err := saved.Load(path); n != 3 || err != nil {
+		t.Errorf("got %d entries, %v, expected 3", n, err)
+	}
+	if result, ok := saved["decision/"].Peek("bob:Mail"); !ok || result != "ERR" {
+		t.Errorf("got decision %q, %v", result, ok)
+	}
+}
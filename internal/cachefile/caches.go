@@ -0,0 +1,113 @@
+package cachefile
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/resultcache"
+)
+
+// Caches are the result caches kept in a cache file, by the prefix telling
+// apart their entries in the file
+type Caches map[string]*resultcache.Cache
+
+// Load fills the caches with the entries of the file at path. It returns the
+// number of entries read, which are restored even if the file is damaged.
+func (cs Caches) Load(path string) (int, error) {
+	entries, err := Load(path)
+	for _, entry := range entries {
+		for prefix, cache := range cs {
+			if strings.HasPrefix(entry.Key, prefix) {
+				restoreEntry(cache, strings.TrimPrefix(entry.Key, prefix), entry.Value)
+				break
+			}
+		}
+	}
+	return len(entries), err
+}
+
+// Save replaces the file at path with the entries of the caches, keeping the
+// entries expiring last if they do not all fit in maxSize bytes
+func (cs Caches) Save(path string, maxSize int64) error {
+	var entries []Entry
+	for prefix, cache := range cs {
+		entries = append(entries, fileEntries(cache, prefix)...)
+	}
+	_, err := Save(path, entries, maxSize)
+	return err
+}
+
+// Keep loads the caches from the file at path and saves them every
+// interval. The file is only saved by the process holding its lock, so that
+// the helper processes started by Squid do not overwrite each other's saves;
+// the others try to take the lock at each save. The returned function stops
+// the periodic saves and saves the file one last time.
+func (cs Caches) Keep(path string, maxSize int64, interval time.Duration) (stop func()) {
+	if n, err := cs.Load(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("[WARN] Cannot read cache file %s, %d entries recovered. Message - %s", path, n, err.Error())
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var lock *Lock
+		save := func() {
+			if lock == nil {
+				var err error
+				if lock, err = TryLock(path); err != nil {
+					if err != ErrLocked {
+						log.Printf("[WARN] Cannot lock cache file %s. Message - %s", path, err.Error())
+					}
+					return
+				}
+			}
+			if err := cs.Save(path, maxSize); err != nil {
+				log.Printf("[WARN] Cannot write cache file %s. Message - %s", path, err.Error())
+			}
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-quit:
+				save()
+				if lock != nil {
+					lock.Unlock()
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// restoreEntry adds an entry of the cache file, holding the lookup time and
+// the answer, to the cache
+func restoreEntry(cache *resultcache.Cache, key string, value []byte) {
+	fs := strings.SplitN(string(value), "\n", 2)
+	if lookupTime, err := strconv.ParseInt(fs[0], 10, 64); err == nil && len(fs) == 2 {
+		cache.Restore(resultcache.Entry{Key: key, Result: fs[1], Time: time.Unix(0, lookupTime)})
+	}
+}
+
+// fileEntries returns the entries of the cache for the cache file, with the
+// prefix added to their keys
+func fileEntries(cache *resultcache.Cache, prefix string) []Entry {
+	var entries []Entry
+	for _, entry := range cache.Entries() {
+		entries = append(entries, Entry{
+			Key:        prefix + entry.Key,
+			Value:      []byte(strconv.FormatInt(entry.Time.UnixNano(), 10) + "\n" + entry.Result),
+			Expiration: entry.Expires.UnixNano(),
+		})
+	}
+	return entries
+}
@@ -0,0 +1,39 @@
+package cachefile
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// ErrLocked is returned by TryLock when another process holds the lock
+var ErrLocked = errors.New("cachefile: cache file is locked by another process")
+
+// Lock is the lock of a cache file, which lets one of the processes sharing
+// the file write it
+type Lock struct {
+	f *os.File
+}
+
+// TryLock takes the lock of the cache file at path, kept in the file
+// path.lock. It fails with ErrLocked without waiting if another process
+// holds it. The lock is released by Unlock or when the process exits.
+func TryLock(path string) (*Lock, error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
+
+// Unlock releases the lock
+func (l *Lock) Unlock() error {
+	return l.f.Close()
+}
@@ -0,0 +1,343 @@
+// Package changewatch polls a directory for the entries changed since the
+// last poll, so that the helpers can evict the cached answers depending on
+// them instead of waiting for their expiry.
+//
+// Active Directory is polled by uSNChanged, the update sequence number the
+// domain controller stamps on each entry it changes. Deleted entries are
+// seen as well with the show deleted control, if the base DN holds the
+// Deleted Objects container. The sequence numbers are local to a domain
+// controller, so the watcher keeps polling the server it connected to; when
+// it has to connect again, changes may have been missed and the watcher
+// reports a reset.
+//
+// The other directories are polled by modifyTimestamp, which has a
+// resolution of one second and depends on the clocks of the directory and
+// the helper being in sync.
+package changewatch
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+)
+
+// The modes of polling
+const (
+	// USN polls by uSNChanged, for Active Directory
+	USN = "usn"
+	// Timestamp polls by modifyTimestamp, for OpenLDAP, 389 Directory Server
+	// and FreeIPA
+	Timestamp = "timestamp"
+)
+
+// timestampLayout is the layout of the generalized time of the filters
+const timestampLayout = "20060102150405Z"
+
+// pagingSize is the page size of the searches of changed entries
+const pagingSize = 500
+
+// Config sets the directory watched
+type Config struct {
+	// Mode is USN or Timestamp
+	Mode string
+	// Servers are the addresses, as host:port, of the servers tried in turn
+	Servers      []string
+	UseTLS       bool
+	BindUsername string
+	BindPassword string
+	BaseDN       string
+	// Filter selects the entries watched
+	Filter string
+	// Attributes are the attributes returned of the changed entries
+	Attributes []string
+	// Interval is the time between two polls
+	Interval time.Duration
+	// Timeout bounds each poll
+	Timeout time.Duration
+}
+
+// Handler is told about the changes of the directory
+type Handler interface {
+	// Changed is called with the entries changed since the last poll
+	Changed(entries []*ldap.Entry)
+	// Reset is called when changes may have been missed, because the watcher
+	// connected again to the directory
+	Reset()
+}
+
+// Stats counts the polls of a watcher
+type Stats struct {
+	Polls   uint64
+	Changes uint64
+	Resets  uint64
+	Errors  uint64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("polls: %d, changes: %d, resets: %d, errors: %d", s.Polls, s.Changes, s.Resets, s.Errors)
+}
+
+// Watcher polls a directory for changes. Start runs the polls in the
+// background; the polls run one at a time.
+type Watcher struct {
+	// stats is first to keep its counters 64-bit aligned for atomic access
+	stats   Stats
+	config  Config
+	handler Handler
+
+	// mu serializes the polls
+	mu        sync.Mutex
+	conn      *ldap.Conn
+	connected bool
+	// usn is the highest uSNChanged seen
+	usn int64
+	// timestamp is the highest modifyTimestamp seen, and seen the DNs of the
+	// entries changed at that time which were reported already
+	timestamp string
+	seen      map[string]bool
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// New returns a watcher of the directory reporting to handler
+func New(config Config, handler Handler) (*Watcher, error) {
+	if config.Mode != USN && config.Mode != Timestamp {
+		return nil, fmt.Errorf("changewatch: unknown mode %q", config.Mode)
+	}
+	if len(config.Servers) == 0 {
+		return nil, errors.New("changewatch: no server")
+	}
+	return &Watcher{config: config, handler: handler}, nil
+}
+
+// Start polls the directory every interval until Stop is called. The first
+// poll connects and records the state of the directory, the changes are
+// reported from the next ones.
+func (w *Watcher) Start() {
+	w.quit = make(chan struct{})
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(w.config.Interval)
+		defer ticker.Stop()
+		for {
+			if err := w.Poll(); err != nil {
+				log.Printf("[WARN] Cannot poll the directory changes. Message - %s", err.Error())
+			}
+			select {
+			case <-ticker.C:
+			case <-w.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the polls started by Start and closes the connection
+func (w *Watcher) Stop() {
+	close(w.quit)
+	<-w.done
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// Poll reports the entries changed since the last poll. Without connection,
+// it connects and records the state of the directory instead.
+func (w *Watcher) Poll() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	atomic.AddUint64(&w.stats.Polls, 1)
+	ctx := context.Background()
+	if w.config.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.config.Timeout)
+		defer cancel()
+	}
+
+	if w.conn == nil {
+		if err := w.connect(ctx); err != nil {
+			atomic.AddUint64(&w.stats.Errors, 1)
+			return err
+		}
+		return nil
+	}
+
+	entries, err := w.changes(ctx)
+	if err != nil {
+		atomic.AddUint64(&w.stats.Errors, 1)
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	if len(entries) != 0 {
+		atomic.AddUint64(&w.stats.Changes, uint64(len(entries)))
+		w.handler.Changed(entries)
+	}
+	return nil
+}
+
+// connect connects to the first server available and records the state of
+// the directory. A connection after the first one is reported as a reset.
+func (w *Watcher) connect(ctx context.Context) error {
+	var err error
+	for _, server := range w.config.Servers {
+		var conn *ldap.Conn
+		if w.config.UseTLS {
+			conn, err = ldap.DialTLSContext(ctx, "tcp", server, &tls.Config{InsecureSkipVerify: true})
+		} else {
+			conn, err = ldap.DialContext(ctx, "tcp", server)
+		}
+		if err != nil {
+			continue
+		}
+		if err = conn.BindContext(ctx, w.config.BindUsername, w.config.BindPassword); err == nil {
+			err = w.checkpoint(ctx, conn)
+		}
+		if err != nil {
+			conn.Close()
+			continue
+		}
+
+		w.conn = conn
+		if w.connected {
+			atomic.AddUint64(&w.stats.Resets, 1)
+			w.handler.Reset()
+		}
+		w.connected = true
+		return nil
+	}
+	return err
+}
+
+// checkpoint records the state of the directory from which the changes are
+// reported
+func (w *Watcher) checkpoint(ctx context.Context, conn *ldap.Conn) error {
+	if w.config.Mode == Timestamp {
+		w.timestamp = time.Now().UTC().Format(timestampLayout)
+		w.seen = nil
+		return nil
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"highestCommittedUSN"},
+		nil,
+	)
+	sr, err := conn.SearchContext(ctx, searchRequest)
+	if err != nil {
+		return err
+	}
+	if len(sr.Entries) != 1 {
+		return errors.New("changewatch: no root DSE")
+	}
+	usn, err := strconv.ParseInt(sr.Entries[0].GetAttributeValue("highestCommittedUSN"), 10, 64)
+	if err != nil {
+		return errors.New("changewatch: invalid highestCommittedUSN of the root DSE")
+	}
+	w.usn = usn
+	return nil
+}
+
+// changes returns the entries changed since the last poll
+func (w *Watcher) changes(ctx context.Context) ([]*ldap.Entry, error) {
+	var (
+		filter   string
+		controls []ldap.Control
+	)
+	attributes := append([]string(nil), w.config.Attributes...)
+	if w.config.Mode == USN {
+		filter = fmt.Sprintf("(&%s(uSNChanged>=%d))", w.config.Filter, w.usn+1)
+		attributes = append(attributes, "uSNChanged")
+		controls = append(controls, ldap.NewControlShowDeleted(false))
+	} else {
+		filter = fmt.Sprintf("(&%s(modifyTimestamp>=%s))", w.config.Filter, w.timestamp)
+		attributes = append(attributes, "modifyTimestamp")
+	}
+	searchRequest := ldap.NewSearchRequest(
+		w.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		attributes,
+		controls,
+	)
+
+	var entries []*ldap.Entry
+	_, err := w.conn.SearchStreamContext(ctx, searchRequest, pagingSize, func(entry *ldap.Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if w.config.Mode == USN {
+		return w.newUSNChanges(entries), nil
+	}
+	return w.newTimestampChanges(entries), nil
+}
+
+// newUSNChanges moves the sequence number past the changed entries
+func (w *Watcher) newUSNChanges(entries []*ldap.Entry) []*ldap.Entry {
+	for _, entry := range entries {
+		if usn, err := strconv.ParseInt(entry.GetAttributeValue("uSNChanged"), 10, 64); err == nil && usn > w.usn {
+			w.usn = usn
+		}
+	}
+	return entries
+}
+
+// newTimestampChanges returns the entries not reported yet, and moves the
+// timestamp to the latest change. The filter matches the entries changed at
+// the last timestamp again, so they are remembered until it moves.
+func (w *Watcher) newTimestampChanges(entries []*ldap.Entry) []*ldap.Entry {
+	var changed []*ldap.Entry
+	latest := w.timestamp
+	for _, entry := range entries {
+		timestamp := entry.GetAttributeValue("modifyTimestamp")
+		if timestamp == w.timestamp && w.seen[entry.DN] {
+			continue
+		}
+		changed = append(changed, entry)
+		if timestamp > latest {
+			latest = timestamp
+		}
+	}
+
+	if latest != w.timestamp {
+		w.timestamp = latest
+		w.seen = nil
+	}
+	for _, entry := range changed {
+		if entry.GetAttributeValue("modifyTimestamp") == w.timestamp {
+			if w.seen == nil {
+				w.seen = make(map[string]bool)
+			}
+			w.seen[entry.DN] = true
+		}
+	}
+	return changed
+}
+
+// Stats returns the counters of the watcher
+func (w *Watcher) Stats() Stats {
+	return Stats{
+		Polls:   atomic.LoadUint64(&w.stats.Polls),
+		Changes: atomic.LoadUint64(&w.stats.Changes),
+		Resets:  atomic.LoadUint64(&w.stats.Resets),
+		Errors:  atomic.LoadUint64(&w.stats.Errors),
+	}
+}
@@ -0,0 +1,140 @@
+package changewatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldaptest"
+)
+
+type recorder struct {
+	changed []string
+	resets  int
+}
+
+func (r *recorder) Changed(entries []*ldap.Entry) {
+	for _, entry := range entries {
+		r.changed = append(r.changed, entry.DN)
+	}
+}
+
+func (r *recorder) Reset() {
+	r.resets++
+}
+
+func newTestDirectory(t *testing.T) *ldaptest.Server {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	srv.AddCredentials("squid@domain.local", "secret")
+	srv.AddEntry("dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	srv.AddEntry("cn=John Doe,dc=domain,dc=local", map[string][]string{"objectClass": {"user"}, "sAMAccountName": {"jdoe"}})
+	srv.AddEntry("cn=Internet,dc=domain,dc=local", map[string][]string{"objectClass": {"group"}, "cn": {"Internet"}})
+	return srv
+}
+
+func newTestWatcher(t *testing.T, srv *ldaptest.Server, mode string, r *recorder) *Watcher {
+	w, err := New(Config{
+		Mode:         mode,
+		Servers:      []string{srv.Addr()},
+		BindUsername: "squid@domain.local",
+		BindPassword: "secret",
+		BaseDN:       "dc=domain,dc=local",
+		Filter:       "(|(objectClass=user)(objectClass=group))",
+		Attributes:   []string{"sAMAccountName"},
+		Interval:     time.Hour,
+		Timeout:      time.Second,
+	}, r)
+	if err != nil {
+		t.Fatalf("cannot create watcher: %s", err)
+	}
+	return w
+}
+
+func poll(t *testing.T, w *Watcher) {
+	if err := w.Poll(); err != nil {
+		t.Fatalf("cannot poll: %s", err)
+	}
+}
+
+func TestUSNChanges(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	r := &recorder{}
+	w := newTestWatcher(t, srv, USN, r)
+
+	// the first poll records the state of the directory
+	poll(t, w)
+	if len(r.changed) != 0 {
+		t.Errorf("got changes %v before any change", r.changed)
+	}
+
+	srv.SetAttribute("cn=Internet,dc=domain,dc=local", "member", []string{"cn=John Doe,dc=domain,dc=local"})
+	poll(t, w)
+	if len(r.changed) != 1 || r.changed[0] != "cn=Internet,dc=domain,dc=local" {
+		t.Errorf("got changes %v", r.changed)
+	}
+
+	// a change is reported once
+	poll(t, w)
+	srv.SetAttribute("cn=John Doe,dc=domain,dc=local", "description", []string{"moved"})
+	poll(t, w)
+	if len(r.changed) != 2 || r.changed[1] != "cn=John Doe,dc=domain,dc=local" {
+		t.Errorf("got changes %v", r.changed)
+	}
+	if s := w.Stats(); s.Polls != 4 || s.Changes != 2 || s.Errors != 0 {
+		t.Errorf("got stats %s", s)
+	}
+}
+
+func TestTimestampChanges(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	r := &recorder{}
+	w := newTestWatcher(t, srv, Timestamp, r)
+
+	// the entries changed within the second of the first poll are reported,
+	// as they may have changed after it, so the fixtures are left behind
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	poll(t, w)
+	srv.SetAttribute("cn=Internet,dc=domain,dc=local", "member", []string{"cn=John Doe,dc=domain,dc=local"})
+	poll(t, w)
+	// the entries changed within the same second are reported once
+	poll(t, w)
+	if len(r.changed) != 1 || r.changed[0] != "cn=Internet,dc=domain,dc=local" {
+		t.Errorf("got changes %v", r.changed)
+	}
+	srv.SetAttribute("cn=John Doe,dc=domain,dc=local", "description", []string{"moved"})
+	poll(t, w)
+	if len(r.changed) != 2 || r.changed[1] != "cn=John Doe,dc=domain,dc=local" {
+		t.Errorf("got changes %v", r.changed)
+	}
+}
+
+func TestReconnectionResets(t *testing.T) {
+	srv := newTestDirectory(t)
+	defer srv.Close()
+	r := &recorder{}
+	w := newTestWatcher(t, srv, USN, r)
+
+	poll(t, w)
+	srv.Disconnect()
+	if err := w.Poll(); err == nil {
+		t.Fatalf("poll on a dropped connection succeeded")
+	}
+	poll(t, w)
+	if r.resets != 1 {
+		t.Errorf("got %d resets after a reconnection, expected 1", r.resets)
+	}
+	if s := w.Stats(); s.Resets != 1 || s.Errors != 1 {
+		t.Errorf("got stats %s", s)
+	}
+}
+
+func TestNewRejectsUnknownMode(t *testing.T) {
+	if _, err := New(Config{Mode: "dirsync", Servers: []string{"localhost:389"}}, &recorder{}); err == nil {
+		t.Error("accepted an unknown mode")
+	}
+}
@@ -0,0 +1,188 @@
+// Package control serves the administration commands of a helper on a unix
+// socket, so that operators can inspect and flush its caches without
+// restarting Squid.
+//
+// A client sends one command per line: the name of the command followed by
+// its arguments, separated by spaces. The server answers each command with
+// "OK" or "ERR <message>", then the lines of its output, then a line holding
+// a single dot. Output lines starting with a dot are sent with another dot
+// in front, as in SMTP.
+package control
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/unixsock"
+)
+
+// Handler runs a command with its arguments and returns its output
+type Handler func(args []string) (string, error)
+
+type command struct {
+	usage   string
+	handler Handler
+}
+
+// Server runs the commands sent on its connections. It is safe for
+// concurrent use.
+type Server struct {
+	mu       sync.Mutex
+	commands map[string]command
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewServer returns a server knowing the help command only
+func NewServer() *Server {
+	s := &Server{
+		commands: make(map[string]command),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.Handle("help", "help - list the commands", s.help)
+	return s
+}
+
+// Handle registers the handler of the command name. usage describes the
+// command and its arguments in the output of help.
+func (s *Server) Handle(name, usage string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands[name] = command{usage: usage, handler: handler}
+}
+
+func (s *Server) help(args []string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var usages []string
+	for _, c := range s.commands {
+		usages = append(usages, c.usage)
+	}
+	sort.Strings(usages)
+	return strings.Join(usages, "\n"), nil
+}
+
+// Serve runs the commands of the connections accepted on l until l is
+// closed. It then stops reading the connections, and returns once the
+// commands in flight are answered and the connections closed.
+func (s *Server) Serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// serveConn runs the commands of the connection one at a time
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	out := bufio.NewWriter(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fs := strings.Fields(scanner.Text())
+		if len(fs) == 0 {
+			continue
+		}
+		output, err := s.run(fs[0], fs[1:])
+		if err != nil {
+			fmt.Fprintf(out, "ERR %s\n", strings.Replace(err.Error(), "\n", " ", -1))
+		} else {
+			out.WriteString("OK\n")
+		}
+		if output != "" {
+			for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+				if strings.HasPrefix(line, ".") {
+					line = "." + line
+				}
+				out.WriteString(line + "\n")
+			}
+		}
+		out.WriteString(".\n")
+		if out.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) run(name string, args []string) (string, error) {
+	s.mu.Lock()
+	c, ok := s.commands[name]
+	s.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("unknown command %q, see help", name)
+	}
+	return c.handler(args)
+}
+
+// Listen listens on the unix socket at path and sets its permissions to
+// mode, so that only the operators allowed by mode run commands. A socket
+// left by a process which did not exit cleanly is removed first, unless a
+// process still listens on it.
+func Listen(path string, mode os.FileMode) (net.Listener, error) {
+	return unixsock.Listen(path, mode)
+}
+
+// Run sends the command line to the server listening on the unix socket at
+// path, and returns the output of the command. A command answered with ERR
+// returns its output along with the error.
+func Run(path string, timeout time.Duration, line string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		return "", errors.New("control: no answer")
+	}
+	status := scanner.Text()
+	var output []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "." {
+			if strings.HasPrefix(status, "ERR ") {
+				return strings.Join(output, "\n"), errors.New(strings.TrimPrefix(status, "ERR "))
+			}
+			return strings.Join(output, "\n"), nil
+		}
+		output = append(output, strings.TrimPrefix(line, "."))
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("control: truncated answer")
+}
@@ -0,0 +1,92 @@
+package control
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempSocket(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "control.sock"), func() { os.RemoveAll(dir) }
+}
+
+func startServer(t *testing.T, path string, s *Server) (stop func()) {
+	l, err := Listen(path, 0600)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Serve(l)
+		close(done)
+	}()
+	return func() {
+		l.Close()
+		<-done
+	}
+}
+
+func TestRun(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	s := NewServer()
+	s.Handle("echo", "echo ARGS... - print the arguments, one per line", func(args []string) (string, error) {
+		return strings.Join(args, "\n"), nil
+	})
+	s.Handle("fail", "fail - fail", func(args []string) (string, error) {
+		return "partial output", errors.New("failed")
+	})
+	defer startServer(t, path, s)()
+
+	// the dot ending the output is escaped in the output
+	output, err := Run(path, time.Second, "echo a . .b")
+	if err != nil || output != "a\n.\n.b" {
+		t.Errorf("got output %q, error %v", output, err)
+	}
+	output, err = Run(path, time.Second, "fail")
+	if err == nil || err.Error() != "failed" || output != "partial output" {
+		t.Errorf("got output %q, error %v", output, err)
+	}
+	if _, err := Run(path, time.Second, "unknown"); err == nil {
+		t.Error("ran an unknown command")
+	}
+	output, err = Run(path, time.Second, "help")
+	if err != nil || !strings.HasPrefix(output, "echo ARGS...") || strings.Count(output, "\n") != 2 {
+		t.Errorf("got help %q, error %v", output, err)
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	stop := startServer(t, path, NewServer())
+	if _, err := Listen(path, 0600); err == nil {
+		t.Error("listened on a socket in use")
+	}
+	stop()
+
+	// a socket file left without listener
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = Listen(path, 0600)
+	if err != nil {
+		t.Fatalf("cannot listen on a stale socket: %s", err)
+	}
+	defer l.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got socket %v, error %v", fi, err)
+	}
+}
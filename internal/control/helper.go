@@ -0,0 +1,232 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldapbackend"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldappool"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/resultcache"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/unixsock"
+)
+
+// Helper gives the commands shared by the helpers access to the caches and
+// the backends of a helper
+type Helper struct {
+	// Entity names the search entity of the requests, such as group or OU
+	Entity string
+	// Answers caches the answers, by the backend cache key of
+	// identity:entity
+	Answers *resultcache.Cache
+	// Caches are the other caches of the helper
+	Caches []Cache
+	// Stats returns the stats lines of the rest of the helper, printed
+	// between those of the caches and those of the backends
+	Stats func() []string
+	// Backends returns the backends, the default one first
+	Backends func() []Backend
+	// Normalize returns the identity of a username
+	Normalize func(username string) (normalize.Identity, error)
+	// Route returns the backend of a username
+	Route func(username string) *ldapbackend.Backend
+	// Reload is sent a SIGHUP by the reload command
+	Reload chan<- os.Signal
+}
+
+// Cache is a cache of a helper besides its answers
+type Cache struct {
+	// Name names the cache in the stats, Entries its entries in the usage of
+	// the commands
+	Name, Entries string
+	Cache         *resultcache.Cache
+	// ByUser tells that the cache is keyed by the backend cache key of the
+	// identity of a user, so that evict-user evicts its entries
+	ByUser bool
+}
+
+// Backend is a backend of a helper
+type Backend struct {
+	*ldapbackend.Backend
+	// GlobalCatalog is the pool of the connections to the Global Catalog, if
+	// the backend keeps them apart
+	GlobalCatalog ldappool.Pool
+}
+
+// HandleHelper registers the commands shared by the helpers: stats, health,
+// get, evict-user, flush and reload. The helpers register the eviction of
+// their search entities themselves.
+func (s *Server) HandleHelper(h *Helper) {
+	entity := strings.ToUpper(h.Entity)
+	evictUser, flush := "evict the cached answers", "evict every cached answer"
+	for _, cache := range h.Caches {
+		if cache.ByUser {
+			evictUser += " and " + cache.Entries
+		}
+		flush += " and " + cache.Entries
+	}
+	s.Handle("stats", "stats - print the counters of the caches, the workers and the backends", h.stats)
+	s.Handle("health", "health - print the state of the servers and the connection pools of the backends", h.health)
+	s.Handle("get", fmt.Sprintf("get USER %s - print the cached answer of the request of the user for the %s", entity, h.Entity), h.get)
+	s.Handle("evict-user", "evict-user USER - "+evictUser+" of the user, of any NT domain and realm if USER has none", h.evictUser)
+	s.Handle("flush", "flush - "+flush, h.flush)
+	s.Handle("reload", "reload - reload the configuration, as on SIGHUP", h.reload)
+}
+
+// Start serves the commands on the unix socket at path, where %p is replaced
+// by the process ID, with the permissions given in octal by mode. The
+// returned function stops serving them once the commands in flight are
+// answered.
+func (s *Server) Start(path, mode string) (stop func()) {
+	path = strings.Replace(path, "%p", strconv.Itoa(os.Getpid()), -1)
+	fileMode, err := unixsock.ParseMode(mode)
+	if err != nil {
+		log.Printf("[WARN] Invalid control socket permissions. Message - %s", err.Error())
+		return func() {}
+	}
+	l, err := Listen(path, fileMode)
+	if err != nil {
+		log.Printf("[WARN] Cannot listen on the control socket. Message - %s", err.Error())
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Serve(l)
+		close(done)
+	}()
+	return func() {
+		l.Close()
+		<-done
+	}
+}
+
+func (h *Helper) stats(args []string) (string, error) {
+	lines := []string{"cache: " + h.Answers.Stats().String()}
+	for _, cache := range h.Caches {
+		lines = append(lines, cache.Name+" cache: "+cache.Cache.Stats().String())
+	}
+	lines = append(lines, h.Stats()...)
+	for _, b := range h.Backends() {
+		line := fmt.Sprintf("backend %s: %s", b.Label(), b.Metrics.String())
+		if b.Watcher != nil {
+			line += ", directory changes: " + b.Watcher.Stats().String()
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (h *Helper) health(args []string) (string, error) {
+	var lines []string
+	for _, b := range h.Backends() {
+		lines = append(lines, poolHealth("backend "+b.Label(), b.Pool)...)
+		if b.GlobalCatalog != nil {
+			lines = append(lines, poolHealth("backend "+b.Label()+" global catalog", b.GlobalCatalog)...)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// poolHealth returns the lines describing the connections and the servers
+// of the pool
+func poolHealth(label string, pool ldappool.Pool) []string {
+	stats := pool.Stats()
+	lines := []string{fmt.Sprintf("%s: idle connections: %d, gets: %d, reused: %d, dials: %d, dial errors: %d, discarded: %d, dial waits: %d",
+		label, stats.Idle, stats.Gets, stats.Reused, stats.Dials, stats.DialErrors, stats.Discarded, stats.DialWaits)}
+	for _, server := range pool.Servers() {
+		state := "up"
+		if !server.Alive {
+			state = "down"
+		}
+		lines = append(lines, fmt.Sprintf("  server %s: %s, checked %s", server.Address, state, server.LastCheck.Format(time.RFC3339)))
+	}
+	return lines
+}
+
+func (h *Helper) get(args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("usage: get USER " + strings.ToUpper(h.Entity))
+	}
+	identity, err := h.Normalize(args[0])
+	if err != nil {
+		return "", err
+	}
+	key := h.Route(args[0]).CacheKey(fmt.Sprintf("%s:%s", identity.Key(), args[1]))
+	entry, found := h.Answers.Inspect(key)
+	if !found {
+		return "", fmt.Errorf("no cached answer of %s", key)
+	}
+	return fmt.Sprintf("key: %s\nresult: %s\nlooked up: %s\nexpires: %s",
+		entry.Key, entry.Result, entry.Time.Format(time.RFC3339), entry.Expires.Format(time.RFC3339)), nil
+}
+
+func (h *Helper) evictUser(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("usage: evict-user USER")
+	}
+	identity, err := h.Normalize(args[0])
+	if err != nil {
+		return "", err
+	}
+	match := func(id string) bool {
+		if identity.Domain == "" && identity.Realm == "" {
+			return strings.EqualFold(normalize.KeyName(id), identity.Name)
+		}
+		return strings.EqualFold(id, identity.Key())
+	}
+	evicted := h.Answers.DeleteFunc(func(key, result string) bool {
+		id, _ := h.SplitKey(key)
+		return match(id)
+	})
+	for _, cache := range h.Caches {
+		if cache.ByUser {
+			cache.Cache.DeleteFunc(func(key, result string) bool {
+				return match(h.StripProfile(key))
+			})
+		}
+	}
+	return fmt.Sprintf("%d cached answers evicted", evicted), nil
+}
+
+func (h *Helper) flush(args []string) (string, error) {
+	evicted := h.Answers.Stats().Entries
+	h.Answers.Flush()
+	for _, cache := range h.Caches {
+		cache.Cache.Flush()
+	}
+	return fmt.Sprintf("%d cached answers evicted", evicted), nil
+}
+
+func (h *Helper) reload(args []string) (string, error) {
+	select {
+	case h.Reload <- syscall.SIGHUP:
+	default:
+	}
+	return "reloading", nil
+}
+
+// SplitKey returns the identity and the search entity of the key of a
+// cached answer, of any backend
+func (h *Helper) SplitKey(key string) (identity, entity string) {
+	fs := strings.SplitN(h.StripProfile(key), ":", 2)
+	if len(fs) != 2 {
+		return fs[0], ""
+	}
+	return fs[0], fs[1]
+}
+
+// StripProfile returns the key of a cache entry without its profile prefix
+func (h *Helper) StripProfile(key string) string {
+	for _, b := range h.Backends() {
+		if b.Name != "" && strings.HasPrefix(key, b.Name+"/") {
+			return strings.TrimPrefix(key, b.Name+"/")
+		}
+	}
+	return key
+}
@@ -0,0 +1,119 @@
+package control
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldapbackend"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/resultcache"
+)
+
+func newTestHelper() *Helper {
+	defaultBackend, corp := &ldapbackend.Backend{}, &ldapbackend.Backend{Name: "corp"}
+	h := &Helper{
+		Entity:    "OU",
+		Answers:   resultcache.New(),
+		Caches:    []Cache{{Name: "user DN", Entries: "user DN", Cache: resultcache.New(), ByUser: true}},
+		Backends:  func() []Backend { return []Backend{{Backend: defaultBackend}, {Backend: corp}} },
+		Normalize: func(username string) (normalize.Identity, error) { return normalize.Parse(username), nil },
+		Route: func(username string) *ldapbackend.Backend {
+			if normalize.Parse(username).Domain == "CORP" {
+				return corp
+			}
+			return defaultBackend
+		},
+		Reload: make(chan os.Signal, 1),
+	}
+	h.Answers.SetTTL(time.Hour, 0, 0)
+	h.Caches[0].Cache.SetTTL(time.Hour, 0, 0)
+	return h
+}
+
+func TestHelperCommands(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	h := newTestHelper()
+	h.Answers.Set("jdoe:Sales", "OK tag=Sales")
+	h.Answers.Set("corp/CORP\\jdoe:Sales", "ERR")
+	h.Answers.Set("bob:Sales", "ERR")
+	h.Caches[0].Cache.Set("corp/CORP\\jdoe", "cn=jdoe,ou=Sales,dc=corp,dc=local")
+	h.Caches[0].Cache.Set("bob", "cn=bob,ou=IT,dc=domain,dc=local")
+	s := NewServer()
+	s.HandleHelper(h)
+	defer startServer(t, path, s)()
+
+	output, err := Run(path, time.Second, "get CORP\\jdoe Sales")
+	if err != nil || !strings.Contains(output, "key: corp/CORP\\jdoe:Sales\nresult: ERR") {
+		t.Errorf("got output %q, error %v", output, err)
+	}
+	if _, err := Run(path, time.Second, "get jdoe"); err == nil || err.Error() != "usage: get USER OU" {
+		t.Errorf("got error %v", err)
+	}
+	// a user without NT domain nor realm is evicted from every domain
+	output, err = Run(path, time.Second, "evict-user jdoe")
+	if err != nil || output != "2 cached answers evicted" {
+		t.Errorf("got output %q, error %v", output, err)
+	}
+	if _, found := h.Caches[0].Cache.Inspect("corp/CORP\\jdoe"); found {
+		t.Error("the user DN of the evicted user is still cached")
+	}
+	if _, found := h.Caches[0].Cache.Inspect("bob"); !found {
+		t.Error("the user DN of another user is evicted")
+	}
+	output, err = Run(path, time.Second, "flush")
+	if err != nil || output != "1 cached answers evicted" || h.Caches[0].Cache.Stats().Entries != 0 {
+		t.Errorf("got output %q, error %v", output, err)
+	}
+	if output, err = Run(path, time.Second, "reload"); err != nil || output != "reloading" || len(h.Reload) != 1 {
+		t.Errorf("got output %q, error %v", output, err)
+	}
+	output, err = Run(path, time.Second, "help")
+	for _, usage := range []string{
+		"evict-user USER - evict the cached answers and user DN of the user",
+		"flush - evict every cached answer and user DN",
+		"get USER OU - print the cached answer of the request of the user for the OU",
+	} {
+		if !strings.Contains(output, usage) {
+			t.Errorf("got help %q, error %v, expected %q", output, err, usage)
+		}
+	}
+}
+
+func TestHelperSplitKey(t *testing.T) {
+	h := newTestHelper()
+	tests := map[string][2]string{
+		"jdoe:Sales":               {"jdoe", "Sales"},
+		"corp/CORP\\jdoe:Sales/IT": {"CORP\\jdoe", "Sales/IT"},
+		"lab/jdoe:Sales":           {"lab/jdoe", "Sales"},
+		"corp/jdoe@CORP.LOCAL":     {"jdoe@CORP.LOCAL", ""},
+	}
+	for key, expected := range tests {
+		if identity, entity := h.SplitKey(key); identity != expected[0] || entity != expected[1] {
+			t.Errorf("%s: got %q, %q, expected %q", key, identity, entity, expected)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	path = filepath.Join(filepath.Dir(path), "control-%p.sock")
+	stop := NewServer().Start(path, "0640")
+	defer stop()
+	path = strings.Replace(path, "%p", fmt.Sprint(os.Getpid()), -1)
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("got control socket %v, error %v", fi, err)
+	}
+	if _, err := Run(path, time.Second, "help"); err != nil {
+		t.Errorf("got error %v", err)
+	}
+
+	if stop := NewServer().Start(path+".invalid", "rw"); stop == nil {
+		t.Error("got no stop function for invalid permissions")
+	}
+}
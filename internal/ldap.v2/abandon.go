@@ -0,0 +1,34 @@
+// File contains Abandon functionality
+//
+// https://tools.ietf.org/html/rfc4511
+//
+// AbandonRequest ::= [APPLICATION 16] MessageID
+
+package ldap
+
+import (
+	"gopkg.in/asn1-ber.v1"
+)
+
+func encodeAbandonRequest(messageID, abandonID int64) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(ber.NewInteger(ber.ClassApplication, ber.TypePrimitive, ApplicationAbandonRequest, abandonID, "Abandon Request"))
+	return packet
+}
+
+// Abandon asks the server to stop processing the request with the given
+// message ID. The server does not answer an abandon request, so no error is
+// returned once the request has been handed to the connection.
+func (l *Conn) Abandon(messageID int64) error {
+	packet := encodeAbandonRequest(l.nextMessageID(), messageID)
+
+	l.Debug.PrintPacket(packet)
+
+	msgCtx, err := l.sendMessage(packet)
+	if err != nil {
+		return err
+	}
+	l.finishMessage(msgCtx)
+	return nil
+}
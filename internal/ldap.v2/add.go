@@ -10,6 +10,7 @@
 package ldap
 
 import (
+	"context"
 	"errors"
 	"log"
 
@@ -41,6 +42,8 @@ type AddRequest struct {
 	DN string
 	// Attributes list the attributes of the new entry
 	Attributes []Attribute
+	// Controls hold optional controls to send with the request
+	Controls []Control
 }
 
 func (a AddRequest) encode() *ber.Packet {
@@ -59,34 +62,40 @@ func (a *AddRequest) Attribute(attrType string, attrVals []string) {
 	a.Attributes = append(a.Attributes, Attribute{Type: attrType, Vals: attrVals})
 }
 
-// NewAddRequest returns an AddRequest for the given DN, with no attributes
-func NewAddRequest(dn string) *AddRequest {
+// NewAddRequest returns an AddRequest for the given DN and controls, with no
+// attributes
+func NewAddRequest(dn string, controls []Control) *AddRequest {
 	return &AddRequest{
-		DN: dn,
+		DN:       dn,
+		Controls: controls,
 	}
 
 }
 
 // Add performs the given AddRequest
 func (l *Conn) Add(addRequest *AddRequest) error {
+	return l.AddContext(context.Background(), addRequest)
+}
+
+// AddContext is like Add, but gives up when ctx is done
+func (l *Conn) AddContext(ctx context.Context, addRequest *AddRequest) error {
 	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
 	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
 	packet.AppendChild(addRequest.encode())
+	if addRequest.Controls != nil {
+		packet.AppendChild(encodeControls(addRequest.Controls))
+	}
 
 	l.Debug.PrintPacket(packet)
 
-	msgCtx, err := l.sendMessage(packet)
+	msgCtx, err := l.sendMessageContext(ctx, packet)
 	if err != nil {
 		return err
 	}
 	defer l.finishMessage(msgCtx)
 
 	l.Debug.Printf("%d: waiting for response", msgCtx.id)
-	packetResponse, ok := <-msgCtx.responses
-	if !ok {
-		return NewError(ErrorNetwork, errors.New("ldap: response channel closed"))
-	}
-	packet, err = packetResponse.ReadPacket()
+	packet, err = l.readPacket(ctx, msgCtx)
 	l.Debug.Printf("%d: got response %p", msgCtx.id, packet)
 	if err != nil {
 		return err
@@ -5,6 +5,7 @@
 package ldap
 
 import (
+	"context"
 	"errors"
 
 	"gopkg.in/asn1-ber.v1"
@@ -47,6 +48,11 @@ func (bindRequest *SimpleBindRequest) encode() *ber.Packet {
 
 // SimpleBind performs the simple bind operation defined in the given request
 func (l *Conn) SimpleBind(simpleBindRequest *SimpleBindRequest) (*SimpleBindResult, error) {
+	return l.SimpleBindContext(context.Background(), simpleBindRequest)
+}
+
+// SimpleBindContext is like SimpleBind, but gives up when ctx is done
+func (l *Conn) SimpleBindContext(ctx context.Context, simpleBindRequest *SimpleBindRequest) (*SimpleBindResult, error) {
 	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
 	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
 	encodedBindRequest := simpleBindRequest.encode()
@@ -56,17 +62,13 @@ func (l *Conn) SimpleBind(simpleBindRequest *SimpleBindRequest) (*SimpleBindResu
 		ber.PrintPacket(packet)
 	}
 
-	msgCtx, err := l.sendMessage(packet)
+	msgCtx, err := l.sendMessageContext(ctx, packet)
 	if err != nil {
 		return nil, err
 	}
 	defer l.finishMessage(msgCtx)
 
-	packetResponse, ok := <-msgCtx.responses
-	if !ok {
-		return nil, NewError(ErrorNetwork, errors.New("ldap: response channel closed"))
-	}
-	packet, err = packetResponse.ReadPacket()
+	packet, err = l.readPacket(ctx, msgCtx)
 	l.Debug.Printf("%d: got response %p", msgCtx.id, packet)
 	if err != nil {
 		return nil, err
@@ -85,7 +87,9 @@ func (l *Conn) SimpleBind(simpleBindRequest *SimpleBindRequest) (*SimpleBindResu
 
 	if len(packet.Children) == 3 {
 		for _, child := range packet.Children[2].Children {
-			result.Controls = append(result.Controls, DecodeControl(child))
+			if control := DecodeControl(child); control != nil {
+				result.Controls = append(result.Controls, control)
+			}
 		}
 	}
 
@@ -99,6 +103,11 @@ func (l *Conn) SimpleBind(simpleBindRequest *SimpleBindRequest) (*SimpleBindResu
 
 // Bind performs a bind with the given username and password
 func (l *Conn) Bind(username, password string) error {
+	return l.BindContext(context.Background(), username, password)
+}
+
+// BindContext is like Bind, but gives up when ctx is done
+func (l *Conn) BindContext(ctx context.Context, username, password string) error {
 	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
 	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
 	bindRequest := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationBindRequest, nil, "Bind Request")
@@ -111,17 +120,13 @@ func (l *Conn) Bind(username, password string) error {
 		ber.PrintPacket(packet)
 	}
 
-	msgCtx, err := l.sendMessage(packet)
+	msgCtx, err := l.sendMessageContext(ctx, packet)
 	if err != nil {
 		return err
 	}
 	defer l.finishMessage(msgCtx)
 
-	packetResponse, ok := <-msgCtx.responses
-	if !ok {
-		return NewError(ErrorNetwork, errors.New("ldap: response channel closed"))
-	}
-	packet, err = packetResponse.ReadPacket()
+	packet, err = l.readPacket(ctx, msgCtx)
 	l.Debug.Printf("%d: got response %p", msgCtx.id, packet)
 	if err != nil {
 		return err
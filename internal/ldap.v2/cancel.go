@@ -0,0 +1,35 @@
+// File contains the cancel extended operation
+//
+// https://tools.ietf.org/html/rfc3909
+//
+//         cancelRequestValue ::= SEQUENCE {
+//             cancelID        MessageID
+//         }
+
+package ldap
+
+import (
+	"context"
+
+	"gopkg.in/asn1-ber.v1"
+)
+
+const cancelOID = "1.3.6.1.1.8"
+
+// Cancel asks the server to stop processing the request with the given
+// message ID. Unlike Abandon, the server answers the canceled request with
+// LDAPResultCanceled and tells whether it was canceled: an error with
+// LDAPResultNoSuchOperation, LDAPResultTooLate or LDAPResultCannotCancel is
+// returned if it was not.
+func (l *Conn) Cancel(messageID int64) error {
+	return l.CancelContext(context.Background(), messageID)
+}
+
+// CancelContext is like Cancel, but gives up when ctx is done
+func (l *Conn) CancelContext(ctx context.Context, messageID int64) error {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Cancel Request Value")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Cancel ID"))
+
+	_, err := l.ExtendedContext(ctx, cancelOID, value.Bytes())
+	return err
+}
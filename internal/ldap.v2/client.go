@@ -1,6 +1,7 @@
 package ldap
 
 import (
+	"context"
 	"crypto/tls"
 	"time"
 )
@@ -10,18 +11,45 @@ type Client interface {
 	Start()
 	StartTLS(config *tls.Config) error
 	Close()
+	Unbind() error
+	IsClosing() bool
 	SetTimeout(time.Duration)
 
 	Bind(username, password string) error
+	BindContext(ctx context.Context, username, password string) error
 	SimpleBind(simpleBindRequest *SimpleBindRequest) (*SimpleBindResult, error)
+	SimpleBindContext(ctx context.Context, simpleBindRequest *SimpleBindRequest) (*SimpleBindResult, error)
 
 	Add(addRequest *AddRequest) error
+	AddContext(ctx context.Context, addRequest *AddRequest) error
 	Del(delRequest *DelRequest) error
+	DelContext(ctx context.Context, delRequest *DelRequest) error
 	Modify(modifyRequest *ModifyRequest) error
+	ModifyContext(ctx context.Context, modifyRequest *ModifyRequest) error
+	ModifyDN(modifyDNRequest *ModifyDNRequest) error
+	ModifyDNContext(ctx context.Context, modifyDNRequest *ModifyDNRequest) error
 
 	Compare(dn, attribute, value string) (bool, error)
+	CompareContext(ctx context.Context, dn, attribute, value string) (bool, error)
 	PasswordModify(passwordModifyRequest *PasswordModifyRequest) (*PasswordModifyResult, error)
+	PasswordModifyContext(ctx context.Context, passwordModifyRequest *PasswordModifyRequest) (*PasswordModifyResult, error)
+	Extended(oid string, value []byte) (*ExtendedResult, error)
+	ExtendedContext(ctx context.Context, oid string, value []byte) (*ExtendedResult, error)
+	WhoAmI() (string, error)
+	WhoAmIContext(ctx context.Context) (string, error)
 
 	Search(searchRequest *SearchRequest) (*SearchResult, error)
+	SearchContext(ctx context.Context, searchRequest *SearchRequest) (*SearchResult, error)
 	SearchWithPaging(searchRequest *SearchRequest, pagingSize uint32) (*SearchResult, error)
+	SearchWithPagingContext(ctx context.Context, searchRequest *SearchRequest, pagingSize uint32) (*SearchResult, error)
+	SearchStream(searchRequest *SearchRequest, pagingSize uint32, handler func(*Entry) error) (*SearchResult, error)
+	SearchStreamContext(ctx context.Context, searchRequest *SearchRequest, pagingSize uint32, handler func(*Entry) error) (*SearchResult, error)
+	SearchWithReferrals(searchRequest *SearchRequest, config *ReferralConfig) (*SearchResult, error)
+	SearchWithReferralsContext(ctx context.Context, searchRequest *SearchRequest, config *ReferralConfig) (*SearchResult, error)
+	SearchRangedAttribute(dn, attribute string) ([]string, error)
+	SearchRangedAttributeContext(ctx context.Context, dn, attribute string) ([]string, error)
+
+	Abandon(messageID int64) error
+	Cancel(messageID int64) error
+	CancelContext(ctx context.Context, messageID int64) error
 }
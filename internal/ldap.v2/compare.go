@@ -24,6 +24,7 @@
 package ldap
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -33,6 +34,11 @@ import (
 // Compare checks to see if the attribute of the dn matches value. Returns true if it does otherwise
 // false with any error that occurs if any.
 func (l *Conn) Compare(dn, attribute, value string) (bool, error) {
+	return l.CompareContext(context.Background(), dn, attribute, value)
+}
+
+// CompareContext is like Compare, but gives up when ctx is done
+func (l *Conn) CompareContext(ctx context.Context, dn, attribute, value string) (bool, error) {
 	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
 	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
 
@@ -47,18 +53,14 @@ func (l *Conn) Compare(dn, attribute, value string) (bool, error) {
 
 	l.Debug.PrintPacket(packet)
 
-	msgCtx, err := l.sendMessage(packet)
+	msgCtx, err := l.sendMessageContext(ctx, packet)
 	if err != nil {
 		return false, err
 	}
 	defer l.finishMessage(msgCtx)
 
 	l.Debug.Printf("%d: waiting for response", msgCtx.id)
-	packetResponse, ok := <-msgCtx.responses
-	if !ok {
-		return false, NewError(ErrorNetwork, errors.New("ldap: response channel closed"))
-	}
-	packet, err = packetResponse.ReadPacket()
+	packet, err = l.readPacket(ctx, msgCtx)
 	l.Debug.Printf("%d: got response %p", msgCtx.id, packet)
 	if err != nil {
 		return false, err
@@ -5,6 +5,7 @@
 package ldap
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -49,7 +50,8 @@ func (pr *PacketResponse) ReadPacket() (*ber.Packet, error) {
 type messageContext struct {
 	id int64
 	// close(done) should only be called from finishMessage()
-	done chan struct{}
+	done     chan struct{}
+	finished sync.Once
 	// close(responses) should only be called from processMessages(), and only sent to from sendResponse()
 	responses chan *PacketResponse
 }
@@ -85,6 +87,8 @@ type Conn struct {
 	isTLS               bool
 	closing             uint32
 	closeErr            atomicValue
+	notificationHandler atomicValue
+	unbindErr           error
 	isStartingTLS       bool
 	Debug               debugging
 	chanConfirm         chan struct{}
@@ -109,7 +113,13 @@ var DefaultTimeout = 60 * time.Second
 // Dial connects to the given address on the given network using net.Dial
 // and then returns a new Conn for the connection.
 func Dial(network, addr string) (*Conn, error) {
-	c, err := net.DialTimeout(network, addr, DefaultTimeout)
+	return DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial, but gives up connecting when ctx is done
+func DialContext(ctx context.Context, network, addr string) (*Conn, error) {
+	dialer := net.Dialer{Timeout: DefaultTimeout}
+	c, err := dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, NewError(ErrorNetwork, err)
 	}
@@ -121,10 +131,20 @@ func Dial(network, addr string) (*Conn, error) {
 // DialTLS connects to the given address on the given network using tls.Dial
 // and then returns a new Conn for the connection.
 func DialTLS(network, addr string, config *tls.Config) (*Conn, error) {
-	dc, err := net.DialTimeout(network, addr, DefaultTimeout)
+	return DialTLSContext(context.Background(), network, addr, config)
+}
+
+// DialTLSContext is like DialTLS, but gives up connecting and the TLS
+// handshake when ctx is done
+func DialTLSContext(ctx context.Context, network, addr string, config *tls.Config) (*Conn, error) {
+	dialer := net.Dialer{Timeout: DefaultTimeout}
+	dc, err := dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, NewError(ErrorNetwork, err)
 	}
+	if deadline, ok := ctx.Deadline(); ok {
+		dc.SetDeadline(deadline)
+	}
 	c := tls.Client(dc, config)
 	err = c.Handshake()
 	if err != nil {
@@ -132,6 +152,7 @@ func DialTLS(network, addr string, config *tls.Config) (*Conn, error) {
 		dc.Close()
 		return nil, NewError(ErrorNetwork, err)
 	}
+	dc.SetDeadline(time.Time{})
 	conn := NewConn(c, true)
 	conn.Start()
 	return conn, nil
@@ -162,21 +183,36 @@ func (l *Conn) isClosing() bool {
 	return atomic.LoadUint32(&l.closing) == 1
 }
 
+// IsClosing returns whether the connection is closed or closing, e.g.
+// after the server sent a Notice of Disconnection
+func (l *Conn) IsClosing() bool {
+	return l.isClosing()
+}
+
 // setClosing sets the closing value to true
 func (l *Conn) setClosing() bool {
 	return atomic.CompareAndSwapUint32(&l.closing, 0, 1)
 }
 
-// Close closes the connection.
+// Close closes the connection without telling the server. Use Unbind to
+// close the connection gracefully.
 func (l *Conn) Close() {
+	l.close(nil)
+}
+
+// close stops processing messages and closes the network connection. If
+// unbind is not nil, it is the last request written to the server.
+func (l *Conn) close(unbind *ber.Packet) error {
 	l.messageMutex.Lock()
 	defer l.messageMutex.Unlock()
 
+	var err error
 	if l.setClosing() {
 		l.Debug.Printf("Sending quit message and waiting for confirmation")
-		l.chanMessage <- &messagePacket{Op: MessageQuit}
+		l.chanMessage <- &messagePacket{Op: MessageQuit, Packet: unbind}
 		<-l.chanConfirm
 		close(l.chanMessage)
+		err = l.unbindErr
 
 		l.Debug.Printf("Closing network connection")
 		if err := l.conn.Close(); err != nil {
@@ -184,8 +220,11 @@ func (l *Conn) Close() {
 		}
 
 		l.wgClose.Done()
+	} else if unbind != nil {
+		err = NewError(ErrorNetwork, errors.New("ldap: connection closed"))
 	}
 	l.wgClose.Wait()
+	return err
 }
 
 // SetTimeout sets the time after a request is sent that a MessageTimeout triggers
@@ -264,6 +303,33 @@ func (l *Conn) sendMessage(packet *ber.Packet) (*messageContext, error) {
 	return l.sendMessageWithFlags(packet, 0)
 }
 
+// sendMessageContext sends the request unless ctx is already done
+func (l *Conn) sendMessageContext(ctx context.Context, packet *ber.Packet) (*messageContext, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, NewError(ErrorCanceled, err)
+	}
+	return l.sendMessage(packet)
+}
+
+// readPacket waits for the next response to the message. If ctx is done
+// first, the request is abandoned on the server and an ErrorCanceled error
+// is returned.
+func (l *Conn) readPacket(ctx context.Context, msgCtx *messageContext) (*ber.Packet, error) {
+	select {
+	case packetResponse, ok := <-msgCtx.responses:
+		if !ok {
+			return nil, NewError(ErrorNetwork, errors.New("ldap: response channel closed"))
+		}
+		return packetResponse.ReadPacket()
+	case <-ctx.Done():
+		l.Debug.Printf("%d: abandoning request: %s", msgCtx.id, ctx.Err())
+		if err := l.abandonMessage(msgCtx); err != nil {
+			l.Debug.Printf("%d: cannot abandon request: %s", msgCtx.id, err)
+		}
+		return nil, NewError(ErrorCanceled, ctx.Err())
+	}
+}
+
 func (l *Conn) sendMessageWithFlags(packet *ber.Packet, flags sendMessageFlags) (*messageContext, error) {
 	if l.isClosing() {
 		return nil, NewError(ErrorNetwork, errors.New("ldap: connection closed"))
@@ -301,7 +367,15 @@ func (l *Conn) sendMessageWithFlags(packet *ber.Packet, flags sendMessageFlags)
 	return message.Context, nil
 }
 
+// finishMessage stops waiting for responses to the message. Calling it
+// again for the same message has no effect.
 func (l *Conn) finishMessage(msgCtx *messageContext) {
+	msgCtx.finished.Do(func() {
+		l.doFinishMessage(msgCtx)
+	})
+}
+
+func (l *Conn) doFinishMessage(msgCtx *messageContext) {
 	close(msgCtx.done)
 
 	if l.isClosing() {
@@ -322,6 +396,14 @@ func (l *Conn) finishMessage(msgCtx *messageContext) {
 	l.sendProcessMessage(message)
 }
 
+// abandonMessage stops waiting for responses to the message and asks the
+// server to stop processing it. The message has to be finished first, as
+// processMessages may be blocked delivering the next response to it.
+func (l *Conn) abandonMessage(msgCtx *messageContext) error {
+	l.finishMessage(msgCtx)
+	return l.Abandon(msgCtx.id)
+}
+
 func (l *Conn) sendProcessMessage(message *messagePacket) bool {
 	l.messageMutex.Lock()
 	defer l.messageMutex.Unlock()
@@ -360,6 +442,12 @@ func (l *Conn) processMessages() {
 			switch message.Op {
 			case MessageQuit:
 				l.Debug.Printf("Shutting down - quit message received")
+				if message.Packet != nil {
+					if _, err := l.conn.Write(message.Packet.Bytes()); err != nil {
+						l.Debug.Printf("Error Sending Unbind: %s", err.Error())
+						l.unbindErr = NewError(ErrorNetwork, err)
+					}
+				}
 				return
 			case MessageRequest:
 				// Add to message list and write to network
@@ -410,6 +498,15 @@ func (l *Conn) processMessages() {
 				// All reads will return immediately
 				if msgCtx, ok := l.messageContexts[message.MessageID]; ok {
 					l.Debug.Printf("Receiving message timeout for %d", message.MessageID)
+
+					// Nobody will wait for the result any more, so tell
+					// the server to stop working on the request
+					abandon := encodeAbandonRequest(messageID, message.MessageID)
+					messageID++
+					if _, err := l.conn.Write(abandon.Bytes()); err != nil {
+						l.Debug.Printf("Error Sending Abandon: %s", err.Error())
+					}
+
 					msgCtx.sendResponse(&PacketResponse{message.Packet, errors.New("ldap: connection timed out")})
 					delete(l.messageContexts, message.MessageID)
 					close(msgCtx.responses)
@@ -443,8 +540,9 @@ func (l *Conn) reader() {
 		}
 		packet, err := ber.ReadPacket(l.conn)
 		if err != nil {
-			// A read error is expected here if we are closing the connection...
-			if !l.isClosing() {
+			// A read error is expected here if we are closing the connection,
+			// or after a notice of disconnection
+			if !l.isClosing() && l.closeErr.Load() == nil {
 				l.closeErr.Store(fmt.Errorf("unable to read LDAP response packet: %s", err))
 				l.Debug.Printf("reader error: %s", err.Error())
 			}
@@ -455,6 +553,13 @@ func (l *Conn) reader() {
 			l.Debug.Printf("Received bad ldap packet")
 			continue
 		}
+		messageID := packet.Children[0].Value.(int64)
+		if messageID == 0 && len(packet.Children) > 1 {
+			if l.handleNotification(packet) {
+				return
+			}
+			continue
+		}
 		l.messageMutex.Lock()
 		if l.isStartingTLS {
 			cleanstop = true
@@ -462,7 +567,7 @@ func (l *Conn) reader() {
 		l.messageMutex.Unlock()
 		message := &messagePacket{
 			Op:        MessageResponse,
-			MessageID: packet.Children[0].Value.(int64),
+			MessageID: messageID,
 			Packet:    packet,
 		}
 		if !l.sendProcessMessage(message) {
@@ -2,6 +2,7 @@ package ldap
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -104,6 +105,196 @@ func TestFinishMessage(t *testing.T) {
 	conn.Close()
 }
 
+// TestSearchContextCanceled tests that a request whose context is canceled
+// returns right away and is abandoned on the server.
+func TestSearchContextCanceled(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.SearchContext(ctx, NewSearchRequest("dc=example,dc=com", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(uid=jdoe)", nil, nil))
+		errs <- err
+	}()
+
+	var search, abandon *ber.Packet
+	runWithTimeout(t, time.Second, func() {
+		var err error
+		if search, err = ptc.ReceiveRequest(); err != nil {
+			t.Fatalf("receiveRequest failed: %v", err)
+		}
+	})
+	cancel()
+	runWithTimeout(t, time.Second, func() {
+		var err error
+		if abandon, err = ptc.ReceiveRequest(); err != nil {
+			t.Fatalf("receiveRequest failed: %v", err)
+		}
+	})
+
+	if abandon.Children[1].ClassType != ber.ClassApplication || abandon.Children[1].Tag != ApplicationAbandonRequest {
+		t.Fatalf("expected an abandon request, got %s", ApplicationMap[uint8(abandon.Children[1].Tag)])
+	}
+	abandonedID, err := ber.ParseInt64(abandon.Children[1].Data.Bytes())
+	if err != nil {
+		t.Fatalf("cannot parse abandoned message ID: %v", err)
+	}
+	if searchID := search.Children[0].Value.(int64); abandonedID != searchID {
+		t.Errorf("abandoned message ID %d, expected %d", abandonedID, searchID)
+	}
+
+	runWithTimeout(t, time.Second, func() {
+		if err := <-errs; !IsErrorWithCode(err, ErrorCanceled) {
+			t.Errorf("expected ErrorCanceled, got %v", err)
+		}
+	})
+}
+
+// TestBindContextDone tests that no request is sent when the context is
+// already done.
+func TestBindContextDone(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	if err := conn.BindContext(ctx, "cn=admin", "secret"); !IsErrorWithCode(err, ErrorCanceled) {
+		t.Fatalf("expected ErrorCanceled, got %v", err)
+	}
+	ptc.lock.Lock()
+	defer ptc.lock.Unlock()
+	if ptc.requestBuf.Len() != 0 {
+		t.Errorf("a request was sent with a done context")
+	}
+}
+
+// TestRequestTimeoutAbandons tests that a request which times out is
+// abandoned on the server.
+func TestRequestTimeoutAbandons(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.SetTimeout(10 * time.Millisecond)
+	conn.Start()
+	defer conn.Close()
+
+	msgCtx := testSendRequest(t, ptc, conn)
+	defer conn.finishMessage(msgCtx)
+
+	runWithTimeout(t, time.Second, func() {
+		abandon, err := ptc.ReceiveRequest()
+		if err != nil {
+			t.Fatalf("receiveRequest failed: %v", err)
+		}
+		testAbandonRequest(t, abandon, msgCtx.id)
+	})
+
+	runWithTimeout(t, time.Second, func() {
+		packetResponse, ok := <-msgCtx.responses
+		if !ok {
+			t.Fatalf("no PacketResponse in response channel")
+		}
+		if _, err := packetResponse.ReadPacket(); err == nil {
+			t.Errorf("expected timeout error")
+		}
+	})
+}
+
+// TestAbandon tests the PDU of an explicit abandon request.
+func TestAbandon(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	runWithTimeout(t, time.Second, func() {
+		if err := conn.Abandon(42); err != nil {
+			t.Fatalf("abandon failed: %v", err)
+		}
+		abandon, err := ptc.ReceiveRequest()
+		if err != nil {
+			t.Fatalf("receiveRequest failed: %v", err)
+		}
+		testAbandonRequest(t, abandon, 42)
+	})
+}
+
+func testAbandonRequest(t *testing.T, packet *ber.Packet, abandonID int64) {
+	if len(packet.Children) != 2 {
+		t.Fatalf("expected 2 children in the request, got %d", len(packet.Children))
+	}
+	request := packet.Children[1]
+	if request.ClassType != ber.ClassApplication || request.TagType != ber.TypePrimitive || request.Tag != ApplicationAbandonRequest {
+		t.Fatalf("expected an abandon request, got %s", ApplicationMap[uint8(request.Tag)])
+	}
+	id, err := ber.ParseInt64(request.Data.Bytes())
+	if err != nil {
+		t.Fatalf("cannot parse abandoned message ID: %v", err)
+	}
+	if id != abandonID {
+		t.Errorf("abandoned message ID %d, expected %d", id, abandonID)
+	}
+}
+
+// TestUnbind tests that Unbind sends an unbind request before closing the
+// connection.
+func TestUnbind(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	conn := NewConn(client, false)
+	conn.Start()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- conn.Unbind()
+	}()
+
+	runWithTimeout(t, time.Second, func() {
+		packet, err := ber.ReadPacket(server)
+		if err != nil {
+			t.Fatalf("cannot read request: %v", err)
+		}
+		if len(packet.Children) != 2 {
+			t.Fatalf("expected 2 children in the request, got %d", len(packet.Children))
+		}
+		request := packet.Children[1]
+		if request.ClassType != ber.ClassApplication || request.TagType != ber.TypePrimitive || request.Tag != ApplicationUnbindRequest {
+			t.Fatalf("expected an unbind request, got %s", ApplicationMap[uint8(request.Tag)])
+		}
+		if request.Data.Len() != 0 {
+			t.Errorf("unbind request must be empty, got %d bytes", request.Data.Len())
+		}
+	})
+
+	runWithTimeout(t, time.Second, func() {
+		if err := <-errs; err != nil {
+			t.Errorf("unbind failed: %v", err)
+		}
+	})
+	if !conn.isClosing() {
+		t.Errorf("connection is not closed after unbind")
+	}
+	if err := conn.Unbind(); !IsErrorWithCode(err, ErrorNetwork) {
+		t.Errorf("expected ErrorNetwork unbinding a closed connection, got %v", err)
+	}
+}
+
 func testSendRequest(t *testing.T, ptc *packetTranslatorConn, conn *Conn) (msgCtx *messageContext) {
 	var msgID int64
 	runWithTimeout(t, time.Second, func() {
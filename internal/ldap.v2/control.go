@@ -22,13 +22,53 @@ const (
 	ControlTypeVChuPasswordWarning = "2.16.840.1.113730.3.4.5"
 	// ControlTypeManageDsaIT - https://tools.ietf.org/html/rfc3296
 	ControlTypeManageDsaIT = "2.16.840.1.113730.3.4.2"
+	// ControlTypeServerSideSort - https://tools.ietf.org/html/rfc2891
+	ControlTypeServerSideSort = "1.2.840.113556.1.4.473"
+	// ControlTypeServerSideSortResult - https://tools.ietf.org/html/rfc2891
+	ControlTypeServerSideSortResult = "1.2.840.113556.1.4.474"
+	// ControlTypeVirtualListView - https://tools.ietf.org/html/draft-ietf-ldapext-ldapv3-vlv-09
+	ControlTypeVirtualListView = "2.16.840.1.113730.3.4.9"
+	// ControlTypeVirtualListViewResult - https://tools.ietf.org/html/draft-ietf-ldapext-ldapv3-vlv-09
+	ControlTypeVirtualListViewResult = "2.16.840.1.113730.3.4.10"
+	// ControlTypeAttributeScopedQuery - https://msdn.microsoft.com/en-us/library/cc223322.aspx
+	ControlTypeAttributeScopedQuery = "1.2.840.113556.1.4.1504"
+	// ControlTypeDirSync - https://msdn.microsoft.com/en-us/library/cc223347.aspx
+	ControlTypeDirSync = "1.2.840.113556.1.4.841"
+	// ControlTypeShowDeleted - https://msdn.microsoft.com/en-us/library/cc223326.aspx
+	ControlTypeShowDeleted = "1.2.840.113556.1.4.417"
+	// ControlTypeExtendedDN - https://msdn.microsoft.com/en-us/library/cc223349.aspx
+	ControlTypeExtendedDN = "1.2.840.113556.1.4.529"
+	// ControlTypeDomainScope - https://msdn.microsoft.com/en-us/library/cc223323.aspx
+	ControlTypeDomainScope = "1.2.840.113556.1.4.1339"
+)
+
+// DirSync control flags
+const (
+	DirSyncObjectSecurity      = 0x1
+	DirSyncAncestorsFirstOrder = 0x800
+	DirSyncPublicDataOnly      = 0x2000
+)
+
+// Extended DN control formats
+const (
+	ExtendedDNHexFormat    = 0
+	ExtendedDNStringFormat = 1
 )
 
 // ControlTypeMap maps controls to text descriptions
 var ControlTypeMap = map[string]string{
-	ControlTypePaging:               "Paging",
-	ControlTypeBeheraPasswordPolicy: "Password Policy - Behera Draft",
-	ControlTypeManageDsaIT:          "Manage DSA IT",
+	ControlTypePaging:                "Paging",
+	ControlTypeBeheraPasswordPolicy:  "Password Policy - Behera Draft",
+	ControlTypeManageDsaIT:           "Manage DSA IT",
+	ControlTypeServerSideSort:        "Server Side Sort",
+	ControlTypeServerSideSortResult:  "Server Side Sort Result",
+	ControlTypeVirtualListView:       "Virtual List View",
+	ControlTypeVirtualListViewResult: "Virtual List View Result",
+	ControlTypeAttributeScopedQuery:  "Attribute Scoped Query",
+	ControlTypeDirSync:               "DirSync",
+	ControlTypeShowDeleted:           "Show Deleted",
+	ControlTypeExtendedDN:            "Extended DN",
+	ControlTypeDomainScope:           "Domain Scope",
 }
 
 // Control defines an interface controls provide to encode and describe themselves
@@ -242,6 +282,526 @@ func NewControlManageDsaIT(Criticality bool) *ControlManageDsaIT {
 	return &ControlManageDsaIT{Criticality: Criticality}
 }
 
+// newControlPacket returns the control packet without its value
+func newControlPacket(controlType string, criticality bool) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, controlType, "Control Type ("+ControlTypeMap[controlType]+")"))
+	if criticality {
+		packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, criticality, "Criticality"))
+	}
+	return packet
+}
+
+// newControlValue returns the control value packet holding the BER encoded
+// value
+func newControlValue(controlType string, value *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value ("+ControlTypeMap[controlType]+")")
+	packet.AppendChild(value)
+	return packet
+}
+
+// newOctetString returns an octet string packet holding binary data
+func newOctetString(data []byte, description string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, description)
+	packet.Value = data
+	packet.Data.Write(data)
+	return packet
+}
+
+// decodeControlValue decodes the BER encoded control value in place and
+// returns it, or nil if the control has no value or a malformed one
+func decodeControlValue(value *ber.Packet) *ber.Packet {
+	if value == nil {
+		return nil
+	}
+	if value.Value != nil {
+		valueChildren, err := ber.DecodePacketErr(value.Data.Bytes())
+		if err != nil {
+			return nil
+		}
+		value.Data.Truncate(0)
+		value.Value = nil
+		value.AppendChild(valueChildren)
+	}
+	if len(value.Children) == 0 {
+		return nil
+	}
+	return value.Children[0]
+}
+
+// packetInt64 returns the integer value of the packet
+func packetInt64(packet *ber.Packet) int64 {
+	if v, ok := packet.Value.(int64); ok {
+		return v
+	}
+	v, _ := ber.ParseInt64(packet.Data.Bytes())
+	return v
+}
+
+// packetBytes returns the data of the packet, or nil if it is empty
+func packetBytes(packet *ber.Packet) []byte {
+	if packet.Data.Len() == 0 {
+		return nil
+	}
+	return append([]byte(nil), packet.Data.Bytes()...)
+}
+
+// SortKey is a key of the server side sort control
+type SortKey struct {
+	// AttributeType is the name of the attribute to sort by
+	AttributeType string
+	// OrderingRule is the OID of the matching rule to sort with, if not the
+	// ordering rule of the attribute
+	OrderingRule string
+	// Reverse sorts in descending order
+	Reverse bool
+}
+
+// ControlServerSideSort implements the sort request control described in https://tools.ietf.org/html/rfc2891
+type ControlServerSideSort struct {
+	// Criticality indicates if this control is required
+	Criticality bool
+	// SortKeys are the keys to sort by, in order of precedence
+	SortKeys []*SortKey
+}
+
+// GetControlType returns the OID
+func (c *ControlServerSideSort) GetControlType() string {
+	return ControlTypeServerSideSort
+}
+
+// Encode returns the ber packet representation
+func (c *ControlServerSideSort) Encode() *ber.Packet {
+	packet := newControlPacket(ControlTypeServerSideSort, c.Criticality)
+
+	keys := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sort Key List")
+	for _, key := range c.SortKeys {
+		seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sort Key")
+		seq.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, key.AttributeType, "Attribute Type"))
+		if key.OrderingRule != "" {
+			seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, key.OrderingRule, "Ordering Rule"))
+		}
+		if key.Reverse {
+			seq.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 1, key.Reverse, "Reverse Order"))
+		}
+		keys.AppendChild(seq)
+	}
+
+	packet.AppendChild(newControlValue(ControlTypeServerSideSort, keys))
+	return packet
+}
+
+// String returns a human-readable description
+func (c *ControlServerSideSort) String() string {
+	var keys []string
+	for _, key := range c.SortKeys {
+		description := key.AttributeType
+		if key.OrderingRule != "" {
+			description += ":" + key.OrderingRule
+		}
+		if key.Reverse {
+			description = "-" + description
+		}
+		keys = append(keys, description)
+	}
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t  SortKeys: %v",
+		ControlTypeMap[ControlTypeServerSideSort],
+		ControlTypeServerSideSort,
+		c.Criticality,
+		keys)
+}
+
+// NewControlServerSideSort returns a ControlServerSideSort control
+func NewControlServerSideSort(criticality bool, sortKeys []*SortKey) *ControlServerSideSort {
+	return &ControlServerSideSort{Criticality: criticality, SortKeys: sortKeys}
+}
+
+// ControlServerSideSortResult implements the sort response control described in https://tools.ietf.org/html/rfc2891
+type ControlServerSideSortResult struct {
+	// Result is the LDAP result code of the sort
+	Result int64
+	// AttributeType is the attribute which caused the sort to fail
+	AttributeType string
+}
+
+// GetControlType returns the OID
+func (c *ControlServerSideSortResult) GetControlType() string {
+	return ControlTypeServerSideSortResult
+}
+
+// Encode returns the ber packet representation
+func (c *ControlServerSideSortResult) Encode() *ber.Packet {
+	packet := newControlPacket(ControlTypeServerSideSortResult, false)
+
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sort Result")
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, c.Result, "Sort Result Code"))
+	if c.AttributeType != "" {
+		seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, c.AttributeType, "Attribute Type"))
+	}
+
+	packet.AppendChild(newControlValue(ControlTypeServerSideSortResult, seq))
+	return packet
+}
+
+// String returns a human-readable description
+func (c *ControlServerSideSortResult) String() string {
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t  Result: %d  AttributeType: %s",
+		ControlTypeMap[ControlTypeServerSideSortResult],
+		ControlTypeServerSideSortResult,
+		false,
+		c.Result,
+		c.AttributeType)
+}
+
+// ControlVirtualListView implements the request control described in https://tools.ietf.org/html/draft-ietf-ldapext-ldapv3-vlv-09
+// It has to be sent along with a ControlServerSideSort.
+type ControlVirtualListView struct {
+	// Criticality indicates if this control is required
+	Criticality bool
+	// BeforeCount and AfterCount are the number of entries to return before
+	// and after the target entry
+	BeforeCount int64
+	AfterCount  int64
+	// Offset is the position of the target entry, starting at 1, out of
+	// ContentCount entries. It is used unless GreaterThanOrEqual is set.
+	Offset       int64
+	ContentCount int64
+	// GreaterThanOrEqual selects the first entry whose sort key is greater
+	// than or equal to the value as the target entry
+	GreaterThanOrEqual string
+	// ContextID is an opaque value returned by the server
+	ContextID []byte
+}
+
+// GetControlType returns the OID
+func (c *ControlVirtualListView) GetControlType() string {
+	return ControlTypeVirtualListView
+}
+
+// Encode returns the ber packet representation
+func (c *ControlVirtualListView) Encode() *ber.Packet {
+	packet := newControlPacket(ControlTypeVirtualListView, c.Criticality)
+
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Virtual List View Request")
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.BeforeCount, "Before Count"))
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.AfterCount, "After Count"))
+	if c.GreaterThanOrEqual != "" {
+		seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, c.GreaterThanOrEqual, "Greater Than Or Equal"))
+	} else {
+		byOffset := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "By Offset")
+		byOffset.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.Offset, "Offset"))
+		byOffset.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.ContentCount, "Content Count"))
+		seq.AppendChild(byOffset)
+	}
+	if len(c.ContextID) > 0 {
+		seq.AppendChild(newOctetString(c.ContextID, "Context ID"))
+	}
+
+	packet.AppendChild(newControlValue(ControlTypeVirtualListView, seq))
+	return packet
+}
+
+// String returns a human-readable description
+func (c *ControlVirtualListView) String() string {
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t  BeforeCount: %d  AfterCount: %d  Offset: %d  ContentCount: %d  GreaterThanOrEqual: %q  ContextID: %q",
+		ControlTypeMap[ControlTypeVirtualListView],
+		ControlTypeVirtualListView,
+		c.Criticality,
+		c.BeforeCount,
+		c.AfterCount,
+		c.Offset,
+		c.ContentCount,
+		c.GreaterThanOrEqual,
+		c.ContextID)
+}
+
+// ControlVirtualListViewResult implements the response control described in https://tools.ietf.org/html/draft-ietf-ldapext-ldapv3-vlv-09
+type ControlVirtualListViewResult struct {
+	// TargetPosition is the position of the target entry, starting at 1
+	TargetPosition int64
+	// ContentCount is the server estimate of the number of entries
+	ContentCount int64
+	// Result is the LDAP result code of the list view
+	Result int64
+	// ContextID is an opaque value to send with the next request
+	ContextID []byte
+}
+
+// GetControlType returns the OID
+func (c *ControlVirtualListViewResult) GetControlType() string {
+	return ControlTypeVirtualListViewResult
+}
+
+// Encode returns the ber packet representation
+func (c *ControlVirtualListViewResult) Encode() *ber.Packet {
+	packet := newControlPacket(ControlTypeVirtualListViewResult, false)
+
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Virtual List View Response")
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.TargetPosition, "Target Position"))
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.ContentCount, "Content Count"))
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, c.Result, "Virtual List View Result"))
+	if len(c.ContextID) > 0 {
+		seq.AppendChild(newOctetString(c.ContextID, "Context ID"))
+	}
+
+	packet.AppendChild(newControlValue(ControlTypeVirtualListViewResult, seq))
+	return packet
+}
+
+// String returns a human-readable description
+func (c *ControlVirtualListViewResult) String() string {
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t  TargetPosition: %d  ContentCount: %d  Result: %d  ContextID: %q",
+		ControlTypeMap[ControlTypeVirtualListViewResult],
+		ControlTypeVirtualListViewResult,
+		false,
+		c.TargetPosition,
+		c.ContentCount,
+		c.Result,
+		c.ContextID)
+}
+
+// ControlAttributeScopedQuery implements the request control described in https://msdn.microsoft.com/en-us/library/cc223322.aspx
+// The search is performed against the objects named by the DN-valued
+// SourceAttribute of the base object, e.g. the members of a group.
+type ControlAttributeScopedQuery struct {
+	// Criticality indicates if this control is required
+	Criticality bool
+	// SourceAttribute is the DN-valued attribute of the base object to
+	// search the values of
+	SourceAttribute string
+}
+
+// GetControlType returns the OID
+func (c *ControlAttributeScopedQuery) GetControlType() string {
+	return ControlTypeAttributeScopedQuery
+}
+
+// Encode returns the ber packet representation
+func (c *ControlAttributeScopedQuery) Encode() *ber.Packet {
+	packet := newControlPacket(ControlTypeAttributeScopedQuery, c.Criticality)
+
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute Scoped Query Request")
+	seq.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, c.SourceAttribute, "Source Attribute"))
+
+	packet.AppendChild(newControlValue(ControlTypeAttributeScopedQuery, seq))
+	return packet
+}
+
+// String returns a human-readable description
+func (c *ControlAttributeScopedQuery) String() string {
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t  SourceAttribute: %s",
+		ControlTypeMap[ControlTypeAttributeScopedQuery],
+		ControlTypeAttributeScopedQuery,
+		c.Criticality,
+		c.SourceAttribute)
+}
+
+// NewControlAttributeScopedQuery returns a ControlAttributeScopedQuery control
+func NewControlAttributeScopedQuery(criticality bool, sourceAttribute string) *ControlAttributeScopedQuery {
+	return &ControlAttributeScopedQuery{Criticality: criticality, SourceAttribute: sourceAttribute}
+}
+
+// ControlAttributeScopedQueryResult implements the response control described in https://msdn.microsoft.com/en-us/library/cc223322.aspx
+type ControlAttributeScopedQueryResult struct {
+	// Result is the LDAP result code of the query
+	Result int64
+}
+
+// GetControlType returns the OID
+func (c *ControlAttributeScopedQueryResult) GetControlType() string {
+	return ControlTypeAttributeScopedQuery
+}
+
+// Encode returns the ber packet representation
+func (c *ControlAttributeScopedQueryResult) Encode() *ber.Packet {
+	packet := newControlPacket(ControlTypeAttributeScopedQuery, false)
+
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute Scoped Query Response")
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, c.Result, "Result"))
+
+	packet.AppendChild(newControlValue(ControlTypeAttributeScopedQuery, seq))
+	return packet
+}
+
+// String returns a human-readable description
+func (c *ControlAttributeScopedQueryResult) String() string {
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t  Result: %d",
+		ControlTypeMap[ControlTypeAttributeScopedQuery],
+		ControlTypeAttributeScopedQuery,
+		false,
+		c.Result)
+}
+
+// ControlDirSync implements the control described in https://msdn.microsoft.com/en-us/library/cc223347.aspx
+// The same control is returned by the server, with Flags telling whether
+// more results are left and the Cookie to send with the next request.
+type ControlDirSync struct {
+	// Criticality indicates if this control is required
+	Criticality bool
+	// Flags are the DirSync* flags of the request, or the MoreResults value
+	// of the response
+	Flags int64
+	// MaxAttrCount is the maximum number of attribute values returned in
+	// the response
+	MaxAttrCount int64
+	// Cookie is an opaque value tracking the changes already returned
+	Cookie []byte
+}
+
+// GetControlType returns the OID
+func (c *ControlDirSync) GetControlType() string {
+	return ControlTypeDirSync
+}
+
+// Encode returns the ber packet representation
+func (c *ControlDirSync) Encode() *ber.Packet {
+	packet := newControlPacket(ControlTypeDirSync, c.Criticality)
+
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "DirSync Control Value")
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.Flags, "Flags"))
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.MaxAttrCount, "Max Attribute Count"))
+	seq.AppendChild(newOctetString(c.Cookie, "Cookie"))
+
+	packet.AppendChild(newControlValue(ControlTypeDirSync, seq))
+	return packet
+}
+
+// String returns a human-readable description
+func (c *ControlDirSync) String() string {
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t  Flags: %#x  MaxAttrCount: %d  Cookie: %q",
+		ControlTypeMap[ControlTypeDirSync],
+		ControlTypeDirSync,
+		c.Criticality,
+		c.Flags,
+		c.MaxAttrCount,
+		c.Cookie)
+}
+
+// MoreResults reports whether the server has more changes to return when
+// the control is received in a response
+func (c *ControlDirSync) MoreResults() bool {
+	return c.Flags != 0
+}
+
+// SetCookie stores the given cookie in the DirSync control
+func (c *ControlDirSync) SetCookie(cookie []byte) {
+	c.Cookie = cookie
+}
+
+// NewControlDirSync returns a ControlDirSync control. DirSync has to be
+// critical for Active Directory to honour it.
+func NewControlDirSync(flags int64, maxAttrCount int64, cookie []byte) *ControlDirSync {
+	return &ControlDirSync{Criticality: true, Flags: flags, MaxAttrCount: maxAttrCount, Cookie: cookie}
+}
+
+// ControlShowDeleted implements the control described in https://msdn.microsoft.com/en-us/library/cc223326.aspx
+type ControlShowDeleted struct {
+	// Criticality indicates if this control is required
+	Criticality bool
+}
+
+// GetControlType returns the OID
+func (c *ControlShowDeleted) GetControlType() string {
+	return ControlTypeShowDeleted
+}
+
+// Encode returns the ber packet representation
+func (c *ControlShowDeleted) Encode() *ber.Packet {
+	return newControlPacket(ControlTypeShowDeleted, c.Criticality)
+}
+
+// String returns a human-readable description
+func (c *ControlShowDeleted) String() string {
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t",
+		ControlTypeMap[ControlTypeShowDeleted],
+		ControlTypeShowDeleted,
+		c.Criticality)
+}
+
+// NewControlShowDeleted returns a ControlShowDeleted control
+func NewControlShowDeleted(criticality bool) *ControlShowDeleted {
+	return &ControlShowDeleted{Criticality: criticality}
+}
+
+// ControlExtendedDN implements the control described in https://msdn.microsoft.com/en-us/library/cc223349.aspx
+// DNs are returned as <GUID=...>;<SID=...>;distinguishedName.
+type ControlExtendedDN struct {
+	// Criticality indicates if this control is required
+	Criticality bool
+	// Flag is ExtendedDNHexFormat or ExtendedDNStringFormat
+	Flag int64
+}
+
+// GetControlType returns the OID
+func (c *ControlExtendedDN) GetControlType() string {
+	return ControlTypeExtendedDN
+}
+
+// Encode returns the ber packet representation
+func (c *ControlExtendedDN) Encode() *ber.Packet {
+	packet := newControlPacket(ControlTypeExtendedDN, c.Criticality)
+
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Extended DN Request Value")
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.Flag, "Flag"))
+
+	packet.AppendChild(newControlValue(ControlTypeExtendedDN, seq))
+	return packet
+}
+
+// String returns a human-readable description
+func (c *ControlExtendedDN) String() string {
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t  Flag: %d",
+		ControlTypeMap[ControlTypeExtendedDN],
+		ControlTypeExtendedDN,
+		c.Criticality,
+		c.Flag)
+}
+
+// NewControlExtendedDN returns a ControlExtendedDN control
+func NewControlExtendedDN(criticality bool, flag int64) *ControlExtendedDN {
+	return &ControlExtendedDN{Criticality: criticality, Flag: flag}
+}
+
+// ControlDomainScope implements the control described in https://msdn.microsoft.com/en-us/library/cc223323.aspx
+// The server does not return referrals to other domains.
+type ControlDomainScope struct {
+	// Criticality indicates if this control is required
+	Criticality bool
+}
+
+// GetControlType returns the OID
+func (c *ControlDomainScope) GetControlType() string {
+	return ControlTypeDomainScope
+}
+
+// Encode returns the ber packet representation
+func (c *ControlDomainScope) Encode() *ber.Packet {
+	return newControlPacket(ControlTypeDomainScope, c.Criticality)
+}
+
+// String returns a human-readable description
+func (c *ControlDomainScope) String() string {
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t",
+		ControlTypeMap[ControlTypeDomainScope],
+		ControlTypeDomainScope,
+		c.Criticality)
+}
+
+// NewControlDomainScope returns a ControlDomainScope control
+func NewControlDomainScope(criticality bool) *ControlDomainScope {
+	return &ControlDomainScope{Criticality: criticality}
+}
+
 // FindControl returns the first control of the given type in the list, or nil
 func FindControl(controls []Control, controlType string) Control {
 	for _, c := range controls {
@@ -377,6 +937,109 @@ func DecodeControl(packet *ber.Packet) Control {
 		value.Value = c.Expire
 
 		return c
+	case ControlTypeServerSideSort:
+		seq := decodeControlValue(value)
+		if seq == nil {
+			return nil
+		}
+		c := NewControlServerSideSort(Criticality, nil)
+		for _, child := range seq.Children {
+			if len(child.Children) == 0 {
+				return nil
+			}
+			key := &SortKey{AttributeType: child.Children[0].Data.String()}
+			for _, option := range child.Children[1:] {
+				switch option.Tag {
+				case 0:
+					key.OrderingRule = option.Data.String()
+				case 1:
+					key.Reverse = option.Data.Len() > 0 && option.Data.Bytes()[0] != 0
+				}
+			}
+			c.SortKeys = append(c.SortKeys, key)
+		}
+		return c
+	case ControlTypeServerSideSortResult:
+		seq := decodeControlValue(value)
+		if seq == nil || len(seq.Children) == 0 {
+			return nil
+		}
+		c := &ControlServerSideSortResult{Result: packetInt64(seq.Children[0])}
+		if len(seq.Children) > 1 {
+			c.AttributeType = seq.Children[1].Data.String()
+		}
+		return c
+	case ControlTypeVirtualListView:
+		seq := decodeControlValue(value)
+		if seq == nil || len(seq.Children) < 3 {
+			return nil
+		}
+		c := &ControlVirtualListView{
+			Criticality: Criticality,
+			BeforeCount: packetInt64(seq.Children[0]),
+			AfterCount:  packetInt64(seq.Children[1]),
+		}
+		target := seq.Children[2]
+		switch target.Tag {
+		case 0:
+			if len(target.Children) != 2 {
+				return nil
+			}
+			c.Offset = packetInt64(target.Children[0])
+			c.ContentCount = packetInt64(target.Children[1])
+		case 1:
+			c.GreaterThanOrEqual = target.Data.String()
+		}
+		if len(seq.Children) > 3 {
+			c.ContextID = packetBytes(seq.Children[3])
+		}
+		return c
+	case ControlTypeVirtualListViewResult:
+		seq := decodeControlValue(value)
+		if seq == nil || len(seq.Children) < 3 {
+			return nil
+		}
+		c := &ControlVirtualListViewResult{
+			TargetPosition: packetInt64(seq.Children[0]),
+			ContentCount:   packetInt64(seq.Children[1]),
+			Result:         packetInt64(seq.Children[2]),
+		}
+		if len(seq.Children) > 3 {
+			c.ContextID = packetBytes(seq.Children[3])
+		}
+		return c
+	case ControlTypeAttributeScopedQuery:
+		seq := decodeControlValue(value)
+		if seq == nil || len(seq.Children) == 0 {
+			return nil
+		}
+		// the request names the source attribute, the response holds
+		// the result code
+		if seq.Children[0].Tag == ber.TagEnumerated {
+			return &ControlAttributeScopedQueryResult{Result: packetInt64(seq.Children[0])}
+		}
+		return NewControlAttributeScopedQuery(Criticality, seq.Children[0].Data.String())
+	case ControlTypeDirSync:
+		seq := decodeControlValue(value)
+		if seq == nil || len(seq.Children) != 3 {
+			return nil
+		}
+		return &ControlDirSync{
+			Criticality:  Criticality,
+			Flags:        packetInt64(seq.Children[0]),
+			MaxAttrCount: packetInt64(seq.Children[1]),
+			Cookie:       packetBytes(seq.Children[2]),
+		}
+	case ControlTypeShowDeleted:
+		return NewControlShowDeleted(Criticality)
+	case ControlTypeExtendedDN:
+		c := NewControlExtendedDN(Criticality, ExtendedDNHexFormat)
+		if seq := decodeControlValue(value); seq != nil && len(seq.Children) > 0 {
+			c.Flag = packetInt64(seq.Children[0])
+		}
+		return c
+	case ControlTypeDomainScope:
+		return NewControlDomainScope(Criticality)
 	default:
 		c := new(ControlString)
 		c.ControlType = ControlType
@@ -27,6 +27,70 @@ func TestControlString(t *testing.T) {
 	runControlTest(t, NewControlString("x", false, ""))
 }
 
+func TestControlServerSideSort(t *testing.T) {
+	runControlTest(t, NewControlServerSideSort(true, []*SortKey{{AttributeType: "cn"}}))
+	runControlTest(t, NewControlServerSideSort(false, []*SortKey{
+		{AttributeType: "sn", OrderingRule: "2.5.13.3", Reverse: true},
+		{AttributeType: "givenName", Reverse: true},
+	}))
+	runControlValueTest(t, NewControlServerSideSort(false, []*SortKey{
+		{AttributeType: "sn", OrderingRule: "2.5.13.3", Reverse: true},
+		{AttributeType: "givenName"},
+	}))
+	runControlValueTest(t, &ControlServerSideSortResult{Result: LDAPResultSuccess})
+	runControlValueTest(t, &ControlServerSideSortResult{Result: LDAPResultNoSuchAttribute, AttributeType: "sn"})
+}
+
+func TestControlVirtualListView(t *testing.T) {
+	runControlValueTest(t, &ControlVirtualListView{Criticality: true, BeforeCount: 0, AfterCount: 9, Offset: 1, ContentCount: 0})
+	runControlValueTest(t, &ControlVirtualListView{BeforeCount: 2, AfterCount: 2, GreaterThanOrEqual: "j", ContextID: []byte{0, 1, 2}})
+	runControlValueTest(t, &ControlVirtualListViewResult{TargetPosition: 11, ContentCount: 250, Result: LDAPResultSuccess})
+	runControlValueTest(t, &ControlVirtualListViewResult{TargetPosition: 1, ContentCount: 1, Result: LDAPResultUnwillingToPerform, ContextID: []byte("ctx")})
+}
+
+func TestControlAttributeScopedQuery(t *testing.T) {
+	runControlValueTest(t, NewControlAttributeScopedQuery(true, "member"))
+	runControlValueTest(t, &ControlAttributeScopedQueryResult{Result: LDAPResultSuccess})
+	runControlValueTest(t, &ControlAttributeScopedQueryResult{Result: LDAPResultInvalidAttributeSyntax})
+}
+
+func TestControlDirSync(t *testing.T) {
+	runControlValueTest(t, NewControlDirSync(DirSyncObjectSecurity|DirSyncAncestorsFirstOrder, 1000, nil))
+	runControlValueTest(t, NewControlDirSync(0, 0, []byte{0x4d, 0x53, 0x44, 0x53, 0x00, 0xff}))
+
+	response := &ControlDirSync{Flags: 1, Cookie: []byte("next")}
+	runControlValueTest(t, response)
+	if !response.MoreResults() {
+		t.Errorf("expected more results")
+	}
+}
+
+func TestControlShowDeleted(t *testing.T) {
+	runControlValueTest(t, NewControlShowDeleted(true))
+	runControlValueTest(t, NewControlShowDeleted(false))
+}
+
+func TestControlExtendedDN(t *testing.T) {
+	runControlValueTest(t, NewControlExtendedDN(false, ExtendedDNHexFormat))
+	runControlValueTest(t, NewControlExtendedDN(true, ExtendedDNStringFormat))
+}
+
+func TestControlDomainScope(t *testing.T) {
+	runControlValueTest(t, NewControlDomainScope(true))
+	runControlValueTest(t, NewControlDomainScope(false))
+}
+
+// runControlValueTest runs runControlTest and checks that the control
+// decoded from the wire bytes has the fields of the original control
+func runControlValueTest(t *testing.T, originalControl Control) {
+	runControlTest(t, originalControl)
+
+	fromBytes := DecodeControl(ber.DecodePacket(originalControl.Encode().Bytes()))
+	if !reflect.DeepEqual(originalControl, fromBytes) {
+		t.Errorf("decoded %s, expected %s", fromBytes, originalControl)
+	}
+}
+
 func runControlTest(t *testing.T, originalControl Control) {
 	header := ""
 	if callerpc, _, line, ok := runtime.Caller(1); ok {
@@ -74,6 +138,18 @@ func TestDescribeControlString(t *testing.T) {
 	runAddControlDescriptions(t, NewControlString("x", false, ""), "Control Type ()", "Control Value")
 }
 
+func TestDescribeControlServerSideSort(t *testing.T) {
+	runAddControlDescriptions(t, NewControlServerSideSort(true, []*SortKey{{AttributeType: "cn"}}), "Control Type (Server Side Sort)", "Criticality", "Control Value (Server Side Sort)")
+}
+
+func TestDescribeControlDirSync(t *testing.T) {
+	runAddControlDescriptions(t, NewControlDirSync(0, 0, nil), "Control Type (DirSync)", "Criticality", "Control Value (DirSync)")
+}
+
+func TestDescribeControlShowDeleted(t *testing.T) {
+	runAddControlDescriptions(t, NewControlShowDeleted(false), "Control Type (Show Deleted)")
+}
+
 func runAddControlDescriptions(t *testing.T, originalControl Control, childDescriptions ...string) {
 	header := ""
 	if callerpc, _, line, ok := runtime.Caller(1); ok {
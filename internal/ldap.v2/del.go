@@ -6,6 +6,7 @@
 package ldap
 
 import (
+	"context"
 	"errors"
 	"log"
 
@@ -37,6 +38,11 @@ func NewDelRequest(DN string,
 
 // Del executes the given delete request
 func (l *Conn) Del(delRequest *DelRequest) error {
+	return l.DelContext(context.Background(), delRequest)
+}
+
+// DelContext is like Del, but gives up when ctx is done
+func (l *Conn) DelContext(ctx context.Context, delRequest *DelRequest) error {
 	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
 	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
 	packet.AppendChild(delRequest.encode())
@@ -46,18 +52,14 @@ func (l *Conn) Del(delRequest *DelRequest) error {
 
 	l.Debug.PrintPacket(packet)
 
-	msgCtx, err := l.sendMessage(packet)
+	msgCtx, err := l.sendMessageContext(ctx, packet)
 	if err != nil {
 		return err
 	}
 	defer l.finishMessage(msgCtx)
 
 	l.Debug.Printf("%d: waiting for response", msgCtx.id)
-	packetResponse, ok := <-msgCtx.responses
-	if !ok {
-		return NewError(ErrorNetwork, errors.New("ldap: response channel closed"))
-	}
-	packet, err = packetResponse.ReadPacket()
+	packet, err = l.readPacket(ctx, msgCtx)
 	l.Debug.Printf("%d: got response %p", msgCtx.id, packet)
 	if err != nil {
 		return err
@@ -47,6 +47,10 @@ const (
 	LDAPResultObjectClassModsProhibited    = 69
 	LDAPResultAffectsMultipleDSAs          = 71
 	LDAPResultOther                        = 80
+	LDAPResultCanceled                     = 118
+	LDAPResultNoSuchOperation              = 119
+	LDAPResultTooLate                      = 120
+	LDAPResultCannotCancel                 = 121
 
 	ErrorNetwork            = 200
 	ErrorFilterCompile      = 201
@@ -54,6 +58,7 @@ const (
 	ErrorDebugging          = 203
 	ErrorUnexpectedMessage  = 204
 	ErrorUnexpectedResponse = 205
+	ErrorCanceled           = 206
 )
 
 // LDAPResultCodeMap contains string descriptions for LDAP error codes
@@ -97,6 +102,10 @@ var LDAPResultCodeMap = map[uint8]string{
 	LDAPResultObjectClassModsProhibited:    "Object Class Mods Prohibited",
 	LDAPResultAffectsMultipleDSAs:          "Affects Multiple DSAs",
 	LDAPResultOther:                        "Other",
+	LDAPResultCanceled:                     "Canceled",
+	LDAPResultNoSuchOperation:              "No Such Operation",
+	LDAPResultTooLate:                      "Too Late",
+	LDAPResultCannotCancel:                 "Cannot Cancel",
 
 	ErrorNetwork:            "Network Error",
 	ErrorFilterCompile:      "Filter Compile Error",
@@ -104,6 +113,7 @@ var LDAPResultCodeMap = map[uint8]string{
 	ErrorDebugging:          "Debugging Error",
 	ErrorUnexpectedMessage:  "Unexpected Message",
 	ErrorUnexpectedResponse: "Unexpected Response",
+	ErrorCanceled:           "Canceled",
 }
 
 func getLDAPResultCode(packet *ber.Packet) (code uint8, description string) {
@@ -116,7 +126,11 @@ func getLDAPResultCode(packet *ber.Packet) (code uint8, description string) {
 		}
 		if response.ClassType == ber.ClassApplication && response.TagType == ber.TypeConstructed && len(response.Children) >= 3 {
 			// Children[1].Children[2] is the diagnosticMessage which is guaranteed to exist as seen here: https://tools.ietf.org/html/rfc4511#section-4.1.9
-			return uint8(response.Children[0].Value.(int64)), response.Children[2].Value.(string)
+			code, ok := response.Children[0].Value.(int64)
+			if !ok {
+				return ErrorUnexpectedResponse, "Invalid result code"
+			}
+			return uint8(code), response.Children[2].Data.String()
 		}
 	}
 
@@ -0,0 +1,195 @@
+// File contains the generic extended operation functionality
+//
+// https://tools.ietf.org/html/rfc4511#section-4.12
+//
+//         ExtendedRequest ::= [APPLICATION 23] SEQUENCE {
+//              requestName      [0] LDAPOID,
+//              requestValue     [1] OCTET STRING OPTIONAL }
+//
+//         ExtendedResponse ::= [APPLICATION 24] SEQUENCE {
+//              COMPONENTS OF LDAPResult,
+//              responseName     [10] LDAPOID OPTIONAL,
+//              responseValue    [11] OCTET STRING OPTIONAL }
+//
+//         IntermediateResponse ::= [APPLICATION 25] SEQUENCE {
+//              responseName     [0] LDAPOID OPTIONAL,
+//              responseValue    [1] OCTET STRING OPTIONAL }
+//
+// https://tools.ietf.org/html/rfc4511#section-4.4
+//
+// Unsolicited notifications are extended responses with a message ID of
+// zero. The Notice of Disconnection is sent by the server right before it
+// closes the connection.
+
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gopkg.in/asn1-ber.v1"
+)
+
+// NoticeOfDisconnectionOID is the response name of the unsolicited
+// notification sent by a server which is about to close the connection
+const NoticeOfDisconnectionOID = "1.3.6.1.4.1.1466.20036"
+
+// IntermediateResponse holds an intermediate response returned by the
+// server before the final response of an extended operation
+type IntermediateResponse struct {
+	// Name is the OID of the response, if present
+	Name string
+	// Value is the response value, if present
+	Value []byte
+}
+
+// ExtendedResult holds the server response to an extended operation, or an
+// unsolicited notification
+type ExtendedResult struct {
+	// ResultCode and Message are the LDAP result of the operation
+	ResultCode uint8
+	Message    string
+	// Name is the OID of the response, if present
+	Name string
+	// Value is the response value, if present
+	Value []byte
+	// Intermediates are the intermediate responses received before the
+	// final response
+	Intermediates []*IntermediateResponse
+	// Controls are the response controls
+	Controls []Control
+}
+
+// NotificationHandler is called with the unsolicited notifications received
+// on the connection. It is called from the goroutine reading responses, so
+// it must neither block nor send requests on the connection.
+type NotificationHandler func(notification *ExtendedResult)
+
+// SetNotificationHandler sets the handler of unsolicited notifications.
+// Whatever the handler, the connection is closed after a Notice of
+// Disconnection, failing the outstanding requests with the result code of
+// the notice.
+func (l *Conn) SetNotificationHandler(handler NotificationHandler) {
+	l.notificationHandler.Store(handler)
+}
+
+// Extended performs the extended operation with the given OID. value is the
+// BER encoded request value, or nil if the operation takes none.
+func (l *Conn) Extended(oid string, value []byte) (*ExtendedResult, error) {
+	return l.ExtendedContext(context.Background(), oid, value)
+}
+
+// ExtendedContext is like Extended, but gives up when ctx is done
+func (l *Conn) ExtendedContext(ctx context.Context, oid string, value []byte) (*ExtendedResult, error) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationExtendedRequest, nil, "Extended Request")
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, oid, "Extended Request Name"))
+	if value != nil {
+		requestValue := ber.Encode(ber.ClassContext, ber.TypePrimitive, 1, nil, "Extended Request Value")
+		requestValue.Data.Write(value)
+		request.AppendChild(requestValue)
+	}
+	packet.AppendChild(request)
+
+	l.Debug.PrintPacket(packet)
+
+	msgCtx, err := l.sendMessageContext(ctx, packet)
+	if err != nil {
+		return nil, err
+	}
+	defer l.finishMessage(msgCtx)
+
+	result := &ExtendedResult{}
+	for {
+		l.Debug.Printf("%d: waiting for response", msgCtx.id)
+		packet, err = l.readPacket(ctx, msgCtx)
+		l.Debug.Printf("%d: got response %p", msgCtx.id, packet)
+		if err != nil {
+			return result, err
+		}
+
+		if packet == nil {
+			return result, NewError(ErrorNetwork, errors.New("ldap: could not retrieve message"))
+		}
+
+		if l.Debug {
+			if err := addLDAPDescriptions(packet); err != nil {
+				return result, err
+			}
+			ber.PrintPacket(packet)
+		}
+
+		switch packet.Children[1].Tag {
+		case ApplicationIntermediateResponse:
+			result.Intermediates = append(result.Intermediates, decodeIntermediateResponse(packet.Children[1]))
+		case ApplicationExtendedResponse:
+			decodeExtendedResponse(packet, result)
+			if result.ResultCode != LDAPResultSuccess {
+				return result, NewError(result.ResultCode, errors.New(result.Message))
+			}
+			return result, nil
+		default:
+			return result, NewError(ErrorUnexpectedResponse, fmt.Errorf("Unexpected Response: %d", packet.Children[1].Tag))
+		}
+	}
+}
+
+// decodeExtendedResponse stores the result, name, value and controls of an
+// extended response packet in result
+func decodeExtendedResponse(packet *ber.Packet, result *ExtendedResult) {
+	result.ResultCode, result.Message = getLDAPResultCode(packet)
+	for _, child := range packet.Children[1].Children {
+		if child.ClassType != ber.ClassContext {
+			continue
+		}
+		switch child.Tag {
+		case 10:
+			result.Name = child.Data.String()
+		case 11:
+			result.Value = append([]byte(nil), child.Data.Bytes()...)
+		}
+	}
+	if len(packet.Children) == 3 {
+		for _, child := range packet.Children[2].Children {
+			if control := DecodeControl(child); control != nil {
+				result.Controls = append(result.Controls, control)
+			}
+		}
+	}
+}
+
+func decodeIntermediateResponse(response *ber.Packet) *IntermediateResponse {
+	intermediate := &IntermediateResponse{}
+	for _, child := range response.Children {
+		switch child.Tag {
+		case 0:
+			intermediate.Name = child.Data.String()
+		case 1:
+			intermediate.Value = append([]byte(nil), child.Data.Bytes()...)
+		}
+	}
+	return intermediate
+}
+
+// handleNotification processes an unsolicited notification and reports
+// whether the server is closing the connection
+func (l *Conn) handleNotification(packet *ber.Packet) bool {
+	if packet.Children[1].Tag != ApplicationExtendedResponse {
+		l.Debug.Printf("Received unexpected unsolicited message %d", packet.Children[1].Tag)
+		return false
+	}
+	notification := &ExtendedResult{}
+	decodeExtendedResponse(packet, notification)
+
+	disconnect := notification.Name == NoticeOfDisconnectionOID
+	if disconnect {
+		l.Debug.Printf("Received notice of disconnection: %s", notification.Message)
+		l.closeErr.Store(NewError(notification.ResultCode, fmt.Errorf("ldap: notice of disconnection: %s", notification.Message)))
+	}
+	if handler, ok := l.notificationHandler.Load().(NotificationHandler); ok && handler != nil {
+		handler(notification)
+	}
+	return disconnect
+}
@@ -0,0 +1,199 @@
+package ldap
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/asn1-ber.v1"
+)
+
+// TestExtendedIntermediateResponses tests that the intermediate responses
+// sent before the final response of an extended operation are returned.
+func TestExtendedIntermediateResponses(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	go func() {
+		packet, err := ptc.ReceiveRequest()
+		if err != nil {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		if request.Tag != ApplicationExtendedRequest || len(request.Children) != 2 ||
+			request.Children[0].Data.String() != "1.2.3.4" || request.Children[1].Data.String() != "request" {
+			ptc.SendResponse(testExtendedResponse(messageID, LDAPResultProtocolError, "", nil))
+			return
+		}
+		for _, value := range []string{"first", "second"} {
+			ptc.SendResponse(testIntermediateResponse(messageID, "1.2.3.5", value))
+		}
+		ptc.SendResponse(testExtendedResponse(messageID, LDAPResultSuccess, "1.2.3.6", []byte("response")))
+	}()
+
+	var (
+		result *ExtendedResult
+		err    error
+	)
+	runWithTimeout(t, time.Second, func() {
+		result, err = conn.Extended("1.2.3.4", []byte("request"))
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.Name != "1.2.3.6" || string(result.Value) != "response" {
+		t.Errorf("got response %q %q", result.Name, result.Value)
+	}
+	if len(result.Intermediates) != 2 {
+		t.Fatalf("got %d intermediate responses, expected 2", len(result.Intermediates))
+	}
+	for i, value := range []string{"first", "second"} {
+		if result.Intermediates[i].Name != "1.2.3.5" || string(result.Intermediates[i].Value) != value {
+			t.Errorf("intermediate response %d: got %q %q", i, result.Intermediates[i].Name, result.Intermediates[i].Value)
+		}
+	}
+}
+
+func TestWhoAmI(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	go func() {
+		packet, err := ptc.ReceiveRequest()
+		if err != nil {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		if len(request.Children) != 1 || request.Children[0].Data.String() != whoAmIOID {
+			ptc.SendResponse(testExtendedResponse(messageID, LDAPResultProtocolError, "", nil))
+			return
+		}
+		ptc.SendResponse(testExtendedResponse(messageID, LDAPResultSuccess, "", []byte("u:EXAMPLE\\squid")))
+	}()
+
+	runWithTimeout(t, time.Second, func() {
+		authzID, err := conn.WhoAmI()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if authzID != "u:EXAMPLE\\squid" {
+			t.Errorf("got authorization identity %q", authzID)
+		}
+	})
+}
+
+func TestCancel(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	cancelIDs := make(chan int64, 1)
+	go func() {
+		packet, err := ptc.ReceiveRequest()
+		if err != nil {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		if len(request.Children) == 2 && request.Children[0].Data.String() == cancelOID {
+			value := ber.DecodePacket(request.Children[1].Data.Bytes())
+			if len(value.Children) == 1 {
+				cancelIDs <- value.Children[0].Value.(int64)
+			}
+		}
+		ptc.SendResponse(testExtendedResponse(messageID, LDAPResultTooLate, "", nil))
+	}()
+
+	runWithTimeout(t, time.Second, func() {
+		if err := conn.Cancel(42); !IsErrorWithCode(err, LDAPResultTooLate) {
+			t.Errorf("expected LDAPResultTooLate, got %v", err)
+		}
+		if id := <-cancelIDs; id != 42 {
+			t.Errorf("canceled message ID %d, expected 42", id)
+		}
+	})
+}
+
+// TestNoticeOfDisconnection tests that a Notice of Disconnection fails the
+// outstanding requests and closes the connection.
+func TestNoticeOfDisconnection(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	notifications := make(chan *ExtendedResult, 1)
+	conn.SetNotificationHandler(func(notification *ExtendedResult) {
+		notifications <- notification
+	})
+	conn.Start()
+	defer conn.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Search(NewSearchRequest("dc=example,dc=com", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(uid=jdoe)", nil, nil))
+		errs <- err
+	}()
+
+	runWithTimeout(t, time.Second, func() {
+		if _, err := ptc.ReceiveRequest(); err != nil {
+			t.Fatalf("receiveRequest failed: %v", err)
+		}
+	})
+	ptc.SendResponse(testExtendedResponse(0, LDAPResultUnavailable, NoticeOfDisconnectionOID, nil))
+
+	runWithTimeout(t, time.Second, func() {
+		if err := <-errs; !IsErrorWithCode(err, LDAPResultUnavailable) {
+			t.Errorf("expected the outstanding search to fail with LDAPResultUnavailable, got %v", err)
+		}
+		notification := <-notifications
+		if notification.Name != NoticeOfDisconnectionOID || notification.ResultCode != LDAPResultUnavailable {
+			t.Errorf("got notification %q with result %d", notification.Name, notification.ResultCode)
+		}
+	})
+	if !conn.IsClosing() {
+		t.Errorf("connection is not closed after a notice of disconnection")
+	}
+}
+
+func testExtendedResponse(messageID int64, resultCode uint8, name string, value []byte) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationExtendedResponse, nil, "Extended Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(resultCode), "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	if name != "" {
+		response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, name, "Response Name"))
+	}
+	if value != nil {
+		responseValue := ber.Encode(ber.ClassContext, ber.TypePrimitive, 11, nil, "Response Value")
+		responseValue.Data.Write(value)
+		response.AppendChild(responseValue)
+	}
+	packet.AppendChild(response)
+	return packet
+}
+
+func testIntermediateResponse(messageID int64, name, value string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationIntermediateResponse, nil, "Intermediate Response")
+	response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, name, "Response Name"))
+	responseValue := ber.Encode(ber.ClassContext, ber.TypePrimitive, 1, nil, "Response Value")
+	responseValue.Data.WriteString(value)
+	response.AppendChild(responseValue)
+	packet.AppendChild(response)
+	return packet
+}
@@ -34,6 +34,7 @@ const (
 	ApplicationSearchResultReference = 19
 	ApplicationExtendedRequest       = 23
 	ApplicationExtendedResponse      = 24
+	ApplicationIntermediateResponse  = 25
 )
 
 // ApplicationMap contains human readable descriptions of LDAP Application Codes
@@ -58,6 +59,7 @@ var ApplicationMap = map[uint8]string{
 	ApplicationSearchResultReference: "Search Result Reference",
 	ApplicationExtendedRequest:       "Extended Request",
 	ApplicationExtendedResponse:      "Extended Response",
+	ApplicationIntermediateResponse:  "Intermediate Response",
 }
 
 // Ldap Behera Password Policy Draft 10 (https://tools.ietf.org/html/draft-behera-ldap-password-policy-10)
@@ -145,6 +147,7 @@ func addLDAPDescriptions(packet *ber.Packet) (err error) {
 	case ApplicationExtendedRequest:
 		addRequestDescriptions(packet)
 	case ApplicationExtendedResponse:
+	case ApplicationIntermediateResponse:
 	}
 
 	return nil
@@ -244,6 +247,11 @@ func addControlDescriptions(packet *ber.Packet) {
 					child.Value = val
 				}
 			}
+
+		default:
+			if name, ok := ControlTypeMap[controlType]; ok {
+				value.Description += " (" + name + ")"
+			}
 		}
 	}
 }
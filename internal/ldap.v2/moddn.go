@@ -0,0 +1,108 @@
+// File contains ModifyDN functionality
+//
+// https://tools.ietf.org/html/rfc4511
+//
+// ModifyDNRequest ::= [APPLICATION 12] SEQUENCE {
+//      entry           LDAPDN,
+//      newrdn          RelativeLDAPDN,
+//      deleteoldrdn    BOOLEAN,
+//      newSuperior     [0] LDAPDN OPTIONAL }
+//
+
+package ldap
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"gopkg.in/asn1-ber.v1"
+)
+
+// ModifyDNRequest holds the request to rename or move an entry
+type ModifyDNRequest struct {
+	// DN is the distinguishedName of the directory entry to rename
+	DN string
+	// NewRDN is the new relative distinguished name of the entry
+	NewRDN string
+	// DeleteOldRDN removes the values of the old RDN from the entry
+	DeleteOldRDN bool
+	// NewSuperior is the DN of the new parent of the entry, or empty to
+	// rename the entry in place
+	NewSuperior string
+	// Controls hold optional controls to send with the request
+	Controls []Control
+}
+
+// NewModifyDNRequest creates a request which renames the entry with the
+// given DN to newRDN and moves it under newSuperior, unless newSuperior is
+// empty.
+func NewModifyDNRequest(dn string, newRDN string, deleteOldRDN bool, newSuperior string, controls []Control) *ModifyDNRequest {
+	return &ModifyDNRequest{
+		DN:           dn,
+		NewRDN:       newRDN,
+		DeleteOldRDN: deleteOldRDN,
+		NewSuperior:  newSuperior,
+		Controls:     controls,
+	}
+}
+
+func (m ModifyDNRequest) encode() *ber.Packet {
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationModifyDNRequest, nil, "Modify DN Request")
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, m.DN, "DN"))
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, m.NewRDN, "New RDN"))
+	request.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, m.DeleteOldRDN, "Delete Old RDN"))
+	if m.NewSuperior != "" {
+		request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, m.NewSuperior, "New Superior"))
+	}
+	return request
+}
+
+// ModifyDN renames or moves the entry of the given request
+func (l *Conn) ModifyDN(modifyDNRequest *ModifyDNRequest) error {
+	return l.ModifyDNContext(context.Background(), modifyDNRequest)
+}
+
+// ModifyDNContext is like ModifyDN, but gives up when ctx is done
+func (l *Conn) ModifyDNContext(ctx context.Context, modifyDNRequest *ModifyDNRequest) error {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
+	packet.AppendChild(modifyDNRequest.encode())
+	if modifyDNRequest.Controls != nil {
+		packet.AppendChild(encodeControls(modifyDNRequest.Controls))
+	}
+
+	l.Debug.PrintPacket(packet)
+
+	msgCtx, err := l.sendMessageContext(ctx, packet)
+	if err != nil {
+		return err
+	}
+	defer l.finishMessage(msgCtx)
+
+	l.Debug.Printf("%d: waiting for response", msgCtx.id)
+	packet, err = l.readPacket(ctx, msgCtx)
+	l.Debug.Printf("%d: got response %p", msgCtx.id, packet)
+	if err != nil {
+		return err
+	}
+
+	if l.Debug {
+		if err := addLDAPDescriptions(packet); err != nil {
+			return err
+		}
+		ber.PrintPacket(packet)
+	}
+
+	if packet.Children[1].Tag == ApplicationModifyDNResponse {
+		resultCode, resultDescription := getLDAPResultCode(packet)
+		if resultCode != 0 {
+			return NewError(resultCode, errors.New(resultDescription))
+		}
+	} else {
+		log.Printf("Unexpected Response: %d", packet.Children[1].Tag)
+	}
+
+	l.Debug.Printf("%d: returning", msgCtx.id)
+	return nil
+}
@@ -30,6 +30,7 @@
 package ldap
 
 import (
+	"context"
 	"errors"
 	"log"
 
@@ -72,6 +73,8 @@ type ModifyRequest struct {
 	DeleteAttributes []PartialAttribute
 	// ReplaceAttributes contain the attributes to replace
 	ReplaceAttributes []PartialAttribute
+	// Controls hold optional controls to send with the request
+	Controls []Control
 }
 
 // Add inserts the given attribute to the list of attributes to add
@@ -115,35 +118,41 @@ func (m ModifyRequest) encode() *ber.Packet {
 	return request
 }
 
-// NewModifyRequest creates a modify request for the given DN
+// NewModifyRequest creates a modify request for the given DN and controls
 func NewModifyRequest(
 	dn string,
+	controls []Control,
 ) *ModifyRequest {
 	return &ModifyRequest{
-		DN: dn,
+		DN:       dn,
+		Controls: controls,
 	}
 }
 
 // Modify performs the ModifyRequest
 func (l *Conn) Modify(modifyRequest *ModifyRequest) error {
+	return l.ModifyContext(context.Background(), modifyRequest)
+}
+
+// ModifyContext is like Modify, but gives up when ctx is done
+func (l *Conn) ModifyContext(ctx context.Context, modifyRequest *ModifyRequest) error {
 	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
 	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
 	packet.AppendChild(modifyRequest.encode())
+	if modifyRequest.Controls != nil {
+		packet.AppendChild(encodeControls(modifyRequest.Controls))
+	}
 
 	l.Debug.PrintPacket(packet)
 
-	msgCtx, err := l.sendMessage(packet)
+	msgCtx, err := l.sendMessageContext(ctx, packet)
 	if err != nil {
 		return err
 	}
 	defer l.finishMessage(msgCtx)
 
 	l.Debug.Printf("%d: waiting for response", msgCtx.id)
-	packetResponse, ok := <-msgCtx.responses
-	if !ok {
-		return NewError(ErrorNetwork, errors.New("ldap: response channel closed"))
-	}
-	packet, err = packetResponse.ReadPacket()
+	packet, err = l.readPacket(ctx, msgCtx)
 	l.Debug.Printf("%d: got response %p", msgCtx.id, packet)
 	if err != nil {
 		return err
@@ -0,0 +1,115 @@
+// File contains ranged attribute retrieval functionality
+//
+// Active Directory returns at most MaxValRange values (1500 by default) of a
+// multi-valued attribute like member. The rest has to be requested with
+// attribute options:
+//
+//         member;range=0-*      requests values starting at 0
+//         member;range=0-1499   is returned when more values are left
+//         member;range=1500-*   is returned with the last values
+//
+// https://msdn.microsoft.com/en-us/library/cc223242.aspx
+
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SearchRangedAttribute returns every value of the attribute of the entry
+// with the given DN, following ;range= options until the server returns the
+// last values.
+func (l *Conn) SearchRangedAttribute(dn, attribute string) ([]string, error) {
+	return l.SearchRangedAttributeContext(context.Background(), dn, attribute)
+}
+
+// SearchRangedAttributeContext is like SearchRangedAttribute, but gives up
+// when ctx is done
+func (l *Conn) SearchRangedAttributeContext(ctx context.Context, dn, attribute string) ([]string, error) {
+	var (
+		values    []string
+		requested = attribute
+		low       = 0
+	)
+	for {
+		searchRequest := NewSearchRequest(
+			dn,
+			ScopeBaseObject, NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			[]string{requested},
+			nil,
+		)
+		result, err := l.SearchContext(ctx, searchRequest)
+		if err != nil {
+			return values, err
+		}
+		if len(result.Entries) == 0 {
+			return values, NewError(LDAPResultNoSuchObject, fmt.Errorf("ldap: entry %q not found", dn))
+		}
+
+		var (
+			found bool
+			last  bool
+			high  int
+		)
+		for _, attr := range result.Entries[0].Attributes {
+			name, rangeLow, rangeHigh, ranged, err := ParseRangeOption(attr.Name)
+			if err != nil {
+				return values, NewError(ErrorUnexpectedResponse, err)
+			}
+			if !strings.EqualFold(name, attribute) {
+				continue
+			}
+			values = append(values, attr.Values...)
+			if !ranged {
+				return values, nil
+			}
+			if rangeLow != low {
+				return values, NewError(ErrorUnexpectedResponse, fmt.Errorf("ldap: expected %s values starting at %d, got %s", attribute, low, attr.Name))
+			}
+			found, last, high = true, rangeHigh < 0, rangeHigh
+			break
+		}
+		if !found || last {
+			return values, nil
+		}
+		if high < low {
+			return values, NewError(ErrorUnexpectedResponse, fmt.Errorf("ldap: invalid %s value range %d-%d", attribute, low, high))
+		}
+
+		low = high + 1
+		requested = fmt.Sprintf("%s;range=%d-*", attribute, low)
+	}
+}
+
+// ParseRangeOption splits an attribute description like "member;range=0-1499"
+// into the attribute name and the value range. A high bound of "*" is
+// returned as -1. ranged is false if the description has no range option.
+func ParseRangeOption(description string) (name string, low, high int, ranged bool, err error) {
+	options := strings.Split(description, ";")
+	name = options[0]
+	for _, option := range options[1:] {
+		if !strings.HasPrefix(strings.ToLower(option), "range=") {
+			continue
+		}
+		bounds := strings.SplitN(option[len("range="):], "-", 2)
+		if len(bounds) != 2 {
+			return name, 0, 0, false, errors.New("ldap: invalid range option " + option)
+		}
+		if low, err = strconv.Atoi(bounds[0]); err != nil || low < 0 {
+			return name, 0, 0, false, errors.New("ldap: invalid range option " + option)
+		}
+		if bounds[1] == "*" {
+			return name, low, -1, true, nil
+		}
+		if high, err = strconv.Atoi(bounds[1]); err != nil || high < 0 {
+			return name, 0, 0, false, errors.New("ldap: invalid range option " + option)
+		}
+		return name, low, high, true, nil
+	}
+	return name, 0, 0, false, nil
+}
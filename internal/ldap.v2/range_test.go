@@ -0,0 +1,148 @@
+package ldap
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gopkg.in/asn1-ber.v1"
+)
+
+func TestParseRangeOption(t *testing.T) {
+	tests := []struct {
+		description string
+		name        string
+		low, high   int
+		ranged      bool
+		err         bool
+	}{
+		{description: "member", name: "member"},
+		{description: "member;binary", name: "member"},
+		{description: "member;range=0-1499", name: "member", low: 0, high: 1499, ranged: true},
+		{description: "member;Range=1500-*", name: "member", low: 1500, high: -1, ranged: true},
+		{description: "member;binary;range=10-20", name: "member", low: 10, high: 20, ranged: true},
+		{description: "member;range=1500", err: true},
+		{description: "member;range=a-*", err: true},
+		{description: "member;range=0-b", err: true},
+	}
+
+	for _, test := range tests {
+		name, low, high, ranged, err := ParseRangeOption(test.description)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.description)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.description, err)
+			continue
+		}
+		if name != test.name || low != test.low || high != test.high || ranged != test.ranged {
+			t.Errorf("%q: got %q %d-%d ranged=%v, expected %q %d-%d ranged=%v", test.description, name, low, high, ranged, test.name, test.low, test.high, test.ranged)
+		}
+	}
+}
+
+// TestSearchRangedAttribute tests that every value of a large attribute is
+// retrieved from a server returning at most 1500 values at once.
+func TestSearchRangedAttribute(t *testing.T) {
+	const (
+		dn          = "cn=Domain Users,cn=Users,dc=example,dc=com"
+		maxValRange = 1500
+	)
+	var members []string
+	for i := 0; i < 3700; i++ {
+		members = append(members, fmt.Sprintf("cn=user%d,cn=Users,dc=example,dc=com", i))
+	}
+
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	var requested []string
+	go func() {
+		for {
+			packet, err := ptc.ReceiveRequest()
+			if err != nil {
+				return
+			}
+			messageID := packet.Children[0].Value.(int64)
+			request := packet.Children[1]
+			if request.Tag != ApplicationSearchRequest {
+				continue
+			}
+			attribute := request.Children[7].Children[0].Value.(string)
+			requested = append(requested, attribute)
+
+			_, low, _, _, _ := ParseRangeOption(attribute)
+			high := low + maxValRange - 1
+			name := fmt.Sprintf("member;range=%d-%d", low, high)
+			if high >= len(members)-1 {
+				high = len(members) - 1
+				name = fmt.Sprintf("member;range=%d-*", low)
+			}
+			ptc.SendResponse(testSearchEntry(messageID, dn, name, members[low:high+1]))
+			ptc.SendResponse(testSearchDone(messageID))
+		}
+	}()
+
+	var (
+		values []string
+		err    error
+	)
+	runWithTimeout(t, time.Second, func() {
+		values, err = conn.SearchRangedAttribute(dn, "member")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(values) != len(members) {
+		t.Fatalf("got %d values, expected %d", len(values), len(members))
+	}
+	for i := range members {
+		if values[i] != members[i] {
+			t.Fatalf("value %d: got %q, expected %q", i, values[i], members[i])
+		}
+	}
+	expected := []string{"member", "member;range=1500-*", "member;range=3000-*"}
+	if fmt.Sprint(requested) != fmt.Sprint(expected) {
+		t.Errorf("requested %q, expected %q", requested, expected)
+	}
+}
+
+func testSearchEntry(messageID int64, dn, attribute string, values []string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationSearchResultEntry, nil, "Search Result Entry")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "Object Name"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+	attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute, "Attribute Name"))
+	set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Attribute Values")
+	for _, value := range values {
+		set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Attribute Value"))
+	}
+	attr.AppendChild(set)
+	attributes.AppendChild(attr)
+	entry.AppendChild(attributes)
+	packet.AppendChild(entry)
+	return packet
+}
+
+func testSearchDone(messageID int64, controls ...Control) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	done := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationSearchResultDone, nil, "Search Result Done")
+	done.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(LDAPResultSuccess), "Result Code"))
+	done.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	done.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	packet.AppendChild(done)
+	if len(controls) > 0 {
+		packet.AppendChild(encodeControls(controls))
+	}
+	return packet
+}
@@ -0,0 +1,278 @@
+// File contains referral chasing functionality
+//
+// https://tools.ietf.org/html/rfc4511#section-4.1.10
+//
+//         Referral ::= SEQUENCE SIZE (1..MAX) OF uri URI
+//
+//         SearchResultReference ::= [APPLICATION 19] SEQUENCE
+//                                   SIZE (1..MAX) OF uri URI
+//
+// https://tools.ietf.org/html/rfc4516
+//
+//         ldapurl = scheme "://" [host [":" port] ] ["/" dn ["?" [attributes] ["?" [scope] ["?" [filter] ["?" extensions]]]]]
+
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/asn1-ber.v1"
+)
+
+// DefaultReferralHopLimit is the number of referrals followed in a row when
+// ReferralConfig.HopLimit is not set
+const DefaultReferralHopLimit = 10
+
+// ReferralConfig configures how referrals are followed
+type ReferralConfig struct {
+	// HopLimit is the number of referrals followed in a row
+	HopLimit int
+	// Username and Password are used to bind to the referred servers. The
+	// referred servers are searched anonymously if Username is empty.
+	Username string
+	Password string
+	// TLSConfig is used to connect to ldaps:// referrals. ServerName is set
+	// to the host of the referral if empty.
+	TLSConfig *tls.Config
+	// Timeout is set on the connections to the referred servers
+	Timeout time.Duration
+	// Hosts are the hosts referrals are followed to, as host names or
+	// addresses, or DNS domains matching the host names under them.
+	// Referrals are followed to any host if empty.
+	Hosts []string
+	// InsecureBind sends Username and Password to the referred servers over
+	// plain LDAP or over TLS without certificate verification. The bind to
+	// such servers is refused otherwise.
+	InsecureBind bool
+}
+
+// allowsHost reports whether referrals may be followed to the host
+func (config *ReferralConfig) allowsHost(host string) bool {
+	if len(config.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range config.Hosts {
+		allowed = strings.ToLower(strings.Trim(allowed, "."))
+		if allowed != "" && (host == allowed || strings.HasSuffix(host, "."+allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// referral is a parsed LDAP URL of a referral
+type referral struct {
+	host   string
+	addr   string
+	useTLS bool
+	baseDN string
+	// scope is -1 if the URL does not contain one
+	scope int
+}
+
+// parseReferral parses an LDAP URL returned as a referral
+func parseReferral(uri string) (*referral, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &referral{scope: -1}
+	port := "389"
+	switch strings.ToLower(u.Scheme) {
+	case "ldap":
+	case "ldaps":
+		r.useTLS = true
+		port = "636"
+	default:
+		return nil, fmt.Errorf("ldap: unsupported referral %q", uri)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("ldap: referral %q has no host", uri)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	r.host = u.Hostname()
+	r.addr = net.JoinHostPort(r.host, port)
+	r.baseDN = strings.TrimPrefix(u.Path, "/")
+
+	parts := strings.Split(u.RawQuery, "?")
+	if len(parts) > 1 {
+		switch strings.ToLower(parts[1]) {
+		case "base":
+			r.scope = ScopeBaseObject
+		case "one":
+			r.scope = ScopeSingleLevel
+		case "sub":
+			r.scope = ScopeWholeSubtree
+		}
+	}
+	return r, nil
+}
+
+// getReferralURIs returns the URIs of the referral field of an LDAPResult
+func getReferralURIs(packet *ber.Packet) []string {
+	var uris []string
+	if len(packet.Children) < 2 {
+		return uris
+	}
+	for _, child := range packet.Children[1].Children {
+		if child.ClassType != ber.ClassContext || child.Tag != 3 {
+			continue
+		}
+		for _, uri := range child.Children {
+			uris = append(uris, uri.Data.String())
+		}
+	}
+	return uris
+}
+
+func referralKey(addr, baseDN string, scope int) string {
+	return fmt.Sprintf("%s/%s?%d", strings.ToLower(addr), strings.ToLower(baseDN), scope)
+}
+
+// SearchWithReferrals performs the given search request and follows the
+// referrals returned by the server, merging the entries found on the
+// referred servers into the result. Search continuation references that
+// cannot be followed are returned in the Referrals of the result.
+func (l *Conn) SearchWithReferrals(searchRequest *SearchRequest, config *ReferralConfig) (*SearchResult, error) {
+	return l.SearchWithReferralsContext(context.Background(), searchRequest, config)
+}
+
+// SearchWithReferralsContext is like SearchWithReferrals, but gives up when
+// ctx is done
+func (l *Conn) SearchWithReferralsContext(ctx context.Context, searchRequest *SearchRequest, config *ReferralConfig) (*SearchResult, error) {
+	if config == nil {
+		config = &ReferralConfig{}
+	}
+	visited := map[string]bool{}
+	if addr := l.conn.RemoteAddr(); addr != nil {
+		visited[referralKey(addr.String(), searchRequest.BaseDN, searchRequest.Scope)] = true
+	}
+	return l.searchWithReferrals(ctx, searchRequest, config, visited, 0)
+}
+
+func (l *Conn) searchWithReferrals(ctx context.Context, searchRequest *SearchRequest, config *ReferralConfig, visited map[string]bool, hops int) (*SearchResult, error) {
+	result, err := l.SearchContext(ctx, searchRequest)
+	if err != nil {
+		if IsErrorWithCode(err, LDAPResultReferral) && result != nil && len(result.Referrals) > 0 {
+			return followReferral(ctx, result.Referrals, searchRequest, config, visited, hops, false)
+		}
+		return result, err
+	}
+
+	references := result.Referrals
+	result.Referrals = make([]string, 0)
+	for _, uri := range references {
+		referred, err := followReferral(ctx, []string{uri}, searchRequest, config, visited, hops, true)
+		if err != nil {
+			if ctx.Err() != nil {
+				return result, NewError(ErrorCanceled, ctx.Err())
+			}
+			l.Debug.Printf("Cannot follow referral %s: %s", uri, err)
+			result.Referrals = append(result.Referrals, uri)
+			continue
+		}
+		result.Entries = append(result.Entries, referred.Entries...)
+		result.Referrals = append(result.Referrals, referred.Referrals...)
+	}
+	return result, nil
+}
+
+// followReferral searches the first reachable server of the referral URIs.
+// A continuation reference to a server and base that has already been
+// searched yields an empty result, while a referral loop is an error.
+func followReferral(ctx context.Context, uris []string, searchRequest *SearchRequest, config *ReferralConfig, visited map[string]bool, hops int, continuation bool) (*SearchResult, error) {
+	hopLimit := config.HopLimit
+	if hopLimit <= 0 {
+		hopLimit = DefaultReferralHopLimit
+	}
+	if hops >= hopLimit {
+		return nil, NewError(LDAPResultReferral, fmt.Errorf("ldap: referral hop limit %d exceeded", hopLimit))
+	}
+
+	err := errors.New("ldap: empty referral")
+	for _, uri := range uris {
+		var r *referral
+		if r, err = parseReferral(uri); err != nil {
+			continue
+		}
+		if !config.allowsHost(r.host) {
+			err = fmt.Errorf("ldap: referral %q to a host not allowed", uri)
+			continue
+		}
+
+		referred := *searchRequest
+		if r.baseDN != "" {
+			referred.BaseDN = r.baseDN
+		}
+		if r.scope >= 0 {
+			referred.Scope = r.scope
+		} else if continuation && searchRequest.Scope == ScopeSingleLevel {
+			referred.Scope = ScopeBaseObject
+		}
+
+		key := referralKey(r.addr, referred.BaseDN, referred.Scope)
+		if visited[key] {
+			if continuation {
+				return &SearchResult{Entries: make([]*Entry, 0), Referrals: make([]string, 0), Controls: make([]Control, 0)}, nil
+			}
+			return nil, NewError(LDAPResultLoopDetect, fmt.Errorf("ldap: referral loop at %s", uri))
+		}
+		visited[key] = true
+
+		var conn *Conn
+		if conn, err = dialReferral(ctx, r, config); err != nil {
+			continue
+		}
+		result, err := conn.searchWithReferrals(ctx, &referred, config, visited, hops+1)
+		conn.Unbind()
+		return result, err
+	}
+	return nil, err
+}
+
+func dialReferral(ctx context.Context, r *referral, config *ReferralConfig) (*Conn, error) {
+	tlsConfig := &tls.Config{}
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = r.host
+	}
+	if config.Username != "" && !config.InsecureBind && (!r.useTLS || tlsConfig.InsecureSkipVerify) {
+		return nil, fmt.Errorf("ldap: refusing to send the credentials to %s without verified TLS", r.addr)
+	}
+
+	var (
+		conn *Conn
+		err  error
+	)
+	if r.useTLS {
+		conn, err = DialTLSContext(ctx, "tcp", r.addr, tlsConfig)
+	} else {
+		conn, err = DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		conn.SetTimeout(config.Timeout)
+	}
+	if config.Username != "" {
+		if err := conn.BindContext(ctx, config.Username, config.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,204 @@
+package ldap_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldaptest"
+)
+
+// newForest starts the servers of a forest with a root domain and a child
+// domain that the root domain refers to
+func newForest(t *testing.T) (root, child *ldaptest.Server) {
+	var err error
+	if root, err = ldaptest.NewServer(); err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	if child, err = ldaptest.NewServer(); err != nil {
+		root.Close()
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	for _, srv := range []*ldaptest.Server{root, child} {
+		srv.AddCredentials("squid@domain.local", "secret")
+	}
+
+	root.AddEntry("dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	root.AddEntry("cn=John Doe,dc=domain,dc=local", map[string][]string{"objectClass": {"user"}, "sAMAccountName": {"jdoe"}})
+	root.AddReferral("dc=child,dc=domain,dc=local", fmt.Sprintf("ldap://%s/dc=child,dc=domain,dc=local", child.Addr()))
+
+	child.AddEntry("dc=child,dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	child.AddEntry("cn=Alice,dc=child,dc=domain,dc=local", map[string][]string{"objectClass": {"user"}, "sAMAccountName": {"alice"}})
+	return root, child
+}
+
+func searchUsers(t *testing.T, srv *ldaptest.Server, baseDN string, config *ldap.ReferralConfig) ([]string, *ldap.SearchResult, error) {
+	conn, err := ldap.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.Bind("squid@domain.local", "secret"); err != nil {
+		t.Fatalf("cannot bind: %s", err)
+	}
+
+	result, err := conn.SearchWithReferrals(ldap.NewSearchRequest(
+		baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=user)",
+		[]string{"sAMAccountName"},
+		nil,
+	), config)
+	var users []string
+	if result != nil {
+		for _, entry := range result.Entries {
+			users = append(users, entry.GetAttributeValue("sAMAccountName"))
+		}
+	}
+	sort.Strings(users)
+	return users, result, err
+}
+
+func TestSearchFollowsContinuationReferences(t *testing.T) {
+	root, child := newForest(t)
+	defer root.Close()
+	defer child.Close()
+
+	users, result, err := searchUsers(t, root, "dc=domain,dc=local", &ldap.ReferralConfig{Username: "squid@domain.local", Password: "secret", InsecureBind: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fmt.Sprint(users) != "[alice jdoe]" {
+		t.Errorf("got users %v, expected [alice jdoe]", users)
+	}
+	if len(result.Referrals) != 0 {
+		t.Errorf("followed referrals are still returned: %v", result.Referrals)
+	}
+}
+
+func TestSearchFollowsReferralResult(t *testing.T) {
+	root, child := newForest(t)
+	defer root.Close()
+	defer child.Close()
+
+	users, _, err := searchUsers(t, root, "dc=child,dc=domain,dc=local", &ldap.ReferralConfig{Username: "squid@domain.local", Password: "secret", InsecureBind: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fmt.Sprint(users) != "[alice]" {
+		t.Errorf("got users %v, expected [alice]", users)
+	}
+}
+
+func TestSearchKeepsUnreachableReferences(t *testing.T) {
+	root, child := newForest(t)
+	defer root.Close()
+	child.Close()
+
+	users, result, err := searchUsers(t, root, "dc=domain,dc=local", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fmt.Sprint(users) != "[jdoe]" {
+		t.Errorf("got users %v, expected [jdoe]", users)
+	}
+	if len(result.Referrals) != 1 {
+		t.Errorf("expected the unreachable referral in the result, got %v", result.Referrals)
+	}
+}
+
+func TestSearchReferralCredentials(t *testing.T) {
+	root, child := newForest(t)
+	defer root.Close()
+	defer child.Close()
+
+	_, result, err := searchUsers(t, root, "dc=domain,dc=local", &ldap.ReferralConfig{Username: "squid@domain.local", Password: "wrong", InsecureBind: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(result.Referrals) != 1 {
+		t.Errorf("expected the referral to fail with invalid credentials, got %v", result.Referrals)
+	}
+	if child.CountRequests(ldap.ApplicationSearchRequest) != 0 {
+		t.Errorf("referred server was searched without a successful bind")
+	}
+}
+
+func TestSearchReferralLoop(t *testing.T) {
+	root, child := newForest(t)
+	defer root.Close()
+	defer child.Close()
+	child.AddReferral("dc=loop,dc=child,dc=domain,dc=local", fmt.Sprintf("ldap://%s/dc=loop,dc=child,dc=domain,dc=local", root.Addr()))
+	root.AddReferral("dc=loop,dc=child,dc=domain,dc=local", fmt.Sprintf("ldap://%s/dc=loop,dc=child,dc=domain,dc=local", child.Addr()))
+
+	_, _, err := searchUsers(t, root, "dc=loop,dc=child,dc=domain,dc=local", nil)
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultLoopDetect) {
+		t.Errorf("expected a loop to be detected, got %v", err)
+	}
+}
+
+func TestSearchReferralHopLimit(t *testing.T) {
+	root, child := newForest(t)
+	defer root.Close()
+	defer child.Close()
+
+	_, _, err := searchUsers(t, root, "dc=child,dc=domain,dc=local", &ldap.ReferralConfig{HopLimit: 1})
+	if err != nil {
+		t.Fatalf("unexpected error within the hop limit: %s", err)
+	}
+
+	grandchild, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	defer grandchild.Close()
+	child.AddReferral("dc=sub,dc=child,dc=domain,dc=local", fmt.Sprintf("ldap://%s/dc=sub,dc=child,dc=domain,dc=local", grandchild.Addr()))
+
+	_, _, err = searchUsers(t, root, "dc=sub,dc=child,dc=domain,dc=local", &ldap.ReferralConfig{HopLimit: 1})
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+		t.Errorf("expected the hop limit to be exceeded, got %v", err)
+	}
+	if grandchild.Connections() != 0 {
+		t.Errorf("referral beyond the hop limit was followed")
+	}
+}
+
+func TestSearchReferralRefusesPlainBind(t *testing.T) {
+	root, child := newForest(t)
+	defer root.Close()
+	defer child.Close()
+
+	users, result, err := searchUsers(t, root, "dc=domain,dc=local", &ldap.ReferralConfig{Username: "squid@domain.local", Password: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fmt.Sprint(users) != "[jdoe]" || len(result.Referrals) != 1 {
+		t.Errorf("got users %v and referrals %v, expected the referral not followed", users, result.Referrals)
+	}
+	if child.CountRequests(ldap.ApplicationBindRequest) != 0 {
+		t.Errorf("credentials were sent to the referred server over plain LDAP")
+	}
+}
+
+func TestSearchReferralHosts(t *testing.T) {
+	root, child := newForest(t)
+	defer root.Close()
+	defer child.Close()
+
+	_, _, err := searchUsers(t, root, "dc=child,dc=domain,dc=local", &ldap.ReferralConfig{Hosts: []string{"domain.local"}})
+	if err == nil {
+		t.Errorf("followed a referral to a host not allowed")
+	}
+	if child.CountRequests(ldap.ApplicationSearchRequest) != 0 {
+		t.Errorf("referred server not allowed was searched")
+	}
+
+	users, _, err := searchUsers(t, root, "dc=child,dc=domain,dc=local", &ldap.ReferralConfig{Hosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fmt.Sprint(users) != "[alice]" {
+		t.Errorf("got users %v, expected [alice]", users)
+	}
+}
@@ -60,6 +60,7 @@
 package ldap
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sort"
@@ -304,6 +305,55 @@ func NewSearchRequest(
 //  - given SearchRequest contains a control of type ControlTypePaging with pagingSize not equal to the size requested: fail without issuing any queries
 // A requested pagingSize of 0 is interpreted as no limit by LDAP servers.
 func (l *Conn) SearchWithPaging(searchRequest *SearchRequest, pagingSize uint32) (*SearchResult, error) {
+	return l.SearchWithPagingContext(context.Background(), searchRequest, pagingSize)
+}
+
+// SearchWithPagingContext is like SearchWithPaging, but gives up when ctx is done
+func (l *Conn) SearchWithPagingContext(ctx context.Context, searchRequest *SearchRequest, pagingSize uint32) (*SearchResult, error) {
+	var entries []*Entry
+	searchResult, err := l.searchWithPaging(ctx, searchRequest, pagingSize, func(entry *Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if searchResult != nil {
+		searchResult.Entries = append(searchResult.Entries, entries...)
+	}
+	return searchResult, err
+}
+
+// ErrStopSearch can be returned by the handler of a streaming search to stop
+// the search early. The search operation is abandoned on the server and no
+// error is returned by the search.
+var ErrStopSearch = errors.New("ldap: search stopped")
+
+// SearchStream performs the given search request and calls handler for every
+// entry as soon as it is received, instead of collecting the entries in the
+// result. If pagingSize is not 0, the entries are requested in pages of that
+// size. If handler returns an error, the search is abandoned on the server
+// and the error is returned, unless it is ErrStopSearch. The returned result
+// holds the referrals and controls but no entries.
+func (l *Conn) SearchStream(searchRequest *SearchRequest, pagingSize uint32, handler func(*Entry) error) (*SearchResult, error) {
+	return l.SearchStreamContext(context.Background(), searchRequest, pagingSize, handler)
+}
+
+// SearchStreamContext is like SearchStream, but gives up when ctx is done
+func (l *Conn) SearchStreamContext(ctx context.Context, searchRequest *SearchRequest, pagingSize uint32, handler func(*Entry) error) (*SearchResult, error) {
+	var (
+		result *SearchResult
+		err    error
+	)
+	if pagingSize == 0 {
+		result, err = l.searchStream(ctx, searchRequest, handler)
+	} else {
+		result, err = l.searchWithPaging(ctx, searchRequest, pagingSize, handler)
+	}
+	if err == ErrStopSearch {
+		err = nil
+	}
+	return result, err
+}
+
+func (l *Conn) searchWithPaging(ctx context.Context, searchRequest *SearchRequest, pagingSize uint32, handler func(*Entry) error) (*SearchResult, error) {
 	var pagingControl *ControlPaging
 
 	control := FindControl(searchRequest.Controls, ControlTypePaging)
@@ -321,10 +371,23 @@ func (l *Conn) SearchWithPaging(searchRequest *SearchRequest, pagingSize uint32)
 		pagingControl = castControl
 	}
 
-	searchResult := new(SearchResult)
+	searchResult := &SearchResult{
+		Entries:   make([]*Entry, 0),
+		Referrals: make([]string, 0),
+		Controls:  make([]Control, 0)}
 	for {
-		result, err := l.Search(searchRequest)
+		result, err := l.searchStream(ctx, searchRequest, handler)
 		l.Debug.Printf("Looking for Paging Control...")
+		if result != nil {
+			searchResult.Referrals = append(searchResult.Referrals, result.Referrals...)
+		}
+		if err == ErrStopSearch && len(pagingControl.Cookie) != 0 {
+			// let the server release the paged search
+			l.Debug.Printf("Abandoning Paging...")
+			pagingControl.PagingSize = 0
+			l.searchStream(ctx, searchRequest, func(*Entry) error { return nil })
+			return searchResult, err
+		}
 		if err != nil {
 			return searchResult, err
 		}
@@ -332,12 +395,6 @@ func (l *Conn) SearchWithPaging(searchRequest *SearchRequest, pagingSize uint32)
 			return searchResult, NewError(ErrorNetwork, errors.New("ldap: packet not received"))
 		}
 
-		for _, entry := range result.Entries {
-			searchResult.Entries = append(searchResult.Entries, entry)
-		}
-		for _, referral := range result.Referrals {
-			searchResult.Referrals = append(searchResult.Referrals, referral)
-		}
 		for _, control := range result.Controls {
 			searchResult.Controls = append(searchResult.Controls, control)
 		}
@@ -362,7 +419,7 @@ func (l *Conn) SearchWithPaging(searchRequest *SearchRequest, pagingSize uint32)
 	if pagingControl != nil {
 		l.Debug.Printf("Abandoning Paging...")
 		pagingControl.PagingSize = 0
-		l.Search(searchRequest)
+		l.SearchContext(ctx, searchRequest)
 	}
 
 	return searchResult, nil
@@ -370,6 +427,25 @@ func (l *Conn) SearchWithPaging(searchRequest *SearchRequest, pagingSize uint32)
 
 // Search performs the given search request
 func (l *Conn) Search(searchRequest *SearchRequest) (*SearchResult, error) {
+	return l.SearchContext(context.Background(), searchRequest)
+}
+
+// SearchContext is like Search, but gives up when ctx is done
+func (l *Conn) SearchContext(ctx context.Context, searchRequest *SearchRequest) (*SearchResult, error) {
+	var entries []*Entry
+	result, err := l.searchStream(ctx, searchRequest, func(entry *Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if result != nil {
+		result.Entries = append(result.Entries, entries...)
+	}
+	return result, err
+}
+
+// searchStream performs a single search operation and passes the entries to
+// handler as they arrive. The operation is abandoned if handler fails.
+func (l *Conn) searchStream(ctx context.Context, searchRequest *SearchRequest, handler func(*Entry) error) (*SearchResult, error) {
 	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
 	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
 	// encode search request
@@ -385,7 +461,7 @@ func (l *Conn) Search(searchRequest *SearchRequest) (*SearchResult, error) {
 
 	l.Debug.PrintPacket(packet)
 
-	msgCtx, err := l.sendMessage(packet)
+	msgCtx, err := l.sendMessageContext(ctx, packet)
 	if err != nil {
 		return nil, err
 	}
@@ -399,11 +475,7 @@ func (l *Conn) Search(searchRequest *SearchRequest) (*SearchResult, error) {
 	foundSearchResultDone := false
 	for !foundSearchResultDone {
 		l.Debug.Printf("%d: waiting for response", msgCtx.id)
-		packetResponse, ok := <-msgCtx.responses
-		if !ok {
-			return nil, NewError(ErrorNetwork, errors.New("ldap: response channel closed"))
-		}
-		packet, err = packetResponse.ReadPacket()
+		packet, err = l.readPacket(ctx, msgCtx)
 		l.Debug.Printf("%d: got response %p", msgCtx.id, packet)
 		if err != nil {
 			return nil, err
@@ -418,33 +490,66 @@ func (l *Conn) Search(searchRequest *SearchRequest) (*SearchResult, error) {
 
 		switch packet.Children[1].Tag {
 		case 4:
-			entry := new(Entry)
-			entry.DN = packet.Children[1].Children[0].Value.(string)
-			for _, child := range packet.Children[1].Children[1].Children {
-				attr := new(EntryAttribute)
-				attr.Name = child.Children[0].Value.(string)
-				for _, value := range child.Children[1].Children {
-					attr.Values = append(attr.Values, value.Value.(string))
-					attr.ByteValues = append(attr.ByteValues, value.ByteValue)
+			entry, err := decodeEntry(packet.Children[1])
+			if err != nil {
+				l.Debug.Printf("%d: abandoning search: %s", msgCtx.id, err)
+				if err := l.abandonMessage(msgCtx); err != nil {
+					l.Debug.Printf("%d: cannot abandon search: %s", msgCtx.id, err)
+				}
+				return result, err
+			}
+			if err := handler(entry); err != nil {
+				l.Debug.Printf("%d: abandoning search: %s", msgCtx.id, err)
+				if err := l.abandonMessage(msgCtx); err != nil {
+					l.Debug.Printf("%d: cannot abandon search: %s", msgCtx.id, err)
 				}
-				entry.Attributes = append(entry.Attributes, attr)
+				return result, err
 			}
-			result.Entries = append(result.Entries, entry)
 		case 5:
 			resultCode, resultDescription := getLDAPResultCode(packet)
+			if resultCode == LDAPResultReferral {
+				result.Referrals = append(result.Referrals, getReferralURIs(packet)...)
+			}
 			if resultCode != 0 {
 				return result, NewError(resultCode, errors.New(resultDescription))
 			}
 			if len(packet.Children) == 3 {
 				for _, child := range packet.Children[2].Children {
-					result.Controls = append(result.Controls, DecodeControl(child))
+					if control := DecodeControl(child); control != nil {
+						result.Controls = append(result.Controls, control)
+					}
 				}
 			}
 			foundSearchResultDone = true
 		case 19:
-			result.Referrals = append(result.Referrals, packet.Children[1].Children[0].Value.(string))
+			for _, uri := range packet.Children[1].Children {
+				result.Referrals = append(result.Referrals, uri.Data.String())
+			}
 		}
 	}
 	l.Debug.Printf("%d: returning", msgCtx.id)
 	return result, nil
 }
+
+// decodeEntry decodes a SearchResultEntry. The values are read from the raw
+// packet data, so binary values such as objectSid or objectGUID are kept
+// intact. A malformed entry is reported as ErrorUnexpectedResponse.
+func decodeEntry(response *ber.Packet) (*Entry, error) {
+	if len(response.Children) != 2 {
+		return nil, NewError(ErrorUnexpectedResponse, errors.New("ldap: malformed search result entry"))
+	}
+	entry := &Entry{DN: response.Children[0].Data.String()}
+	for _, child := range response.Children[1].Children {
+		if len(child.Children) != 2 {
+			return nil, NewError(ErrorUnexpectedResponse, fmt.Errorf("ldap: malformed attribute in search result entry %s", entry.DN))
+		}
+		attr := &EntryAttribute{Name: child.Children[0].Data.String()}
+		for _, value := range child.Children[1].Children {
+			data := append([]byte(nil), value.Data.Bytes()...)
+			attr.Values = append(attr.Values, string(data))
+			attr.ByteValues = append(attr.ByteValues, data)
+		}
+		entry.Attributes = append(entry.Attributes, attr)
+	}
+	return entry, nil
+}
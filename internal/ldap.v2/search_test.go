@@ -1,8 +1,13 @@
 package ldap
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
+
+	"gopkg.in/asn1-ber.v1"
 )
 
 // TestNewEntry tests that repeated calls to NewEntry return the same value with the same input
@@ -29,3 +34,263 @@ func TestNewEntry(t *testing.T) {
 		iteration = iteration + 1
 	}
 }
+
+func testStreamRequest() *SearchRequest {
+	return NewSearchRequest("dc=example,dc=com", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=user)", []string{"cn"}, nil)
+}
+
+// TestSearchStreamStop tests that a streaming search stopped by its handler
+// is abandoned on the server.
+func TestSearchStreamStop(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	var (
+		received []string
+		err      error
+		done     = make(chan struct{})
+	)
+	go func() {
+		_, err = conn.SearchStream(testStreamRequest(), 0, func(entry *Entry) error {
+			received = append(received, entry.DN)
+			return ErrStopSearch
+		})
+		close(done)
+	}()
+
+	runWithTimeout(t, time.Second, func() {
+		search, err := ptc.ReceiveRequest()
+		if err != nil {
+			t.Fatalf("receiveRequest failed: %v", err)
+		}
+		messageID := search.Children[0].Value.(int64)
+		ptc.SendResponse(testSearchEntry(messageID, "cn=first,dc=example,dc=com", "cn", []string{"first"}))
+
+		abandon, err := ptc.ReceiveRequest()
+		if err != nil {
+			t.Fatalf("receiveRequest failed: %v", err)
+		}
+		testAbandonRequest(t, abandon, messageID)
+
+		ptc.SendResponse(testSearchEntry(messageID, "cn=second,dc=example,dc=com", "cn", []string{"second"}))
+		ptc.SendResponse(testSearchDone(messageID))
+		<-done
+	})
+
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(received) != 1 {
+		t.Errorf("handler got %v, expected only the first entry", received)
+	}
+}
+
+// TestSearchStreamHandlerError tests that the error of the handler is
+// returned.
+func TestSearchStreamHandlerError(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	go func() {
+		search, err := ptc.ReceiveRequest()
+		if err != nil {
+			return
+		}
+		messageID := search.Children[0].Value.(int64)
+		ptc.SendResponse(testSearchEntry(messageID, "cn=first,dc=example,dc=com", "cn", []string{"first"}))
+	}()
+
+	handlerErr := errors.New("handler failed")
+	runWithTimeout(t, time.Second, func() {
+		_, err := conn.SearchStream(testStreamRequest(), 0, func(entry *Entry) error {
+			return handlerErr
+		})
+		if err != handlerErr {
+			t.Errorf("got error %v, expected %v", err, handlerErr)
+		}
+	})
+}
+
+// TestSearchStreamPaging tests that the pages of a streaming search are
+// requested one after another.
+func TestSearchStreamPaging(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	var cookies []string
+	go func() {
+		for page := 0; page < 2; page++ {
+			search, err := ptc.ReceiveRequest()
+			if err != nil {
+				return
+			}
+			messageID := search.Children[0].Value.(int64)
+			var cookie string
+			if len(search.Children) > 2 {
+				cookie = string(DecodeControl(search.Children[2].Children[0]).(*ControlPaging).Cookie)
+			}
+			cookies = append(cookies, cookie)
+
+			for i := 0; i < 2; i++ {
+				dn := fmt.Sprintf("cn=user%d,dc=example,dc=com", page*2+i)
+				ptc.SendResponse(testSearchEntry(messageID, dn, "cn", []string{dn}))
+			}
+			next := &ControlPaging{PagingSize: 2}
+			if page == 0 {
+				next.SetCookie([]byte("page1"))
+			}
+			ptc.SendResponse(testSearchDone(messageID, next))
+		}
+	}()
+
+	var received int
+	runWithTimeout(t, time.Second, func() {
+		result, err := conn.SearchStream(testStreamRequest(), 2, func(entry *Entry) error {
+			received++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(result.Entries) != 0 {
+			t.Errorf("streaming search collected %d entries", len(result.Entries))
+		}
+	})
+
+	if received != 4 {
+		t.Errorf("handler got %d entries, expected 4", received)
+	}
+	if fmt.Sprint(cookies) != "[ page1]" {
+		t.Errorf("pages were requested with cookies %q", cookies)
+	}
+}
+
+// TestSearchValuelessControls tests that the response controls which
+// cannot be decoded are left out of the result instead of panicking the
+// paged search looking for the paging control.
+func TestSearchValuelessControls(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	go func() {
+		search, err := ptc.ReceiveRequest()
+		if err != nil {
+			return
+		}
+		messageID := search.Children[0].Value.(int64)
+		ptc.SendResponse(testSearchEntry(messageID, "cn=user0,dc=example,dc=com", "cn", []string{"user0"}))
+		ptc.SendResponse(testSearchDone(messageID,
+			&ControlString{ControlType: ControlTypeServerSideSortResult},
+			&ControlString{ControlType: ControlTypeVirtualListViewResult},
+			&ControlPaging{PagingSize: 2},
+		))
+	}()
+
+	runWithTimeout(t, time.Second, func() {
+		result, err := conn.SearchWithPaging(testStreamRequest(), 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(result.Entries) != 1 {
+			t.Errorf("got %d entries, expected 1", len(result.Entries))
+		}
+		for _, control := range result.Controls {
+			if control == nil {
+				t.Errorf("got controls %v", result.Controls)
+			}
+		}
+	})
+}
+
+// TestSearchBinaryValues tests that binary attribute values are returned
+// unchanged.
+func TestSearchBinaryValues(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	sid := []byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x20, 0x00, 0x00, 0x00, 0x20, 0x02, 0x00, 0x00}
+	guid := []byte{0x10, 0x32, 0x54, 0x76, 0x98, 0xba, 0xdc, 0xfe, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	go func() {
+		search, err := ptc.ReceiveRequest()
+		if err != nil {
+			return
+		}
+		messageID := search.Children[0].Value.(int64)
+		ptc.SendResponse(testSearchEntry(messageID, "cn=Administrators,cn=Builtin,dc=example,dc=com", "objectSid", []string{string(sid)}))
+		ptc.SendResponse(testSearchEntry(messageID, "cn=Administrators,cn=Builtin,dc=example,dc=com", "objectGUID", []string{string(guid)}))
+		ptc.SendResponse(testSearchDone(messageID))
+	}()
+
+	runWithTimeout(t, time.Second, func() {
+		result, err := conn.Search(testStreamRequest())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(result.Entries) != 2 {
+			t.Fatalf("got %d entries, expected 2", len(result.Entries))
+		}
+		values := result.Entries[0].GetRawAttributeValues("objectSid")
+		if len(values) != 1 || string(values[0]) != string(sid) {
+			t.Errorf("got objectSid %x, expected %x", values, sid)
+		}
+		if s, err := ParseSID(values[0]); err != nil || s != "S-1-5-32-544" {
+			t.Errorf("got SID %q (%v)", s, err)
+		}
+		values = result.Entries[1].GetRawAttributeValues("objectGUID")
+		if len(values) != 1 || string(values[0]) != string(guid) {
+			t.Errorf("got objectGUID %x, expected %x", values, guid)
+		}
+	})
+}
+
+// TestSearchMalformedEntry tests that a malformed entry fails the search
+// instead of panicking.
+func TestSearchMalformedEntry(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	go func() {
+		search, err := ptc.ReceiveRequest()
+		if err != nil {
+			return
+		}
+		messageID := search.Children[0].Value.(int64)
+		packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+		packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationSearchResultEntry, nil, "Search Result Entry")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "cn=first,dc=example,dc=com", "Object Name"))
+		packet.AppendChild(entry)
+		ptc.SendResponse(packet)
+	}()
+
+	runWithTimeout(t, time.Second, func() {
+		_, err := conn.Search(testStreamRequest())
+		if !IsErrorWithCode(err, ErrorUnexpectedResponse) {
+			t.Errorf("expected ErrorUnexpectedResponse, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+// File contains helpers for the binary identifiers of Active Directory
+//
+// https://msdn.microsoft.com/en-us/library/cc230371.aspx
+//
+//         SID ::= revision (1 byte)
+//                 subAuthorityCount (1 byte)
+//                 identifierAuthority (6 bytes, big endian)
+//                 subAuthority (subAuthorityCount * 4 bytes, little endian)
+//
+// https://msdn.microsoft.com/en-us/library/cc230326.aspx
+//
+// The string form of a GUID reads its first three fields as little endian
+// integers and its last two as bytes, so the objectGUID value
+// 10 32 54 76 98 ba dc fe 01 23 45 67 89 ab cd ef is written
+// 76543210-ba98-fedc-0123-456789abcdef.
+
+package ldap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxSubAuthorities is the largest number of sub-authorities of a SID
+const maxSubAuthorities = 15
+
+// ParseSID returns the string form, e.g. "S-1-5-21-1004336348-1177238915-682003330-512",
+// of a binary SID such as an objectSid or tokenGroups value
+func ParseSID(sid []byte) (string, error) {
+	if len(sid) < 8 {
+		return "", fmt.Errorf("ldap: SID too short: %d bytes", len(sid))
+	}
+	count := int(sid[1])
+	if count > maxSubAuthorities || len(sid) != 8+4*count {
+		return "", fmt.Errorf("ldap: invalid SID length %d for %d sub-authorities", len(sid), count)
+	}
+
+	var authority uint64
+	for _, b := range sid[2:8] {
+		authority = authority<<8 | uint64(b)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("S-")
+	buf.WriteString(strconv.Itoa(int(sid[0])))
+	buf.WriteByte('-')
+	if authority >= 1<<32 {
+		fmt.Fprintf(&buf, "0x%012X", authority)
+	} else {
+		buf.WriteString(strconv.FormatUint(authority, 10))
+	}
+	for i := 0; i < count; i++ {
+		buf.WriteByte('-')
+		buf.WriteString(strconv.FormatUint(uint64(binary.LittleEndian.Uint32(sid[8+4*i:])), 10))
+	}
+	return buf.String(), nil
+}
+
+// EncodeSID returns the binary form of a SID given in its string form
+func EncodeSID(sid string) ([]byte, error) {
+	parts := strings.Split(sid, "-")
+	if len(parts) < 3 || !strings.EqualFold(parts[0], "S") {
+		return nil, fmt.Errorf("ldap: invalid SID %q", sid)
+	}
+	count := len(parts) - 3
+	if count > maxSubAuthorities {
+		return nil, fmt.Errorf("ldap: too many sub-authorities in SID %q", sid)
+	}
+	revision, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid SID revision %q", parts[1])
+	}
+	var authority uint64
+	if strings.HasPrefix(parts[2], "0x") || strings.HasPrefix(parts[2], "0X") {
+		authority, err = strconv.ParseUint(parts[2][2:], 16, 48)
+	} else {
+		authority, err = strconv.ParseUint(parts[2], 10, 48)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid SID identifier authority %q", parts[2])
+	}
+
+	buf := make([]byte, 8+4*count)
+	buf[0] = byte(revision)
+	buf[1] = byte(count)
+	for i := 7; i >= 2; i-- {
+		buf[i] = byte(authority)
+		authority >>= 8
+	}
+	for i, part := range parts[3:] {
+		subAuthority, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: invalid SID sub-authority %q", part)
+		}
+		binary.LittleEndian.PutUint32(buf[8+4*i:], uint32(subAuthority))
+	}
+	return buf, nil
+}
+
+// ParseGUID returns the string form, e.g. "76543210-ba98-fedc-0123-456789abcdef",
+// of a binary GUID such as an objectGUID value
+func ParseGUID(guid []byte) (string, error) {
+	if len(guid) != 16 {
+		return "", fmt.Errorf("ldap: invalid GUID length %d", len(guid))
+	}
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(guid[0:4]),
+		binary.LittleEndian.Uint16(guid[4:6]),
+		binary.LittleEndian.Uint16(guid[6:8]),
+		guid[8:10],
+		guid[10:16]), nil
+}
+
+// EncodeGUID returns the binary form of a GUID given in its string form,
+// with or without the surrounding braces
+func EncodeGUID(guid string) ([]byte, error) {
+	s := strings.TrimSuffix(strings.TrimPrefix(guid, "{"), "}")
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return nil, fmt.Errorf("ldap: invalid GUID %q", guid)
+	}
+	digits := strings.Join(parts, "")
+	raw := make([]byte, 16)
+	for i := range raw {
+		b, err := strconv.ParseUint(digits[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: invalid GUID %q", guid)
+		}
+		raw[i] = byte(b)
+	}
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint32(buf[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(buf[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(buf[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	copy(buf[8:], raw[8:])
+	return buf, nil
+}
+
+// EscapeFilterBytes escapes every byte of a binary value, so that it can be
+// used as an assertion value in a filter
+func EscapeFilterBytes(value []byte) string {
+	buf := make([]byte, 3*len(value))
+	for i, c := range value {
+		buf[3*i] = '\\'
+		buf[3*i+1] = hex[c>>4]
+		buf[3*i+2] = hex[c&0xf]
+	}
+	return string(buf)
+}
+
+// SIDFilter returns an equality filter matching the binary attribute, e.g.
+// objectSid, against a SID given in its string form
+func SIDFilter(attribute, sid string) (string, error) {
+	value, err := EncodeSID(sid)
+	if err != nil {
+		return "", err
+	}
+	return "(" + attribute + "=" + EscapeFilterBytes(value) + ")", nil
+}
+
+// GUIDFilter returns an equality filter matching the binary attribute, e.g.
+// objectGUID, against a GUID given in its string form
+func GUIDFilter(attribute, guid string) (string, error) {
+	value, err := EncodeGUID(guid)
+	if err != nil {
+		return "", err
+	}
+	return "(" + attribute + "=" + EscapeFilterBytes(value) + ")", nil
+}
+
+// SIDsFilter returns a filter matching the binary attribute against any of
+// the given binary SIDs, e.g. the tokenGroups values of a user
+func SIDsFilter(attribute string, sids [][]byte) (string, error) {
+	if len(sids) == 0 {
+		return "", errors.New("ldap: no SID to match")
+	}
+	var buf bytes.Buffer
+	if len(sids) > 1 {
+		buf.WriteString("(|")
+	}
+	for _, sid := range sids {
+		if _, err := ParseSID(sid); err != nil {
+			return "", err
+		}
+		buf.WriteString("(" + attribute + "=" + EscapeFilterBytes(sid) + ")")
+	}
+	if len(sids) > 1 {
+		buf.WriteByte(')')
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,124 @@
+package ldap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSID(t *testing.T) {
+	tests := []struct {
+		binary []byte
+		sid    string
+	}{
+		{
+			binary: []byte{0x01, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x15, 0x00, 0x00, 0x00, 0xdc, 0xf4, 0xdc, 0x3b, 0x83, 0x3d, 0x2b, 0x46, 0x82, 0x8b, 0xa6, 0x28, 0x00, 0x02, 0x00, 0x00},
+			sid:    "S-1-5-21-1004336348-1177238915-682003330-512",
+		},
+		{
+			binary: []byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x20, 0x00, 0x00, 0x00, 0x20, 0x02, 0x00, 0x00},
+			sid:    "S-1-5-32-544",
+		},
+		{
+			binary: []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			sid:    "S-1-0",
+		},
+		{
+			binary: []byte{0x01, 0x01, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x01, 0x00, 0x00, 0x00},
+			sid:    "S-1-0x010203040506-1",
+		},
+	}
+
+	for _, test := range tests {
+		sid, err := ParseSID(test.binary)
+		if err != nil {
+			t.Errorf("%s: unexpected error parsing: %s", test.sid, err)
+		} else if sid != test.sid {
+			t.Errorf("%s: parsed as %s", test.sid, sid)
+		}
+		binary, err := EncodeSID(test.sid)
+		if err != nil {
+			t.Errorf("%s: unexpected error encoding: %s", test.sid, err)
+		} else if !bytes.Equal(binary, test.binary) {
+			t.Errorf("%s: encoded as %x, expected %x", test.sid, binary, test.binary)
+		}
+	}
+
+	for _, binary := range [][]byte{nil, {0x01, 0x01, 0, 0, 0, 0, 0, 5}, {0x01, 0x10, 0, 0, 0, 0, 0, 5}} {
+		if _, err := ParseSID(binary); err == nil {
+			t.Errorf("%x: expected an error parsing", binary)
+		}
+	}
+	for _, sid := range []string{"", "S-1", "X-1-5-21", "S-1-5-a", "S-1-5-4294967296", "S-1-281474976710656-1"} {
+		if _, err := EncodeSID(sid); err == nil {
+			t.Errorf("%q: expected an error encoding", sid)
+		}
+	}
+}
+
+func TestGUID(t *testing.T) {
+	binary := []byte{0x10, 0x32, 0x54, 0x76, 0x98, 0xba, 0xdc, 0xfe, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	const guid = "76543210-ba98-fedc-0123-456789abcdef"
+
+	parsed, err := ParseGUID(binary)
+	if err != nil {
+		t.Fatalf("unexpected error parsing: %s", err)
+	}
+	if parsed != guid {
+		t.Errorf("parsed as %s, expected %s", parsed, guid)
+	}
+	for _, s := range []string{guid, "{76543210-BA98-FEDC-0123-456789ABCDEF}"} {
+		encoded, err := EncodeGUID(s)
+		if err != nil {
+			t.Errorf("%s: unexpected error encoding: %s", s, err)
+		} else if !bytes.Equal(encoded, binary) {
+			t.Errorf("%s: encoded as %x, expected %x", s, encoded, binary)
+		}
+	}
+
+	if _, err := ParseGUID(binary[:15]); err == nil {
+		t.Errorf("expected an error parsing a short GUID")
+	}
+	for _, s := range []string{"", "76543210ba98fedc0123456789abcdef", "76543210-ba98-fedc-0123-456789abcdeg", "7654321-0ba98-fedc-0123-456789abcdef"} {
+		if _, err := EncodeGUID(s); err == nil {
+			t.Errorf("%q: expected an error encoding", s)
+		}
+	}
+}
+
+func TestSIDFilter(t *testing.T) {
+	filter, err := SIDFilter("objectSid", "S-1-5-32-544")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	const expected = `(objectSid=\01\02\00\00\00\00\00\05\20\00\00\00\20\02\00\00)`
+	if filter != expected {
+		t.Errorf("got filter %s, expected %s", filter, expected)
+	}
+	if _, err := CompileFilter(filter); err != nil {
+		t.Errorf("cannot compile filter %s: %s", filter, err)
+	}
+
+	filter, err = GUIDFilter("objectGUID", "76543210-ba98-fedc-0123-456789abcdef")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if filter != `(objectGUID=\10\32\54\76\98\ba\dc\fe\01\23\45\67\89\ab\cd\ef)` {
+		t.Errorf("got filter %s", filter)
+	}
+
+	first, _ := EncodeSID("S-1-5-32-544")
+	second, _ := EncodeSID("S-1-5-32-545")
+	filter, err = SIDsFilter("objectSid", [][]byte{first, second})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if filter != "(|"+`(objectSid=\01\02\00\00\00\00\00\05\20\00\00\00\20\02\00\00)(objectSid=\01\02\00\00\00\00\00\05\20\00\00\00\21\02\00\00)`+")" {
+		t.Errorf("got filter %s", filter)
+	}
+	if _, err := SIDsFilter("objectSid", nil); err == nil {
+		t.Errorf("expected an error without SIDs")
+	}
+	if _, err := SIDsFilter("objectSid", [][]byte{{0x01}}); err == nil {
+		t.Errorf("expected an error with an invalid SID")
+	}
+}
@@ -0,0 +1,29 @@
+// File contains Unbind functionality
+//
+// https://tools.ietf.org/html/rfc4511
+//
+// UnbindRequest ::= [APPLICATION 2] NULL
+
+package ldap
+
+import (
+	"errors"
+
+	"gopkg.in/asn1-ber.v1"
+)
+
+// Unbind tells the server the client is going away and closes the
+// connection. The connection is closed even if the request cannot be sent.
+func (l *Conn) Unbind() error {
+	if l.isClosing() {
+		return NewError(ErrorNetwork, errors.New("ldap: connection closed"))
+	}
+
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
+	packet.AppendChild(ber.Encode(ber.ClassApplication, ber.TypePrimitive, ApplicationUnbindRequest, nil, "Unbind Request"))
+
+	l.Debug.PrintPacket(packet)
+
+	return l.close(packet)
+}
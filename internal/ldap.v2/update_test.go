@@ -0,0 +1,130 @@
+package ldap_test
+
+import (
+	"testing"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldaptest"
+)
+
+func newUpdateDirectory(t *testing.T) (*ldaptest.Server, *ldap.Conn) {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	srv.AddCredentials("admin@domain.local", "secret")
+	srv.AddEntry("dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	srv.AddEntry("ou=Sales,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}, "ou": {"Sales"}})
+	srv.AddEntry("ou=IT,dc=domain,dc=local", map[string][]string{"objectClass": {"organizationalUnit"}, "ou": {"IT"}})
+
+	conn, err := ldap.Dial("tcp", srv.Addr())
+	if err != nil {
+		srv.Close()
+		t.Fatalf("cannot connect: %s", err)
+	}
+	if err := conn.Bind("admin@domain.local", "secret"); err != nil {
+		conn.Close()
+		srv.Close()
+		t.Fatalf("cannot bind: %s", err)
+	}
+	return srv, conn
+}
+
+func searchEntry(t *testing.T, conn *ldap.Conn, filter string) *ldap.Entry {
+	result, err := conn.Search(ldap.NewSearchRequest(
+		"dc=domain,dc=local",
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		nil,
+		nil,
+	))
+	if err != nil {
+		t.Fatalf("search failed: %s", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil
+	}
+	return result.Entries[0]
+}
+
+func TestUpdateOperations(t *testing.T) {
+	srv, conn := newUpdateDirectory(t)
+	defer srv.Close()
+	defer conn.Close()
+
+	add := ldap.NewAddRequest("cn=John Doe,ou=Sales,dc=domain,dc=local", []ldap.Control{ldap.NewControlManageDsaIT(false)})
+	add.Attribute("objectClass", []string{"user"})
+	add.Attribute("cn", []string{"John Doe"})
+	add.Attribute("sAMAccountName", []string{"jdoe"})
+	if err := conn.Add(add); err != nil {
+		t.Fatalf("add failed: %s", err)
+	}
+	if err := conn.Add(add); !ldap.IsErrorWithCode(err, ldap.LDAPResultEntryAlreadyExists) {
+		t.Errorf("expected LDAPResultEntryAlreadyExists adding the entry again, got %v", err)
+	}
+
+	modify := ldap.NewModifyRequest("cn=John Doe,ou=Sales,dc=domain,dc=local", []ldap.Control{ldap.NewControlManageDsaIT(false)})
+	modify.Add("mail", []string{"jdoe@domain.local"})
+	modify.Replace("sAMAccountName", []string{"john.doe"})
+	if err := conn.Modify(modify); err != nil {
+		t.Fatalf("modify failed: %s", err)
+	}
+	entry := searchEntry(t, conn, "(sAMAccountName=john.doe)")
+	if entry == nil || entry.GetAttributeValue("mail") != "jdoe@domain.local" {
+		t.Fatalf("modified entry not found")
+	}
+
+	move := ldap.NewModifyDNRequest("cn=John Doe,ou=Sales,dc=domain,dc=local", "cn=John Smith", true, "ou=IT,dc=domain,dc=local", []ldap.Control{ldap.NewControlManageDsaIT(false)})
+	if err := conn.ModifyDN(move); err != nil {
+		t.Fatalf("modify DN failed: %s", err)
+	}
+	entry = searchEntry(t, conn, "(sAMAccountName=john.doe)")
+	if entry == nil || entry.DN != "cn=John Smith,ou=IT,dc=domain,dc=local" {
+		t.Fatalf("entry was not moved: %v", entry)
+	}
+	if cn := entry.GetAttributeValues("cn"); len(cn) != 1 || cn[0] != "John Smith" {
+		t.Errorf("got cn %q after the rename, expected [John Smith]", cn)
+	}
+
+	if err := conn.Del(ldap.NewDelRequest("ou=IT,dc=domain,dc=local", nil)); !ldap.IsErrorWithCode(err, ldap.LDAPResultNotAllowedOnNonLeaf) {
+		t.Errorf("expected LDAPResultNotAllowedOnNonLeaf deleting a parent entry, got %v", err)
+	}
+	if err := conn.Del(ldap.NewDelRequest("cn=John Smith,ou=IT,dc=domain,dc=local", []ldap.Control{ldap.NewControlManageDsaIT(false)})); err != nil {
+		t.Fatalf("delete failed: %s", err)
+	}
+	if entry = searchEntry(t, conn, "(sAMAccountName=john.doe)"); entry != nil {
+		t.Errorf("deleted entry is still found")
+	}
+
+	// every update request carries its control
+	for _, packet := range srv.Requests() {
+		switch packet.Children[1].Tag {
+		case ldap.ApplicationAddRequest, ldap.ApplicationModifyRequest, ldap.ApplicationModifyDNRequest:
+			if len(packet.Children) != 3 {
+				t.Errorf("%s sent without controls", ldap.ApplicationMap[uint8(packet.Children[1].Tag)])
+			}
+		}
+	}
+}
+
+func TestModifyDNInPlace(t *testing.T) {
+	srv, conn := newUpdateDirectory(t)
+	defer srv.Close()
+	defer conn.Close()
+
+	if err := conn.ModifyDN(ldap.NewModifyDNRequest("ou=Sales,dc=domain,dc=local", "ou=Marketing", false, "", nil)); err != nil {
+		t.Fatalf("modify DN failed: %s", err)
+	}
+	entry := searchEntry(t, conn, "(ou=Marketing)")
+	if entry == nil || entry.DN != "ou=Marketing,dc=domain,dc=local" {
+		t.Fatalf("entry was not renamed: %v", entry)
+	}
+	if ou := entry.GetAttributeValues("ou"); len(ou) != 2 {
+		t.Errorf("got ou %q, expected the old RDN value to be kept", ou)
+	}
+
+	err := conn.ModifyDN(ldap.NewModifyDNRequest("ou=Missing,dc=domain,dc=local", "ou=Other", true, "", nil))
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		t.Errorf("expected LDAPResultNoSuchObject renaming a missing entry, got %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+// File contains the "Who am I?" extended operation
+//
+// https://tools.ietf.org/html/rfc4532
+//
+//         authzId ::= "dn:" dn / "u:" userid / ""
+
+package ldap
+
+import (
+	"context"
+)
+
+const whoAmIOID = "1.3.6.1.4.1.4203.1.11.3"
+
+// WhoAmI returns the authorization identity of the connection, e.g.
+// "dn:cn=squid,dc=example,dc=com" or "u:EXAMPLE\squid". It is empty if the
+// connection is anonymous.
+func (l *Conn) WhoAmI() (string, error) {
+	return l.WhoAmIContext(context.Background())
+}
+
+// WhoAmIContext is like WhoAmI, but gives up when ctx is done
+func (l *Conn) WhoAmIContext(ctx context.Context) (string, error) {
+	result, err := l.ExtendedContext(ctx, whoAmIOID, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(result.Value), nil
+}
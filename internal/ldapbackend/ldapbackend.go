@@ -0,0 +1,339 @@
+// Package ldapbackend holds what the helpers share about the LDAP directories
+// they query: the connection options, the pool of connections to the
+// servers, the searches following referrals, and the backend profiles
+// overriding the options for the users of some domains.
+//
+// The helpers embed Options in their options and Backend in their backends,
+// and keep the queries of their own to themselves.
+package ldapbackend
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/changewatch"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldappool"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/profile"
+)
+
+// Options are the options of the connection to an LDAP directory
+type Options struct {
+	ServerSlice      []string `short:"s" long:"server" description:"Domain controller server address (required)" required:"true"`
+	ServerPort       int      `short:"p" long:"port" description:"Domain controller LDAP service port (default: 389)" default:"389"`
+	UseTLS           bool     `long:"tls" description:"Using LDAP over TLS"`
+	BindUsername     string   `short:"u" long:"binduser" description:"Username for LDAP Bind operation (required)" required:"true"`
+	BindPassword     string   `short:"w" long:"bindpassword" description:"Password for LDAP Bind operation"`
+	PwdFile          string   `short:"f" long:"pwdfile" description:"File with password for Bind operation"`
+	BaseDN           string   `short:"b" long:"basedn" description:"BaseDN for user search process. %ou = OU (required)" required:"true"`
+	UPNLookup        bool     `long:"upn-lookup" description:"Search the usernames with a Kerberos realm by userPrincipalName"`
+	MaxDials         int      `long:"max-dials" description:"Maximum number of connections dialed at the same time to the servers of a backend. 0 = no limit (default: 10)" default:"10"`
+	Referrals        bool     `long:"referrals" description:"Follow referrals to the other domains of the forest"`
+	ReferralHops     int      `long:"referral-hops" description:"Maximum number of referrals followed in a row (default: 5)" default:"5"`
+	ReferralHosts    []string `long:"referral-hosts" description:"Follow referrals only to these hosts, or to the hosts of these DNS domains, comma separated. Can be repeated (default: the servers and the DNS domain of --basedn)"`
+	ReferralTimeout  int      `long:"referral-timeout" description:"Timeout in milliseconds of the LDAP operations on the referred servers (default: 300)" default:"300"`
+	ReferralNoVerify bool     `long:"referral-no-verify" description:"Do not verify the certificates of the ldaps:// referred servers"`
+	ReferralInsecure bool     `long:"referral-insecure-bind" description:"Bind to the referred servers over plain LDAP, or without verifying their certificates. The credentials are only sent over verified TLS otherwise"`
+	GlobalCatalog    bool     `long:"gc" description:"Search users in the Global Catalog to serve users from all domains of the forest"`
+	GCPort           int      `long:"gc-port" description:"Global Catalog port (default: 3268, 3269 with --tls)"`
+	Watch            string   `long:"watch" description:"Evict the cached answers depending on the entries changed in the directory, polled by uSNChanged (Active Directory) or modifyTimestamp" choice:"usn" choice:"timestamp"`
+}
+
+// Servers returns the addresses of the servers on the given port
+func (o *Options) Servers(port int) []string {
+	var servers []string
+	for _, server := range o.ServerSlice {
+		servers = append(servers, fmt.Sprintf("%s:%d", server, port))
+	}
+	return servers
+}
+
+// GlobalCatalogPort returns the port of the Global Catalog of the servers
+func (o *Options) GlobalCatalogPort() int {
+	if o.GCPort != 0 {
+		return o.GCPort
+	}
+	if o.UseTLS {
+		return 3269
+	}
+	return 3268
+}
+
+// ApplyProfile applies the settings of the profile to the options. The
+// settings which are not connection options are passed to apply. A profile
+// listing servers replaces the servers of the options, and the bind password
+// is read from the password file unless the profile sets it.
+func (o *Options) ApplyProfile(p *profile.Profile, apply func(setting profile.Setting) error) error {
+	servers := o.ServerSlice
+	o.ServerSlice = nil
+	for _, setting := range p.Settings {
+		handled, err := o.applySetting(setting)
+		if err == nil && !handled {
+			err = apply(setting)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if o.ServerSlice == nil {
+		o.ServerSlice = servers
+	}
+	if o.BindPassword == "" {
+		if o.PwdFile == "" {
+			return fmt.Errorf("password for LDAP connection is not set")
+		}
+		password, err := ReadPasswordFile(o.PwdFile)
+		if err != nil {
+			return err
+		}
+		o.BindPassword = password
+	}
+	return nil
+}
+
+// applySetting sets the connection option named by the key of the setting,
+// and reports whether the key names one
+func (o *Options) applySetting(setting profile.Setting) (bool, error) {
+	var err error
+	value := setting.Value
+	switch setting.Key {
+	case "server":
+		o.ServerSlice = append(o.ServerSlice, value)
+	case "port":
+		o.ServerPort, err = strconv.Atoi(value)
+	case "tls":
+		o.UseTLS, err = strconv.ParseBool(value)
+	case "binduser":
+		o.BindUsername = value
+	case "bindpassword":
+		o.BindPassword = value
+	case "pwdfile":
+		o.PwdFile = value
+		o.BindPassword = ""
+	case "basedn":
+		o.BaseDN = value
+	case "upn-lookup":
+		o.UPNLookup, err = strconv.ParseBool(value)
+	case "referrals":
+		o.Referrals, err = strconv.ParseBool(value)
+	case "referral-hops":
+		o.ReferralHops, err = strconv.Atoi(value)
+	case "referral-hosts":
+		o.ReferralHosts = []string{value}
+	case "referral-timeout":
+		o.ReferralTimeout, err = strconv.Atoi(value)
+	case "referral-no-verify":
+		o.ReferralNoVerify, err = strconv.ParseBool(value)
+	case "referral-insecure-bind":
+		o.ReferralInsecure, err = strconv.ParseBool(value)
+	case "gc":
+		o.GlobalCatalog, err = strconv.ParseBool(value)
+	case "gc-port":
+		o.GCPort, err = strconv.Atoi(value)
+	case "max-dials":
+		o.MaxDials, err = strconv.Atoi(value)
+	case "watch":
+		if value != changewatch.USN && value != changewatch.Timestamp {
+			return true, fmt.Errorf("unknown watch mode %q", value)
+		}
+		o.Watch = value
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid value %q of option %s", value, setting.Key)
+	}
+	return true, nil
+}
+
+// ReadPasswordFile returns the first line of the password file
+func ReadPasswordFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	line, _ := bufio.NewReader(file).ReadString('\n')
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// NewPool creates a pool of connections to the LDAP servers of the options
+// on the given port
+func NewPool(o *Options, port int) (ldappool.Pool, error) {
+	servers := o.Servers(port)
+	serverpool, err := ldappool.NewServerPool(&servers, 10000, 200, true)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create LDAP server pool: %s", err.Error())
+	}
+	pool, err := ldappool.NewChannelPool(0, 100*len(o.ServerSlice), o.MaxDials, serverpool, o.UseTLS, []uint8{ldap.LDAPResultTimeLimitExceeded, ldap.ErrorNetwork, ldap.LDAPResultInvalidCredentials})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create LDAP connection pool: %s", err.Error())
+	}
+	return pool, nil
+}
+
+// Backend is an LDAP directory served by a helper: the default one set up by
+// the options, or a profile overriding some of them
+type Backend struct {
+	// Name is the profile name, empty for the default backend
+	Name    string
+	Pool    ldappool.Pool
+	Metrics profile.Metrics
+	Watcher *changewatch.Watcher
+
+	opts *Options
+}
+
+// New returns the backend with the options, with a pool of connections to
+// its servers on the given port
+func New(name string, o *Options, port int) (*Backend, error) {
+	pool, err := NewPool(o, port)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{Name: name, Pool: pool, opts: o}, nil
+}
+
+// Close closes the connection pool of the backend and logs its metrics
+func (b *Backend) Close() {
+	stats := b.Pool.Stats()
+	log.Printf("[INFO] Backend %s - %s, connection gets: %d, reused: %d, dials: %d, dial errors: %d, discarded: %d, dial waits: %d", b.Label(), b.Metrics.String(), stats.Gets, stats.Reused, stats.Dials, stats.DialErrors, stats.Discarded, stats.DialWaits)
+	b.Pool.Close()
+}
+
+// Label returns the name of the backend in the logs
+func (b *Backend) Label() string {
+	if b.Name == "" {
+		return "default"
+	}
+	return b.Name
+}
+
+// CacheKey returns the key of a cache entry of the backend, so that the
+// users of two backends never share an entry
+func (b *Backend) CacheKey(key string) string {
+	if b.Name == "" {
+		return key
+	}
+	return b.Name + "/" + key
+}
+
+// Search performs the search request, following referrals to the other
+// domains of the forest if enabled
+func (b *Backend) Search(ctx context.Context, conn *ldappool.PoolConn, searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if !b.opts.Referrals {
+		return conn.SearchContext(ctx, searchRequest)
+	}
+	return conn.SearchWithReferralsContext(ctx, searchRequest, b.referralConfig())
+}
+
+// SearchExists reports whether the search request matches an entry. The
+// search is stopped as soon as the first entry arrives.
+func (b *Backend) SearchExists(ctx context.Context, conn *ldappool.PoolConn, searchRequest *ldap.SearchRequest) (bool, error) {
+	if b.opts.Referrals {
+		sr, err := b.Search(ctx, conn, searchRequest)
+		if err != nil {
+			return false, err
+		}
+		return len(sr.Entries) > 0, nil
+	}
+
+	found := false
+	_, err := conn.SearchStreamContext(ctx, searchRequest, 0, func(*ldap.Entry) error {
+		found = true
+		return ldap.ErrStopSearch
+	})
+	return found, err
+}
+
+// referralConfig returns the settings of the referrals followed from the
+// servers of the backend
+func (b *Backend) referralConfig() *ldap.ReferralConfig {
+	return &ldap.ReferralConfig{
+		HopLimit:     b.opts.ReferralHops,
+		Username:     b.opts.BindUsername,
+		Password:     b.opts.BindPassword,
+		TLSConfig:    &tls.Config{InsecureSkipVerify: b.opts.ReferralNoVerify},
+		Timeout:      time.Duration(b.opts.ReferralTimeout) * time.Millisecond,
+		Hosts:        referralHosts(b.opts),
+		InsecureBind: b.opts.ReferralInsecure,
+	}
+}
+
+// referralHosts returns the hosts referrals are followed to, those of
+// --referral-hosts or else the servers of the backend and the DNS domain of
+// its BaseDN
+func referralHosts(o *Options) []string {
+	var hosts []string
+	for _, value := range o.ReferralHosts {
+		for _, host := range strings.Split(value, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	if len(hosts) != 0 {
+		return hosts
+	}
+	hosts = append(hosts, o.ServerSlice...)
+	if domain := dnsDomain(o.BaseDN); domain != "" {
+		hosts = append(hosts, domain)
+	}
+	return hosts
+}
+
+// dnsDomain returns the DNS domain named by the dc components of the DN,
+// empty if it has none
+func dnsDomain(s string) string {
+	dn, err := ldap.ParseDN(s)
+	if err != nil {
+		return ""
+	}
+	var labels []string
+	for _, rdn := range dn.RDNs {
+		for _, attribute := range rdn.Attributes {
+			if strings.EqualFold(attribute.Type, "dc") {
+				labels = append(labels, attribute.Value)
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// ParseProfiles parses the profiles and the routes of the users to them, and
+// passes each profile to open, which sets up its backend. It fails on the
+// profiles defined twice and the routes to undefined profiles.
+func ParseProfiles(specs, routes []string, open func(p *profile.Profile) error) (*profile.Router, error) {
+	defined := map[string]bool{}
+	for _, spec := range specs {
+		p, err := profile.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		if defined[p.Name] {
+			return nil, fmt.Errorf("profile %s is defined twice", p.Name)
+		}
+		defined[p.Name] = true
+		if err := open(p); err != nil {
+			return nil, fmt.Errorf("profile %s: %s", p.Name, err.Error())
+		}
+	}
+
+	r, err := profile.NewRouter(routes)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range r.Profiles() {
+		if !defined[name] {
+			return nil, fmt.Errorf("profile %s of a route is not defined", name)
+		}
+	}
+	return r, nil
+}
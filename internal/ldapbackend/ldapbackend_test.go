@@ -0,0 +1,139 @@
+package ldapbackend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/profile"
+)
+
+func TestApplyProfile(t *testing.T) {
+	file, err := ioutil.TempFile("", "pwdfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("corpsecret\n")
+	file.Close()
+
+	o := Options{ServerSlice: []string{"dc1.domain.local"}, ServerPort: 389, BindPassword: "secret", ReferralHops: 5}
+	p, err := profile.Parse("corp:server=dc1.corp.local;server=dc2.corp.local;tls;pwdfile=" + file.Name() + ";gc-port=3269;schema=ad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var passed []string
+	err = o.ApplyProfile(p, func(setting profile.Setting) error {
+		passed = append(passed, setting.Key+"="+setting.Value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Options{
+		ServerSlice:  []string{"dc1.corp.local", "dc2.corp.local"},
+		ServerPort:   389,
+		UseTLS:       true,
+		BindPassword: "corpsecret",
+		PwdFile:      file.Name(),
+		ReferralHops: 5,
+		GCPort:       3269,
+	}
+	if !reflect.DeepEqual(o, expected) {
+		t.Errorf("got %+v, expected %+v", o, expected)
+	}
+	if fmt.Sprint(passed) != "[schema=ad]" {
+		t.Errorf("got settings %v passed to the helper, expected schema=ad", passed)
+	}
+
+	o = Options{ServerSlice: []string{"dc1.domain.local"}, BindPassword: "secret"}
+	p, _ = profile.Parse("lab:basedn=dc=lab,dc=local")
+	if err := o.ApplyProfile(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(o.ServerSlice) != "[dc1.domain.local]" || o.BaseDN != "dc=lab,dc=local" {
+		t.Errorf("got %+v, expected the servers of the options to be kept", o)
+	}
+
+	for _, spec := range []string{"lab:port=ldap", "lab:watch=never", "lab:pwdfile=/nonexistent", "lab:unknown=1"} {
+		o = Options{BindPassword: "secret"}
+		p, _ = profile.Parse(spec)
+		err := o.ApplyProfile(p, func(setting profile.Setting) error {
+			return fmt.Errorf("unknown option %q", setting.Key)
+		})
+		if err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestParseProfiles(t *testing.T) {
+	var opened []string
+	open := func(p *profile.Profile) error {
+		opened = append(opened, p.Name)
+		return nil
+	}
+	r, err := ParseProfiles([]string{"corp:tls", "lab:gc"}, []string{"CORP=corp"}, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(opened) != "[corp lab]" || fmt.Sprint(r.Profiles()) != "[corp]" {
+		t.Errorf("got profiles %v and routes to %v", opened, r.Profiles())
+	}
+
+	tests := map[string][][]string{
+		"defined twice": {{"corp:tls", "corp:gc"}, nil},
+		"undefined":     {{"corp:tls"}, {"LAB=lab"}},
+		"invalid":       {{"corp"}, nil},
+		"bad route":     {{"corp:tls"}, {"corp"}},
+	}
+	for name, test := range tests {
+		if _, err := ParseProfiles(test[0], test[1], open); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	_, err = ParseProfiles([]string{"corp:tls"}, nil, func(p *profile.Profile) error {
+		return fmt.Errorf("no servers")
+	})
+	if err == nil || err.Error() != "profile corp: no servers" {
+		t.Errorf("got error %v, expected the error of the profile", err)
+	}
+}
+
+func TestReferralHosts(t *testing.T) {
+	o := Options{ServerSlice: []string{"dc1.domain.local"}, BaseDN: "ou=Users,dc=domain,dc=local"}
+	if hosts := referralHosts(&o); fmt.Sprint(hosts) != "[dc1.domain.local domain.local]" {
+		t.Errorf("got default referral hosts %v", hosts)
+	}
+	o.ReferralHosts = []string{"dc1.domain.local, other.local", "127.0.0.1"}
+	if hosts := referralHosts(&o); fmt.Sprint(hosts) != "[dc1.domain.local other.local 127.0.0.1]" {
+		t.Errorf("got referral hosts %v", hosts)
+	}
+}
+
+func TestGlobalCatalogPort(t *testing.T) {
+	tests := []struct {
+		o    Options
+		port int
+	}{
+		{Options{}, 3268},
+		{Options{UseTLS: true}, 3269},
+		{Options{UseTLS: true, GCPort: 3270}, 3270},
+	}
+	for _, test := range tests {
+		if port := test.o.GlobalCatalogPort(); port != test.port {
+			t.Errorf("%+v: got port %d, expected %d", test.o, port, test.port)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	if key := (&Backend{}).CacheKey("jdoe:Internet"); key != "jdoe:Internet" {
+		t.Errorf("got default backend key %q", key)
+	}
+	if key := (&Backend{Name: "corp"}).CacheKey("jdoe:Internet"); key != "corp/jdoe:Internet" {
+		t.Errorf("got profile backend key %q", key)
+	}
+}
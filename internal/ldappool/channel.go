@@ -1,10 +1,12 @@
 package ldappool
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
@@ -12,15 +14,35 @@ import (
 
 // channelPool implements the Pool interface based on buffered channels.
 type channelPool struct {
+	// stats is first to keep its counters 64-bit aligned for atomic access
+	stats Stats
 	// storage for our net.Conn connections
 	mu         sync.RWMutex
-	conns      chan ldap.Client
+	conns      chan idleConn
 	name       string
 	serverPool *serverPool
 	useTLS     bool
 	closeAt    []uint8
+	// dials bounds the number of connections dialed at the same time, nil
+	// if unlimited
+	dials chan struct{}
+	// probeIdle is the idle time after which a connection is probed before
+	// it is handed out again
+	probeIdle time.Duration
 }
 
+// idleConn is a connection waiting in the pool since a time
+type idleConn struct {
+	conn  ldap.Client
+	since time.Time
+}
+
+// defaultProbeIdle is the idle time after which a connection is probed
+// before it is handed out again. Connections used more recently than that
+// are only checked for a Notice of Disconnection, so that busy pools do not
+// pay a round trip per request.
+const defaultProbeIdle = 10 * time.Second
+
 // PoolFactory is a function to create new connections.
 // type ChannelPoolFactory func(string) (ldap.Client, error)
 
@@ -35,33 +57,41 @@ type channelPool struct {
 // of the call is one of those passed, most likely you want to set this to something
 // like
 //   []uint8{ldap.LDAPResultTimeLimitExceeded, ldap.ErrorNetwork}
-func NewChannelPool(initialCap, maxCap int, servers *serverPool, useTLS bool, closeAt []uint8) (Pool, error) {
-	if initialCap < 0 || maxCap <= 0 || initialCap > maxCap {
+//
+// maxDials bounds the number of connections dialed at the same time, so that
+// a burst of requests does not stampede an overloaded server. A zero maxDials
+// sets no limit.
+func NewChannelPool(initialCap, maxCap, maxDials int, servers *serverPool, useTLS bool, closeAt []uint8) (Pool, error) {
+	if initialCap < 0 || maxCap <= 0 || initialCap > maxCap || maxDials < 0 {
 		return nil, errors.New("invalid capacity settings")
 	}
 
 	c := &channelPool{
-		conns:      make(chan ldap.Client, maxCap),
+		conns:      make(chan idleConn, maxCap),
 		serverPool: servers,
 		useTLS:     useTLS,
 		closeAt:    closeAt,
+		probeIdle:  defaultProbeIdle,
+	}
+	if maxDials > 0 {
+		c.dials = make(chan struct{}, maxDials)
 	}
 
 	// create initial connections, if something goes wrong,
 	// just close the pool error out.
 	for i := 0; i < initialCap; i++ {
-		conn, err := c.NewConn(useTLS)
+		conn, err := c.NewConn(context.Background(), useTLS)
 		if err != nil {
 			c.Close()
 			return nil, errors.New("factory is not able to fill the pool: " + err.Error())
 		}
-		c.conns <- conn
+		c.conns <- idleConn{conn: conn, since: time.Now()}
 	}
 
 	return c, nil
 }
 
-func (c *channelPool) getConns() chan ldap.Client {
+func (c *channelPool) getConns() chan idleConn {
 	c.mu.RLock()
 	conns := c.conns
 	c.mu.RUnlock()
@@ -71,35 +101,87 @@ func (c *channelPool) getConns() chan ldap.Client {
 // Get implements the Pool interfaces Get() method. If there is no new
 // connection available in the pool, a new connection will be created via the
 // Factory() method.
-func (c *channelPool) Get() (*PoolConn, error) {
+func (c *channelPool) Get(ctx context.Context) (*PoolConn, error) {
 	conns := c.getConns()
 	if conns == nil {
 		return nil, ErrClosed
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// wrap our connections with our ldap.Client implementation (wrapConn
 	// method) that puts the connection back to the pool if it's closed.
 	select {
-	case conn := <-conns:
-		if conn == nil {
+	case idle, ok := <-conns:
+		if !ok {
 			return nil, ErrClosed
 		}
-		if isAlive(conn) {
-			return c.wrapConn(conn, c.closeAt), nil
+		if c.isAlive(ctx, idle) {
+			atomic.AddUint64(&c.stats.Gets, 1)
+			atomic.AddUint64(&c.stats.Reused, 1)
+			return c.wrapConn(idle.conn, c.closeAt), nil
 		}
-		conn.Close()
-		return c.NewConn(c.useTLS)
+		atomic.AddUint64(&c.stats.Discarded, 1)
+		idle.conn.Close()
+		return c.getNewConn(ctx)
 	default:
-		return c.NewConn(c.useTLS)
+		return c.getNewConn(ctx)
 	}
 }
 
-func isAlive(conn ldap.Client) bool {
-	_, err := conn.Search(&ldap.SearchRequest{BaseDN: "", Scope: ldap.ScopeBaseObject, Filter: "(&)", Attributes: []string{"1.1"}})
-	return err == nil
+// getNewConn dials a new connection, once the number of dials in flight is
+// below the limit
+func (c *channelPool) getNewConn(ctx context.Context) (*PoolConn, error) {
+	if c.dials != nil {
+		select {
+		case c.dials <- struct{}{}:
+		default:
+			atomic.AddUint64(&c.stats.DialWaits, 1)
+			select {
+			case c.dials <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		defer func() { <-c.dials }()
+	}
+
+	conn, err := c.NewConn(ctx, c.useTLS)
+	if err != nil {
+		atomic.AddUint64(&c.stats.DialErrors, 1)
+		return nil, err
+	}
+	atomic.AddUint64(&c.stats.Gets, 1)
+	atomic.AddUint64(&c.stats.Dials, 1)
+	return conn, nil
 }
 
-func (c *channelPool) NewConn(useTLS bool) (*PoolConn, error) {
+// isAlive reports whether the idle connection is still usable. Connections
+// idle for longer than probeIdle are probed with a WhoAmI request. Any
+// answer of the server, even an error for servers which do not support
+// WhoAmI, shows that the connection is alive.
+func (c *channelPool) isAlive(ctx context.Context, idle idleConn) bool {
+	if idle.conn.IsClosing() {
+		return false
+	}
+	if time.Since(idle.since) < c.probeIdle {
+		return true
+	}
+	_, err := idle.conn.WhoAmIContext(ctx)
+	return err == nil || isServerResult(err)
+}
+
+// isServerResult reports whether err is an LDAP result returned by the
+// server rather than a client side error
+func isServerResult(err error) bool {
+	if ldapErr, ok := err.(*ldap.Error); ok {
+		return ldapErr.ResultCode < ldap.ErrorNetwork
+	}
+	return false
+}
+
+func (c *channelPool) NewConn(ctx context.Context, useTLS bool) (*PoolConn, error) {
 	var conn *ldap.Conn
 
 	server, err := c.serverPool.Get()
@@ -108,15 +190,16 @@ func (c *channelPool) NewConn(useTLS bool) (*PoolConn, error) {
 	}
 
 	if useTLS {
-		conn, err = ldap.DialTLS("tcp", server, &tls.Config{InsecureSkipVerify: true})
+		conn, err = ldap.DialTLSContext(ctx, "tcp", server, &tls.Config{InsecureSkipVerify: true})
 	} else {
-		conn, err = ldap.Dial("tcp", server)
+		conn, err = ldap.DialContext(ctx, "tcp", server)
 	}
 
 	if err != nil {
 		return nil, err
 	}
-	conn.SetTimeout(time.Duration(300) * time.Millisecond)
+	// the connections set no request timeout of their own: each request
+	// is bounded by the deadline of its context
 	return c.wrapConn(conn, c.closeAt), nil
 }
 
@@ -133,18 +216,18 @@ func (c *channelPool) put(conn ldap.Client) {
 
 	if c.conns == nil {
 		// pool is closed, close passed connection
-		conn.Close()
+		conn.Unbind()
 		return
 	}
 
 	// put the resource back into the pool. If the pool is full, this will
 	// block and the default case will be executed.
 	select {
-	case c.conns <- conn:
+	case c.conns <- idleConn{conn: conn, since: time.Now()}:
 		return
 	default:
 		// pool is full, close passed connection
-		conn.Close()
+		conn.Unbind()
 		return
 	}
 }
@@ -160,14 +243,30 @@ func (c *channelPool) Close() {
 	}
 
 	close(conns)
-	for conn := range conns {
-		conn.Close()
+	for idle := range conns {
+		idle.conn.Unbind()
 	}
 	return
 }
 
 func (c *channelPool) Len() int { return len(c.getConns()) }
 
+func (c *channelPool) Stats() Stats {
+	return Stats{
+		Gets:       atomic.LoadUint64(&c.stats.Gets),
+		Reused:     atomic.LoadUint64(&c.stats.Reused),
+		Dials:      atomic.LoadUint64(&c.stats.Dials),
+		DialErrors: atomic.LoadUint64(&c.stats.DialErrors),
+		Discarded:  atomic.LoadUint64(&c.stats.Discarded),
+		DialWaits:  atomic.LoadUint64(&c.stats.DialWaits),
+		Idle:       c.Len(),
+	}
+}
+
+func (c *channelPool) Servers() []ServerStatus {
+	return c.serverPool.status()
+}
+
 func (c *channelPool) wrapConn(conn ldap.Client, closeAt []uint8) *PoolConn {
 	p := &PoolConn{c: c, closeAt: closeAt}
 	p.Conn = conn
@@ -0,0 +1,302 @@
+package ldappool
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldaptest"
+)
+
+// stalledServer accepts connections and never answers, so that TLS dials to
+// it last until their context is done
+func stalledServer(t *testing.T) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return l.Addr().String(), func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+func TestMaxDialsLimitsConcurrentDials(t *testing.T) {
+	addr, stop := stalledServer(t)
+	defer stop()
+	servers, err := NewServerPool(&[]string{addr}, 10000, 200, true)
+	if err != nil {
+		t.Fatalf("cannot create server pool: %s", err)
+	}
+	p, err := NewChannelPool(0, 10, 1, servers, true, nil)
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer p.Close()
+
+	// the first dial stalls in the TLS handshake
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		if _, err := p.Get(ctx); err == nil {
+			t.Error("got a connection to a stalled server")
+		}
+	}()
+	for len(p.(*channelPool).dials) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if _, err := p.Get(ctx); err != context.DeadlineExceeded {
+				t.Errorf("got error %v, expected the deadline of the wait", err)
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+
+	// one dial reaches the server, the others wait for it until they give up
+	if s := p.Stats(); s.DialErrors != 1 || s.DialWaits != 2 {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestNewChannelPoolRejectsInvalidCapacity(t *testing.T) {
+	servers, err := NewServerPool(&[]string{"127.0.0.1:389"}, 10000, 200, true)
+	if err != nil {
+		t.Fatalf("cannot create server pool: %s", err)
+	}
+	if _, err := NewChannelPool(0, 10, -1, servers, false, nil); err == nil {
+		t.Error("accepted a negative dial limit")
+	}
+}
+
+func TestServersReportsUnreachableServers(t *testing.T) {
+	addr, stop := stalledServer(t)
+	stop()
+	servers, err := NewServerPool(&[]string{addr}, 10000, 200, true)
+	if err != nil {
+		t.Fatalf("cannot create server pool: %s", err)
+	}
+	p, err := NewChannelPool(0, 10, 1, servers, false, nil)
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer p.Close()
+
+	if s := p.Servers(); len(s) != 1 || s[0].Address != addr || !s[0].Alive {
+		t.Fatalf("got servers %+v before any connection", s)
+	}
+	if _, err := p.Get(context.Background()); err == nil {
+		t.Fatal("got a connection to a stopped server")
+	}
+	if s := p.Servers(); s[0].Alive {
+		t.Errorf("got servers %+v after a failed connection", s)
+	}
+}
+
+func TestProbeIdleConnections(t *testing.T) {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	defer srv.Close()
+	srv.AddCredentials("squid@domain.local", "secret")
+	servers, err := NewServerPool(&[]string{srv.Addr()}, 10000, 200, true)
+	if err != nil {
+		t.Fatalf("cannot create server pool: %s", err)
+	}
+	p, err := NewChannelPool(0, 10, 1, servers, false, nil)
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer p.Close()
+	get := func() {
+		conn, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatalf("cannot get a connection: %s", err)
+		}
+		if err := conn.Bind("squid@domain.local", "secret"); err != nil {
+			t.Fatalf("cannot bind: %s", err)
+		}
+		conn.Close()
+	}
+
+	// a connection used recently is handed out without a round trip, each
+	// bind is checked with WhoAmI
+	get()
+	get()
+	if n := srv.CountRequests(ldap.ApplicationExtendedRequest); n != 2 {
+		t.Errorf("got %d WhoAmI requests for a connection used recently, expected 2", n)
+	}
+
+	p.(*channelPool).probeIdle = 0
+	get()
+	if n := srv.CountRequests(ldap.ApplicationExtendedRequest); n != 4 {
+		t.Errorf("got %d WhoAmI requests for an idle connection, expected 4", n)
+	}
+	if s := p.Stats(); s.Dials != 1 || s.Reused != 2 {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestSlowSearchWithinDeadline(t *testing.T) {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	defer srv.Close()
+	srv.AddEntry("dc=domain,dc=local", map[string][]string{"objectClass": {"domain"}})
+	srv.SetSearchDelay(500 * time.Millisecond)
+	servers, err := NewServerPool(&[]string{srv.Addr()}, 10000, 200, true)
+	if err != nil {
+		t.Fatalf("cannot create server pool: %s", err)
+	}
+	p, err := NewChannelPool(0, 10, 1, servers, false, nil)
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf("cannot get a connection: %s", err)
+	}
+	defer conn.Close()
+	sr, err := conn.SearchContext(ctx, ldap.NewSearchRequest("dc=domain,dc=local", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+	if err != nil || len(sr.Entries) != 1 {
+		t.Fatalf("got %v, error %v for a search answered within the deadline", sr, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := conn.SearchContext(ctx, ldap.NewSearchRequest("dc=domain,dc=local", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil)); err == nil {
+		t.Error("got no error for a search answered after the deadline")
+	}
+}
+
+func TestBindWithoutPasswordIsRefused(t *testing.T) {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	defer srv.Close()
+	servers, err := NewServerPool(&[]string{srv.Addr()}, 10000, 200, true)
+	if err != nil {
+		t.Fatalf("cannot create server pool: %s", err)
+	}
+	p, err := NewChannelPool(0, 10, 1, servers, false, nil)
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer p.Close()
+
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("cannot get a connection: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.Bind("squid@domain.local", ""); !ldap.IsErrorWithCode(err, ldap.LDAPResultInappropriateAuthentication) {
+		t.Errorf("got %v binding without password", err)
+	}
+	if srv.CountRequests(ldap.ApplicationBindRequest) != 0 {
+		t.Errorf("bind without password was sent to the server")
+	}
+}
+
+func TestBindCheckedWithWhoAmI(t *testing.T) {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("cannot start fake LDAP server: %s", err)
+	}
+	defer srv.Close()
+	srv.AddCredentials("squid@domain.local", "secret")
+	servers, err := NewServerPool(&[]string{srv.Addr()}, 10000, 200, true)
+	if err != nil {
+		t.Fatalf("cannot create server pool: %s", err)
+	}
+	p, err := NewChannelPool(0, 10, 1, servers, false, nil)
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer p.Close()
+
+	for _, test := range []struct {
+		authzID string
+		ok      bool
+	}{
+		{"u:DOMAIN\\squid", true},
+		{"", false},
+		{"u:DOMAIN\\guest", false},
+	} {
+		srv.SetIdentity("squid@domain.local", test.authzID)
+		dials := p.Stats().Dials
+		conn, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatalf("cannot get a connection: %s", err)
+		}
+		err = conn.Bind("squid@domain.local", "secret")
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got bind error %v", test.authzID, err)
+		}
+		conn.Close()
+		if !test.ok && p.Len() != 0 {
+			t.Errorf("%q: the connection went back to the pool", test.authzID)
+		}
+		if test.ok && p.Stats().Dials != dials+1 {
+			t.Errorf("%q: got stats %+v", test.authzID, p.Stats())
+		}
+	}
+}
+
+func TestAuthzIDMatches(t *testing.T) {
+	for _, test := range []struct {
+		authzID, username string
+		expected          bool
+	}{
+		{"u:squid@domain.local", "squid@domain.local", true},
+		{"u:DOMAIN\\squid", "squid@domain.local", true},
+		{"u:DOMAIN\\squid", "DOMAIN\\Squid", true},
+		{"u:DOMAIN\\guest", "squid@domain.local", false},
+		{"dn:cn=Squid,ou=Services,dc=domain,dc=local", "CN=Squid, OU=Services, DC=domain, DC=local", true},
+		{"dn:cn=Guest,ou=Services,dc=domain,dc=local", "cn=Squid,ou=Services,dc=domain,dc=local", false},
+		{"dn:cn=Squid,ou=Services,dc=domain,dc=local", "squid@domain.local", true},
+		{"u:DOMAIN\\squid", "cn=Squid,ou=Services,dc=domain,dc=local", true},
+	} {
+		if got := authzIDMatches(test.authzID, test.username); got != test.expected {
+			t.Errorf("%q, %q: got %t", test.authzID, test.username, got)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package ldappool
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
@@ -27,22 +31,117 @@ func (p *PoolConn) StartTLS(config *tls.Config) error {
 
 // Close() puts the given connects back to the pool instead of closing it.
 func (p *PoolConn) Close() {
-	if p.unusable {
+	if p.Conn == nil {
+		return
+	}
+	if p.unusable || p.Conn.IsClosing() {
 		log.Printf("Closing unusable connection")
-		if p.Conn != nil {
-			p.Conn.Close()
-		}
+		atomic.AddUint64(&p.c.stats.Discarded, 1)
+		p.Conn.Unbind()
 		return
 	}
 	p.c.put(p.Conn)
 }
 
+// Unbind() closes the underlying connection gracefully instead of putting it
+// back to the pool.
+func (p *PoolConn) Unbind() error {
+	p.unusable = true
+	return p.Conn.Unbind()
+}
+
 func (p *PoolConn) SimpleBind(simpleBindRequest *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
 	return p.Conn.SimpleBind(simpleBindRequest)
 }
 
+func (p *PoolConn) SimpleBindContext(ctx context.Context, simpleBindRequest *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+	return p.Conn.SimpleBindContext(ctx, simpleBindRequest)
+}
+
+// IsClosing() reports whether the underlying connection is closed, e.g. after
+// a Notice of Disconnection from the server.
+func (p *PoolConn) IsClosing() bool {
+	return p.Conn.IsClosing()
+}
+
 func (p *PoolConn) Bind(username, password string) error {
-	return p.Conn.Bind(username, password)
+	return p.BindContext(context.Background(), username, password)
+}
+
+// BindContext() binds the connection and checks with WhoAmI that the server
+// authenticated the bind user. A bind with a name and an empty password is
+// refused without asking the server, as servers like Active Directory accept
+// it as an unauthenticated bind leaving the connection anonymous.
+func (p *PoolConn) BindContext(ctx context.Context, username, password string) error {
+	if username != "" && password == "" {
+		return ldap.NewError(ldap.LDAPResultInappropriateAuthentication, fmt.Errorf("ldap: bind as %q without password would leave the connection anonymous", username))
+	}
+	if err := p.Conn.BindContext(ctx, username, password); err != nil {
+		return err
+	}
+	return p.checkBind(ctx, username)
+}
+
+// checkBind() detects a bind that left the connection anonymous or bound to
+// another identity than username, and marks the connection unusable. Servers
+// which do not support WhoAmI are trusted.
+func (p *PoolConn) checkBind(ctx context.Context, username string) error {
+	if username == "" {
+		return nil
+	}
+	authzID, err := p.Conn.WhoAmIContext(ctx)
+	if err != nil {
+		if isServerResult(err) {
+			return nil
+		}
+		p.MarkUnusable()
+		return err
+	}
+	if authzID == "" {
+		p.MarkUnusable()
+		return ldap.NewError(ldap.LDAPResultInappropriateAuthentication, fmt.Errorf("ldap: bind as %q left the connection anonymous", username))
+	}
+	if !authzIDMatches(authzID, username) {
+		p.MarkUnusable()
+		return ldap.NewError(ldap.LDAPResultInappropriateAuthentication, fmt.Errorf("ldap: bind as %q authorized %q", username, authzID))
+	}
+	return nil
+}
+
+// authzIDMatches reports whether the authorization identity returned by
+// WhoAmI names the bind user. A "dn:" identity is compared with a bind DN,
+// and a "u:" identity with the account name of a bind given as user@realm or
+// DOMAIN\user. Identities which cannot be compared with the form of the bind
+// name are trusted.
+func authzIDMatches(authzID, username string) bool {
+	userDN, userErr := ldap.ParseDN(username)
+	isDN := userErr == nil && strings.Contains(username, "=")
+	switch {
+	case strings.HasPrefix(authzID, "dn:"):
+		if !isDN {
+			return true
+		}
+		dn, err := ldap.ParseDN(authzID[len("dn:"):])
+		return err == nil && dn.Equal(userDN)
+	case strings.HasPrefix(authzID, "u:"):
+		if isDN {
+			return true
+		}
+		return strings.EqualFold(accountName(authzID[len("u:"):]), accountName(username))
+	}
+	return true
+}
+
+// accountName returns the account name of a user name given as user@realm
+// or DOMAIN\user
+func accountName(name string) string {
+	if i := strings.LastIndex(name, "\\"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	return name
 }
 
 // MarkUnusable() marks the connection not usable any more, to let the pool close it
@@ -68,25 +167,114 @@ func (p *PoolConn) Add(addRequest *ldap.AddRequest) error {
 	return p.Conn.Add(addRequest)
 }
 
+func (p *PoolConn) AddContext(ctx context.Context, addRequest *ldap.AddRequest) error {
+	return p.Conn.AddContext(ctx, addRequest)
+}
+
 func (p *PoolConn) Del(delRequest *ldap.DelRequest) error {
 	return p.Conn.Del(delRequest)
 }
 
+func (p *PoolConn) DelContext(ctx context.Context, delRequest *ldap.DelRequest) error {
+	return p.Conn.DelContext(ctx, delRequest)
+}
+
 func (p *PoolConn) Modify(modifyRequest *ldap.ModifyRequest) error {
 	return p.Conn.Modify(modifyRequest)
 }
 
+func (p *PoolConn) ModifyContext(ctx context.Context, modifyRequest *ldap.ModifyRequest) error {
+	return p.Conn.ModifyContext(ctx, modifyRequest)
+}
+
+func (p *PoolConn) ModifyDN(modifyDNRequest *ldap.ModifyDNRequest) error {
+	return p.Conn.ModifyDN(modifyDNRequest)
+}
+
+func (p *PoolConn) ModifyDNContext(ctx context.Context, modifyDNRequest *ldap.ModifyDNRequest) error {
+	return p.Conn.ModifyDNContext(ctx, modifyDNRequest)
+}
+
 func (p *PoolConn) Compare(dn, attribute, value string) (bool, error) {
 	return p.Conn.Compare(dn, attribute, value)
 }
 
+func (p *PoolConn) CompareContext(ctx context.Context, dn, attribute, value string) (bool, error) {
+	return p.Conn.CompareContext(ctx, dn, attribute, value)
+}
+
 func (p *PoolConn) PasswordModify(passwordModifyRequest *ldap.PasswordModifyRequest) (*ldap.PasswordModifyResult, error) {
 	return p.Conn.PasswordModify(passwordModifyRequest)
 }
 
+func (p *PoolConn) PasswordModifyContext(ctx context.Context, passwordModifyRequest *ldap.PasswordModifyRequest) (*ldap.PasswordModifyResult, error) {
+	return p.Conn.PasswordModifyContext(ctx, passwordModifyRequest)
+}
+
+func (p *PoolConn) Extended(oid string, value []byte) (*ldap.ExtendedResult, error) {
+	return p.Conn.Extended(oid, value)
+}
+
+func (p *PoolConn) ExtendedContext(ctx context.Context, oid string, value []byte) (*ldap.ExtendedResult, error) {
+	return p.Conn.ExtendedContext(ctx, oid, value)
+}
+
+func (p *PoolConn) WhoAmI() (string, error) {
+	return p.Conn.WhoAmI()
+}
+
+func (p *PoolConn) WhoAmIContext(ctx context.Context) (string, error) {
+	return p.Conn.WhoAmIContext(ctx)
+}
+
 func (p *PoolConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
 	return p.Conn.Search(searchRequest)
 }
+
+func (p *PoolConn) SearchContext(ctx context.Context, searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return p.Conn.SearchContext(ctx, searchRequest)
+}
+
 func (p *PoolConn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
 	return p.Conn.SearchWithPaging(searchRequest, pagingSize)
 }
+
+func (p *PoolConn) SearchWithPagingContext(ctx context.Context, searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	return p.Conn.SearchWithPagingContext(ctx, searchRequest, pagingSize)
+}
+
+func (p *PoolConn) SearchStream(searchRequest *ldap.SearchRequest, pagingSize uint32, handler func(*ldap.Entry) error) (*ldap.SearchResult, error) {
+	return p.Conn.SearchStream(searchRequest, pagingSize, handler)
+}
+
+func (p *PoolConn) SearchStreamContext(ctx context.Context, searchRequest *ldap.SearchRequest, pagingSize uint32, handler func(*ldap.Entry) error) (*ldap.SearchResult, error) {
+	return p.Conn.SearchStreamContext(ctx, searchRequest, pagingSize, handler)
+}
+
+func (p *PoolConn) SearchWithReferrals(searchRequest *ldap.SearchRequest, config *ldap.ReferralConfig) (*ldap.SearchResult, error) {
+	return p.Conn.SearchWithReferrals(searchRequest, config)
+}
+
+func (p *PoolConn) SearchWithReferralsContext(ctx context.Context, searchRequest *ldap.SearchRequest, config *ldap.ReferralConfig) (*ldap.SearchResult, error) {
+	return p.Conn.SearchWithReferralsContext(ctx, searchRequest, config)
+}
+
+func (p *PoolConn) SearchRangedAttribute(dn, attribute string) ([]string, error) {
+	return p.Conn.SearchRangedAttribute(dn, attribute)
+}
+
+func (p *PoolConn) SearchRangedAttributeContext(ctx context.Context, dn, attribute string) ([]string, error) {
+	return p.Conn.SearchRangedAttributeContext(ctx, dn, attribute)
+}
+
+func (p *PoolConn) Abandon(messageID int64) error {
+	return p.Conn.Abandon(messageID)
+}
+
+func (p *PoolConn) Cancel(messageID int64) error {
+	return p.Conn.Cancel(messageID)
+}
+
+func (p *PoolConn) CancelContext(ctx context.Context, messageID int64) error {
+	return p.Conn.CancelContext(ctx, messageID)
+}
@@ -1,7 +1,9 @@
 package ldappool
 
 import (
+	"context"
 	"errors"
+	"time"
 )
 
 var (
@@ -14,8 +16,9 @@ var (
 type Pool interface {
 	// Get returns a new connection from the pool. Closing the connections puts
 	// it back to the Pool. Closing it when the pool is destroyed or full will
-	// be counted as an error.
-	Get() (*PoolConn, error)
+	// be counted as an error. Checking and dialing connections gives up when
+	// ctx is done.
+	Get(ctx context.Context) (*PoolConn, error)
 
 	// Close closes the pool and all its connections. After Close() the pool is
 	// no longer usable.
@@ -23,4 +26,38 @@ type Pool interface {
 
 	// Len returns the current number of connections of the pool.
 	Len() int
+
+	// Stats returns the counters of the pool.
+	Stats() Stats
+
+	// Servers returns the state of the servers of the pool.
+	Servers() []ServerStatus
+}
+
+// Stats holds the counters of a pool since its creation
+type Stats struct {
+	// Gets is the number of connections handed out by Get
+	Gets uint64
+	// Reused is the number of connections handed out from the pool
+	Reused uint64
+	// Dials is the number of new connections
+	Dials uint64
+	// DialErrors is the number of failed connection attempts
+	DialErrors uint64
+	// Discarded is the number of dead or unusable connections closed
+	Discarded uint64
+	// DialWaits is the number of dials which waited for other dials to
+	// finish
+	DialWaits uint64
+	// Idle is the number of connections in the pool
+	Idle int
+}
+
+// ServerStatus is the state of a server of a pool
+type ServerStatus struct {
+	Address string
+	// Alive is unset if the server could not be reached at its last check
+	Alive bool
+	// LastCheck is the time the server was last checked
+	LastCheck time.Time
 }
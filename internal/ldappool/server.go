@@ -3,6 +3,7 @@ package ldappool
 import (
 	"errors"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -31,31 +32,36 @@ func (s *server) checkAvailability() bool {
 }
 
 type serverPool struct {
+	mu                sync.Mutex
 	servers           []server
 	lastUsed          int
 	strategy          poolStrategy
 	checkRetryTimeout time.Duration
 }
 
+// Get returns the address of an available server. The servers are dialed
+// without holding the lock, so that an unreachable server does not hold up
+// the other callers for its check timeout.
 func (c *serverPool) Get() (string, error) {
-	if len(c.servers) != 0 {
-		var serverIndex int
-		var err error
-
-		if c.strategy == RR {
-			serverIndex, err = c.findActiveServer(c.lastUsed + 1)
-		} else {
-			serverIndex, err = c.findActiveServer(0)
-		}
-		if err != nil {
-			return "", err
-		}
-		c.lastUsed = serverIndex
-
-		return c.servers[serverIndex].address, nil
-	} else {
+	c.mu.Lock()
+	if len(c.servers) == 0 {
+		c.mu.Unlock()
 		return "", errors.New("ldap server pool is empty")
 	}
+	starting := 0
+	if c.strategy == RR {
+		starting = c.lastUsed + 1
+	}
+	c.mu.Unlock()
+
+	serverIndex, err := c.findActiveServer(starting)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastUsed = serverIndex
+	return c.servers[serverIndex].address, nil
 }
 
 func (c *serverPool) findActiveServer(starting int) (int, error) {
@@ -75,23 +81,40 @@ func (c *serverPool) findActiveServer(starting int) (int, error) {
 				offset = (index + starting - pool_size)
 			}
 
+			c.mu.Lock()
 			if !c.servers[offset].alive {
 				if time.Now().Sub(c.servers[offset].lastCheck) < c.checkRetryTimeout {
+					c.mu.Unlock()
 					continue
 				}
 			}
 			c.servers[offset].lastCheck = time.Now()
-			if c.servers[offset].checkAvailability() {
-				c.servers[offset].alive = true
+			s := c.servers[offset]
+			c.mu.Unlock()
+
+			alive := s.checkAvailability()
+			c.mu.Lock()
+			c.servers[offset].alive = alive
+			c.mu.Unlock()
+			if alive {
 				return offset, nil
-			} else {
-				c.servers[offset].alive = false
 			}
 		}
 	}
 	return 0, errors.New("no active ldap server found")
 }
 
+// status returns the state of the servers
+func (c *serverPool) status() []ServerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var servers []ServerStatus
+	for _, s := range c.servers {
+		servers = append(servers, ServerStatus{Address: s.address, Alive: s.alive, LastCheck: s.lastCheck})
+	}
+	return servers
+}
+
 func NewServerPool(servers *[]string, checkRetryTimeout, serverCheckTimeout int, roundrobin bool) (*serverPool, error) {
 	var pool_server server
 	var c *serverPool
@@ -0,0 +1,208 @@
+package ldaptest
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"gopkg.in/asn1-ber.v1"
+)
+
+// Active Directory matching rules understood by the fake server
+const (
+	matchingRuleBitAnd  = "1.2.840.113556.1.4.803"
+	matchingRuleBitOr   = "1.2.840.113556.1.4.804"
+	matchingRuleInChain = "1.2.840.113556.1.4.1941"
+)
+
+// matchFilter evaluates a BER-encoded search filter against the entry. The
+// caller must hold s.mu.
+func (s *Server) matchFilter(filter *ber.Packet, entry *Entry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !s.matchFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if s.matchFilter(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		if len(filter.Children) != 1 {
+			return false
+		}
+		return !s.matchFilter(filter.Children[0], entry)
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch:
+		attribute, value := assertion(filter)
+		for _, v := range entry.GetAttributeValues(attribute) {
+			if equalValues(v, value) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		attribute, value := assertion(filter)
+		for _, v := range entry.GetAttributeValues(attribute) {
+			cmp := compareValues(v, value)
+			if (filter.Tag == ldap.FilterGreaterOrEqual && cmp >= 0) || (filter.Tag == ldap.FilterLessOrEqual && cmp <= 0) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(entry.GetAttributeValues(filter.Data.String())) > 0
+	case ldap.FilterSubstrings:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		attribute, _ := filter.Children[0].Value.(string)
+		for _, v := range entry.GetAttributeValues(attribute) {
+			if matchSubstrings(strings.ToLower(v), filter.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterExtensibleMatch:
+		return s.matchExtensible(filter, entry)
+	}
+	return false
+}
+
+func (s *Server) matchExtensible(filter *ber.Packet, entry *Entry) bool {
+	var rule, attribute, value string
+	for _, child := range filter.Children {
+		switch child.Tag {
+		case ldap.MatchingRuleAssertionMatchingRule:
+			rule = child.Data.String()
+		case ldap.MatchingRuleAssertionType:
+			attribute = child.Data.String()
+		case ldap.MatchingRuleAssertionMatchValue:
+			value = child.Data.String()
+		}
+	}
+
+	switch rule {
+	case matchingRuleInChain:
+		return s.inChain(entry, attribute, value)
+	case matchingRuleBitAnd, matchingRuleBitOr:
+		mask, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		for _, v := range entry.GetAttributeValues(attribute) {
+			flags, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			if rule == matchingRuleBitAnd && flags&mask == mask {
+				return true
+			}
+			if rule == matchingRuleBitOr && flags&mask != 0 {
+				return true
+			}
+		}
+		return false
+	case "":
+		for _, v := range entry.GetAttributeValues(attribute) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inChain implements LDAP_MATCHING_RULE_IN_CHAIN: it walks the DN-valued
+// attribute transitively, starting at the entry, looking for the given DN.
+func (s *Server) inChain(entry *Entry, attribute, dn string) bool {
+	target, err := parseDN(dn)
+	if err != nil {
+		return false
+	}
+
+	visited := map[string]bool{}
+	pending := entry.GetAttributeValues(attribute)
+	for len(pending) > 0 {
+		value := pending[0]
+		pending = pending[1:]
+
+		key := strings.ToLower(value)
+		if visited[key] {
+			continue
+		}
+		visited[key] = true
+
+		if current, err := parseDN(value); err == nil && current.Equal(target) {
+			return true
+		}
+		if next := s.findEntry(value); next != nil {
+			pending = append(pending, next.GetAttributeValues(attribute)...)
+		}
+	}
+	return false
+}
+
+func assertion(filter *ber.Packet) (attribute, value string) {
+	if len(filter.Children) != 2 {
+		return "", ""
+	}
+	attribute, _ = filter.Children[0].Value.(string)
+	value, _ = filter.Children[1].Value.(string)
+	return attribute, value
+}
+
+// equalValues compares two values ignoring case. Binary values, such as
+// SIDs, must match exactly.
+func equalValues(a, b string) bool {
+	if !utf8.ValidString(a) || !utf8.ValidString(b) {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
+}
+
+func compareValues(a, b string) int {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+func matchSubstrings(value string, substrings []*ber.Packet) bool {
+	pos := 0
+	for _, part := range substrings {
+		s := strings.ToLower(part.Data.String())
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, s) {
+				return false
+			}
+			pos = len(s)
+		case ldap.FilterSubstringsAny:
+			index := strings.Index(value[pos:], s)
+			if index < 0 {
+				return false
+			}
+			pos += index + len(s)
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value[pos:], s) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package ldaptest
+
+import (
+	"bufio"
+	"io"
+	"testing"
+	"time"
+)
+
+// ResponseTimeout bounds how long Helper waits for an answer line
+var ResponseTimeout = 5 * time.Second
+
+// Helper drives a Squid external ACL helper loop over in-memory pipes, the
+// same way Squid talks to the helper over its stdin and stdout.
+type Helper struct {
+	t         testing.TB
+	in        *io.PipeWriter
+	out       *io.PipeWriter
+	responses chan string
+	done      chan struct{}
+	err       error
+}
+
+// StartHelper runs serve in the background, feeding it the lines passed to
+// Send and collecting the lines it answers with.
+func StartHelper(t testing.TB, serve func(io.Reader, io.Writer) error) *Helper {
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+
+	h := &Helper{
+		t:         t,
+		in:        inWriter,
+		out:       outWriter,
+		responses: make(chan string, 1024),
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(outReader)
+		for scanner.Scan() {
+			h.responses <- scanner.Text()
+		}
+		close(h.responses)
+	}()
+
+	go func() {
+		h.err = serve(inReader, outWriter)
+		outWriter.Close()
+		close(h.done)
+	}()
+
+	return h
+}
+
+// Send writes request lines to the helper
+func (h *Helper) Send(lines ...string) {
+	for _, line := range lines {
+		if _, err := io.WriteString(h.in, line+"\n"); err != nil {
+			h.t.Fatalf("cannot send %q to the helper: %s", line, err)
+		}
+	}
+}
+
+// Receive returns the next answer line of the helper
+func (h *Helper) Receive() string {
+	select {
+	case line, ok := <-h.responses:
+		if !ok {
+			h.t.Fatal("helper closed its output")
+		}
+		return line
+	case <-time.After(ResponseTimeout):
+		h.t.Fatal("timed out waiting for the helper answer")
+	}
+	return ""
+}
+
+// ReceiveAll returns the next n answer lines of the helper
+func (h *Helper) ReceiveAll(n int) []string {
+	var lines []string
+	for i := 0; i < n; i++ {
+		lines = append(lines, h.Receive())
+	}
+	return lines
+}
+
+// CloseInput closes the helper input, as Squid does when it shuts the
+// helper down
+func (h *Helper) CloseInput() {
+	h.in.Close()
+}
+
+// Wait waits for the helper loop to return and returns the answer lines that
+// have not been received yet
+func (h *Helper) Wait() []string {
+	select {
+	case <-h.done:
+	case <-time.After(ResponseTimeout):
+		h.t.Fatal("timed out waiting for the helper to stop")
+	}
+
+	var lines []string
+	for line := range h.responses {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// CloseInputWithError fails the reads of the helper input with err, as a
+// broken stdin does
+func (h *Helper) CloseInputWithError(err error) {
+	h.in.CloseWithError(err)
+}
+
+// Err returns the error the helper loop returned, once Wait has returned
+func (h *Helper) Err() error {
+	return h.err
+}
+
+// Stop closes the helper input and waits for the helper loop to return
+func (h *Helper) Stop() {
+	h.CloseInput()
+	h.Wait()
+}
@@ -0,0 +1,786 @@
+// Package ldaptest implements a small in-memory LDAP directory server that
+// speaks enough of the protocol to drive the helpers and the connection pool
+// in tests.
+package ldaptest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"gopkg.in/asn1-ber.v1"
+)
+
+// Entry is a single object stored in the fake directory
+type Entry struct {
+	// DN is the distinguished name of the entry
+	DN string
+	// Attributes holds the attribute values of the entry by attribute name
+	Attributes map[string][]string
+}
+
+// GetAttributeValues returns the values of the named attribute. Attribute
+// names are compared case-insensitively.
+func (e *Entry) GetAttributeValues(name string) []string {
+	for attr, values := range e.Attributes {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Server is an in-memory LDAP server listening on the loopback interface
+type Server struct {
+	listener net.Listener
+
+	mu          sync.RWMutex
+	entries     []*Entry
+	referrals   []*Entry
+	passwords   map[string]string
+	identities  map[string]string
+	requests    []*ber.Packet
+	conns       map[net.Conn]*sync.Mutex
+	connections int
+	closed      bool
+	searchDelay time.Duration
+	maxValRange int
+	// rejected are the types of the critical controls answered with
+	// unavailableCriticalExtension
+	rejected map[string]bool
+	// usn is the update sequence number of the last change, stamped on the
+	// changed entry as uSNChanged the way Active Directory does
+	usn int64
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a new fake directory server on a random loopback port
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener:   listener,
+		passwords:  map[string]string{},
+		identities: map[string]string{},
+		rejected:   map[string]bool{},
+		conns:      map[net.Conn]*sync.Mutex{},
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server is listening on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Host returns the address the server is listening on, without the port
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+	return host
+}
+
+// Port returns the port the server is listening on
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// AddEntry stores a new entry in the directory
+func (s *Server) AddEntry(dn string, attributes map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &Entry{DN: dn, Attributes: attributes}
+	s.stamp(entry)
+	s.entries = append(s.entries, entry)
+}
+
+// SetAttribute replaces the values of an attribute of the entry at dn, the
+// way a modify request does
+func (s *Server) SetAttribute(dn, name string, values []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.findEntry(dn)
+	if entry == nil {
+		return
+	}
+	attributes := map[string][]string{}
+	for attr, v := range entry.Attributes {
+		if !strings.EqualFold(attr, name) {
+			attributes[attr] = v
+		}
+	}
+	attributes[name] = values
+	entry.Attributes = attributes
+	s.stamp(entry)
+}
+
+// stamp records a change of the entry in its uSNChanged and modifyTimestamp
+// attributes. The caller must hold s.mu.
+func (s *Server) stamp(entry *Entry) {
+	s.usn++
+	attributes := map[string][]string{}
+	for name, values := range entry.Attributes {
+		if !strings.EqualFold(name, "uSNChanged") && !strings.EqualFold(name, "modifyTimestamp") {
+			attributes[name] = values
+		}
+	}
+	attributes["uSNChanged"] = []string{strconv.FormatInt(s.usn, 10)}
+	attributes["modifyTimestamp"] = []string{time.Now().UTC().Format("20060102150405Z")}
+	entry.Attributes = attributes
+}
+
+// AddReferral makes the subtree at dn a referral to the LDAP URL uri, the
+// way Active Directory refers to the naming contexts of other domains
+func (s *Server) AddReferral(dn, uri string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.referrals = append(s.referrals, &Entry{DN: dn, Attributes: map[string][]string{"ref": {uri}}})
+}
+
+// AddCredentials allows a simple bind with the given name and password
+func (s *Server) AddCredentials(name, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passwords[strings.ToLower(name)] = password
+}
+
+// SetIdentity makes WhoAmI answer authzID after a bind with the given name,
+// instead of "u:" followed by the name. An empty authzID answers as for an
+// anonymous connection.
+func (s *Server) SetIdentity(name, authzID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identities[strings.ToLower(name)] = authzID
+}
+
+// RejectControl makes the server answer unavailableCriticalExtension to the
+// searches with a critical control of the given type, the way servers do for
+// the controls they do not support
+func (s *Server) RejectControl(controlType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected[controlType] = true
+}
+
+// SetSearchDelay makes the server wait d before answering search requests
+func (s *Server) SetSearchDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.searchDelay = d
+}
+
+// SetMaxValRange limits the number of values returned for a multi-valued
+// attribute, the way the MaxValRange policy of Active Directory does. Larger
+// attributes are returned as "name;range=low-high" and have to be retrieved
+// with ranged attribute requests. Zero disables the limit.
+func (s *Server) SetMaxValRange(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxValRange = n
+}
+
+// Requests returns every request packet received by the server so far
+func (s *Server) Requests() []*ber.Packet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	requests := make([]*ber.Packet, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+// CountRequests returns the number of received requests with the given
+// application tag (e.g. ldap.ApplicationSearchRequest)
+func (s *Server) CountRequests(application uint8) int {
+	count := 0
+	for _, packet := range s.Requests() {
+		if len(packet.Children) > 1 && uint8(packet.Children[1].Tag) == application {
+			count++
+		}
+	}
+	return count
+}
+
+// WaitRequest waits until a request with the given application tag has been
+// received and reports whether one arrived within timeout
+func (s *Server) WaitRequest(application uint8, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for s.CountRequests(application) == 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// Connections returns the number of client connections accepted so far
+func (s *Server) Connections() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.connections
+}
+
+// Disconnect sends a Notice of Disconnection to every client and closes
+// their connections, the way a server shutting down does. The connections
+// are closed once the clients have closed them after reading the notice, or
+// after a second.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	notice := newExtendedResponse(0, ldap.LDAPResultUnavailable, "server is shutting down", ldap.NoticeOfDisconnectionOID, nil)
+	var conns []net.Conn
+	for conn, writeMu := range s.conns {
+		writeMu.Lock()
+		conn.Write(notice.Bytes())
+		writeMu.Unlock()
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.mu.RLock()
+		open := 0
+		for _, conn := range conns {
+			if _, ok := s.conns[conn]; ok {
+				open++
+			}
+		}
+		s.mu.RUnlock()
+		if open == 0 {
+			break
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Close stops the server and drops every client connection
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		writeMu := &sync.Mutex{}
+		s.conns[conn] = writeMu
+		s.connections++
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn, writeMu)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn, writeMu *sync.Mutex) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	// requests are answered concurrently, like a real directory server does,
+	// so that an abandon request can overtake the request it abandons
+	var (
+		abandoned = map[int64]bool{}
+		pending   = map[int64]bool{}
+		// identity is the authorization identity of the connection
+		identity string
+	)
+	reply := func(messageID int64, responses []*ber.Packet) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		delete(pending, messageID)
+		if abandoned[messageID] {
+			return
+		}
+		for _, response := range responses {
+			if _, err := conn.Write(response.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+
+		s.mu.Lock()
+		s.requests = append(s.requests, packet)
+		s.mu.Unlock()
+
+		messageID, ok := packet.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+		request := packet.Children[1]
+
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			var responses []*ber.Packet
+			responses, identity = s.handleBind(messageID, request)
+			reply(messageID, responses)
+		case ldap.ApplicationExtendedRequest:
+			reply(messageID, s.handleExtended(messageID, request, identity, func(id int64) bool {
+				// a pending search is canceled by answering it right away
+				writeMu.Lock()
+				defer writeMu.Unlock()
+				if !pending[id] || abandoned[id] {
+					return false
+				}
+				abandoned[id] = true
+				conn.Write(newResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultCanceled, "", "canceled").Bytes())
+				return true
+			}))
+		case ldap.ApplicationSearchRequest:
+			writeMu.Lock()
+			pending[messageID] = true
+			writeMu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.mu.RLock()
+				delay := s.searchDelay
+				s.mu.RUnlock()
+				time.Sleep(delay)
+				reply(messageID, s.handleSearch(messageID, request, requestControls(packet)))
+			}()
+		case ldap.ApplicationAddRequest:
+			reply(messageID, s.handleAdd(messageID, request))
+		case ldap.ApplicationDelRequest:
+			reply(messageID, s.handleDel(messageID, request))
+		case ldap.ApplicationModifyRequest:
+			reply(messageID, s.handleModify(messageID, request))
+		case ldap.ApplicationModifyDNRequest:
+			reply(messageID, s.handleModifyDN(messageID, request))
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationAbandonRequest:
+			if id, err := ber.ParseInt64(request.Data.Bytes()); err == nil {
+				writeMu.Lock()
+				abandoned[id] = true
+				writeMu.Unlock()
+			}
+		default:
+			reply(messageID, []*ber.Packet{newResult(messageID, request.Tag+1, ldap.LDAPResultUnwillingToPerform, "", "operation is not supported")})
+		}
+	}
+}
+
+// handleBind answers a simple bind and returns the authorization identity
+// of the connection after the bind
+func (s *Server) handleBind(messageID int64, request *ber.Packet) ([]*ber.Packet, string) {
+	if len(request.Children) < 3 {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationBindResponse, ldap.LDAPResultProtocolError, "", "malformed bind request")}, ""
+	}
+	name, _ := request.Children[1].Value.(string)
+	password := request.Children[2].Data.String()
+
+	// an unauthenticated bind succeeds anonymously, like on Active Directory
+	if password == "" {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "", "")}, ""
+	}
+
+	s.mu.RLock()
+	expected, ok := s.passwords[strings.ToLower(name)]
+	identity, set := s.identities[strings.ToLower(name)]
+	s.mu.RUnlock()
+	if !ok || expected != password {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials, "", "invalid credentials")}, ""
+	}
+	if !set {
+		identity = "u:" + name
+	}
+	return []*ber.Packet{newResult(messageID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "", "")}, identity
+}
+
+// handleExtended answers the WhoAmI and Cancel extended operations. cancel
+// cancels the pending request with the given message ID and reports
+// whether there was one.
+func (s *Server) handleExtended(messageID int64, request *ber.Packet, identity string, cancel func(int64) bool) []*ber.Packet {
+	if len(request.Children) < 1 {
+		return []*ber.Packet{newExtendedResponse(messageID, ldap.LDAPResultProtocolError, "malformed extended request", "", nil)}
+	}
+	switch request.Children[0].Data.String() {
+	case "1.3.6.1.4.1.4203.1.11.3":
+		return []*ber.Packet{newExtendedResponse(messageID, ldap.LDAPResultSuccess, "", "", []byte(identity))}
+	case "1.3.6.1.1.8":
+		if len(request.Children) < 2 {
+			return []*ber.Packet{newExtendedResponse(messageID, ldap.LDAPResultProtocolError, "missing cancel request value", "", nil)}
+		}
+		value := ber.DecodePacket(request.Children[1].Data.Bytes())
+		if len(value.Children) != 1 {
+			return []*ber.Packet{newExtendedResponse(messageID, ldap.LDAPResultProtocolError, "malformed cancel request value", "", nil)}
+		}
+		cancelID, _ := value.Children[0].Value.(int64)
+		if !cancel(cancelID) {
+			return []*ber.Packet{newExtendedResponse(messageID, ldap.LDAPResultNoSuchOperation, "no such operation", "", nil)}
+		}
+		return []*ber.Packet{newExtendedResponse(messageID, ldap.LDAPResultSuccess, "", "", nil)}
+	}
+	return []*ber.Packet{newExtendedResponse(messageID, ldap.LDAPResultProtocolError, "unsupported extended operation", "", nil)}
+}
+
+// requestControls returns the controls of the request packet
+func requestControls(packet *ber.Packet) []*ber.Packet {
+	if len(packet.Children) < 3 {
+		return nil
+	}
+	return packet.Children[2].Children
+}
+
+func (s *Server) handleSearch(messageID int64, request *ber.Packet, controls []*ber.Packet) []*ber.Packet {
+	if len(request.Children) < 8 {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError, "", "malformed search request")}
+	}
+	// sourceAttribute is the attribute of an Attribute Scoped Query, which
+	// searches the entries listed by the attribute of the base entry
+	var sourceAttribute string
+	for _, control := range controls {
+		if len(control.Children) == 0 {
+			continue
+		}
+		controlType, _ := control.Children[0].Value.(string)
+		critical := len(control.Children) > 1 && control.Children[1].Value == true
+		s.mu.RLock()
+		rejected := s.rejected[controlType]
+		s.mu.RUnlock()
+		if critical && rejected {
+			return []*ber.Packet{newResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultUnavailableCriticalExtension, "", "unsupported critical control")}
+		}
+		if asq, ok := ldap.DecodeControl(control).(*ldap.ControlAttributeScopedQuery); ok {
+			sourceAttribute = asq.SourceAttribute
+		}
+	}
+	baseDN, _ := request.Children[0].Value.(string)
+	scope, _ := request.Children[1].Value.(int64)
+	filter := request.Children[6]
+	var attributes []string
+	for _, child := range request.Children[7].Children {
+		if name, ok := child.Value.(string); ok {
+			attributes = append(attributes, name)
+		}
+	}
+
+	base, err := parseDN(baseDN)
+	if err != nil {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultInvalidDNSyntax, "", err.Error())}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(base.RDNs) == 0 && scope == ldap.ScopeBaseObject {
+		rootDSE := &Entry{Attributes: map[string][]string{
+			"highestCommittedUSN": {strconv.FormatInt(s.usn, 10)},
+			"currentTime":         {time.Now().UTC().Format("20060102150405.0Z")},
+		}}
+		return []*ber.Packet{
+			newSearchEntry(messageID, rootDSE, attributes, s.maxValRange),
+			newResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, "", ""),
+		}
+	}
+
+	if sourceAttribute != "" {
+		return s.attributeScopedQuery(messageID, baseDN, scope, sourceAttribute, filter, attributes)
+	}
+
+	var (
+		responses []*ber.Packet
+		baseFound = len(base.RDNs) == 0
+	)
+	for _, referral := range s.referrals {
+		dn, err := parseDN(referral.DN)
+		if err != nil {
+			continue
+		}
+		uri := referral.GetAttributeValues("ref")[0]
+		if dn.Equal(base) || dn.AncestorOf(base) {
+			// the whole search has to be performed by the other server
+			return []*ber.Packet{newReferralResult(messageID, uri, baseDN)}
+		}
+		if !base.AncestorOf(dn) || (scope == ldap.ScopeSingleLevel && len(dn.RDNs) != len(base.RDNs)+1) || scope == ldap.ScopeBaseObject {
+			continue
+		}
+		baseFound = true
+		responses = append(responses, newSearchReference(messageID, uri))
+	}
+	for _, entry := range s.entries {
+		dn, err := parseDN(entry.DN)
+		if err != nil {
+			continue
+		}
+		isBase := base.Equal(dn)
+		if isBase || base.AncestorOf(dn) {
+			baseFound = true
+		}
+
+		switch scope {
+		case ldap.ScopeBaseObject:
+			if !isBase {
+				continue
+			}
+		case ldap.ScopeSingleLevel:
+			if len(dn.RDNs) != len(base.RDNs)+1 || !base.AncestorOf(dn) {
+				continue
+			}
+		default:
+			if !isBase && !base.AncestorOf(dn) {
+				continue
+			}
+		}
+
+		if s.matchFilter(filter, entry) {
+			responses = append(responses, newSearchEntry(messageID, entry, attributes, s.maxValRange))
+		}
+	}
+
+	if !baseFound {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject, "", "no such object")}
+	}
+	return append(responses, newResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, "", ""))
+}
+
+// attributeScopedQuery answers the entries listed by the source attribute of
+// the base entry which match the filter. The caller must hold s.mu.
+func (s *Server) attributeScopedQuery(messageID int64, baseDN string, scope int64, sourceAttribute string, filter *ber.Packet, attributes []string) []*ber.Packet {
+	if scope != ldap.ScopeBaseObject {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError, "", "attribute scoped query requires a base scope")}
+	}
+	base := s.findEntry(baseDN)
+	if base == nil {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject, "", "no such object")}
+	}
+	var responses []*ber.Packet
+	for _, dn := range base.GetAttributeValues(sourceAttribute) {
+		if entry := s.findEntry(dn); entry != nil && s.matchFilter(filter, entry) {
+			responses = append(responses, newSearchEntry(messageID, entry, attributes, s.maxValRange))
+		}
+	}
+	return append(responses, newResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, "", ""))
+}
+
+// findEntry returns the entry with the given DN. The caller must hold s.mu.
+func (s *Server) findEntry(dn string) *Entry {
+	target, err := parseDN(dn)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range s.entries {
+		if other, err := parseDN(entry.DN); err == nil && target.Equal(other) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// parseDN parses a DN, ignoring the case of attribute values the way Active
+// Directory does
+func parseDN(dn string) (*ldap.DN, error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return nil, errors.New("invalid DN syntax")
+	}
+	for _, rdn := range parsed.RDNs {
+		for _, attr := range rdn.Attributes {
+			attr.Value = strings.ToLower(attr.Value)
+		}
+	}
+	return parsed, nil
+}
+
+func newResult(messageID int64, application ber.Tag, resultCode uint8, matchedDN, message string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, application, nil, "Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(resultCode), "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, matchedDN, "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "Diagnostic Message"))
+	packet.AppendChild(response)
+	return packet
+}
+
+// newExtendedResponse returns an extended response with the optional
+// response name and value
+func newExtendedResponse(messageID int64, resultCode uint8, message, name string, value []byte) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedResponse, nil, "Extended Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(resultCode), "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "Diagnostic Message"))
+	if name != "" {
+		response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, name, "Response Name"))
+	}
+	if value != nil {
+		responseValue := ber.Encode(ber.ClassContext, ber.TypePrimitive, 11, nil, "Response Value")
+		responseValue.Data.Write(value)
+		response.AppendChild(responseValue)
+	}
+	packet.AppendChild(response)
+	return packet
+}
+
+// newReferralResult returns a referral to the server of uri for the search
+// of baseDN
+func newReferralResult(messageID int64, uri, baseDN string) *ber.Packet {
+	if u, err := url.Parse(uri); err == nil {
+		u.Path = "/" + baseDN
+		uri = u.String()
+	}
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultDone, nil, "Search Result Done")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldap.LDAPResultReferral), "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "referral", "Diagnostic Message"))
+	referral := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "Referral")
+	referral.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, uri, "URI"))
+	response.AppendChild(referral)
+	packet.AppendChild(response)
+	return packet
+}
+
+func newSearchReference(messageID int64, uri string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	reference := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultReference, nil, "Search Result Reference")
+	reference.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, uri, "URI"))
+	packet.AppendChild(reference)
+	return packet
+}
+
+func newSearchEntry(messageID int64, entry *Entry, attributes []string, maxValRange int) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "Object Name"))
+
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range entry.Attributes {
+		if !selectAttribute(name, attributes) {
+			continue
+		}
+		low, high, ranged := requestedRange(name, attributes)
+		if ranged || (maxValRange > 0 && len(values) > maxValRange) {
+			if maxValRange > 0 && (high < 0 || high-low+1 > maxValRange) {
+				high = low + maxValRange - 1
+			}
+			if high < 0 || high >= len(values)-1 {
+				high = len(values) - 1
+			}
+			if low > len(values) {
+				low = len(values)
+			}
+			if high == len(values)-1 {
+				name = fmt.Sprintf("%s;range=%d-*", name, low)
+			} else {
+				name = fmt.Sprintf("%s;range=%d-%d", name, low, high)
+			}
+			if low > high {
+				values = nil
+			} else {
+				values = values[low : high+1]
+			}
+		}
+
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Attribute Name"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Attribute Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Attribute Value"))
+		}
+		attr.AppendChild(set)
+		list.AppendChild(attr)
+	}
+	response.AppendChild(list)
+	packet.AppendChild(response)
+	return packet
+}
+
+// requestedRange returns the value range requested for the attribute with
+// an "attribute;range=low-high" description. A high bound of "*" is
+// returned as -1.
+func requestedRange(name string, attributes []string) (low, high int, ok bool) {
+	for _, attr := range attributes {
+		parts := strings.SplitN(attr, ";", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], name) || !strings.HasPrefix(strings.ToLower(parts[1]), "range=") {
+			continue
+		}
+		bounds := strings.SplitN(parts[1][len("range="):], "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		high := -1
+		if bounds[1] != "*" {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		return low, high, true
+	}
+	return 0, -1, false
+}
+
+// selectAttribute reports whether the attribute is part of the requested
+// attribute selection
+func selectAttribute(name string, attributes []string) bool {
+	if len(attributes) == 0 {
+		return true
+	}
+	for _, attr := range attributes {
+		attr = strings.SplitN(attr, ";", 2)[0]
+		if attr == "*" || strings.EqualFold(attr, name) {
+			return true
+		}
+	}
+	return false
+}
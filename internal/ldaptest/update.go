@@ -0,0 +1,244 @@
+package ldaptest
+
+import (
+	"strings"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/ldap.v2"
+	"gopkg.in/asn1-ber.v1"
+)
+
+// handleAdd adds the entry of an add request to the directory
+func (s *Server) handleAdd(messageID int64, request *ber.Packet) []*ber.Packet {
+	if len(request.Children) < 2 {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationAddResponse, ldap.LDAPResultProtocolError, "", "malformed add request")}
+	}
+	dn := request.Children[0].Data.String()
+	if _, err := parseDN(dn); err != nil {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationAddResponse, ldap.LDAPResultInvalidDNSyntax, "", err.Error())}
+	}
+	attributes := map[string][]string{}
+	for _, attribute := range request.Children[1].Children {
+		name, values := decodeAttribute(attribute)
+		attributes[name] = append(attributes[name], values...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findEntry(dn) != nil {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationAddResponse, ldap.LDAPResultEntryAlreadyExists, "", "entry already exists")}
+	}
+	entry := &Entry{DN: dn, Attributes: attributes}
+	s.stamp(entry)
+	s.entries = append(s.entries, entry)
+	return []*ber.Packet{newResult(messageID, ldap.ApplicationAddResponse, ldap.LDAPResultSuccess, "", "")}
+}
+
+// handleDel removes the leaf entry of a delete request from the directory
+func (s *Server) handleDel(messageID int64, request *ber.Packet) []*ber.Packet {
+	dn := request.Data.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.findEntry(dn)
+	if entry == nil {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationDelResponse, ldap.LDAPResultNoSuchObject, "", "no such object")}
+	}
+	if len(s.descendants(entry.DN)) != 0 {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationDelResponse, ldap.LDAPResultNotAllowedOnNonLeaf, "", "entry has children")}
+	}
+	for i, e := range s.entries {
+		if e == entry {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			break
+		}
+	}
+	return []*ber.Packet{newResult(messageID, ldap.ApplicationDelResponse, ldap.LDAPResultSuccess, "", "")}
+}
+
+// handleModify applies the changes of a modify request to an entry
+func (s *Server) handleModify(messageID int64, request *ber.Packet) []*ber.Packet {
+	if len(request.Children) < 2 {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyResponse, ldap.LDAPResultProtocolError, "", "malformed modify request")}
+	}
+	dn := request.Children[0].Data.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.findEntry(dn)
+	if entry == nil {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyResponse, ldap.LDAPResultNoSuchObject, "", "no such object")}
+	}
+
+	// changes are applied to a copy so that a failed request changes nothing
+	attributes := map[string][]string{}
+	for name, values := range entry.Attributes {
+		attributes[name] = values
+	}
+	for _, change := range request.Children[1].Children {
+		if len(change.Children) != 2 {
+			return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyResponse, ldap.LDAPResultProtocolError, "", "malformed change")}
+		}
+		operation, _ := change.Children[0].Value.(int64)
+		name, values := decodeAttribute(change.Children[1])
+		for attr := range attributes {
+			if strings.EqualFold(attr, name) {
+				name = attr
+			}
+		}
+		switch operation {
+		case ldap.AddAttribute:
+			attributes[name] = append(append([]string(nil), attributes[name]...), values...)
+		case ldap.DeleteAttribute:
+			if _, ok := attributes[name]; !ok {
+				return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyResponse, ldap.LDAPResultNoSuchAttribute, "", "no such attribute")}
+			}
+			if len(values) == 0 {
+				delete(attributes, name)
+				continue
+			}
+			var kept []string
+			for _, value := range attributes[name] {
+				if !containsFold(values, value) {
+					kept = append(kept, value)
+				}
+			}
+			attributes[name] = kept
+		case ldap.ReplaceAttribute:
+			if len(values) == 0 {
+				delete(attributes, name)
+				continue
+			}
+			attributes[name] = values
+		default:
+			return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyResponse, ldap.LDAPResultProtocolError, "", "unknown modify operation")}
+		}
+	}
+	entry.Attributes = attributes
+	s.stamp(entry)
+	return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyResponse, ldap.LDAPResultSuccess, "", "")}
+}
+
+// handleModifyDN renames an entry and its subtree, moving it under the new
+// superior if the request has one
+func (s *Server) handleModifyDN(messageID int64, request *ber.Packet) []*ber.Packet {
+	if len(request.Children) < 3 {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyDNResponse, ldap.LDAPResultProtocolError, "", "malformed modify DN request")}
+	}
+	dn := request.Children[0].Data.String()
+	newRDN := request.Children[1].Data.String()
+	deleteOldRDN := request.Children[2].Data.Len() > 0 && request.Children[2].Data.Bytes()[0] != 0
+
+	rdn, err := ldap.ParseDN(newRDN)
+	if err != nil || len(rdn.RDNs) != 1 {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyDNResponse, ldap.LDAPResultInvalidDNSyntax, "", "invalid new RDN")}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.findEntry(dn)
+	if entry == nil {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyDNResponse, ldap.LDAPResultNoSuchObject, "", "no such object")}
+	}
+
+	oldRDN, superior := splitDN(entry.DN)
+	if len(request.Children) > 3 {
+		superior = request.Children[3].Data.String()
+		if s.findEntry(superior) == nil {
+			return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyDNResponse, ldap.LDAPResultNoSuchObject, "", "no such new superior")}
+		}
+	}
+	newDN := newRDN
+	if superior != "" {
+		newDN += "," + superior
+	}
+	if other := s.findEntry(newDN); other != nil && other != entry {
+		return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyDNResponse, ldap.LDAPResultEntryAlreadyExists, "", "entry already exists")}
+	}
+
+	if deleteOldRDN {
+		if old, err := ldap.ParseDN(oldRDN); err == nil {
+			for _, attr := range old.RDNs[0].Attributes {
+				for name, values := range entry.Attributes {
+					if !strings.EqualFold(name, attr.Type) {
+						continue
+					}
+					var kept []string
+					for _, value := range values {
+						if !strings.EqualFold(value, attr.Value) {
+							kept = append(kept, value)
+						}
+					}
+					entry.Attributes[name] = kept
+				}
+			}
+		}
+	}
+	for _, attr := range rdn.RDNs[0].Attributes {
+		name := attr.Type
+		for existing := range entry.Attributes {
+			if strings.EqualFold(existing, name) {
+				name = existing
+			}
+		}
+		if !containsFold(entry.Attributes[name], attr.Value) {
+			entry.Attributes[name] = append(entry.Attributes[name], attr.Value)
+		}
+	}
+
+	for _, descendant := range s.descendants(entry.DN) {
+		if strings.HasSuffix(strings.ToLower(descendant.DN), strings.ToLower(entry.DN)) {
+			descendant.DN = descendant.DN[:len(descendant.DN)-len(entry.DN)] + newDN
+		}
+	}
+	entry.DN = newDN
+	s.stamp(entry)
+	return []*ber.Packet{newResult(messageID, ldap.ApplicationModifyDNResponse, ldap.LDAPResultSuccess, "", "")}
+}
+
+// descendants returns the entries below dn. The caller must hold s.mu.
+func (s *Server) descendants(dn string) []*Entry {
+	base, err := parseDN(dn)
+	if err != nil {
+		return nil
+	}
+	var entries []*Entry
+	for _, entry := range s.entries {
+		if other, err := parseDN(entry.DN); err == nil && base.AncestorOf(other) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// splitDN splits a DN into its first RDN and the DN of its parent
+func splitDN(dn string) (rdn, parent string) {
+	for i := 0; i < len(dn); i++ {
+		switch dn[i] {
+		case '\\':
+			i++
+		case ',':
+			return dn[:i], strings.TrimSpace(dn[i+1:])
+		}
+	}
+	return dn, ""
+}
+
+func decodeAttribute(attribute *ber.Packet) (name string, values []string) {
+	if len(attribute.Children) != 2 {
+		return "", nil
+	}
+	name = attribute.Children[0].Data.String()
+	for _, value := range attribute.Children[1].Children {
+		values = append(values, value.Data.String())
+	}
+	return name, values
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
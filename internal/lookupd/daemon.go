@@ -0,0 +1,78 @@
+package lookupd
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/unixsock"
+)
+
+// Daemon runs the lookups of the helpers sharing it, until it is told to
+// exit
+type Daemon struct {
+	// Start sets up the lookups and returns the function tearing them down
+	Start func() (stop func())
+	// Lookup answers the request of the user for the entity
+	Lookup func(username, entity string) string
+	// Negative is the answer to the requests without user and entity
+	Negative string
+	// Reload restarts the lookups to reload the configuration, Exit stops
+	// the daemon
+	Reload, Exit <-chan os.Signal
+}
+
+// Serve answers the requests of the helpers on the unix socket at path,
+// created with the permissions mode, until a signal arrives on Exit. A
+// signal on Reload tears down the lookups and sets them up again.
+func (d *Daemon) Serve(path string, mode os.FileMode) error {
+	for {
+		log.Print("[INFO] Start squid LDAP lookup daemon")
+		reload, err := d.run(path, mode)
+		if err != nil {
+			return err
+		}
+		if !reload {
+			break
+		}
+	}
+	log.Print("[INFO] Stop squid LDAP lookup daemon")
+	return nil
+}
+
+// run answers the requests of the helpers until a signal arrives. It waits
+// for the requests still in flight and reports whether the daemon has to be
+// started again to reload its configuration.
+func (d *Daemon) run(path string, mode os.FileMode) (bool, error) {
+	stop := d.Start()
+	defer stop()
+
+	l, err := unixsock.Listen(path, mode)
+	if err != nil {
+		return false, err
+	}
+	server := NewServer(func(request string) string {
+		fs := strings.Fields(request)
+		if len(fs) < 2 {
+			return d.Negative
+		}
+		return d.Lookup(fs[0], fs[1])
+	})
+	done := make(chan struct{})
+	go func() {
+		server.Serve(l)
+		close(done)
+	}()
+
+	reload := false
+	select {
+	case <-d.Reload:
+		log.Print("[INFO] Got SIGHUP to reload configuration")
+		reload = true
+	case <-d.Exit:
+		log.Print("[INFO] Got signal to exit squid LDAP lookup daemon")
+	}
+	l.Close()
+	<-done
+	return reload, nil
+}
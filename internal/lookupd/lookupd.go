@@ -0,0 +1,238 @@
+// Package lookupd shares the lookups of the helper processes started by
+// Squid through one local daemon, which owns the LDAP connection pool and the
+// cache.
+//
+// The helpers talk to the daemon over a unix socket with the line protocol
+// of the Squid concurrency channel: a request is
+//
+//	id request
+//
+// where id is chosen by the client and request is the helper request line,
+// and the daemon answers
+//
+//	id result
+//
+// in any order.
+package lookupd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnavailable is returned by Lookup when the daemon cannot be reached
+var ErrUnavailable = errors.New("lookupd: daemon is unavailable")
+
+// retryInterval is the time during which the client does not dial the daemon
+// again after a failed attempt
+const retryInterval = 5 * time.Second
+
+// Handler answers a request line
+type Handler func(request string) string
+
+// Server answers the requests of the helpers
+type Server struct {
+	handler Handler
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewServer returns a server answering requests with the handler
+func NewServer(handler Handler) *Server {
+	return &Server{handler: handler, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accepts connections on the listener until it is closed. It then
+// closes the connections of the clients and returns once the requests in
+// flight are answered.
+func (s *Server) Serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	var (
+		requests sync.WaitGroup
+		writeMu  sync.Mutex
+	)
+	defer func() {
+		requests.Wait()
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	out := bufio.NewWriter(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fs := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(fs) != 2 {
+			continue
+		}
+		requests.Add(1)
+		go func(id, request string) {
+			defer requests.Done()
+			result := s.handler(request)
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			out.WriteString(id + " " + result + "\n")
+			out.Flush()
+		}(fs[0], fs[1])
+	}
+}
+
+// Client sends the requests of a helper to the daemon. It is safe for
+// concurrent use.
+type Client struct {
+	path    string
+	timeout time.Duration
+
+	mu      sync.Mutex
+	conn    net.Conn
+	pending map[uint64]chan string
+	nextID  uint64
+	retryAt time.Time
+}
+
+// NewClient returns a client of the daemon listening on the unix socket
+// path. Lookups not answered within timeout fail. A zero timeout sets no
+// limit.
+func NewClient(path string, timeout time.Duration) *Client {
+	return &Client{path: path, timeout: timeout}
+}
+
+// Lookup returns the result of the request line. It fails with
+// ErrUnavailable without waiting if the daemon cannot be reached.
+func (c *Client) Lookup(request string) (string, error) {
+	c.mu.Lock()
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			c.mu.Unlock()
+			return "", ErrUnavailable
+		}
+	}
+	conn := c.conn
+	c.nextID++
+	id := c.nextID
+	result := make(chan string, 1)
+	c.pending[id] = result
+	c.mu.Unlock()
+
+	if c.timeout != 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	if _, err := fmt.Fprintf(conn, "%d %s\n", id, request); err != nil {
+		c.drop(conn)
+		return "", ErrUnavailable
+	}
+
+	var expired <-chan time.Time
+	if c.timeout != 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case r, ok := <-result:
+		if !ok {
+			return "", ErrUnavailable
+		}
+		return r, nil
+	case <-expired:
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return "", fmt.Errorf("lookupd: no answer within %s", c.timeout)
+	}
+}
+
+// dial connects to the daemon, unless the last attempt failed recently. It
+// is called with c.mu held.
+func (c *Client) dial() error {
+	if time.Now().Before(c.retryAt) {
+		return ErrUnavailable
+	}
+	conn, err := net.DialTimeout("unix", c.path, c.timeout)
+	if err != nil {
+		log.Printf("[WARN] Cannot connect to the lookup daemon. Message - %s", err.Error())
+		c.retryAt = time.Now().Add(retryInterval)
+		return err
+	}
+	c.conn = conn
+	c.pending = make(map[uint64]chan string)
+	go c.readResults(conn, c.pending)
+	return nil
+}
+
+func (c *Client) readResults(conn net.Conn, pending map[uint64]chan string) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fs := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fs) != 2 {
+			continue
+		}
+		id, err := strconv.ParseUint(fs[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		if result, ok := pending[id]; ok {
+			result <- fs[1]
+			delete(pending, id)
+		}
+		c.mu.Unlock()
+	}
+	c.drop(conn)
+}
+
+// drop closes the connection and fails its pending lookups
+func (c *Client) drop(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn {
+		return
+	}
+	conn.Close()
+	for id, result := range c.pending {
+		close(result)
+		delete(c.pending, id)
+	}
+	c.conn = nil
+}
+
+// Close closes the connection to the daemon
+func (c *Client) Close() {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		c.drop(conn)
+	}
+}
@@ -0,0 +1,178 @@
+package lookupd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, path string, handler Handler) (stop func()) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		NewServer(handler).Serve(l)
+		close(done)
+	}()
+	return func() {
+		l.Close()
+		<-done
+	}
+}
+
+func tempSocket(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "lookupd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "lookupd.sock"), func() { os.RemoveAll(dir) }
+}
+
+func TestLookup(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	stop := startServer(t, path, func(request string) string {
+		if request == "slow Internet" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return "OK tag=" + request
+	})
+	defer stop()
+
+	client := NewClient(path, time.Second)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request := fmt.Sprintf("user%d Internet", i)
+			if i == 0 {
+				request = "slow Internet"
+			}
+			result, err := client.Lookup(request)
+			if err != nil || result != "OK tag="+request {
+				t.Errorf("%s: got %q, %v", request, result, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestLookupTimeout(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	stop := startServer(t, path, func(request string) string {
+		time.Sleep(200 * time.Millisecond)
+		return "ERR"
+	})
+	defer stop()
+
+	client := NewClient(path, 20*time.Millisecond)
+	defer client.Close()
+	if _, err := client.Lookup("jdoe Internet"); err == nil || err == ErrUnavailable {
+		t.Errorf("got %v, expected a timeout", err)
+	}
+}
+
+func TestLookupWithoutTimeout(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	stop := startServer(t, path, func(request string) string {
+		time.Sleep(50 * time.Millisecond)
+		return "OK tag=Internet"
+	})
+	defer stop()
+
+	client := NewClient(path, 0)
+	defer client.Close()
+	if result, err := client.Lookup("jdoe Internet"); err != nil || result != "OK tag=Internet" {
+		t.Errorf("got %q, %v", result, err)
+	}
+}
+
+func TestLookupUnavailable(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	client := NewClient(path, time.Second)
+	defer client.Close()
+	if _, err := client.Lookup("jdoe Internet"); err != ErrUnavailable {
+		t.Fatalf("got %v without daemon", err)
+	}
+
+	// the daemon is not dialed again before the retry interval
+	stop := startServer(t, path, func(request string) string { return "ERR" })
+	if _, err := client.Lookup("jdoe Internet"); err != ErrUnavailable {
+		t.Errorf("got %v within the retry interval", err)
+	}
+	client.mu.Lock()
+	client.retryAt = time.Time{}
+	client.mu.Unlock()
+	if result, err := client.Lookup("jdoe Internet"); err != nil || result != "ERR" {
+		t.Errorf("got %q, %v once the daemon is up", result, err)
+	}
+
+	// a daemon going away fails the lookups until it is back
+	stop()
+	if _, err := client.Lookup("jdoe Internet"); err != ErrUnavailable {
+		t.Errorf("got %v after the daemon stopped", err)
+	}
+}
+
+func TestDaemonReload(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	var starts, stops int32
+	reload, exit := make(chan os.Signal, 1), make(chan os.Signal, 1)
+	d := &Daemon{
+		Start: func() func() {
+			atomic.AddInt32(&starts, 1)
+			return func() { atomic.AddInt32(&stops, 1) }
+		},
+		Lookup:   func(username, entity string) string { return "OK tag=" + entity },
+		Negative: "ERR",
+		Reload:   reload,
+		Exit:     exit,
+	}
+	done := make(chan error, 1)
+	go func() { done <- d.Serve(path, 0600) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	client := NewClient(path, time.Second)
+	defer client.Close()
+	if result, err := client.Lookup("jdoe Internet"); err != nil || result != "OK tag=Internet" {
+		t.Errorf("got %q, %v", result, err)
+	}
+	if result, err := client.Lookup("jdoe"); err != nil || result != "ERR" {
+		t.Errorf("got %q, %v for a request without entity", result, err)
+	}
+
+	reload <- syscall.SIGHUP
+	for atomic.LoadInt32(&starts) != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	exit <- syscall.SIGTERM
+	if err := <-done; err != nil {
+		t.Errorf("got %v", err)
+	}
+	if starts, stops := atomic.LoadInt32(&starts), atomic.LoadInt32(&stops); starts != 2 || stops != 2 {
+		t.Errorf("started %d times, stopped %d times, expected 2", starts, stops)
+	}
+}
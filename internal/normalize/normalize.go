@@ -0,0 +1,199 @@
+// Package normalize normalizes the user names sent by Squid before they are
+// searched in the directory.
+//
+// A name is rewritten, split into its NT domain (DOMAIN\name) and Kerberos
+// realm (name@REALM), checked against the allowed and denied domains, then
+// stripped and lower cased as configured.
+package normalize
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrDenied is returned for the names of a domain which is not allowed
+var ErrDenied = errors.New("normalize: domain is not allowed")
+
+// Identity is a normalized user name
+type Identity struct {
+	// Name is the account name
+	Name string
+	// Domain is the NT domain, empty if none
+	Domain string
+	// Realm is the Kerberos realm or UPN suffix, empty if none
+	Realm string
+}
+
+// Key returns the normalized form of the name, which identifies the user in
+// caches
+func (id Identity) Key() string {
+	key := id.Name
+	if id.Domain != "" {
+		key = id.Domain + "\\" + key
+	}
+	if id.Realm != "" {
+		key += "@" + id.Realm
+	}
+	return key
+}
+
+// KeyName returns the name of the user identified by a key returned by Key,
+// without NT domain or realm
+func KeyName(key string) string {
+	if i := strings.LastIndex(key, "\\"); i >= 0 {
+		key = key[i+1:]
+	}
+	if i := strings.Index(key, "@"); i >= 0 {
+		key = key[:i]
+	}
+	return key
+}
+
+// UPN returns the user principal name, name@realm, or an empty string if the
+// name has no realm
+func (id Identity) UPN() string {
+	if id.Realm == "" {
+		return ""
+	}
+	return id.Name + "@" + id.Realm
+}
+
+// Config describes the normalization steps
+type Config struct {
+	// Rewrites are the rules applied to the raw name, in order, given as
+	// "pattern=>replacement" with the syntax of regexp.ReplaceAllString
+	Rewrites []string
+	// AllowDomains, if not empty, are the only domains or realms accepted.
+	// Names without a domain nor realm are always accepted.
+	AllowDomains []string
+	// DenyDomains are the domains or realms rejected
+	DenyDomains []string
+	// StripRealm drops the realm
+	StripRealm bool
+	// StripDomain drops the NT domain
+	StripDomain bool
+	// Lowercase maps the name, domain and realm to lower case
+	Lowercase bool
+}
+
+type rewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Normalizer applies the steps of a Config to user names
+type Normalizer struct {
+	config   Config
+	rewrites []rewrite
+}
+
+// New returns a Normalizer applying the config
+func New(config Config) (*Normalizer, error) {
+	n := &Normalizer{config: config}
+	for _, rule := range config.Rewrites {
+		i := strings.Index(rule, "=>")
+		if i < 0 {
+			return nil, fmt.Errorf("normalize: rewrite rule %q is not pattern=>replacement", rule)
+		}
+		pattern, err := regexp.Compile(rule[:i])
+		if err != nil {
+			return nil, fmt.Errorf("normalize: invalid rewrite pattern %q: %s", rule[:i], err)
+		}
+		n.rewrites = append(n.rewrites, rewrite{pattern: pattern, replacement: rule[i+2:]})
+	}
+	return n, nil
+}
+
+// Normalize returns the normalized identity of the raw name. It fails with
+// ErrDenied if the domain or realm of the name is not allowed.
+func (n *Normalizer) Normalize(raw string) (Identity, error) {
+	id := Parse(n.Rewrite(raw))
+	if !n.Allowed(id) {
+		return id, ErrDenied
+	}
+	if n.config.StripDomain {
+		id.Domain = ""
+	}
+	if n.config.StripRealm {
+		id.Realm = ""
+	}
+	if n.config.Lowercase {
+		id = Lower(id)
+	}
+	return id, nil
+}
+
+// Rewrite applies the rewrite rules to the raw name
+func (n *Normalizer) Rewrite(raw string) string {
+	for _, rule := range n.rewrites {
+		raw = rule.pattern.ReplaceAllString(raw, rule.replacement)
+	}
+	return raw
+}
+
+// Allowed reports whether the domain and realm of the identity are allowed
+func (n *Normalizer) Allowed(id Identity) bool {
+	for _, domain := range []string{id.Domain, id.Realm} {
+		if domain != "" && containsFold(n.config.DenyDomains, domain) {
+			return false
+		}
+	}
+	if len(n.config.AllowDomains) == 0 || (id.Domain == "" && id.Realm == "") {
+		return true
+	}
+	for _, domain := range []string{id.Domain, id.Realm} {
+		if domain != "" && !containsFold(n.config.AllowDomains, domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse splits a name given as DOMAIN\name, name@REALM or name
+func Parse(raw string) Identity {
+	var id Identity
+	if i := strings.Index(raw, "\\"); i >= 0 {
+		id.Domain, raw = raw[:i], raw[i+1:]
+	}
+	if i := strings.LastIndex(raw, "@"); i >= 0 {
+		raw, id.Realm = raw[:i], raw[i+1:]
+	}
+	id.Name = raw
+	return id
+}
+
+// Lower returns the identity with its name, domain and realm mapped to lower
+// case by strings.ToLower. It is not Unicode case folding, which maps ſ to s
+// and ß to ss.
+func Lower(id Identity) Identity {
+	return Identity{
+		Name:   strings.ToLower(id.Name),
+		Domain: strings.ToLower(id.Domain),
+		Realm:  strings.ToLower(id.Realm),
+	}
+}
+
+// ParseMap parses "KEY=VALUE" pairs, such as the base DN of NT domains given
+// as "CORP=dc=corp,dc=example,dc=com". The keys are upper cased.
+func ParseMap(pairs []string) (map[string]string, error) {
+	m := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("normalize: %q is not KEY=VALUE", pair)
+		}
+		m[strings.ToUpper(pair[:i])] = pair[i+1:]
+	}
+	return m, nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
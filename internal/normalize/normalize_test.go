@@ -0,0 +1,159 @@
+package normalize
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]Identity{
+		"jdoe":                   {Name: "jdoe"},
+		"CORP\\jdoe":             {Name: "jdoe", Domain: "CORP"},
+		"jdoe@EXAMPLE.COM":       {Name: "jdoe", Realm: "EXAMPLE.COM"},
+		"CORP\\jdoe@EXAMPLE.COM": {Name: "jdoe", Domain: "CORP", Realm: "EXAMPLE.COM"},
+		"j@doe@EXAMPLE.COM":      {Name: "j@doe", Realm: "EXAMPLE.COM"},
+		"\\jdoe":                 {Name: "jdoe"},
+		"":                       {},
+	}
+	for raw, expected := range tests {
+		if id := Parse(raw); id != expected {
+			t.Errorf("%q: got %+v, expected %+v", raw, id, expected)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := map[Identity]string{
+		{Name: "jdoe"}:                                       "jdoe",
+		{Name: "jdoe", Domain: "CORP"}:                       "CORP\\jdoe",
+		{Name: "jdoe", Realm: "EXAMPLE.COM"}:                 "jdoe@EXAMPLE.COM",
+		{Name: "jdoe", Domain: "CORP", Realm: "EXAMPLE.COM"}: "CORP\\jdoe@EXAMPLE.COM",
+	}
+	for id, expected := range tests {
+		if key := id.Key(); key != expected {
+			t.Errorf("%+v: got key %q, expected %q", id, key, expected)
+		}
+		if Parse(id.Key()) != id {
+			t.Errorf("%+v: key %q does not parse back", id, id.Key())
+		}
+		if name := KeyName(id.Key()); name != "jdoe" {
+			t.Errorf("%+v: got name %q of key %q", id, name, id.Key())
+		}
+	}
+	if upn := (Identity{Name: "jdoe", Realm: "EXAMPLE.COM"}).UPN(); upn != "jdoe@EXAMPLE.COM" {
+		t.Errorf("got UPN %q", upn)
+	}
+	if upn := (Identity{Name: "jdoe", Domain: "CORP"}).UPN(); upn != "" {
+		t.Errorf("got UPN %q without realm", upn)
+	}
+}
+
+func TestLower(t *testing.T) {
+	id := Lower(Identity{Name: "JDoe", Domain: "CORP", Realm: "Example.COM"})
+	if id != (Identity{Name: "jdoe", Domain: "corp", Realm: "example.com"}) {
+		t.Errorf("got %+v", id)
+	}
+	if id := Lower(Identity{Name: "ÉLODIE"}); id.Name != "élodie" {
+		t.Errorf("got %q lower casing a non ASCII name", id.Name)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	n, err := New(Config{Rewrites: []string{
+		`^OLDCORP\\(.*)$=>CORP\$1`,
+		`\.admin$=>`,
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tests := map[string]string{
+		"OLDCORP\\jdoe":       "CORP\\jdoe",
+		"OLDCORP\\jdoe.admin": "CORP\\jdoe",
+		"jdoe.admin":          "jdoe",
+		"jdoe":                "jdoe",
+	}
+	for raw, expected := range tests {
+		if name := n.Rewrite(raw); name != expected {
+			t.Errorf("%q: rewritten to %q, expected %q", raw, name, expected)
+		}
+	}
+
+	for _, rule := range []string{"jdoe", "(=>x"} {
+		if _, err := New(Config{Rewrites: []string{rule}}); err == nil {
+			t.Errorf("%q: expected an error", rule)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	n, _ := New(Config{AllowDomains: []string{"CORP", "example.com"}, DenyDomains: []string{"CORP-GUEST"}})
+	tests := map[string]bool{
+		"jdoe":                   true,
+		"corp\\jdoe":             true,
+		"jdoe@EXAMPLE.COM":       true,
+		"CORP\\jdoe@EXAMPLE.COM": true,
+		"OTHER\\jdoe":            false,
+		"jdoe@OTHER.COM":         false,
+		"CORP\\jdoe@OTHER.COM":   false,
+		"CORP-GUEST\\jdoe":       false,
+	}
+	for raw, expected := range tests {
+		if allowed := n.Allowed(Parse(raw)); allowed != expected {
+			t.Errorf("%q: got allowed %v, expected %v", raw, allowed, expected)
+		}
+	}
+
+	n, _ = New(Config{DenyDomains: []string{"CORP-GUEST"}})
+	if !n.Allowed(Parse("OTHER\\jdoe")) || n.Allowed(Parse("jdoe@corp-guest")) {
+		t.Errorf("deny list without allow list is not applied")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		config   Config
+		raw      string
+		expected Identity
+		err      error
+	}{
+		{config: Config{}, raw: "CORP\\JDoe", expected: Identity{Name: "JDoe", Domain: "CORP"}},
+		{config: Config{StripDomain: true}, raw: "CORP\\jdoe", expected: Identity{Name: "jdoe"}},
+		{config: Config{StripRealm: true}, raw: "jdoe@EXAMPLE.COM", expected: Identity{Name: "jdoe"}},
+		{config: Config{StripDomain: true}, raw: "jdoe@EXAMPLE.COM", expected: Identity{Name: "jdoe", Realm: "EXAMPLE.COM"}},
+		{config: Config{Lowercase: true, StripRealm: true, StripDomain: true}, raw: "CORP\\JDoe@EXAMPLE.COM", expected: Identity{Name: "jdoe"}},
+		{config: Config{Lowercase: true}, raw: "JDoe@EXAMPLE.COM", expected: Identity{Name: "jdoe", Realm: "example.com"}},
+		{config: Config{Rewrites: []string{`^(.*)\.admin$=>$1`}, StripDomain: true}, raw: "CORP\\jdoe.admin", expected: Identity{Name: "jdoe"}},
+		// domains are checked before they are stripped
+		{config: Config{AllowDomains: []string{"CORP"}, StripDomain: true}, raw: "OTHER\\jdoe", expected: Identity{Name: "jdoe", Domain: "OTHER"}, err: ErrDenied},
+		{config: Config{AllowDomains: []string{"CORP"}, StripDomain: true}, raw: "CORP\\jdoe", expected: Identity{Name: "jdoe"}},
+	}
+	for _, test := range tests {
+		n, err := New(test.config)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		id, err := n.Normalize(test.raw)
+		if err != test.err {
+			t.Errorf("%q with %+v: got error %v, expected %v", test.raw, test.config, err, test.err)
+		}
+		if id != test.expected {
+			t.Errorf("%q with %+v: got %+v, expected %+v", test.raw, test.config, id, test.expected)
+		}
+	}
+}
+
+func TestParseMap(t *testing.T) {
+	m, err := ParseMap([]string{"corp=dc=corp,dc=example,dc=com", "LAB=dc=lab,dc=example,dc=com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]string{"CORP": "dc=corp,dc=example,dc=com", "LAB": "dc=lab,dc=example,dc=com"}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("got %v, expected %v", m, expected)
+	}
+	for _, pair := range []string{"corp", "=dc=corp"} {
+		if _, err := ParseMap([]string{pair}); err == nil {
+			t.Errorf("%q: expected an error", pair)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Package profile describes the named LDAP backends of the helpers and
+// routes the users to them from their NT domain or Kerberos realm.
+//
+// A profile is given on the command line as
+//
+//	name:key=value;key=value;flag
+//
+// where the keys are the long option names of the helper, e.g.
+//
+//	corp:server=dc1.corp.local;server=dc2.corp.local;tls;basedn=dc=corp,dc=local
+//
+// and a route as DOMAIN=name or REALM=name.
+package profile
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+)
+
+// Setting is an option of a profile
+type Setting struct {
+	// Key is the long option name
+	Key string
+	// Value is the option value, "true" for a flag given without value
+	Value string
+}
+
+// Profile is a named set of options overriding the options of the helper
+type Profile struct {
+	Name     string
+	Settings []Setting
+}
+
+// Parse parses a profile given as name:key=value;key=value;flag
+func Parse(spec string) (*Profile, error) {
+	i := strings.Index(spec, ":")
+	if i <= 0 {
+		return nil, fmt.Errorf("profile: %q is not name:key=value;...", spec)
+	}
+	p := &Profile{Name: spec[:i]}
+	for _, setting := range strings.Split(spec[i+1:], ";") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		key, value := setting, "true"
+		if j := strings.Index(setting, "="); j >= 0 {
+			key, value = setting[:j], setting[j+1:]
+		}
+		if key == "" {
+			return nil, fmt.Errorf("profile: empty option name in profile %s", p.Name)
+		}
+		p.Settings = append(p.Settings, Setting{Key: strings.TrimPrefix(key, "--"), Value: value})
+	}
+	return p, nil
+}
+
+// Router selects the profile of a user
+type Router struct {
+	routes map[string]string
+}
+
+// NewRouter returns a router for routes given as DOMAIN=name or REALM=name
+func NewRouter(routes []string) (*Router, error) {
+	m, err := normalize.ParseMap(routes)
+	if err != nil {
+		return nil, err
+	}
+	return &Router{routes: m}, nil
+}
+
+// Route returns the name of the profile of the user, from its NT domain, or
+// else its realm. It returns an empty name if no route matches.
+func (r *Router) Route(id normalize.Identity) string {
+	for _, domain := range []string{id.Domain, id.Realm} {
+		if domain == "" {
+			continue
+		}
+		if name, ok := r.routes[strings.ToUpper(domain)]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// Profiles returns the names of the profiles routed to
+func (r *Router) Profiles() []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range r.routes {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Metrics counts the requests answered by a profile. It is safe for
+// concurrent use.
+type Metrics struct {
+	requests uint64
+	positive uint64
+	negative uint64
+	errors   uint64
+}
+
+// Request counts a request
+func (m *Metrics) Request() { atomic.AddUint64(&m.requests, 1) }
+
+// Positive counts a positive answer
+func (m *Metrics) Positive() { atomic.AddUint64(&m.positive, 1) }
+
+// Negative counts a negative answer
+func (m *Metrics) Negative() { atomic.AddUint64(&m.negative, 1) }
+
+// Error counts a request failed by an LDAP error
+func (m *Metrics) Error() { atomic.AddUint64(&m.errors, 1) }
+
+// Counts returns the number of requests, positive and negative answers, and
+// errors
+func (m *Metrics) Counts() (requests, positive, negative, errors uint64) {
+	return atomic.LoadUint64(&m.requests), atomic.LoadUint64(&m.positive), atomic.LoadUint64(&m.negative), atomic.LoadUint64(&m.errors)
+}
+
+// String formats the counters for the log
+func (m *Metrics) String() string {
+	requests, positive, negative, errors := m.Counts()
+	return fmt.Sprintf("requests: %d, positive: %d, negative: %d, errors: %d", requests, positive, negative, errors)
+}
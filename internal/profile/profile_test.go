@@ -0,0 +1,68 @@
+package profile
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/normalize"
+)
+
+func TestParse(t *testing.T) {
+	p, err := Parse("corp:server=dc1.corp.local; server=dc2.corp.local;--tls;basedn=dc=corp,dc=local;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Profile{Name: "corp", Settings: []Setting{
+		{Key: "server", Value: "dc1.corp.local"},
+		{Key: "server", Value: "dc2.corp.local"},
+		{Key: "tls", Value: "true"},
+		{Key: "basedn", Value: "dc=corp,dc=local"},
+	}}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("got %+v, expected %+v", p, expected)
+	}
+
+	for _, spec := range []string{"", "corp", ":server=dc1", "corp:=value"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	r, err := NewRouter([]string{"corp=corp", "CORP.LOCAL=corp", "LAB=lab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username string
+		profile  string
+	}{
+		{"jdoe", ""},
+		{"CORP\\jdoe", "corp"},
+		{"jdoe@corp.local", "corp"},
+		{"lab\\jdoe", "lab"},
+		{"DOMAIN\\jdoe", ""},
+		{"jdoe@DOMAIN.LOCAL", ""},
+	}
+	for _, test := range tests {
+		if profile := r.Route(normalize.Parse(test.username)); profile != test.profile {
+			t.Errorf("%s: got profile %q, expected %q", test.username, profile, test.profile)
+		}
+	}
+
+	if _, err := NewRouter([]string{"corp"}); err == nil {
+		t.Errorf("expected an error for a route without profile")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var m Metrics
+	m.Request()
+	m.Request()
+	m.Positive()
+	m.Error()
+	if s := m.String(); s != "requests: 2, positive: 1, negative: 0, errors: 1" {
+		t.Errorf("got %q", s)
+	}
+}
@@ -0,0 +1,424 @@
+// Package resultcache caches the answers of the helpers. The age of an
+// answer decides how it is served:
+//
+//   - within the fresh TTL, it is served from the cache
+//   - within the fresh TTL plus the stale TTL, it is served at once and
+//     refreshed in the background
+//   - within the fresh TTL plus the error TTL, it is served when the lookup
+//     of a new answer fails
+//
+// Positive and negative answers have fresh TTLs of their own, each shortened
+// by a random part so that the answers cached at the same time do not expire
+// at the same time. Answers given because the lookup failed are not cached.
+//
+// The most hit answers can be listed with Hot and looked up again with Update
+// before they expire.
+package resultcache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lookup computes an answer. A non-nil error reports that the answer was
+// given because the directory could not be queried.
+type Lookup func() (string, error)
+
+// Entry is a cached answer
+type Entry struct {
+	Key    string
+	Result string
+	// Time is the time of the lookup of the answer
+	Time time.Time
+	// Expires is the time the answer leaves the cache, set by the cache
+	Expires time.Time
+}
+
+// Config sets how long the answers are kept
+type Config struct {
+	// PositiveTTL and NegativeTTL are the fresh TTLs of the positive and the
+	// negative answers. The answers with a zero fresh TTL are not cached.
+	PositiveTTL time.Duration
+	NegativeTTL time.Duration
+	// Stale is the time after the fresh TTL during which an answer is served
+	// and refreshed in the background
+	Stale time.Duration
+	// ErrorTTL is the time after the fresh TTL during which an answer is
+	// served when the lookup of a new answer fails
+	ErrorTTL time.Duration
+	// Jitter shortens the fresh TTL of each answer by a random part of up to
+	// this fraction of it
+	Jitter float64
+	// MaxEntries bounds the number of answers, 0 for no limit
+	MaxEntries int
+	// Negative reports whether an answer is negative. By default, the answers
+	// starting with ERR are, as in the Squid helper protocol.
+	Negative func(result string) bool
+	// CountHits counts the hits of each answer for Hot
+	CountHits bool
+}
+
+func isErr(result string) bool {
+	return strings.HasPrefix(result, "ERR")
+}
+
+// Stats counts the answers of the cache
+type Stats struct {
+	// Hits is the number of fresh answers served from the cache
+	Hits uint64
+	// StaleHits is the number of stale answers served while refreshing
+	StaleHits uint64
+	// StaleOnError is the number of stale answers served because the lookup
+	// failed
+	StaleOnError uint64
+	// Misses is the number of answers looked up
+	Misses uint64
+	// Refreshes is the number of background refreshes
+	Refreshes uint64
+	// RefreshErrors is the number of failed background refreshes
+	RefreshErrors uint64
+	// Evictions is the number of answers evicted to make room for others
+	Evictions uint64
+	// Entries is the number of answers in the cache
+	Entries int
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("hits: %d, stale hits: %d, stale on error: %d, misses: %d, refreshes: %d, refresh errors: %d, evictions: %d, entries: %d",
+		s.Hits, s.StaleHits, s.StaleOnError, s.Misses, s.Refreshes, s.RefreshErrors, s.Evictions, s.Entries)
+}
+
+// Cache is a cache of answers. It is safe for concurrent use.
+type Cache struct {
+	// stats is first to keep its counters 64-bit aligned for atomic access
+	stats Stats
+
+	mu         sync.Mutex
+	config     Config
+	store      Store
+	refreshing map[string]bool
+	// hits counts the hits of each answer since the last call to Hot
+	hits        map[string]int
+	refreshDone sync.WaitGroup
+}
+
+// New returns an empty cache in memory, which caches nothing until it is
+// configured
+func New() *Cache {
+	return &Cache{
+		store:      NewLRU(0),
+		refreshing: make(map[string]bool),
+		hits:       make(map[string]int),
+	}
+}
+
+// Configure sets how long the answers are kept. The configuration applies
+// to the answers cached before too.
+func (c *Cache) Configure(config Config) {
+	if config.Negative == nil {
+		config.Negative = isErr
+	}
+	c.mu.Lock()
+	c.config = config
+	store := c.store
+	c.mu.Unlock()
+	store.SetMaxEntries(config.MaxEntries)
+}
+
+// SetTTL sets the same fresh TTL for the positive and the negative answers,
+// and the stale and error TTLs, keeping the rest of the configuration. A
+// zero fresh TTL disables the cache.
+func (c *Cache) SetTTL(fresh, stale, errorTTL time.Duration) {
+	config := c.configuration()
+	config.PositiveTTL, config.NegativeTTL = fresh, fresh
+	config.Stale, config.ErrorTTL = stale, errorTTL
+	c.Configure(config)
+}
+
+// SetStore replaces the store of the answers. The answers of the previous
+// store are dropped.
+func (c *Cache) SetStore(store Store) {
+	c.mu.Lock()
+	c.store = store
+	config := c.config
+	c.mu.Unlock()
+	store.SetMaxEntries(config.MaxEntries)
+}
+
+func (c *Cache) configuration() Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config
+}
+
+func (c *Cache) entries() Store {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.store
+}
+
+// fresh returns the fresh TTL of the answer. The jitter is derived from the
+// key and the lookup time, so that it does not change when the answer is
+// read again or restored.
+func (config Config) fresh(entry Entry) time.Duration {
+	ttl := config.PositiveTTL
+	if config.Negative != nil && config.Negative(entry.Result) {
+		ttl = config.NegativeTTL
+	}
+	if config.Jitter <= 0 || ttl == 0 {
+		return ttl
+	}
+	h := fnv.New64a()
+	h.Write([]byte(entry.Key))
+	h.Write([]byte(strconv.FormatInt(entry.Time.UnixNano(), 10)))
+	part := float64(h.Sum64()%1000) / 1000
+	return ttl - time.Duration(float64(ttl)*config.Jitter*part)
+}
+
+// lifetime returns how long the answer is kept after its lookup, zero if it
+// is not cached
+func (config Config) lifetime(entry Entry) time.Duration {
+	fresh := config.fresh(entry)
+	if fresh == 0 {
+		return 0
+	}
+	if config.ErrorTTL > config.Stale {
+		return fresh + config.ErrorTTL
+	}
+	return fresh + config.Stale
+}
+
+func (config Config) enabled() bool {
+	return config.PositiveTTL != 0 || config.NegativeTTL != 0
+}
+
+// Get returns the answer of key, from the cache or else from lookup
+func (c *Cache) Get(key string, lookup Lookup) string {
+	config := c.configuration()
+	if !config.enabled() {
+		result, _ := lookup()
+		return result
+	}
+
+	cached, found := c.get(key)
+	age := time.Since(cached.Time)
+	fresh := config.fresh(cached)
+	if found && age < fresh {
+		atomic.AddUint64(&c.stats.Hits, 1)
+		c.countHit(config, key)
+		return cached.Result
+	}
+	if found && age < fresh+config.Stale {
+		atomic.AddUint64(&c.stats.StaleHits, 1)
+		c.countHit(config, key)
+		c.refresh(key, lookup)
+		return cached.Result
+	}
+
+	atomic.AddUint64(&c.stats.Misses, 1)
+	result, err := lookup()
+	if err != nil {
+		if found && age < fresh+config.ErrorTTL {
+			atomic.AddUint64(&c.stats.StaleOnError, 1)
+			return cached.Result
+		}
+		return result
+	}
+	c.set(key, result)
+	return result
+}
+
+// refresh looks up the answer of key in the background, unless it is
+// already being refreshed. A failed refresh keeps the stale answer.
+func (c *Cache) refresh(key string, lookup Lookup) {
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.refreshDone.Add(1)
+	c.mu.Unlock()
+
+	go func() {
+		defer c.refreshDone.Done()
+		atomic.AddUint64(&c.stats.Refreshes, 1)
+		result, err := lookup()
+		if err != nil {
+			atomic.AddUint64(&c.stats.RefreshErrors, 1)
+		} else {
+			c.set(key, result)
+		}
+		c.mu.Lock()
+		delete(c.refreshing, key)
+		c.mu.Unlock()
+	}()
+}
+
+func (c *Cache) countHit(config Config, key string) {
+	if !config.CountHits {
+		return
+	}
+	c.mu.Lock()
+	c.hits[key]++
+	c.mu.Unlock()
+}
+
+// Hot returns up to n answers, the most hit since the last call first, whose
+// fresh TTL ends within the given time. The hits are counted again from
+// zero.
+func (c *Cache) Hot(n int, within time.Duration) []Entry {
+	c.mu.Lock()
+	hits := c.hits
+	c.hits = make(map[string]int)
+	config := c.config
+	store := c.store
+	c.mu.Unlock()
+
+	var hot []Entry
+	deadline := time.Now().Add(within)
+	for key := range hits {
+		if entry, found := store.Get(key); found && entry.Time.Add(config.fresh(entry)).Before(deadline) {
+			hot = append(hot, entry)
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		if hits[hot[i].Key] != hits[hot[j].Key] {
+			return hits[hot[i].Key] > hits[hot[j].Key]
+		}
+		return hot[i].Key < hot[j].Key
+	})
+	if len(hot) > n {
+		hot = hot[:n]
+	}
+	return hot
+}
+
+// Update looks up the answer of key now and caches it, unless it is being
+// refreshed already. A failed lookup keeps the cached answer.
+func (c *Cache) Update(key string, lookup Lookup) error {
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return nil
+	}
+	c.refreshing[key] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.refreshing, key)
+		c.mu.Unlock()
+	}()
+
+	atomic.AddUint64(&c.stats.Refreshes, 1)
+	result, err := lookup()
+	if err != nil {
+		atomic.AddUint64(&c.stats.RefreshErrors, 1)
+		return err
+	}
+	c.set(key, result)
+	return nil
+}
+
+func (c *Cache) get(key string) (Entry, bool) {
+	return c.entries().Get(key)
+}
+
+func (c *Cache) set(key, result string) {
+	c.Restore(Entry{Key: key, Result: result, Time: time.Now()})
+}
+
+// Peek returns the fresh answer of key, without looking it up
+func (c *Cache) Peek(key string) (string, bool) {
+	config := c.configuration()
+	if !config.enabled() {
+		return "", false
+	}
+	if cached, found := c.get(key); found && time.Since(cached.Time) < config.fresh(cached) {
+		atomic.AddUint64(&c.stats.Hits, 1)
+		return cached.Result, true
+	}
+	atomic.AddUint64(&c.stats.Misses, 1)
+	return "", false
+}
+
+// Set caches the answer of key, looked up now
+func (c *Cache) Set(key, result string) {
+	c.set(key, result)
+}
+
+// Inspect returns the cached answer of key, fresh or not, without counting
+// it as a hit or a miss
+func (c *Cache) Inspect(key string) (Entry, bool) {
+	return c.get(key)
+}
+
+// Entries returns the answers in the cache which have not expired
+func (c *Cache) Entries() []Entry {
+	return c.entries().Entries()
+}
+
+// Restore adds an entry returned by Entries, unless it has expired
+func (c *Cache) Restore(entry Entry) {
+	lifetime := c.configuration().lifetime(entry)
+	if lifetime == 0 {
+		return
+	}
+	entry.Expires = entry.Time.Add(lifetime)
+	if time.Now().Before(entry.Expires) {
+		c.entries().Set(entry)
+	}
+}
+
+// Delete removes the answer of key
+func (c *Cache) Delete(key string) {
+	c.entries().Delete(key)
+}
+
+// DeleteFunc removes the answers for which match returns true, and returns
+// their number
+func (c *Cache) DeleteFunc(match func(key, result string) bool) int {
+	store := c.entries()
+	deleted := 0
+	for _, entry := range store.Entries() {
+		if match(entry.Key, entry.Result) {
+			store.Delete(entry.Key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Flush removes every answer
+func (c *Cache) Flush() {
+	c.entries().Flush()
+}
+
+// Wait waits for the background refreshes in flight
+func (c *Cache) Wait() {
+	c.refreshDone.Wait()
+}
+
+// Stats returns the counters of the cache
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		Hits:          atomic.LoadUint64(&c.stats.Hits),
+		StaleHits:     atomic.LoadUint64(&c.stats.StaleHits),
+		StaleOnError:  atomic.LoadUint64(&c.stats.StaleOnError),
+		Misses:        atomic.LoadUint64(&c.stats.Misses),
+		Refreshes:     atomic.LoadUint64(&c.stats.Refreshes),
+		RefreshErrors: atomic.LoadUint64(&c.stats.RefreshErrors),
+	}
+	store := c.entries()
+	if lru, ok := store.(*LRU); ok {
+		stats.Evictions = lru.Evictions()
+	}
+	stats.Entries = store.Len()
+	return stats
+}
@@ -0,0 +1,312 @@
+package resultcache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// age makes the answer of key as old as d
+func age(c *Cache, key string, d time.Duration) {
+	entry, _ := c.get(key)
+	entry.Time = time.Now().Add(-d)
+	c.Restore(entry)
+}
+
+func TestFreshAnswers(t *testing.T) {
+	c := New()
+	var lookups int32
+	lookup := func() (string, error) {
+		atomic.AddInt32(&lookups, 1)
+		return "OK tag=Internet", nil
+	}
+
+	// a zero fresh TTL disables the cache
+	c.Get("jdoe:Internet", lookup)
+	c.Get("jdoe:Internet", lookup)
+	if lookups != 2 {
+		t.Fatalf("got %d lookups without cache", lookups)
+	}
+
+	c.SetTTL(time.Minute, 0, 0)
+	for i := 0; i < 3; i++ {
+		if result := c.Get("jdoe:Internet", lookup); result != "OK tag=Internet" {
+			t.Errorf("got %q", result)
+		}
+	}
+	if lookups != 3 {
+		t.Errorf("got %d lookups, expected 3", lookups)
+	}
+
+	// the answers of failed lookups are not cached
+	c.Get("bob:Internet", func() (string, error) { return "ERR", errors.New("down") })
+	if _, found := c.get("bob:Internet"); found {
+		t.Errorf("the answer of a failed lookup was cached")
+	}
+	if s := c.Stats(); s.Hits != 2 || s.Misses != 2 {
+		t.Errorf("got stats %s", s)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	c := New()
+	c.SetTTL(time.Minute, time.Minute, 0)
+	c.Get("jdoe:Internet", func() (string, error) { return "OK tag=Internet", nil })
+	age(c, "jdoe:Internet", 90*time.Second)
+
+	refreshed := make(chan struct{})
+	lookup := func() (string, error) {
+		<-refreshed
+		return "ERR", nil
+	}
+	// the stale answer is served at once, and refreshed once
+	for i := 0; i < 3; i++ {
+		if result := c.Get("jdoe:Internet", lookup); result != "OK tag=Internet" {
+			t.Errorf("got %q while refreshing", result)
+		}
+	}
+	close(refreshed)
+	c.Wait()
+	if result := c.Get("jdoe:Internet", lookup); result != "ERR" {
+		t.Errorf("got %q after the refresh", result)
+	}
+	if s := c.Stats(); s.StaleHits != 3 || s.Refreshes != 1 || s.Hits != 1 {
+		t.Errorf("got stats %s", s)
+	}
+
+	// a failed refresh keeps the stale answer
+	age(c, "jdoe:Internet", 90*time.Second)
+	c.Get("jdoe:Internet", func() (string, error) { return "", errors.New("down") })
+	c.Wait()
+	if result := c.Get("jdoe:Internet", lookup); result != "ERR" {
+		t.Errorf("got %q after a failed refresh", result)
+	}
+	if s := c.Stats(); s.RefreshErrors != 1 {
+		t.Errorf("got stats %s", s)
+	}
+}
+
+func TestStaleOnError(t *testing.T) {
+	c := New()
+	c.SetTTL(time.Minute, 0, time.Hour)
+	c.Get("jdoe:Internet", func() (string, error) { return "OK tag=Internet", nil })
+	failed := func() (string, error) { return "ERR", errors.New("down") }
+
+	age(c, "jdoe:Internet", 30*time.Minute)
+	if result := c.Get("jdoe:Internet", failed); result != "OK tag=Internet" {
+		t.Errorf("got %q, expected the stale answer", result)
+	}
+	if s := c.Stats(); s.StaleOnError != 1 {
+		t.Errorf("got stats %s", s)
+	}
+
+	// a successful lookup replaces the stale answer
+	if result := c.Get("jdoe:Internet", func() (string, error) { return "ERR", nil }); result != "ERR" {
+		t.Errorf("got %q from the lookup", result)
+	}
+
+	// answers older than the error TTL are not served
+	c.Get("bob:Internet", func() (string, error) { return "OK tag=Internet", nil })
+	entry, _ := c.get("bob:Internet")
+	entry.Time = time.Now().Add(-2 * time.Hour)
+	entry.Expires = time.Now().Add(time.Minute)
+	c.entries().Set(entry)
+	if result := c.Get("bob:Internet", failed); result != "ERR" {
+		t.Errorf("got %q past the error TTL", result)
+	}
+}
+
+func TestPositiveAndNegativeTTL(t *testing.T) {
+	c := New()
+	c.Configure(Config{PositiveTTL: time.Hour, NegativeTTL: time.Minute, ErrorTTL: time.Hour})
+	c.Get("jdoe:Internet", func() (string, error) { return "OK tag=Internet", nil })
+	c.Get("bob:Internet", func() (string, error) { return "ERR", nil })
+
+	age(c, "jdoe:Internet", 30*time.Minute)
+	age(c, "bob:Internet", 30*time.Minute)
+	if _, found := c.Peek("jdoe:Internet"); !found {
+		t.Errorf("the positive answer expired before its TTL")
+	}
+	if _, found := c.Peek("bob:Internet"); found {
+		t.Errorf("the negative answer outlived its TTL")
+	}
+
+	// a zero negative TTL does not cache the negative answers
+	c.Configure(Config{PositiveTTL: time.Hour})
+	c.Get("bob:Mail", func() (string, error) { return "ERR", nil })
+	if _, found := c.get("bob:Mail"); found {
+		t.Errorf("a negative answer was cached without negative TTL")
+	}
+
+	// the negative answers are told apart by the configuration
+	c.Configure(Config{PositiveTTL: time.Hour, Negative: func(result string) bool { return result == "" }})
+	c.Set("userdn/bob", "")
+	if _, found := c.get("userdn/bob"); found {
+		t.Errorf("an empty answer was cached without negative TTL")
+	}
+}
+
+func TestJitteredTTL(t *testing.T) {
+	config := Config{PositiveTTL: 100 * time.Second, Jitter: 0.2}
+	now := time.Now()
+	distinct := map[time.Duration]bool{}
+	for i := 0; i < 50; i++ {
+		entry := Entry{Key: fmt.Sprintf("user%d:Internet", i), Result: "OK", Time: now}
+		fresh := config.fresh(entry)
+		if fresh > 100*time.Second || fresh <= 80*time.Second {
+			t.Errorf("got fresh TTL %s out of the jitter range", fresh)
+		}
+		if config.fresh(entry) != fresh {
+			t.Errorf("the fresh TTL of an answer changed")
+		}
+		distinct[fresh] = true
+	}
+	if len(distinct) < 10 {
+		t.Errorf("got %d distinct TTLs for 50 answers", len(distinct))
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	c := New()
+	c.Configure(Config{PositiveTTL: time.Hour, NegativeTTL: time.Hour, MaxEntries: 2})
+	lookup := func() (string, error) { return "OK", nil }
+	c.Get("a", lookup)
+	c.Get("b", lookup)
+	c.Get("a", lookup)
+	c.Get("c", lookup)
+	if _, found := c.get("b"); found {
+		t.Errorf("the least recently used answer was not evicted")
+	}
+	if _, found := c.get("a"); !found {
+		t.Errorf("a recently used answer was evicted")
+	}
+	if s := c.Stats(); s.Evictions != 1 || s.Entries != 2 {
+		t.Errorf("got stats %s", s)
+	}
+
+	// lowering the limit evicts at once
+	c.Configure(Config{PositiveTTL: time.Hour, NegativeTTL: time.Hour, MaxEntries: 1})
+	if s := c.Stats(); s.Entries != 1 {
+		t.Errorf("got stats %s", s)
+	}
+}
+
+// mapStore is a minimal Store standing for the other implementations
+type mapStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+func (s *mapStore) Get(key string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	return entry, ok
+}
+
+func (s *mapStore) Set(entry Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[entry.Key] = entry
+}
+
+func (s *mapStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+func (s *mapStore) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []Entry
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (s *mapStore) Flush()            { s.entries = map[string]Entry{} }
+func (s *mapStore) Len() int          { return len(s.entries) }
+func (s *mapStore) SetMaxEntries(int) {}
+
+func TestSetStore(t *testing.T) {
+	c := New()
+	c.SetTTL(time.Minute, 0, 0)
+	store := &mapStore{entries: map[string]Entry{}}
+	c.SetStore(store)
+	c.Get("jdoe:Internet", func() (string, error) { return "OK tag=Internet", nil })
+	entry, ok := store.Get("jdoe:Internet")
+	if !ok || entry.Result != "OK tag=Internet" {
+		t.Fatalf("got %+v from the store", entry)
+	}
+	if entry.Expires.Sub(entry.Time) != time.Minute {
+		t.Errorf("got an entry expiring %s after its lookup", entry.Expires.Sub(entry.Time))
+	}
+	if result := c.Get("jdoe:Internet", func() (string, error) { return "ERR", nil }); result != "OK tag=Internet" {
+		t.Errorf("got %q, expected the answer of the store", result)
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	c := New()
+	c.SetTTL(time.Minute, 0, 0)
+	for _, key := range []string{"jdoe:Internet", "jdoe:Mail", "bob:Internet"} {
+		c.Set(key, "OK")
+	}
+	deleted := c.DeleteFunc(func(key, result string) bool { return strings.HasPrefix(key, "jdoe:") })
+	if deleted != 2 {
+		t.Errorf("got %d answers deleted, expected 2", deleted)
+	}
+	c.Delete("bob:Internet")
+	if s := c.Stats(); s.Entries != 0 {
+		t.Errorf("got stats %s", s)
+	}
+}
+
+func TestHotAnswers(t *testing.T) {
+	c := New()
+	c.Configure(Config{PositiveTTL: time.Minute, NegativeTTL: time.Hour, CountHits: true})
+	for _, key := range []string{"jdoe", "bob", "eve"} {
+		c.Set(key, "OK")
+	}
+	c.Set("mallory", "ERR")
+	lookup := func() (string, error) { return "OK", nil }
+	for i := 0; i < 3; i++ {
+		c.Get("bob", lookup)
+	}
+	c.Get("jdoe", lookup)
+	for i := 0; i < 5; i++ {
+		c.Get("mallory", lookup)
+	}
+
+	// the negative answer is hit the most but expires in an hour, and eve is
+	// not hit
+	hot := c.Hot(10, 2*time.Minute)
+	if len(hot) != 2 || hot[0].Key != "bob" || hot[1].Key != "jdoe" {
+		t.Fatalf("got hot answers %v", hot)
+	}
+	if hot := c.Hot(1, time.Hour); len(hot) != 0 {
+		t.Errorf("got hot answers %v after a reset of the hits", hot)
+	}
+
+	if err := c.Update("bob", func() (string, error) { return "ERR", nil }); err != nil {
+		t.Fatalf("cannot update: %s", err)
+	}
+	if err := c.Update("jdoe", func() (string, error) { return "BH", errors.New("unavailable") }); err == nil {
+		t.Error("got no error of a failed update")
+	}
+	if result, _ := c.Peek("bob"); result != "ERR" {
+		t.Errorf("got %q after the update", result)
+	}
+	if result, _ := c.Peek("jdoe"); result != "OK" {
+		t.Errorf("got %q after a failed update", result)
+	}
+	if s := c.Stats(); s.Refreshes != 2 || s.RefreshErrors != 1 {
+		t.Errorf("got stats %s", s)
+	}
+}
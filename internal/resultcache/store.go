@@ -0,0 +1,180 @@
+package resultcache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store holds the entries of a cache. The cache keeps its entries in an LRU
+// store in memory by default, and can be given another store, such as one
+// persistent or shared between processes.
+type Store interface {
+	// Get returns the entry of key, unless it has expired
+	Get(key string) (Entry, bool)
+	// Set adds or replaces the entry of its key. The entry expires at its
+	// Expires time.
+	Set(entry Entry)
+	// Delete removes the entry of key
+	Delete(key string)
+	// Entries returns the entries which have not expired
+	Entries() []Entry
+	// Flush removes every entry
+	Flush()
+	// Len returns the number of entries, expired or not
+	Len() int
+	// SetMaxEntries bounds the number of entries, 0 for no limit. Stores
+	// which bound their size otherwise may ignore it.
+	SetMaxEntries(n int)
+}
+
+// expiredSweepInterval is the number of entries set between two sweeps of
+// the expired entries of an LRU store
+const expiredSweepInterval = 1024
+
+// LRU is a Store in memory which evicts the least recently used entries when
+// it is full. It is safe for concurrent use.
+type LRU struct {
+	// evictions is first to keep it 64-bit aligned for atomic access
+	evictions uint64
+
+	mu         sync.Mutex
+	maxEntries int
+	items      map[string]*list.Element
+	// order lists the entries from the most to the least recently used
+	order *list.List
+	sets  int
+}
+
+// NewLRU returns an empty LRU store holding up to maxEntries entries, or
+// without limit if maxEntries is 0
+func NewLRU(maxEntries int) *LRU {
+	return &LRU{
+		maxEntries: maxEntries,
+		items:      make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Get implements the Store interface. The entry becomes the most recently
+// used.
+func (l *LRU) Get(key string) (Entry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.items[key]
+	if !ok {
+		return Entry{}, false
+	}
+	entry := e.Value.(Entry)
+	if expired(entry, time.Now()) {
+		l.remove(e)
+		return Entry{}, false
+	}
+	l.order.MoveToFront(e)
+	return entry, true
+}
+
+// Set implements the Store interface. The least recently used entries are
+// evicted if the store is full.
+func (l *LRU) Set(entry Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[entry.Key]; ok {
+		e.Value = entry
+		l.order.MoveToFront(e)
+	} else {
+		l.items[entry.Key] = l.order.PushFront(entry)
+	}
+
+	l.sets++
+	if l.sets%expiredSweepInterval == 0 {
+		l.removeExpired()
+	}
+	l.evict()
+}
+
+// Delete implements the Store interface
+func (l *LRU) Delete(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.remove(e)
+	}
+}
+
+// Entries implements the Store interface
+func (l *LRU) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var entries []Entry
+	for e := l.order.Front(); e != nil; e = e.Next() {
+		if entry := e.Value.(Entry); !expired(entry, now) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Flush implements the Store interface
+func (l *LRU) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.items = make(map[string]*list.Element)
+	l.order.Init()
+}
+
+// Len implements the Store interface
+func (l *LRU) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+// SetMaxEntries implements the Store interface. The least recently used
+// entries are evicted at once if the store holds more.
+func (l *LRU) SetMaxEntries(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxEntries = n
+	l.evict()
+}
+
+// Evictions returns the number of entries evicted to make room for others
+func (l *LRU) Evictions() uint64 {
+	return atomic.LoadUint64(&l.evictions)
+}
+
+// evict removes the least recently used entries beyond the maximum. It is
+// called with l.mu held.
+func (l *LRU) evict() {
+	if l.maxEntries <= 0 {
+		return
+	}
+	for l.order.Len() > l.maxEntries {
+		l.remove(l.order.Back())
+		atomic.AddUint64(&l.evictions, 1)
+	}
+}
+
+// removeExpired removes the expired entries. It is called with l.mu held.
+func (l *LRU) removeExpired() {
+	now := time.Now()
+	for e := l.order.Front(); e != nil; {
+		next := e.Next()
+		if expired(e.Value.(Entry), now) {
+			l.remove(e)
+		}
+		e = next
+	}
+}
+
+func (l *LRU) remove(e *list.Element) {
+	l.order.Remove(e)
+	delete(l.items, e.Value.(Entry).Key)
+}
+
+func expired(entry Entry, now time.Time) bool {
+	return !entry.Expires.IsZero() && !now.Before(entry.Expires)
+}
@@ -0,0 +1,64 @@
+package resultcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	l := NewLRU(3)
+	for _, key := range []string{"a", "b", "c"} {
+		l.Set(Entry{Key: key, Result: "OK"})
+	}
+	l.Get("a")
+	l.Set(Entry{Key: "d", Result: "OK"})
+	if _, found := l.Get("b"); found {
+		t.Errorf("the least recently used entry was not evicted")
+	}
+	var keys []string
+	for _, entry := range l.Entries() {
+		keys = append(keys, entry.Key)
+	}
+	if len(keys) != 3 || keys[0] != "d" || keys[1] != "a" || keys[2] != "c" {
+		t.Errorf("got entries %v, expected the most recently used first", keys)
+	}
+	if l.Evictions() != 1 {
+		t.Errorf("got %d evictions", l.Evictions())
+	}
+
+	// replacing an entry does not evict
+	l.Set(Entry{Key: "c", Result: "ERR"})
+	if entry, _ := l.Get("c"); entry.Result != "ERR" || l.Len() != 3 {
+		t.Errorf("got %+v and %d entries", entry, l.Len())
+	}
+
+	l.Delete("c")
+	l.SetMaxEntries(1)
+	if l.Len() != 1 {
+		t.Errorf("got %d entries after lowering the limit", l.Len())
+	}
+	l.Flush()
+	if l.Len() != 0 {
+		t.Errorf("got %d entries after a flush", l.Len())
+	}
+}
+
+func TestLRUExpiredEntries(t *testing.T) {
+	l := NewLRU(0)
+	l.Set(Entry{Key: "old", Expires: time.Now().Add(-time.Second)})
+	l.Set(Entry{Key: "new", Expires: time.Now().Add(time.Hour)})
+	if _, found := l.Get("old"); found {
+		t.Errorf("got an expired entry")
+	}
+	if entries := l.Entries(); len(entries) != 1 || entries[0].Key != "new" {
+		t.Errorf("got entries %+v", entries)
+	}
+
+	// the expired entries are swept while entries are set
+	for i := 0; l.sets%expiredSweepInterval != 0 || i == 0; i++ {
+		l.Set(Entry{Key: "expired", Expires: time.Now().Add(-time.Second)})
+	}
+	if l.Len() != 1 {
+		t.Errorf("got %d entries after a sweep", l.Len())
+	}
+}
@@ -0,0 +1,58 @@
+// Package singleflight runs a function once for the callers asking for the
+// same key at the same time, and hands its result to all of them.
+package singleflight
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type call struct {
+	done  sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// Group coalesces the calls of a kind. The zero value is ready to use, and it
+// is safe for concurrent use.
+type Group struct {
+	shared uint64
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// Do runs fn and returns its result, unless a call for the same key is in
+// flight, in which case it waits for that call and returns its result.
+// shared reports whether the result is the one of another call.
+func (g *Group) Do(key string, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		atomic.AddUint64(&g.shared, 1)
+		c.done.Wait()
+		return c.value, c.err, true
+	}
+	c := &call{}
+	c.done.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.done.Done()
+	}()
+	c.value, c.err = fn()
+	return c.value, c.err, false
+}
+
+// Shared returns the number of calls answered with the result of another
+// call
+func (g *Group) Shared() uint64 {
+	return atomic.LoadUint64(&g.shared)
+}
@@ -0,0 +1,61 @@
+package singleflight
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	var g Group
+	value, err, shared := g.Do("key", func() (interface{}, error) { return "value", nil })
+	if value != "value" || err != nil || shared {
+		t.Errorf("got %v, %v, %v", value, err, shared)
+	}
+	failed := errors.New("failed")
+	if _, err, _ := g.Do("key", func() (interface{}, error) { return nil, failed }); err != failed {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestDoCoalesces(t *testing.T) {
+	var (
+		g     Group
+		calls int32
+		wg    sync.WaitGroup
+	)
+	release := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, _, _ := g.Do("key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "value", nil
+			})
+			if value != "value" {
+				t.Errorf("got %v", value)
+			}
+		}()
+	}
+	for g.Shared() != 9 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("got %d calls, expected 1", calls)
+	}
+
+	// the next call runs again
+	g.Do("key", func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	if calls != 2 {
+		t.Errorf("got %d calls after the first completed", calls)
+	}
+}
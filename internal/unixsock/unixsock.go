@@ -0,0 +1,42 @@
+// Package unixsock listens on the unix sockets of the helpers, the socket of
+// the lookup daemon and the control socket, with restricted permissions.
+package unixsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Listen listens on the unix socket at path and sets its permissions to
+// mode. A socket left by a process which did not exit cleanly is removed
+// first, unless a process still listens on it.
+func Listen(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unixsock: %s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// ParseMode parses permissions given in octal, such as 0660
+func ParseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("unixsock: invalid permissions %q", s)
+	}
+	return os.FileMode(mode), nil
+}
@@ -0,0 +1,57 @@
+package unixsock
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.sock")
+
+	l, err := Listen(path, 0600)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got socket %v, %v, expected permissions 0600", fi, err)
+	}
+	if _, err := Listen(path, 0600); err == nil {
+		t.Error("listened on a socket in use")
+	}
+	l.Close()
+
+	// a socket file left without listener
+	l, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = Listen(path, 0660)
+	if err != nil {
+		t.Fatalf("cannot listen on a stale socket: %s", err)
+	}
+	defer l.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("got socket %v, %v, expected permissions 0660", fi, err)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	if mode, err := ParseMode("0660"); err != nil || mode != 0660 {
+		t.Errorf("got %v, %v", mode, err)
+	}
+	for _, s := range []string{"", "rw", "0999", "4755"} {
+		if _, err := ParseMode(s); err == nil {
+			t.Errorf("accepted permissions %q", s)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package warmup looks up answers ahead of the requests, so that they are
+// served from the cache: it preloads the cache when a helper starts, and
+// looks up the most requested answers again before they expire. The lookups
+// are spread out within a budget of lookups per second, so that they do not
+// compete with the requests for the directory.
+package warmup
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/resultcache"
+)
+
+// Config sets the budget of the lookups and the refresh of the hot answers
+type Config struct {
+	// Rate is the number of lookups per second, 0 for no limit
+	Rate int
+	// Hot is the number of the most hit answers refreshed each round, 0 to
+	// refresh none
+	Hot int
+	// Interval is the time between two rounds of refresh. The answers whose
+	// fresh TTL ends within two intervals are refreshed.
+	Interval time.Duration
+}
+
+// Stats counts the lookups of a warmer
+type Stats struct {
+	// Warmed is the number of lookups of the warm-up
+	Warmed uint64
+	// Refreshed is the number of hot answers looked up again
+	Refreshed uint64
+	// RefreshErrors is the number of failed lookups of hot answers, which
+	// keep their cached answer
+	RefreshErrors uint64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("warmed: %d, refreshed: %d, refresh errors: %d", s.Warmed, s.Refreshed, s.RefreshErrors)
+}
+
+// Warmer runs the warm-up and the refresh of the answers of a cache. It is
+// safe for concurrent use.
+type Warmer struct {
+	// stats is first to keep its counters 64-bit aligned for atomic access
+	stats  Stats
+	cache  *resultcache.Cache
+	config Config
+	// lookup returns the lookup of the answer of a cache key
+	lookup func(key string) resultcache.Lookup
+
+	mu sync.Mutex
+	// next is the time of the next lookup within the budget
+	next time.Time
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// New returns a warmer of the cache. The hot answers are looked up again
+// with the lookup returned by lookup for their key.
+func New(cache *resultcache.Cache, config Config, lookup func(key string) resultcache.Lookup) *Warmer {
+	return &Warmer{
+		cache:  cache,
+		config: config,
+		lookup: lookup,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start runs warm in the background, and then refreshes the hot answers
+// every interval until Stop is called. warm runs its lookups with Do.
+func (w *Warmer) Start(warm func()) {
+	go func() {
+		defer close(w.done)
+		if warm != nil {
+			warm()
+		}
+		if w.config.Hot == 0 || w.config.Interval == 0 {
+			<-w.quit
+			return
+		}
+		ticker := time.NewTicker(w.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.Refresh()
+			case <-w.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the warm-up and the refresh, and waits for the lookup in
+// flight
+func (w *Warmer) Stop() {
+	close(w.quit)
+	<-w.done
+}
+
+// Do runs fn, a lookup of the warm-up, once the budget allows it. It returns
+// false without running fn if the warmer is stopped meanwhile.
+func (w *Warmer) Do(fn func()) bool {
+	if !w.Wait() {
+		return false
+	}
+	fn()
+	atomic.AddUint64(&w.stats.Warmed, 1)
+	return true
+}
+
+// Refresh looks up again the most hit answers whose fresh TTL ends before
+// the round after the next one
+func (w *Warmer) Refresh() {
+	for _, entry := range w.cache.Hot(w.config.Hot, 2*w.config.Interval) {
+		if !w.Wait() {
+			return
+		}
+		atomic.AddUint64(&w.stats.Refreshed, 1)
+		if err := w.cache.Update(entry.Key, w.lookup(entry.Key)); err != nil {
+			atomic.AddUint64(&w.stats.RefreshErrors, 1)
+		}
+	}
+}
+
+// Wait waits for the next lookup within the budget. The directory queries
+// listing what to warm up wait for it too, so that they share the budget of
+// the lookups. It returns false if the warmer is stopped meanwhile.
+func (w *Warmer) Wait() bool {
+	select {
+	case <-w.quit:
+		return false
+	default:
+	}
+	if w.config.Rate <= 0 {
+		return true
+	}
+
+	w.mu.Lock()
+	now := time.Now()
+	if w.next.Before(now) {
+		w.next = now
+	}
+	delay := w.next.Sub(now)
+	w.next = w.next.Add(time.Second / time.Duration(w.config.Rate))
+	w.mu.Unlock()
+	if delay == 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.quit:
+		return false
+	}
+}
+
+// Stats returns the counters of the warmer
+func (w *Warmer) Stats() Stats {
+	return Stats{
+		Warmed:        atomic.LoadUint64(&w.stats.Warmed),
+		Refreshed:     atomic.LoadUint64(&w.stats.Refreshed),
+		RefreshErrors: atomic.LoadUint64(&w.stats.RefreshErrors),
+	}
+}
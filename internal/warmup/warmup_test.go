@@ -0,0 +1,72 @@
+package warmup
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/verdel/go-ext-acl-ldap-helper/internal/resultcache"
+)
+
+func TestRateBudget(t *testing.T) {
+	w := New(resultcache.New(), Config{Rate: 50}, nil)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if !w.Do(func() {}) {
+			t.Fatal("lookup refused before stop")
+		}
+	}
+	// the first lookup runs at once, the others 20ms apart
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("5 lookups at 50 per second took %s", d)
+	}
+	if s := w.Stats(); s.Warmed != 5 {
+		t.Errorf("got stats %s", s)
+	}
+}
+
+func TestStopInterruptsWarmUp(t *testing.T) {
+	w := New(resultcache.New(), Config{Rate: 1}, nil)
+	lookups := 0
+	w.Start(func() {
+		for w.Do(func() { lookups++ }) {
+		}
+	})
+	time.Sleep(100 * time.Millisecond)
+	w.Stop()
+	if lookups != 1 {
+		t.Errorf("got %d lookups within the first second at 1 per second", lookups)
+	}
+}
+
+func TestRefreshHotAnswers(t *testing.T) {
+	c := resultcache.New()
+	c.Configure(resultcache.Config{PositiveTTL: time.Minute, NegativeTTL: time.Minute, CountHits: true})
+	c.Set("jdoe:Internet", "OK")
+	c.Set("bob:Internet", "OK")
+	c.Set("eve:Internet", "OK")
+	for _, key := range []string{"jdoe:Internet", "jdoe:Internet", "bob:Internet", "eve:Internet"} {
+		c.Get(key, nil)
+	}
+
+	var refreshed []string
+	w := New(c, Config{Hot: 2, Interval: time.Minute}, func(key string) resultcache.Lookup {
+		return func() (string, error) {
+			refreshed = append(refreshed, key)
+			if key == "bob:Internet" {
+				return "BH", errors.New("unavailable")
+			}
+			return "ERR", nil
+		}
+	})
+	w.Refresh()
+	if len(refreshed) != 2 || refreshed[0] != "jdoe:Internet" {
+		t.Errorf("got refreshed answers %v", refreshed)
+	}
+	if result, _ := c.Peek("jdoe:Internet"); result != "ERR" {
+		t.Errorf("got %q after the refresh", result)
+	}
+	if s := w.Stats(); s.Refreshed != 2 || s.RefreshErrors != 1 {
+		t.Errorf("got stats %s", s)
+	}
+}
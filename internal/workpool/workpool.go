@@ -0,0 +1,102 @@
+// Package workpool bounds the number of LDAP operations in flight. An
+// operation waits in the queue for a free worker, and gives up when none is
+// free within the queue deadline, so that a helper facing an overloaded
+// directory answers at once instead of piling up requests.
+package workpool
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueueTimeout is returned by Do when no worker is free within the queue
+// deadline
+var ErrQueueTimeout = errors.New("workpool: no free worker within the queue deadline")
+
+// Stats counts the operations of a pool
+type Stats struct {
+	// Done is the number of operations run
+	Done uint64
+	// Queued is the number of operations which waited for a free worker
+	Queued uint64
+	// Rejected is the number of operations given up at the queue deadline
+	Rejected uint64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("done: %d, queued: %d, rejected: %d", s.Done, s.Queued, s.Rejected)
+}
+
+// Pool runs operations on a bounded number of workers. It is safe for
+// concurrent use.
+type Pool struct {
+	// stats is first to keep its counters 64-bit aligned for atomic access
+	stats   Stats
+	workers chan struct{}
+	timeout time.Duration
+}
+
+// New returns a pool of size workers, with no limit if size is 0. An
+// operation waits at most timeout for a free worker, without deadline if
+// timeout is 0.
+func New(size int, timeout time.Duration) *Pool {
+	p := &Pool{timeout: timeout}
+	if size > 0 {
+		p.workers = make(chan struct{}, size)
+	}
+	return p
+}
+
+// Do runs fn on a free worker, in the goroutine of the caller, and returns
+// once it is done. It returns ErrQueueTimeout without running fn if no
+// worker is free within the queue deadline.
+func (p *Pool) Do(fn func()) error {
+	if p.workers != nil {
+		if err := p.acquire(); err != nil {
+			return err
+		}
+		defer func() { <-p.workers }()
+	}
+	fn()
+	atomic.AddUint64(&p.stats.Done, 1)
+	return nil
+}
+
+func (p *Pool) acquire() error {
+	select {
+	case p.workers <- struct{}{}:
+		return nil
+	default:
+	}
+
+	atomic.AddUint64(&p.stats.Queued, 1)
+	if p.timeout == 0 {
+		p.workers <- struct{}{}
+		return nil
+	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case p.workers <- struct{}{}:
+		return nil
+	case <-timer.C:
+		atomic.AddUint64(&p.stats.Rejected, 1)
+		return ErrQueueTimeout
+	}
+}
+
+// InFlight returns the number of operations running
+func (p *Pool) InFlight() int {
+	return len(p.workers)
+}
+
+// Stats returns the counters of the pool
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Done:     atomic.LoadUint64(&p.stats.Done),
+		Queued:   atomic.LoadUint64(&p.stats.Queued),
+		Rejected: atomic.LoadUint64(&p.stats.Rejected),
+	}
+}
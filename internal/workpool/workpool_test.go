@@ -0,0 +1,101 @@
+package workpool
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoBoundsInFlight(t *testing.T) {
+	var (
+		p       = New(3, 0)
+		running int32
+		max     int32
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.Do(func() {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&max)
+					if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+			})
+			if err != nil {
+				t.Errorf("got error %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if max > 3 {
+		t.Errorf("got %d operations in flight, expected at most 3", max)
+	}
+	if stats := p.Stats(); stats.Done != 20 || stats.Queued == 0 || stats.Rejected != 0 {
+		t.Errorf("got stats %s", stats)
+	}
+}
+
+func TestDoQueueTimeout(t *testing.T) {
+	p := New(1, 20*time.Millisecond)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go p.Do(func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	ran := false
+	start := time.Now()
+	if err := p.Do(func() { ran = true }); err != ErrQueueTimeout {
+		t.Errorf("got error %v, expected ErrQueueTimeout", err)
+	}
+	if ran {
+		t.Error("operation ran without a free worker")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("gave up after %s, before the queue deadline", elapsed)
+	}
+	if p.InFlight() != 1 {
+		t.Errorf("got %d operations in flight", p.InFlight())
+	}
+
+	close(release)
+	for p.InFlight() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Do(func() { ran = true }); err != nil || !ran {
+		t.Errorf("got error %v once a worker is free", err)
+	}
+	if stats := p.Stats(); stats.Rejected != 1 {
+		t.Errorf("got stats %s", stats)
+	}
+}
+
+func TestDoUnlimited(t *testing.T) {
+	p := New(0, time.Millisecond)
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Do(func() { <-release }); err != nil {
+				t.Errorf("got error %v", err)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+	if stats := p.Stats(); stats.Done != 100 || stats.Queued != 0 {
+		t.Errorf("got stats %s", stats)
+	}
+}